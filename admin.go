@@ -0,0 +1,516 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/audit"
+	"github.com/gyarbij/azure-oai-proxy/pkg/auth"
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+	"github.com/gyarbij/azure-oai-proxy/pkg/budget"
+	"github.com/gyarbij/azure-oai-proxy/pkg/cache"
+	"github.com/gyarbij/azure-oai-proxy/pkg/logging"
+	"github.com/gyarbij/azure-oai-proxy/pkg/openai"
+	"github.com/gyarbij/azure-oai-proxy/pkg/semantic"
+	"github.com/gyarbij/azure-oai-proxy/pkg/store"
+)
+
+// Buckets holding configuration changed through the admin API. Deletions are
+// kept as tombstones so built-in defaults stay deleted after a restart.
+const (
+	modelMappingsBucket = "model_mappings"
+	serverlessBucket    = "serverless_deployments"
+)
+
+var (
+	// AdminKey protects the /admin API. The API is disabled when it is empty.
+	AdminKey = ""
+)
+
+type storedModelMapping struct {
+	Deployment string `json:"deployment"`
+	Deleted    bool   `json:"deleted,omitempty"`
+}
+
+type storedServerlessDeployment struct {
+	azure.ServerlessDeployment
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+func init() {
+	AdminKey = os.Getenv("AZURE_OPENAI_PROXY_ADMIN_KEY")
+}
+
+// applyStoredConfig overlays the model mappings and serverless deployments
+// saved through the admin API on top of the environment configuration.
+func applyStoredConfig() {
+	if _, err := os.Stat(store.Path); err != nil {
+		return
+	}
+	db := store.Default()
+	err := db.ForEach(modelMappingsBucket, func(alias string, raw json.RawMessage) error {
+		var m storedModelMapping
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return err
+		}
+		if m.Deleted {
+			azure.DeleteModelMapping(alias)
+		} else {
+			azure.SetModelMapping(alias, m.Deployment)
+		}
+		return nil
+	})
+	if err == nil {
+		err = db.ForEach(serverlessBucket, func(name string, raw json.RawMessage) error {
+			var d storedServerlessDeployment
+			if err := json.Unmarshal(raw, &d); err != nil {
+				return err
+			}
+			if d.Deleted {
+				azure.DeleteServerlessDeployment(name)
+			} else {
+				azure.SetServerlessDeployment(name, d.ServerlessDeployment)
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		slog.Error("Could not apply stored configuration", "path", store.Path, "error", err)
+		os.Exit(1)
+	}
+	slog.Info("Applied stored configuration", "path", store.Path)
+}
+
+// registerAdminRoutes mounts the admin API when AZURE_OPENAI_PROXY_ADMIN_KEY is set.
+func registerAdminRoutes(router *gin.Engine) {
+	if AdminKey == "" {
+		return
+	}
+	if !auth.Required() {
+		// Keys can be managed before virtual key authentication is switched on
+		if err := auth.Open(store.Default()); err != nil {
+			slog.Error("Could not load virtual keys", "path", store.Path, "error", err)
+			os.Exit(1)
+		}
+	}
+
+	admin := router.Group("/admin", requireAdminKey)
+	admin.GET("/keys", handleListKeys)
+	admin.POST("/keys", handleCreateKey)
+	admin.DELETE("/keys/:key_id", handleRevokeKey)
+	admin.GET("/policies", handleListPolicies)
+	admin.PUT("/policies/:name", handlePutPolicy)
+	admin.DELETE("/policies/:name", handleDeletePolicy)
+	admin.GET("/budgets", handleListBudgets)
+	admin.PUT("/budgets/:scope", handlePutBudget)
+	admin.DELETE("/budgets/:scope", handleDeleteBudget)
+	admin.GET("/prices", handleListPrices)
+	admin.PUT("/prices/:model", handlePutPrice)
+	admin.DELETE("/prices/:model", handleDeletePrice)
+	admin.GET("/models", handleListModelMappings)
+	admin.PUT("/models/:alias", handlePutModelMapping)
+	admin.DELETE("/models/:alias", handleDeleteModelMapping)
+	admin.GET("/serverless", handleListServerless)
+	admin.PUT("/serverless/:name", handlePutServerless)
+	admin.DELETE("/serverless/:name", handleDeleteServerless)
+	admin.GET("/tenants", handleListTenants)
+	admin.GET("/usage", handleUsageReport)
+	admin.GET("/config", handleGetConfig)
+	slog.Info("Admin API enabled", "path", "/admin")
+}
+
+func requireAdminKey(c *gin.Context) {
+	presented := c.GetHeader("api-key")
+	if presented == "" {
+		presented = strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	}
+	if AdminKey == "" || subtle.ConstantTimeCompare([]byte(presented), []byte(AdminKey)) != 1 {
+		abortWithError(c, http.StatusUnauthorized, "Invalid admin key.", "invalid_request_error", "invalid_api_key")
+		return
+	}
+	c.Next()
+}
+
+func handleListKeys(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": auth.Keys.List()})
+}
+
+func handleCreateKey(c *gin.Context) {
+	var req struct {
+		Owner   string   `json:"owner"`
+		Group   string   `json:"group"`
+		Tenant  string   `json:"tenant"`
+		Models  []string `json:"models"`
+		Routes  []string `json:"routes"`
+		Methods []string `json:"methods"`
+		RPM     int      `json:"rpm"`
+		TPM     int      `json:"tpm"`
+		TTL     string   `json:"ttl"`
+
+		Concurrency int    `json:"concurrency"`
+		Priority    string `json:"priority"`
+		Audit       bool   `json:"audit"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Owner == "" {
+		abortWithError(c, http.StatusBadRequest, "owner is required", "invalid_request_error", "invalid_request")
+		return
+	}
+	var ttl time.Duration
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			abortWithError(c, http.StatusBadRequest, "ttl must be a duration such as 720h", "invalid_request_error", "invalid_request")
+			return
+		}
+		ttl = d
+	}
+
+	if _, ok := azure.Tenants[req.Tenant]; req.Tenant != "" && !ok {
+		abortWithError(c, http.StatusBadRequest, "tenant "+req.Tenant+" does not exist", "invalid_request_error", "invalid_request")
+		return
+	}
+	if _, ok := auth.Policies.Get(req.Group); req.Group != "" && !ok {
+		abortWithError(c, http.StatusBadRequest, "group policy "+req.Group+" does not exist", "invalid_request_error", "invalid_request")
+		return
+	}
+
+	policy := auth.Policy{Models: req.Models, Routes: req.Routes, Methods: req.Methods}
+	if err := policy.Validate(); err != nil {
+		abortWithError(c, http.StatusBadRequest, err.Error(), "invalid_request_error", "invalid_request")
+		return
+	}
+	if err := auth.ValidatePriority(&req.Priority); err != nil {
+		abortWithError(c, http.StatusBadRequest, err.Error(), "invalid_request_error", "invalid_request")
+		return
+	}
+	key, secret, err := auth.Keys.Create(auth.KeyOptions{
+		Owner:  req.Owner,
+		Group:  req.Group,
+		Tenant: req.Tenant,
+		Policy: policy,
+		RPM:    req.RPM,
+		TPM:    req.TPM,
+		TTL:    ttl,
+
+		Concurrency: req.Concurrency,
+		Priority:    req.Priority,
+		Audit:       req.Audit,
+	})
+	if err != nil {
+		logging.FromContext(c.Request.Context()).Error("Could not create key", "error", err)
+		abortWithError(c, http.StatusInternalServerError, "failed to create key", "server_error", "store_error")
+		return
+	}
+	logging.FromContext(c.Request.Context()).Info("Admin API created key", "key_id", key.ID, "owner", key.Owner)
+	c.JSON(http.StatusCreated, gin.H{"key": secret, "data": key})
+}
+
+func handleRevokeKey(c *gin.Context) {
+	id := c.Param("key_id")
+	if err := auth.Keys.Revoke(id); err != nil {
+		abortWithError(c, http.StatusNotFound, err.Error(), "invalid_request_error", "not_found")
+		return
+	}
+	logging.FromContext(c.Request.Context()).Info("Admin API revoked key", "key_id", id)
+	c.JSON(http.StatusOK, gin.H{"id": id, "revoked": true})
+}
+
+func handleListPolicies(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": auth.Policies.List()})
+}
+
+func handlePutPolicy(c *gin.Context) {
+	var p auth.Policy
+	if err := c.ShouldBindJSON(&p); err != nil {
+		abortWithError(c, http.StatusBadRequest, err.Error(), "invalid_request_error", "invalid_request")
+		return
+	}
+	p.Name = c.Param("name")
+	if err := p.Validate(); err != nil {
+		abortWithError(c, http.StatusBadRequest, err.Error(), "invalid_request_error", "invalid_request")
+		return
+	}
+	if err := auth.Policies.Put(p); err != nil {
+		logging.FromContext(c.Request.Context()).Error("Could not save policy", "policy", p.Name, "error", err)
+		abortWithError(c, http.StatusInternalServerError, "failed to save policy", "server_error", "store_error")
+		return
+	}
+	logging.FromContext(c.Request.Context()).Info("Admin API saved policy", "policy", p.Name)
+	c.JSON(http.StatusOK, p)
+}
+
+func handleDeletePolicy(c *gin.Context) {
+	name := c.Param("name")
+	if err := auth.Policies.Delete(name); err != nil {
+		abortWithError(c, http.StatusNotFound, err.Error(), "invalid_request_error", "not_found")
+		return
+	}
+	logging.FromContext(c.Request.Context()).Info("Admin API deleted policy", "policy", name)
+	c.JSON(http.StatusOK, gin.H{"name": name, "deleted": true})
+}
+
+func handleListBudgets(c *gin.Context) {
+	type budgetView struct {
+		budget.Budget
+		SpentToday     float64 `json:"spent_today"`
+		SpentThisMonth float64 `json:"spent_this_month"`
+	}
+	views := make([]budgetView, 0)
+	for _, b := range budget.Budgets() {
+		daily, monthly := budget.Spend(b.Scope)
+		views = append(views, budgetView{Budget: b, SpentToday: daily, SpentThisMonth: monthly})
+	}
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": views})
+}
+
+func handlePutBudget(c *gin.Context) {
+	var b budget.Budget
+	if err := c.ShouldBindJSON(&b); err != nil {
+		abortWithError(c, http.StatusBadRequest, err.Error(), "invalid_request_error", "invalid_request")
+		return
+	}
+	b.Scope = c.Param("scope")
+	if err := budget.SetBudget(b); err != nil {
+		abortWithError(c, http.StatusBadRequest, err.Error(), "invalid_request_error", "invalid_request")
+		return
+	}
+	logging.FromContext(c.Request.Context()).Info("Admin API set budget", "scope", b.Scope, "daily", b.Daily, "monthly", b.Monthly)
+	c.JSON(http.StatusOK, b)
+}
+
+func handleDeleteBudget(c *gin.Context) {
+	scope := c.Param("scope")
+	if err := budget.DeleteBudget(scope); err != nil {
+		abortWithError(c, http.StatusNotFound, err.Error(), "invalid_request_error", "not_found")
+		return
+	}
+	logging.FromContext(c.Request.Context()).Info("Admin API deleted budget", "scope", scope)
+	c.JSON(http.StatusOK, gin.H{"scope": scope, "deleted": true})
+}
+
+func handleListPrices(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"object": "map", "data": budget.Prices()})
+}
+
+func handlePutPrice(c *gin.Context) {
+	model := strings.ToLower(c.Param("model"))
+	var p budget.Price
+	if err := c.ShouldBindJSON(&p); err != nil {
+		abortWithError(c, http.StatusBadRequest, err.Error(), "invalid_request_error", "invalid_request")
+		return
+	}
+	if err := budget.SetPrice(model, p); err != nil {
+		abortWithError(c, http.StatusBadRequest, err.Error(), "invalid_request_error", "invalid_request")
+		return
+	}
+	logging.FromContext(c.Request.Context()).Info("Admin API set price", "model", model)
+	c.JSON(http.StatusOK, gin.H{"model": model, "price": p})
+}
+
+func handleDeletePrice(c *gin.Context) {
+	model := strings.ToLower(c.Param("model"))
+	if err := budget.DeletePrice(model); err != nil {
+		logging.FromContext(c.Request.Context()).Error("Could not delete price", "model", model, "error", err)
+		abortWithError(c, http.StatusInternalServerError, "failed to delete price", "server_error", "store_error")
+		return
+	}
+	logging.FromContext(c.Request.Context()).Info("Admin API deleted price", "model", model)
+	c.JSON(http.StatusOK, gin.H{"model": model, "deleted": true})
+}
+
+func handleListModelMappings(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"object": "map", "data": azure.ModelMappings()})
+}
+
+func handlePutModelMapping(c *gin.Context) {
+	alias := strings.ToLower(c.Param("alias"))
+	var req struct {
+		Deployment string `json:"deployment"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Deployment == "" {
+		abortWithError(c, http.StatusBadRequest, "deployment is required", "invalid_request_error", "invalid_request")
+		return
+	}
+	if err := store.Default().Put(modelMappingsBucket, alias, storedModelMapping{Deployment: req.Deployment}); err != nil {
+		logging.FromContext(c.Request.Context()).Error("Could not save model mapping", "alias", alias, "error", err)
+		abortWithError(c, http.StatusInternalServerError, "failed to save model mapping", "server_error", "store_error")
+		return
+	}
+	azure.SetModelMapping(alias, req.Deployment)
+	logging.FromContext(c.Request.Context()).Info("Admin API mapped model", "alias", alias, "deployment", req.Deployment)
+	c.JSON(http.StatusOK, gin.H{"alias": alias, "deployment": req.Deployment})
+}
+
+func handleDeleteModelMapping(c *gin.Context) {
+	alias := strings.ToLower(c.Param("alias"))
+	if err := store.Default().Put(modelMappingsBucket, alias, storedModelMapping{Deleted: true}); err != nil {
+		logging.FromContext(c.Request.Context()).Error("Could not save model mapping", "alias", alias, "error", err)
+		abortWithError(c, http.StatusInternalServerError, "failed to delete model mapping", "server_error", "store_error")
+		return
+	}
+	azure.DeleteModelMapping(alias)
+	logging.FromContext(c.Request.Context()).Info("Admin API deleted model mapping", "alias", alias)
+	c.JSON(http.StatusOK, gin.H{"alias": alias, "deleted": true})
+}
+
+// serverlessView is a serverless deployment without its key.
+type serverlessView struct {
+	Name   string `json:"name"`
+	Region string `json:"region"`
+	HasKey bool   `json:"has_key"`
+}
+
+func serverlessViews() map[string]serverlessView {
+	views := make(map[string]serverlessView)
+	for model, info := range azure.ServerlessDeployments() {
+		views[model] = serverlessView{Name: info.Name, Region: info.Region, HasKey: info.Key != ""}
+	}
+	return views
+}
+
+func handleListServerless(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"object": "map", "data": serverlessViews()})
+}
+
+func handlePutServerless(c *gin.Context) {
+	model := strings.ToLower(c.Param("name"))
+	var req azure.ServerlessDeployment
+	if err := c.ShouldBindJSON(&req); err != nil || req.Name == "" || req.Region == "" {
+		abortWithError(c, http.StatusBadRequest, "name and region are required", "invalid_request_error", "invalid_request")
+		return
+	}
+	if req.Key == "" {
+		// Keep the existing key when only the name or region changes
+		if existing, ok := azure.LookupServerlessDeployment(model); ok {
+			req.Key = existing.Key
+		}
+	}
+	if err := store.Default().Put(serverlessBucket, model, storedServerlessDeployment{ServerlessDeployment: req}); err != nil {
+		logging.FromContext(c.Request.Context()).Error("Could not save serverless deployment", "model", model, "error", err)
+		abortWithError(c, http.StatusInternalServerError, "failed to save serverless deployment", "server_error", "store_error")
+		return
+	}
+	azure.SetServerlessDeployment(model, req)
+	logging.FromContext(c.Request.Context()).Info("Admin API set serverless deployment", "model", model, "name", req.Name, "region", req.Region)
+	c.JSON(http.StatusOK, gin.H{"model": model, "name": req.Name, "region": req.Region, "has_key": req.Key != ""})
+}
+
+func handleDeleteServerless(c *gin.Context) {
+	model := strings.ToLower(c.Param("name"))
+	if err := store.Default().Put(serverlessBucket, model, storedServerlessDeployment{Deleted: true}); err != nil {
+		logging.FromContext(c.Request.Context()).Error("Could not save serverless deployment", "model", model, "error", err)
+		abortWithError(c, http.StatusInternalServerError, "failed to delete serverless deployment", "server_error", "store_error")
+		return
+	}
+	azure.DeleteServerlessDeployment(model)
+	logging.FromContext(c.Request.Context()).Info("Admin API deleted serverless deployment", "model", model)
+	c.JSON(http.StatusOK, gin.H{"model": model, "deleted": true})
+}
+
+// handleListTenants lists the tenants without their keys.
+func handleListTenants(c *gin.Context) {
+	names := make([]string, 0, len(azure.Tenants))
+	for name := range azure.Tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tenants := make([]gin.H, 0, len(names))
+	for _, name := range names {
+		t := azure.Tenants[name]
+		backends := make([]gin.H, 0, len(t.Backends))
+		for _, b := range t.Backends {
+			backends = append(backends, gin.H{"name": b.Name, "endpoint": b.Endpoint, "available": b.Available()})
+		}
+		tenants = append(tenants, gin.H{
+			"name":        t.Name,
+			"hosts":       t.Hosts,
+			"path_prefix": t.PathPrefix,
+			"backends":    backends,
+			"api_versions": gin.H{
+				"default":   t.APIVersion,
+				"models":    t.ModelsAPIVersion,
+				"responses": t.ResponsesAPIVersion,
+				"anthropic": t.AnthropicAPIVersion,
+			},
+			"model_mappings":         t.ModelMappingCount(),
+			"serverless_deployments": len(t.ServerlessDeployments()),
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": tenants})
+}
+
+// handleGetConfig reports the live configuration. Secrets are never included.
+func handleGetConfig(c *gin.Context) {
+	backends := make([]gin.H, 0, len(azure.BackendPool))
+	for _, b := range azure.BackendPool {
+		ttft, samples := b.Stats()
+		backends = append(backends, gin.H{
+			"name":         b.Name,
+			"endpoint":     b.Endpoint,
+			"available":    b.Available(),
+			"has_key":      b.Key != "",
+			"ewma_ttft_ms": ttft,
+			"samples":      samples,
+		})
+	}
+
+	upstreams := make(map[string]string)
+	for name, u := range openai.Upstreams {
+		upstreams[name] = u.BaseURL
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"proxy_mode": ProxyMode,
+		"address":    Address,
+		"endpoint":   azure.AzureOpenAIEndpoint,
+		"api_versions": gin.H{
+			"default":   azure.AzureOpenAIAPIVersion,
+			"models":    azure.AzureOpenAIModelsAPIVersion,
+			"responses": azure.AzureOpenAIResponsesAPIVersion,
+			"anthropic": azure.AnthropicAPIVersion,
+		},
+		"auth": gin.H{
+			"upstream":     azure.AuthMode,
+			"virtual_keys": auth.Enabled,
+			"jwt":          auth.JWTEnabled,
+		},
+		"routing": gin.H{
+			"strategy": azure.RoutingStrategy,
+			"hedging":  azure.HedgingEnabled,
+			"backends": backends,
+		},
+		"traffic_splits": gin.H{
+			"rules":  azure.TrafficSplits,
+			"counts": azure.TrafficSplitCounts(),
+		},
+		"shadow_models":          azure.ShadowModels,
+		"tenants":                len(azure.Tenants),
+		"hybrid_routes":          len(HybridRoutes),
+		"upstreams":              upstreams,
+		"model_mappings":         len(azure.ModelMappings()),
+		"serverless_deployments": serverlessViews(),
+		"store":                  store.Path,
+		"cache": gin.H{
+			"backend":   cache.Backend,
+			"ttl":       cache.TTL.String(),
+			"max_bytes": cache.MaxBytes,
+		},
+		"semantic_cache": gin.H{
+			"enabled":         semantic.Enabled,
+			"embedding_model": semantic.Model,
+			"threshold":       semantic.Threshold,
+			"entries":         semantic.Default.Len(),
+		},
+		"audit": gin.H{
+			"sinks":        audit.SinkNames(),
+			"all_requests": audit.All,
+		},
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/audit"
+	"github.com/gyarbij/azure-oai-proxy/pkg/auth"
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+	"github.com/gyarbij/azure-oai-proxy/pkg/logging"
+	"github.com/tidwall/gjson"
+)
+
+// auditRequest writes the full exchange of audited callers to the audit log.
+// It runs right after authentication, so it sees the body the client sent
+// before the proxy rewrites it, and every response including the proxy's own
+// rejections.
+func auditRequest(c *gin.Context) {
+	if !audit.Enabled() || c.Request.Method == http.MethodOptions {
+		c.Next()
+		return
+	}
+	id := auth.IdentityFrom(c.Request.Context())
+	if !audit.All && (id == nil || !id.Audited()) {
+		c.Next()
+		return
+	}
+
+	c.Request = azure.WithRequestInfo(c.Request)
+	ctx, capture := audit.WithCapture(c.Request.Context())
+	c.Request = c.Request.WithContext(ctx)
+	body := peekBody(c)
+	model := peekModel(c)
+	w := &auditWriter{ResponseWriter: c.Writer}
+	c.Writer = w
+
+	start := time.Now()
+	c.Next()
+
+	r := audit.Record{
+		Time:      start.UTC(),
+		RequestID: logging.RequestID(c.Request.Context()),
+		Method:    c.Request.Method,
+		Path:      c.Request.URL.Path,
+		Model:     model,
+		Status:    c.Writer.Status(),
+		Stream:    gjson.GetBytes(body, "stream").Bool(),
+		LatencyMS: time.Since(start).Milliseconds(),
+	}
+	if id != nil {
+		r.KeyID, r.Owner = id.KeyID, id.Owner
+	}
+	if tenant, _ := azure.TenantFrom(c.Request.Context()); tenant != azure.DefaultTenant {
+		r.Tenant = tenant.Name
+	}
+	if info := azure.GetRequestInfo(c.Request.Context()); info != nil {
+		r.Deployment = info.Deployment
+	}
+	clientBody := body[:min(len(body), audit.MaxBody)]
+	r.ClientRequest = audit.NewMessage(c.ContentType(), clientBody, len(body), false)
+	capture.Fill(&r)
+	r.ClientResponse = audit.NewMessage(w.Header().Get("Content-Type"), w.body.Bytes(), w.body.Size(), true)
+	r.ClientResponse.Status = r.Status
+	audit.Write(r)
+}
+
+// auditWriter keeps a copy of the response sent to the client.
+type auditWriter struct {
+	gin.ResponseWriter
+	body audit.Buffer
+}
+
+func (w *auditWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.body.Write(p[:n])
+	return n, err
+}
+
+func (w *auditWriter) WriteString(s string) (int, error) {
+	n, err := w.ResponseWriter.WriteString(s)
+	w.body.Write([]byte(s[:n]))
+	return n, err
+}
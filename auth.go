@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/auth"
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+	"github.com/gyarbij/azure-oai-proxy/pkg/limits"
+	"github.com/gyarbij/azure-oai-proxy/pkg/logging"
+	"github.com/gyarbij/azure-oai-proxy/pkg/store"
+	"github.com/tidwall/gjson"
+)
+
+// authenticate requires callers to present a proxy-issued virtual key or an
+// OIDC token from the trusted issuer, whichever AZURE_OPENAI_PROXY_AUTH
+// enables. On success the client's credential is replaced with the proxy's own
+// Azure key, so real keys never leave the proxy.
+func authenticate(c *gin.Context) {
+	if !auth.Required() || c.Request.Method == http.MethodOptions {
+		c.Next()
+		return
+	}
+	traceAuthentication(c, checkCaller)
+	if c.IsAborted() {
+		return
+	}
+	c.Next()
+}
+
+// checkCaller verifies the caller's credential and policies, aborting the
+// request when they do not allow it.
+func checkCaller(c *gin.Context) {
+	secret := c.GetHeader("api-key")
+	if secret == "" {
+		secret = strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	}
+	if secret == "" {
+		abortWithError(c, http.StatusUnauthorized, "You didn't provide an API key.", "invalid_request_error", "missing_api_key")
+		return
+	}
+
+	var id *auth.Identity
+	hint := secret
+	if auth.JWTEnabled && auth.LooksLikeJWT(secret) {
+		claims, err := auth.VerifyJWT(c.Request.Context(), secret)
+		if err == nil {
+			id, err = auth.IdentityFromClaims(claims)
+		}
+		if err != nil {
+			logging.FromContext(c.Request.Context()).Warn("Rejected token", "path", c.Request.URL.Path, "error", err)
+			message := "The access token provided is invalid."
+			if errors.Is(err, auth.ErrExpiredKey) {
+				message = "The access token provided has expired."
+			}
+			abortWithError(c, http.StatusUnauthorized, message, "invalid_request_error", "invalid_token")
+			return
+		}
+		hint = id.KeyID
+	} else {
+		if !auth.Enabled {
+			abortWithError(c, http.StatusUnauthorized, "An access token from the configured issuer is required.", "invalid_request_error", "invalid_token")
+			return
+		}
+		key, err := auth.Keys.Authenticate(secret)
+		if err != nil {
+			logging.FromContext(c.Request.Context()).Warn("Rejected API key", "path", c.Request.URL.Path, "error", err)
+			message := "Incorrect API key provided."
+			if errors.Is(err, auth.ErrExpiredKey) {
+				message = "The API key provided has expired."
+			}
+			abortWithError(c, http.StatusUnauthorized, message, "invalid_request_error", "invalid_api_key")
+			return
+		}
+		id = auth.NewIdentity(key)
+		hint = "API key " + key.Hint
+	}
+
+	// Model capabilities name the model in the path rather than the body
+	model := peekModel(c)
+	if m := c.Param("model_id"); m != "" {
+		model = m
+	}
+	if err := id.Check(c.Request.Method, c.Request.URL.Path, model); err != nil {
+		logging.FromContext(c.Request.Context()).Warn("Denied request", "method", c.Request.Method, "path", c.Request.URL.Path, "key_id", id.KeyID, "error", err)
+		var denied *auth.PolicyError
+		if !errors.As(err, &denied) {
+			abortWithError(c, http.StatusInternalServerError, "The caller's policies could not be checked.", "server_error", "policy_check_failed")
+			return
+		}
+		abortWithError(c, http.StatusForbidden,
+			fmt.Sprintf("%s for %s.", denied.Message, hint),
+			"invalid_request_error", denied.Code)
+		return
+	}
+
+	tenant, err := bindTenant(c.Request.Context(), id)
+	if err != nil {
+		logging.FromContext(c.Request.Context()).Warn("Denied request", "method", c.Request.Method, "path", c.Request.URL.Path, "key_id", id.KeyID, "error", err)
+		abortWithError(c, http.StatusForbidden, fmt.Sprintf("%s for %s.", err, hint), "invalid_request_error", "tenant_not_allowed")
+		return
+	}
+	ctx := azure.WithTenant(c.Request.Context(), tenant)
+	c.Request = c.Request.WithContext(auth.WithIdentity(ctx, id))
+
+	c.Request.Header.Del("Authorization")
+	c.Request.Header.Del("api-key")
+	if tenant.APIKey != "" {
+		c.Request.Header.Set("api-key", tenant.APIKey)
+	}
+}
+
+// bindTenant returns the tenant a caller's request is served by. Callers are
+// served by the tenant they are bound to, and may not address another by
+// host or path. Callers bound to no tenant are served by the default one.
+func bindTenant(ctx context.Context, id *auth.Identity) (*azure.Tenant, error) {
+	requested, selected := azure.TenantFrom(ctx)
+	name := id.Tenant
+	if name == "" {
+		name = auth.DefaultTenant
+	}
+	if selected && requested.Name != name {
+		return nil, fmt.Errorf("Tenant %s is not allowed", requested.Name)
+	}
+	tenant, ok := azure.Tenants[name]
+	if !ok {
+		return nil, fmt.Errorf("Tenant %s does not exist", name)
+	}
+	return tenant, nil
+}
+
+// filterModels drops the models the caller's key may not use.
+func filterModels(c *gin.Context, models []Model) []Model {
+	id := auth.IdentityFrom(c.Request.Context())
+	if id == nil {
+		return models
+	}
+	allowed := models[:0]
+	for _, m := range models {
+		if id.AllowsModel(m.ID) {
+			allowed = append(allowed, m)
+		}
+	}
+	return allowed
+}
+
+// abortWithError stops the request with an OpenAI-style error body.
+func abortWithError(c *gin.Context, status int, message, errType, code string) {
+	c.AbortWithStatusJSON(status, gin.H{"error": gin.H{
+		"message": message,
+		"type":    errType,
+		"param":   nil,
+		"code":    code,
+	}})
+}
+
+// peekBody returns the request body, leaving it in place for the proxy.
+func peekBody(c *gin.Context) []byte {
+	if c.Request.Body == nil || c.Request.Method == http.MethodGet {
+		return nil
+	}
+	body, _ := io.ReadAll(c.Request.Body)
+	c.Request.Body = io.NopCloser(bytes.NewBuffer(body))
+	return body
+}
+
+// peekModel returns the model named in a JSON or multipart request body,
+// leaving the body in place for the proxy.
+func peekModel(c *gin.Context) string {
+	body := peekBody(c)
+	if body == nil {
+		return ""
+	}
+	if c.ContentType() == "multipart/form-data" {
+		// Audio uploads carry the model as a form field
+		model := c.Request.FormValue("model")
+		c.Request.Body = io.NopCloser(bytes.NewBuffer(body))
+		return model
+	}
+	return gjson.GetBytes(body, "model").String()
+}
+
+// runKeygen implements the "keygen" subcommand, which issues a virtual key
+// and prints its secret once.
+func runKeygen(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	owner := fs.String("owner", "", "owner of the key (team or user)")
+	models := fs.String("models", "", "comma-separated allowed model aliases, * suffix for prefixes (default all)")
+	routes := fs.String("routes", "", "comma-separated allowed route families: "+strings.Join(auth.RouteFamilies, ", ")+" (default all)")
+	methods := fs.String("methods", "", "comma-separated allowed HTTP methods (default all)")
+	tenant := fs.String("tenant", "", "tenant the key is bound to (default the default tenant)")
+	group := fs.String("group", "", "group policy applied on top of the key's own lists")
+	rpm := fs.Int("rpm", 0, "requests per minute (default AZURE_OPENAI_RATE_LIMIT_KEY_RPM)")
+	tpm := fs.Int("tpm", 0, "tokens per minute (default AZURE_OPENAI_RATE_LIMIT_KEY_TPM)")
+	concurrency := fs.Int("concurrency", 0, "max in-flight requests (default AZURE_OPENAI_CONCURRENCY_KEY)")
+	priority := fs.String("priority", "", "queue priority: "+strings.Join(limits.PriorityNames, ", ")+" (default normal)")
+	ttl := fs.Duration("ttl", 0, "key lifetime, e.g. 720h (default never expires)")
+	audit := fs.Bool("audit", false, "write the key's requests and responses to the audit log")
+	fs.Parse(args)
+
+	if *owner == "" {
+		fmt.Fprintln(os.Stderr, "keygen: -owner is required")
+		os.Exit(2)
+	}
+	if err := auth.Open(store.Default()); err != nil {
+		slog.Error("Could not load virtual keys", "path", store.Path, "error", err)
+		os.Exit(1)
+	}
+	if _, ok := azure.Tenants[*tenant]; *tenant != "" && !ok {
+		slog.Error("Tenant is not configured in AZURE_OPENAI_TENANTS_FILE", "tenant", *tenant)
+		os.Exit(1)
+	}
+	if _, ok := auth.Policies.Get(*group); *group != "" && !ok {
+		slog.Warn("Group policy does not exist yet; the key is denied until it is created", "policy", *group)
+	}
+
+	key, secret, err := auth.Keys.Create(auth.KeyOptions{
+		Owner:  *owner,
+		Group:  *group,
+		Tenant: *tenant,
+		Policy: auth.Policy{Models: splitList(*models), Routes: splitList(*routes), Methods: splitList(*methods)},
+		RPM:    *rpm,
+		TPM:    *tpm,
+		TTL:    *ttl,
+
+		Concurrency: *concurrency,
+		Priority:    *priority,
+		Audit:       *audit,
+	})
+	if err != nil {
+		slog.Error("Could not create key", "error", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("id:      %s\nowner:   %s\nkey:     %s\n", key.ID, key.Owner, secret)
+	if key.ExpiresAt != nil {
+		fmt.Printf("expires: %s\n", key.ExpiresAt.Format(time.RFC3339))
+	}
+	fmt.Println("Store the key now; only its hash is kept in", store.Path)
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(v string) []string {
+	var list []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/auth"
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+	"github.com/tidwall/gjson"
+)
+
+func TestBindTenant(t *testing.T) {
+	retail := &azure.Tenant{Name: "retail"}
+	azure.Tenants["retail"] = retail
+	t.Cleanup(func() { delete(azure.Tenants, "retail") })
+
+	tests := []struct {
+		name      string
+		bound     string
+		requested *azure.Tenant // nil when the request names no tenant
+		want      string
+		wantErr   bool
+	}{
+		{name: "unbound caller gets default", want: "default"},
+		{name: "unbound caller may address default", requested: azure.DefaultTenant, want: "default"},
+		{name: "unbound caller may not address another tenant", requested: retail, wantErr: true},
+		{name: "default caller may not address another tenant", bound: "default", requested: retail, wantErr: true},
+		{name: "bound caller gets its tenant", bound: "retail", want: "retail"},
+		{name: "bound caller may address its tenant", bound: "retail", requested: retail, want: "retail"},
+		{name: "bound caller may not address default", bound: "retail", requested: azure.DefaultTenant, wantErr: true},
+		{name: "missing tenant", bound: "wholesale", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.requested != nil {
+				ctx = azure.WithTenant(ctx, tt.requested)
+			}
+			got, err := bindTenant(ctx, &auth.Identity{KeyID: "test", Tenant: tt.bound})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("bindTenant() = %s, want error", got.Name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("bindTenant() error = %v", err)
+			}
+			if got.Name != tt.want {
+				t.Errorf("bindTenant() = %s, want %s", got.Name, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckCaller(t *testing.T) {
+	saved := auth.Enabled
+	auth.Enabled = true
+	t.Cleanup(func() { auth.Enabled = saved })
+
+	_, mini, err := auth.Keys.Create(auth.KeyOptions{Owner: "test", Policy: auth.Policy{Models: []string{"gpt-4o-mini"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, getOnly, err := auth.Keys.Create(auth.KeyOptions{Owner: "test", Policy: auth.Policy{Methods: []string{"GET"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, orphan, err := auth.Keys.Create(auth.KeyOptions{Owner: "test", Group: "missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := gin.New()
+	router.Use(authenticate)
+	ok := func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"api-key": c.GetHeader("api-key"), "authorization": c.GetHeader("Authorization")})
+	}
+	router.POST("/v1/chat/completions", ok)
+	router.GET("/v1/models/:model_id/capabilities", ok)
+
+	chat := func(model string) string { return `{"model":"` + model + `","messages":[]}` }
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		header string // Authorization
+		want   int
+		code   string
+	}{
+		{name: "no credential", method: "POST", path: "/v1/chat/completions", body: chat("gpt-4o-mini"), want: 401, code: "missing_api_key"},
+		{name: "unknown key", method: "POST", path: "/v1/chat/completions", body: chat("gpt-4o-mini"), header: "Bearer sk-proxy-nope", want: 401, code: "invalid_api_key"},
+		{name: "allowed model", method: "POST", path: "/v1/chat/completions", body: chat("gpt-4o-mini"), header: "Bearer " + mini, want: 200},
+		{name: "key without Bearer", method: "POST", path: "/v1/chat/completions", body: chat("gpt-4o-mini"), header: mini, want: 200},
+		{name: "model not allowed", method: "POST", path: "/v1/chat/completions", body: chat("gpt-4o"), header: "Bearer " + mini, want: 403, code: "model_not_allowed"},
+		{name: "capabilities of allowed model", method: "GET", path: "/v1/models/gpt-4o-mini/capabilities", header: "Bearer " + mini, want: 200},
+		{name: "capabilities of other model", method: "GET", path: "/v1/models/gpt-4o/capabilities", header: "Bearer " + mini, want: 403, code: "model_not_allowed"},
+		{name: "method not allowed", method: "POST", path: "/v1/chat/completions", body: chat("gpt-4o"), header: "Bearer " + getOnly, want: 403, code: "method_not_allowed"},
+		{name: "missing group policy", method: "POST", path: "/v1/chat/completions", body: chat("gpt-4o"), header: "Bearer " + orphan, want: 403, code: "policy_not_found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			res := gjson.Parse(w.Body.String())
+			if tt.code != "" && res.Get("error.code").String() != tt.code {
+				t.Errorf("code = %s, want %s", res.Get("error.code"), tt.code)
+			}
+			if w.Code == 200 && (res.Get("authorization").String() != "" || res.Get("api-key").String() != azure.DefaultTenant.APIKey) {
+				t.Errorf("caller credential reached the handler: %s", w.Body)
+			}
+		})
+	}
+}
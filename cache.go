@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+	"github.com/gyarbij/azure-oai-proxy/pkg/cache"
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+)
+
+// cacheableRoutes are the route suffixes whose responses depend on nothing
+// but the request body and the deployment. Embeddings are cached input by
+// input instead, by batchEmbeddings.
+var cacheableRoutes = []string{"/chat/completions", "/completions"}
+
+// cacheResponses answers repeated identical requests from the response
+// cache. It runs before budgets and rate limits, so a cached answer costs the
+// caller nothing. "Cache-Control: no-cache" skips the lookup but stores the
+// fresh response; "no-store" bypasses the cache altogether.
+func cacheResponses(c *gin.Context) {
+	if !cache.Enabled() || c.Request.Method != http.MethodPost || !isCacheableRoute(c.Request.URL.Path) {
+		c.Next()
+		return
+	}
+	directives := strings.ToLower(c.GetHeader("Cache-Control"))
+	if strings.Contains(directives, "no-store") {
+		c.Next()
+		return
+	}
+
+	model := peekModel(c)
+	key, ok := cache.Key(cacheScope(c, model), c.Request.URL.Path, peekBody(c))
+	if !ok {
+		c.Next()
+		return
+	}
+	tenant, _ := azure.TenantFrom(c.Request.Context())
+	store := cache.Default()
+	if !strings.Contains(directives, "no-cache") {
+		if e, ok := store.Get(key); ok {
+			metrics.CacheLookups.Inc("exact", tenant.Name, modelLabel(tenant, model), "hit")
+			replayCached(c, e)
+			c.Abort()
+			return
+		}
+		metrics.CacheLookups.Inc("exact", tenant.Name, modelLabel(tenant, model), "miss")
+	}
+
+	c.Header("X-Proxy-Cache", "MISS")
+	w := &cacheWriter{ResponseWriter: c.Writer}
+	c.Writer = w
+	c.Next()
+
+	// A downgraded request was answered by another model than its key names
+	if e, ok := w.entry(c); ok && w.Header().Get("X-Budget-Downgraded-From") == "" {
+		store.Put(key, e)
+	}
+}
+
+func isCacheableRoute(path string) bool {
+	for _, suffix := range cacheableRoutes {
+		if strings.HasSuffix(path, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheScope names where a request for model is answered: the tenant and the
+// resolved deployment, or the OpenAI-compatible upstream.
+func cacheScope(c *gin.Context, model string) string {
+	tenant, _ := azure.TenantFrom(c.Request.Context())
+	upstream := "azure"
+	switch ProxyMode {
+	case "openai":
+		upstream = "openai"
+	case "hybrid":
+		upstream = upstreamForModel(tenant, model)
+	}
+	if upstream != "azure" {
+		return tenant.Name + "/" + upstream
+	}
+	c.Request = azure.WithRequestInfo(c.Request)
+	return tenant.Name + "/azure/" + azure.ResolveDeployment(c.Request, model)
+}
+
+// replayCached writes a cached response. Streams are sent event by event, as
+// server-sent events, like the original.
+func replayCached(c *gin.Context, e *cache.Entry) {
+	c.Header("X-Proxy-Cache", "HIT")
+	c.Header("Age", strconv.Itoa(int(time.Since(e.Created).Seconds())))
+	if !e.Stream() {
+		c.Data(e.Status, e.ContentType, e.Body)
+		return
+	}
+
+	c.Header("Content-Type", e.ContentType)
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(e.Status)
+	for _, event := range bytes.SplitAfter(e.Body, []byte("\n\n")) {
+		if len(event) == 0 {
+			continue
+		}
+		if _, err := c.Writer.Write(event); err != nil {
+			return
+		}
+		c.Writer.Flush()
+	}
+}
+
+// cacheWriter keeps a copy of the response, up to cache.MaxEntryBytes.
+type cacheWriter struct {
+	gin.ResponseWriter
+	body     bytes.Buffer
+	tooLarge bool
+}
+
+// entry returns the response as a cache entry, unless it should not be
+// replayed: errors, oversized bodies and cut-short streams.
+func (w *cacheWriter) entry(c *gin.Context) (*cache.Entry, bool) {
+	e := &cache.Entry{
+		Status:      w.Status(),
+		ContentType: w.Header().Get("Content-Type"),
+		Body:        w.body.Bytes(),
+		Created:     time.Now(),
+	}
+	complete := !e.Stream() || bytes.Contains(e.Body, []byte("data: [DONE]"))
+	ok := e.Status == http.StatusOK && !w.tooLarge && complete && c.Request.Context().Err() == nil
+	return e, ok
+}
+
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.keep(p[:n])
+	return n, err
+}
+
+func (w *cacheWriter) WriteString(s string) (int, error) {
+	n, err := w.ResponseWriter.WriteString(s)
+	w.keep([]byte(s[:n]))
+	return n, err
+}
+
+func (w *cacheWriter) keep(p []byte) {
+	if w.tooLarge {
+		return
+	}
+	if int64(w.body.Len()+len(p)) > cache.MaxEntryBytes {
+		w.tooLarge = true
+		w.body.Reset()
+		return
+	}
+	w.body.Write(p)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/auth"
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+	"github.com/gyarbij/azure-oai-proxy/pkg/budget"
+	"github.com/gyarbij/azure-oai-proxy/pkg/cache"
+)
+
+func TestCacheWithBudgetDowngrade(t *testing.T) {
+	saved := cache.Backend
+	cache.Backend = "memory"
+	t.Cleanup(func() { cache.Backend = saved })
+
+	id := &auth.Identity{KeyID: "cache-downgrade", Owner: "cache-downgrade"}
+	scope := budget.KeyScope(id.KeyID)
+	if err := budget.SetBudget(budget.Budget{Scope: scope, Daily: 1, Downgrade: map[string]string{"gpt-4o": "gpt-4o-mini"}}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { budget.DeleteBudget(scope) })
+	budget.Charge([]string{scope}, 2)
+
+	// The handler stands in for the director, which sends the request to
+	// the deployment already resolved for it
+	var sentTo []string
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Request = c.Request.WithContext(auth.WithIdentity(c.Request.Context(), id))
+	}, cacheResponses, enforceBudget)
+	router.POST("/v1/chat/completions", func(c *gin.Context) {
+		deployment := azure.ResolveDeployment(c.Request, peekModel(c))
+		sentTo = append(sentTo, deployment)
+		c.JSON(http.StatusOK, gin.H{"model": deployment})
+	})
+
+	send := func() *httptest.ResponseRecorder {
+		body := `{"model":"gpt-4o","messages":[{"role":"user","content":"cache and downgrade"}]}`
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)))
+		return w
+	}
+
+	w := send()
+	if len(sentTo) != 1 || sentTo[0] != "gpt-4o-mini" {
+		t.Fatalf("downgraded request sent to %v, want gpt-4o-mini", sentTo)
+	}
+	if w.Header().Get("X-Budget-Downgraded-From") != "gpt-4o" {
+		t.Errorf("X-Budget-Downgraded-From = %q", w.Header().Get("X-Budget-Downgraded-From"))
+	}
+
+	// The downgraded answer was not cached for gpt-4o
+	if err := budget.DeleteBudget(scope); err != nil {
+		t.Fatal(err)
+	}
+	w = send()
+	if w.Header().Get("X-Proxy-Cache") != "MISS" || len(sentTo) != 2 || sentTo[1] != "gpt-4o" {
+		t.Errorf("X-Proxy-Cache = %s, sent to %v; want a miss sent to gpt-4o", w.Header().Get("X-Proxy-Cache"), sentTo)
+	}
+	if w = send(); w.Header().Get("X-Proxy-Cache") != "HIT" || len(sentTo) != 2 {
+		t.Errorf("X-Proxy-Cache = %s, sent to %v; want a hit", w.Header().Get("X-Proxy-Cache"), sentTo)
+	}
+}
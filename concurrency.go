@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/auth"
+	"github.com/gyarbij/azure-oai-proxy/pkg/limits"
+	"github.com/gyarbij/azure-oai-proxy/pkg/logging"
+)
+
+// limitConcurrency caps the in-flight requests per key and per model. Requests
+// over a limit wait in a bounded queue, ordered by priority class and taking
+// turns between keys, and get a 429 if no slot frees up in time.
+func limitConcurrency(c *gin.Context) {
+	if c.Request.Method == http.MethodOptions {
+		c.Next()
+		return
+	}
+
+	// Callers may lower their priority with x-priority, but not raise it
+	// above what their key or policy grants. Without authentication there is
+	// nothing to grant, so the header decides.
+	header := c.GetHeader("x-priority")
+	requested, ok := limits.ParsePriority(header)
+	if !ok {
+		abortWithError(c, http.StatusBadRequest,
+			fmt.Sprintf("Invalid x-priority header %q, expected high, normal or low.", header),
+			"invalid_request_error", "invalid_priority")
+		return
+	}
+	c.Request.Header.Del("x-priority")
+
+	var gates []*limits.Gate
+	tenant, priority := c.ClientIP(), limits.PriorityNormal
+	if header != "" {
+		priority = limits.PriorityHigh
+	}
+	if id := auth.IdentityFrom(c.Request.Context()); id != nil {
+		concurrency, granted := id.Scheduling()
+		if concurrency == 0 {
+			concurrency = limits.KeyConcurrency
+		}
+		if concurrency > 0 {
+			gates = append(gates, limits.Gates.Get("key:"+id.KeyID, concurrency))
+		}
+		tenant, priority = id.KeyID, granted
+	}
+	if header != "" {
+		priority = max(priority, requested)
+	}
+
+	model := peekModel(c)
+	if n, ok := limits.ModelConcurrencyLimit(model); ok && model != "" {
+		gates = append(gates, limits.Gates.Get(modelScope(c, model), n))
+	}
+	if len(gates) == 0 {
+		c.Next()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), limits.QueueTimeout)
+	defer cancel()
+	start := time.Now()
+	for _, gate := range gates {
+		release, err := gate.Acquire(ctx, tenant, priority)
+		if err != nil {
+			if c.Request.Context().Err() != nil {
+				// The client went away while waiting
+				c.Abort()
+				return
+			}
+			logging.FromContext(c.Request.Context()).Info("Queue rejected request", "method", c.Request.Method, "path", c.Request.URL.Path, "tenant", tenant, "waited", time.Since(start).Round(time.Millisecond).String(), "error", err)
+			c.Header("Retry-After", "1")
+			message := "Too many concurrent requests; the queue is full. Please try again shortly."
+			if errors.Is(err, limits.ErrQueueTimeout) {
+				message = fmt.Sprintf("Too many concurrent requests; no slot became free within %s. Please try again shortly.", limits.FormatDuration(limits.QueueTimeout))
+			}
+			abortWithError(c, http.StatusTooManyRequests, message, "requests", "concurrency_limit_exceeded")
+			return
+		}
+		defer release()
+	}
+	c.Next()
+}
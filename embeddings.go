@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/auth"
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+	"github.com/gyarbij/azure-oai-proxy/pkg/cache"
+	"github.com/gyarbij/azure-oai-proxy/pkg/embeddings"
+	"github.com/gyarbij/azure-oai-proxy/pkg/logging"
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+	"github.com/gyarbij/azure-oai-proxy/pkg/openai"
+	"github.com/gyarbij/azure-oai-proxy/pkg/tracing"
+	"github.com/gyarbij/azure-oai-proxy/pkg/usage"
+)
+
+// embeddingsTimeout bounds the upstream calls made for one embeddings request.
+const embeddingsTimeout = 2 * time.Minute
+
+var embeddingsCoalescer = embeddings.NewCoalescer()
+
+// upstreamError is a non-200 answer to an upstream call the proxy made on a
+// client's behalf. It is passed on to the client as it came.
+type upstreamError struct {
+	status int
+	header http.Header // content type, request IDs and rate limits
+	body   []byte
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("upstream returned %d: %.200s", e.status, e.body)
+}
+
+// batchEmbeddings answers embeddings requests itself when they need more than
+// one upstream call, or none. Requests with more than embeddings.MaxInputs
+// inputs are split into chunks sent concurrently; with the response cache on,
+// each input's vector is cached on its own, so only new inputs are sent; and
+// with coalescing on, small concurrent requests share upstream calls. Other
+// embeddings requests are proxied as they came.
+func batchEmbeddings(c *gin.Context) {
+	if c.Request.Method != http.MethodPost || !strings.HasSuffix(c.Request.URL.Path, "/embeddings") {
+		c.Next()
+		return
+	}
+	body := peekBody(c)
+	var req struct {
+		Input json.RawMessage `json:"input"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		c.Next()
+		return
+	}
+	inputs, ok := embeddings.Inputs(req.Input)
+	if !ok {
+		c.Next()
+		return
+	}
+	directives := strings.ToLower(c.GetHeader("Cache-Control"))
+	caching := cache.Enabled() && !strings.Contains(directives, "no-store")
+	if !caching && embeddings.CoalesceWindow == 0 && len(inputs) <= embeddings.MaxInputs {
+		c.Next()
+		return
+	}
+
+	model := peekModel(c)
+	tenant, _ := azure.TenantFrom(c.Request.Context())
+	scope := cacheScope(c, model)
+	var keys []string
+	if caching {
+		keys, caching = inputKeys(scope, body, inputs)
+	}
+
+	result := &embeddings.Result{Model: model, Vectors: make([]json.RawMessage, len(inputs))}
+	var missing []int
+	store := cache.Default()
+	for i := range inputs {
+		if caching && !strings.Contains(directives, "no-cache") {
+			if e, ok := store.Get(keys[i]); ok {
+				metrics.CacheLookups.Inc("input", tenant.Name, modelLabel(tenant, model), "hit")
+				result.Vectors[i] = e.Body
+				continue
+			}
+			metrics.CacheLookups.Inc("input", tenant.Name, modelLabel(tenant, model), "miss")
+		}
+		missing = append(missing, i)
+	}
+
+	if len(missing) > 0 {
+		todo := make([]json.RawMessage, len(missing))
+		for j, i := range missing {
+			todo[j] = inputs[i]
+		}
+		fetched, err := fetchEmbeddings(c, scope, body, todo)
+		var ue *upstreamError
+		switch {
+		case errors.As(err, &ue):
+			if m := metrics.RequestFrom(c.Request.Context()); m != nil {
+				m.UpstreamStatus = ue.status
+			}
+			passUpstreamHeaders(c, ue.header)
+			c.Data(ue.status, ue.header.Get("Content-Type"), ue.body)
+			c.Abort()
+			return
+		case err != nil:
+			logging.FromContext(c.Request.Context()).Error("Embeddings request failed", "inputs", len(inputs), "error", err)
+			abortWithError(c, http.StatusBadGateway, "Embeddings request failed: "+err.Error(), "proxy_error", "")
+			return
+		}
+		if m := metrics.RequestFrom(c.Request.Context()); m != nil {
+			m.UpstreamStatus = http.StatusOK
+		}
+		now := time.Now()
+		for j, i := range missing {
+			result.Vectors[i] = fetched.Vectors[j]
+			if caching {
+				store.Put(keys[i], &cache.Entry{Status: http.StatusOK, ContentType: "application/json", Body: fetched.Vectors[j], Created: now})
+			}
+		}
+		if fetched.Model != "" {
+			result.Model = fetched.Model
+		}
+		passUpstreamHeaders(c, fetched.Header)
+		result.PromptTokens = fetched.PromptTokens
+		if rec := usage.RecorderFrom(c.Request.Context()); rec != nil {
+			rec.Record(usage.Usage{PromptTokens: fetched.PromptTokens, TotalTokens: fetched.PromptTokens})
+		}
+	}
+
+	if caching {
+		if len(missing) == 0 {
+			c.Header("X-Proxy-Cache", "HIT")
+		} else {
+			c.Header("X-Proxy-Cache", "MISS")
+		}
+	}
+	c.Data(http.StatusOK, "application/json", result.Response())
+	c.Abort()
+}
+
+// inputKeys returns the response cache key of each input's vector: the scope,
+// the rest of the request, such as the dimensions and encoding format, and
+// the input itself.
+func inputKeys(scope string, body []byte, inputs []json.RawMessage) ([]string, bool) {
+	rest, err := embeddings.WithInputs(body, nil)
+	if err != nil {
+		return nil, false
+	}
+	rest, ok := cache.Normalize(rest)
+	if !ok {
+		return nil, false
+	}
+	keys := make([]string, len(inputs))
+	for i, in := range inputs {
+		h := sha256.New()
+		h.Write([]byte(scope))
+		h.Write([]byte{0})
+		h.Write(rest)
+		h.Write([]byte{0})
+		h.Write(in)
+		keys[i] = hex.EncodeToString(h.Sum(nil))
+	}
+	return keys, true
+}
+
+// fetchEmbeddings gets the vectors of inputs from upstream, sharing the call
+// with other requests when coalescing is on.
+func fetchEmbeddings(c *gin.Context, scope string, body []byte, inputs []json.RawMessage) (*embeddings.Result, error) {
+	if embeddings.CoalesceWindow == 0 || len(inputs) >= embeddings.MaxInputs {
+		ctx, cancel := detachedContext(c.Request.Context(), embeddingsTimeout)
+		defer cancel()
+		// Unlike a shared call, the request's own calls end with it
+		stop := context.AfterFunc(c.Request.Context(), cancel)
+		defer stop()
+		return sendChunks(ctx, c, body, inputs)
+	}
+
+	key, err := coalesceKey(c, scope, body)
+	if err != nil {
+		return nil, err
+	}
+	res, shared, err := embeddingsCoalescer.Do(key, inputs, func(all []json.RawMessage) (*embeddings.Result, error) {
+		ctx, cancel := detachedContext(c.Request.Context(), embeddingsTimeout)
+		defer cancel()
+		return sendChunks(ctx, c, body, all)
+	})
+	// One bad input fails a whole batch; retry alone so it only fails its own request
+	var ue *upstreamError
+	if shared && errors.As(err, &ue) && ue.status == http.StatusBadRequest {
+		ctx, cancel := detachedContext(c.Request.Context(), embeddingsTimeout)
+		defer cancel()
+		return sendChunks(ctx, c, body, inputs)
+	}
+	return res, err
+}
+
+// coalesceKey names the requests that may share an upstream call: the same
+// scope and credentials, and the same request apart from the input.
+func coalesceKey(c *gin.Context, scope string, body []byte) (string, error) {
+	rest, err := embeddings.WithInputs(body, nil)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write([]byte(scope))
+	for _, v := range []string{c.GetHeader("Authorization"), c.GetHeader("api-key")} {
+		h.Write([]byte{0})
+		h.Write([]byte(v))
+	}
+	if id := auth.IdentityFrom(c.Request.Context()); id != nil {
+		h.Write([]byte{0})
+		h.Write([]byte(id.KeyID))
+	}
+	h.Write([]byte{0})
+	h.Write(rest)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sendChunks sends inputs upstream in chunks of at most embeddings.MaxInputs,
+// embeddings.Concurrency at a time, on behalf of c's caller. The first
+// failure is returned.
+func sendChunks(ctx context.Context, c *gin.Context, body []byte, inputs []json.RawMessage) (*embeddings.Result, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	chunks := embeddings.Chunks(inputs)
+	results := make([]*embeddings.Result, len(chunks))
+	errs := make([]error, len(chunks))
+	backends := make([]*azure.Backend, len(chunks))
+	model := peekModel(c)
+	sem := make(chan struct{}, embeddings.Concurrency)
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		latest http.Header
+	)
+	for i, chunk := range chunks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if ctx.Err() != nil {
+				errs[i] = ctx.Err()
+				return
+			}
+			chunkBody, err := embeddings.WithInputs(body, chunk)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			req, err := newEmbeddingsRequest(ctx, c, c.Request.URL.RequestURI(), chunkBody)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			raw, header, err := postEmbeddings(req, model)
+			if err == nil {
+				results[i], err = embeddings.ParseResult(raw, len(chunk))
+			}
+			if err != nil {
+				errs[i] = err
+				cancel()
+				return
+			}
+			mu.Lock()
+			latest = header
+			mu.Unlock()
+			if info := azure.GetRequestInfo(req.Context()); info != nil {
+				backends[i] = info.Backend
+			}
+		}()
+	}
+	wg.Wait()
+
+	// An upstream's own answer says more than the cancellations it caused
+	var firstErr error
+	for _, err := range errs {
+		var ue *upstreamError
+		if errors.As(err, &ue) {
+			return nil, err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if info := azure.GetRequestInfo(c.Request.Context()); info != nil && info.Backend == nil {
+		info.Backend = backends[0]
+	}
+	result := &embeddings.Result{Header: latest}
+	for _, r := range results {
+		result.Append(r)
+	}
+	return result, nil
+}
+
+// detachedContext returns a context carrying src's tenant, identity, request
+// ID and trace, but not its cancellation or its per-request accounting, for
+// upstream calls the proxy makes on a caller's behalf.
+func detachedContext(src context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	tenant, _ := azure.TenantFrom(src)
+	ctx = azure.WithTenant(ctx, tenant)
+	if id := auth.IdentityFrom(src); id != nil {
+		ctx = auth.WithIdentity(ctx, id)
+	}
+	ctx = logging.WithRequestID(ctx, logging.RequestID(src))
+	ctx = tracing.WithSpan(ctx, tracing.SpanFrom(src))
+	return ctx, cancel
+}
+
+// newEmbeddingsRequest builds an embeddings request to uri with the caller's
+// credentials, as authenticate left them.
+func newEmbeddingsRequest(ctx context.Context, c *gin.Context, uri string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = c.Request.Header.Clone()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Del("Content-Length")
+	req.Header.Del("Accept-Encoding")
+	req.Header.Del("Cache-Control")
+	return azure.WithRequestInfo(req), nil
+}
+
+// postEmbeddings sends an embeddings request for model to wherever the proxy
+// mode routes it and returns the response body and upstreamHeaders.
+func postEmbeddings(req *http.Request, model string) ([]byte, http.Header, error) {
+	tenant, _ := azure.TenantFrom(req.Context())
+	upstream := "azure"
+	switch ProxyMode {
+	case "openai":
+		upstream = "openai"
+	case "hybrid":
+		upstream = upstreamForModel(tenant, model)
+	}
+
+	w := azure.NewBufferedResponseWriter()
+	if upstream == "azure" {
+		azure.NewOpenAIReverseProxy().ServeHTTP(w, azure.WithRequestInfo(req))
+	} else {
+		u, ok := openai.Upstreams[upstream]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown upstream %q", upstream)
+		}
+		openai.NewUpstreamReverseProxy(u).ServeHTTP(w, req)
+	}
+	header := upstreamHeaders(w.Header())
+	if w.StatusCode() != http.StatusOK {
+		header.Set("Content-Type", w.Header().Get("Content-Type"))
+		return nil, nil, &upstreamError{status: w.StatusCode(), header: header, body: w.Body()}
+	}
+	return w.Body(), header, nil
+}
+
+// upstreamHeaders picks out the headers of an upstream answer the client
+// would have got had its request been proxied as it came: the upstream's
+// request IDs and rate limits.
+func upstreamHeaders(h http.Header) http.Header {
+	out := make(http.Header)
+	for name, values := range h {
+		if strings.HasPrefix(name, "X-Ratelimit-") {
+			out[name] = values
+		}
+	}
+	for _, u := range logging.UpstreamIDHeaders {
+		if v := h.Get(u.Header); v != "" {
+			out.Set(u.Header, v)
+		}
+	}
+	return out
+}
+
+// passUpstreamHeaders writes h to c's response and tags c's log lines with
+// the upstream request IDs it holds, which were recorded under the detached
+// context of the call rather than c's own.
+func passUpstreamHeaders(c *gin.Context, h http.Header) {
+	for name, values := range h {
+		c.Writer.Header()[name] = values
+	}
+	logging.RecordUpstreamIDs(c.Request.Context(), h)
+}
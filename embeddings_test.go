@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/embeddings"
+	"github.com/gyarbij/azure-oai-proxy/pkg/openai"
+)
+
+// embeddingsUpstream serves embeddings in reverse order, each vector being its
+// input, and refuses batches holding the input "bad". It returns the router
+// the embeddings middleware runs in and a count of upstream calls.
+func embeddingsUpstream(t *testing.T) (*gin.Engine, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		var req struct {
+			Input []string `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		w.Header().Set("apim-request-id", fmt.Sprintf("call-%d", n))
+		w.Header().Set("x-ratelimit-remaining-requests", "99")
+		w.Header().Set("Content-Type", "application/json")
+		if slices.Contains(req.Input, "bad") {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"message":"bad input"}}`))
+			return
+		}
+		type embedding struct {
+			Index     int    `json:"index"`
+			Embedding string `json:"embedding"`
+		}
+		var data []embedding
+		for i := len(req.Input) - 1; i >= 0; i-- {
+			data = append(data, embedding{i, req.Input[i]})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": data, "usage": map[string]int{"prompt_tokens": len(req.Input)}})
+	}))
+	t.Cleanup(srv.Close)
+
+	savedMode, savedUpstream := ProxyMode, openai.Upstreams["openai"]
+	ProxyMode = "openai"
+	openai.Upstreams["openai"] = &openai.Upstream{Name: "openai", BaseURL: srv.URL}
+	t.Cleanup(func() { ProxyMode, openai.Upstreams["openai"] = savedMode, savedUpstream })
+
+	router := gin.New()
+	router.Use(batchEmbeddings)
+	router.POST("/v1/embeddings", func(c *gin.Context) {
+		t.Error("request was proxied as it came")
+	})
+	return router, &calls
+}
+
+func postEmbeddingsRequest(router *gin.Engine, inputs ...string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(map[string]any{"model": "text-embedding-3-small", "input": inputs})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/embeddings", strings.NewReader(string(body))))
+	return w
+}
+
+func embeddingVectors(t *testing.T, w *httptest.ResponseRecorder) []string {
+	t.Helper()
+	var res struct {
+		Data []struct {
+			Embedding string `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("%d %s: %v", w.Code, w.Body, err)
+	}
+	var vectors []string
+	for _, d := range res.Data {
+		vectors = append(vectors, d.Embedding)
+	}
+	return vectors
+}
+
+func TestBatchEmbeddingsChunks(t *testing.T) {
+	router, calls := embeddingsUpstream(t)
+	saved := embeddings.MaxInputs
+	embeddings.MaxInputs = 2
+	t.Cleanup(func() { embeddings.MaxInputs = saved })
+
+	w := postEmbeddingsRequest(router, "a", "b", "c", "d", "e")
+	if w.Code != http.StatusOK || calls.Load() != 3 {
+		t.Fatalf("status %d after %d upstream calls, want 200 after 3", w.Code, calls.Load())
+	}
+	if got, want := embeddingVectors(t, w), []string{"a", "b", "c", "d", "e"}; !slices.Equal(got, want) {
+		t.Errorf("vectors = %v, want %v", got, want)
+	}
+	if !strings.HasPrefix(w.Header().Get("apim-request-id"), "call-") || w.Header().Get("x-ratelimit-remaining-requests") != "99" {
+		t.Errorf("upstream headers not passed on: %v", w.Header())
+	}
+}
+
+func TestBatchEmbeddingsRetriesBadInputAlone(t *testing.T) {
+	router, calls := embeddingsUpstream(t)
+	saved := embeddings.CoalesceWindow
+	embeddings.CoalesceWindow = 100 * time.Millisecond
+	t.Cleanup(func() { embeddings.CoalesceWindow = saved })
+
+	var good, bad *httptest.ResponseRecorder
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); good = postEmbeddingsRequest(router, "a", "b") }()
+	go func() { defer wg.Done(); bad = postEmbeddingsRequest(router, "bad") }()
+	wg.Wait()
+
+	// The shared call failed, then each request was sent on its own
+	if calls.Load() != 3 {
+		t.Errorf("%d upstream calls, want 3", calls.Load())
+	}
+	if got := embeddingVectors(t, good); good.Code != http.StatusOK || !slices.Equal(got, []string{"a", "b"}) {
+		t.Errorf("good request: %d %v", good.Code, got)
+	}
+	if bad.Code != http.StatusBadRequest || !strings.Contains(bad.Body.String(), "bad input") {
+		t.Errorf("bad request: %d %s", bad.Code, bad.Body)
+	}
+	if bad.Header().Get("apim-request-id") == "" {
+		t.Error("upstream request ID not passed on with the error")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/auth"
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+	"github.com/gyarbij/azure-oai-proxy/pkg/openai"
+)
+
+// readiness is the outcome of the checks behind /readyz and /health/backends.
+type readiness struct {
+	// Problems keep the proxy from serving requests: invalid configuration.
+	Problems []string
+	// Degraded lists unhealthy backends and serverless deployments, and
+	// tenants without a single healthy backend, whose requests fail while
+	// the rest keep working.
+	Degraded []string
+	Backends []azure.BackendHealth
+}
+
+// report returns the status code and body of a readiness response.
+func (r readiness) report() (int, gin.H) {
+	code, body := http.StatusOK, gin.H{"status": "ready"}
+	if len(r.Degraded) > 0 {
+		body["status"], body["degraded"] = "degraded", r.Degraded
+	}
+	if len(r.Problems) > 0 {
+		code = http.StatusServiceUnavailable
+		body["status"], body["problems"] = "not_ready", r.Problems
+	}
+	return code, body
+}
+
+// checkReadiness validates the configuration and probes the Azure backends.
+func checkReadiness(ctx context.Context) readiness {
+	r := readiness{Problems: configProblems()}
+	if ProxyMode == "openai" {
+		return r
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, azure.ProbeTimeout+time.Second)
+	defer cancel()
+	r.addBackends(azure.CheckBackends(ctx))
+	return r
+}
+
+// addBackends records probe results. A tenant without a healthy backend only
+// degrades the proxy: taking it out of rotation would fail every other
+// tenant's requests too.
+func (r *readiness) addBackends(backends []azure.BackendHealth) {
+	r.Backends = backends
+	healthy := make(map[string]bool)
+	for _, b := range r.Backends {
+		if b.Kind == "azure_openai" {
+			healthy[b.Tenant] = healthy[b.Tenant] || b.Healthy()
+		}
+		if !b.Healthy() {
+			r.Degraded = append(r.Degraded, fmt.Sprintf("%s %s/%s: %s", b.Kind, b.Tenant, b.Name, b.Status))
+		}
+	}
+	for _, tenant := range slices.Sorted(maps.Keys(healthy)) {
+		if !healthy[tenant] {
+			r.Degraded = append(r.Degraded, fmt.Sprintf("tenant %s has no healthy backend", tenant))
+		}
+	}
+}
+
+// configProblems lists configuration errors that keep requests from being
+// served.
+func configProblems() []string {
+	var problems []string
+	switch ProxyMode {
+	case "azure", "openai", "hybrid":
+	default:
+		problems = append(problems, fmt.Sprintf("unknown AZURE_OPENAI_PROXY_MODE %q", ProxyMode))
+	}
+
+	if ProxyMode != "openai" {
+		for _, name := range slices.Sorted(maps.Keys(azure.Tenants)) {
+			t := azure.Tenants[name]
+			for _, b := range t.Backends {
+				if !validBaseURL(b.Endpoint) {
+					problems = append(problems, fmt.Sprintf("tenant %s: backend %s has no valid endpoint", name, b.Name))
+				}
+				// Callers with virtual keys or tokens never send an Azure key themselves
+				if auth.Required() && azure.AuthMode != "entra" && b.Key == "" && t.APIKey == "" {
+					problems = append(problems, fmt.Sprintf("tenant %s: backend %s has no API key for authenticated callers", name, b.Name))
+				}
+			}
+			for model, d := range t.ServerlessDeployments() {
+				if d.Name == "" || d.Region == "" || d.Key == "" {
+					problems = append(problems, fmt.Sprintf("tenant %s: serverless deployment for %s needs a name, region and key", name, model))
+				}
+			}
+		}
+	}
+	if ProxyMode != "azure" {
+		for _, name := range slices.Sorted(maps.Keys(openai.Upstreams)) {
+			if !validBaseURL(openai.Upstreams[name].BaseURL) {
+				problems = append(problems, fmt.Sprintf("upstream %s has no valid base URL", name))
+			}
+		}
+		if ProxyMode == "openai" && auth.Required() && openai.OpenAIAPIKey == "" {
+			problems = append(problems, "upstream openai has no API key for authenticated callers")
+		}
+		if ProxyMode == "hybrid" {
+			problems = append(problems, checkHybridRoutes()...)
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+func validBaseURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// handleReadyz answers Kubernetes readiness probes: 200 while requests can be
+// served, 503 otherwise.
+func handleReadyz(c *gin.Context) {
+	c.JSON(checkReadiness(c.Request.Context()).report())
+}
+
+// handleBackendHealth reports the probe results of every backend, with the
+// same status code as /readyz.
+func handleBackendHealth(c *gin.Context) {
+	r := checkReadiness(c.Request.Context())
+	code, body := r.report()
+	delete(body, "degraded")
+	body["backends"] = r.Backends
+	if r.Backends == nil {
+		body["backends"] = []azure.BackendHealth{}
+	}
+	c.JSON(code, body)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+)
+
+func TestReadinessWithUnhealthyTenant(t *testing.T) {
+	backend := func(tenant, name, status string) azure.BackendHealth {
+		return azure.BackendHealth{Tenant: tenant, Kind: "azure_openai", Name: name, Probe: azure.Probe{Status: status}}
+	}
+	var r readiness
+	r.addBackends([]azure.BackendHealth{
+		backend("default", "eastus", azure.ProbeOK),
+		backend("default", "westus", azure.ProbeUnreachable),
+		backend("retail", "retail", azure.ProbeUnreachable),
+	})
+
+	// The default tenant still serves requests, so the proxy stays ready
+	code, body := r.report()
+	if code != http.StatusOK || body["status"] != "degraded" {
+		t.Fatalf("report() = %d %v, want 200 degraded", code, body)
+	}
+	want := []string{
+		"azure_openai default/westus: unreachable",
+		"azure_openai retail/retail: unreachable",
+		"tenant retail has no healthy backend",
+	}
+	if !slices.Equal(r.Degraded, want) {
+		t.Errorf("Degraded = %q, want %q", r.Degraded, want)
+	}
+
+	r.Problems = []string{"unknown AZURE_OPENAI_PROXY_MODE \"x\""}
+	if code, body := r.report(); code != http.StatusServiceUnavailable || body["status"] != "not_ready" {
+		t.Errorf("report() with a problem = %d %v", code, body)
+	}
+}
+
+func TestRequireAdminKeyWithoutKey(t *testing.T) {
+	saved := AdminKey
+	AdminKey = ""
+	t.Cleanup(func() { AdminKey = saved })
+
+	router := gin.New()
+	router.GET("/health/backends", requireAdminKey, func(c *gin.Context) { c.Status(http.StatusOK) })
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health/backends", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status %d without an admin key configured, want 401", w.Code)
+	}
+}
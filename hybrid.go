@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+	"github.com/gyarbij/azure-oai-proxy/pkg/logging"
+	"github.com/gyarbij/azure-oai-proxy/pkg/openai"
+)
+
+// hybridRoute sends models matching pattern to upstream. A pattern ending in
+// "*" matches by prefix.
+type hybridRoute struct {
+	pattern  string
+	upstream string
+}
+
+var (
+	// HybridRoutes are checked in order; models that match no route, and
+	// serverless deployments, go to Azure.
+	HybridRoutes []hybridRoute
+)
+
+func init() {
+	// Format: model=upstream,prefix*=upstream where upstream is "azure",
+	// "openai" or a name from OPENAI_COMPATIBLE_UPSTREAMS
+	if v := os.Getenv("AZURE_OPENAI_HYBRID_ROUTES"); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			pattern, upstream, ok := strings.Cut(pair, "=")
+			if !ok || pattern == "" || upstream == "" {
+				continue
+			}
+			HybridRoutes = append(HybridRoutes, hybridRoute{
+				pattern:  strings.ToLower(pattern),
+				upstream: strings.ToLower(upstream),
+			})
+		}
+		slog.Info("Loaded hybrid routes", "routes", len(HybridRoutes))
+	}
+}
+
+// checkHybridRoutes reports routes that cannot work: in hybrid mode callers'
+// credentials are never passed on, so OpenAI needs the proxy's own key.
+func checkHybridRoutes() []string {
+	var problems []string
+	for _, r := range HybridRoutes {
+		if r.upstream == "openai" && openai.OpenAIAPIKey == "" {
+			problems = append(problems, fmt.Sprintf("hybrid route %s goes to openai, which has no OPENAI_API_KEY", r.pattern))
+		}
+	}
+	return problems
+}
+
+// upstreamForModel returns the upstream name for model. Serverless
+// deployments of the request's tenant always go to Azure.
+func upstreamForModel(tenant *azure.Tenant, model string) string {
+	modelLower := strings.ToLower(model)
+	if _, ok := tenant.LookupServerlessDeployment(modelLower); ok {
+		return "azure"
+	}
+	for _, r := range HybridRoutes {
+		if prefix, ok := strings.CutSuffix(r.pattern, "*"); ok {
+			if strings.HasPrefix(modelLower, prefix) {
+				return r.upstream
+			}
+		} else if modelLower == r.pattern {
+			return r.upstream
+		}
+	}
+	return "azure"
+}
+
+func handleHybridProxy(c *gin.Context) {
+	if c.Request.Method == http.MethodOptions {
+		handleOptions(c)
+		return
+	}
+
+	model := peekModel(c)
+	tenant, _ := azure.TenantFrom(c.Request.Context())
+	upstream := upstreamForModel(tenant, model)
+	if upstream == "azure" {
+		handleAzureProxy(c)
+		return
+	}
+	u, ok := openai.Upstreams[upstream]
+	if !ok {
+		logging.FromContext(c.Request.Context()).Error("Hybrid route names unknown upstream", "model", model, "upstream", upstream)
+		c.JSON(http.StatusBadGateway, gin.H{"error": gin.H{
+			"message": "no upstream configured for model " + model,
+			"type":    "proxy_error",
+			"code":    "unknown_upstream",
+		}})
+		return
+	}
+	logging.FromContext(c.Request.Context()).Debug("Hybrid routing model to upstream", "model", model, "upstream", u.Name)
+	openai.NewUpstreamReverseProxy(u).ServeHTTP(c.Writer, c.Request)
+}
+
+// handleGetHybridModels lists models from Azure, serverless deployments and
+// every upstream that a hybrid route points at, without duplicates.
+func handleGetHybridModels(c *gin.Context) {
+	auth := c.GetHeader("Authorization")
+	seen := make(map[string]bool)
+	var models []Model
+	add := func(m Model) {
+		if m.ID == "" || seen[m.ID] {
+			return
+		}
+		seen[m.ID] = true
+		models = append(models, m)
+	}
+
+	req, _ := http.NewRequestWithContext(c.Request.Context(), "GET", c.Request.URL.String(), nil)
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("api-key", c.GetHeader("api-key"))
+	if deployed, err := fetchDeployedModels(req); err != nil {
+		logging.FromContext(c.Request.Context()).Error("Could not fetch deployed Azure models", "error", err)
+	} else {
+		for _, m := range deployed {
+			m.OwnedBy = "azure"
+			add(m)
+		}
+	}
+
+	tenant, _ := azure.TenantFrom(c.Request.Context())
+	for deploymentName := range tenant.ServerlessDeployments() {
+		add(Model{
+			ID:     deploymentName,
+			Object: "model",
+			Capabilities: Capabilities{
+				Completion:     true,
+				ChatCompletion: true,
+				Inference:      true,
+			},
+			LifecycleStatus: "active",
+			Status:          "ready",
+			OwnedBy:         "azure-serverless",
+		})
+	}
+
+	// Upstreams are asked at once, and listed in route order
+	var upstreams []*openai.Upstream
+	for _, r := range HybridRoutes {
+		if u, ok := openai.Upstreams[r.upstream]; ok && !slices.Contains(upstreams, u) {
+			upstreams = append(upstreams, u)
+		}
+	}
+	lists := make([][]map[string]any, len(upstreams))
+	var wg sync.WaitGroup
+	for i, u := range upstreams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var err error
+			if lists[i], err = openai.ListModels(c.Request.Context(), u); err != nil {
+				logging.FromContext(c.Request.Context()).Error("Could not fetch models from upstream", "upstream", u.Name, "error", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, u := range upstreams {
+		for _, m := range lists[i] {
+			id, _ := m["id"].(string)
+			// Only list models that would actually be routed to this upstream
+			if upstreamForModel(tenant, id) != u.Name {
+				continue
+			}
+			created, _ := m["created"].(float64)
+			add(Model{
+				ID:        id,
+				Object:    "model",
+				CreatedAt: int64(created),
+				Capabilities: Capabilities{
+					ChatCompletion: true,
+					Inference:      true,
+				},
+				LifecycleStatus: "active",
+				Status:          "ready",
+				OwnedBy:         u.Name,
+			})
+		}
+	}
+
+	c.JSON(http.StatusOK, ModelList{Object: "list", Data: filterModels(c, models)})
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/openai"
+)
+
+func TestCheckHybridRoutes(t *testing.T) {
+	savedRoutes, savedKey := HybridRoutes, openai.OpenAIAPIKey
+	t.Cleanup(func() { HybridRoutes, openai.OpenAIAPIKey = savedRoutes, savedKey })
+
+	HybridRoutes = []hybridRoute{{pattern: "llama*", upstream: "vllm"}, {pattern: "gpt-4o", upstream: "openai"}}
+	openai.OpenAIAPIKey = ""
+	if problems := checkHybridRoutes(); len(problems) != 1 {
+		t.Errorf("checkHybridRoutes() = %v, want the openai route reported", problems)
+	}
+	openai.OpenAIAPIKey = "sk-proxy"
+	if problems := checkHybridRoutes(); len(problems) != 0 {
+		t.Errorf("checkHybridRoutes() with a key = %v", problems)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/auth"
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+	"github.com/gyarbij/azure-oai-proxy/pkg/ledger"
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+	"github.com/gyarbij/azure-oai-proxy/pkg/tracing"
+	"github.com/gyarbij/azure-oai-proxy/pkg/usage"
+	"github.com/tidwall/gjson"
+)
+
+// recordUsage writes every proxied request, with its token usage, to the
+// usage ledger. It also asks for usage on streams when metrics or traces need
+// it.
+func recordUsage(c *gin.Context) {
+	if (!ledger.Enabled() && !metrics.Enabled && !tracing.Enabled) || c.Request.Method == http.MethodOptions {
+		c.Next()
+		return
+	}
+
+	c.Request = azure.WithRequestInfo(c.Request)
+	ctx, rec := usage.WithRecorder(c.Request.Context())
+	c.Request = c.Request.WithContext(ctx)
+
+	model := peekModel(c)
+	stream := gjson.GetBytes(peekBody(c), "stream").Bool()
+	requestStreamUsage(c, rec, model)
+
+	start := time.Now()
+	c.Next()
+
+	info := azure.GetRequestInfo(c.Request.Context())
+	tenant, _ := azure.TenantFrom(c.Request.Context())
+	e := ledger.Entry{
+		Time:      start.UTC(),
+		Model:     model,
+		Backend:   backendName(tenant, model, info),
+		Route:     auth.RouteFamily(c.Request.URL.Path),
+		Method:    c.Request.Method,
+		Path:      c.Request.URL.Path,
+		Status:    c.Writer.Status(),
+		Stream:    stream,
+		LatencyMS: time.Since(start).Milliseconds(),
+	}
+	if id := auth.IdentityFrom(c.Request.Context()); id != nil {
+		e.KeyID, e.Owner = id.KeyID, id.Owner
+	}
+	if tenant != azure.DefaultTenant {
+		e.Tenant = tenant.Name
+	}
+	if info != nil {
+		e.Deployment = info.Deployment
+	}
+	if u, ok := rec.Usage(); ok {
+		e.PromptTokens, e.CompletionTokens, e.TotalTokens = u.PromptTokens, u.CompletionTokens, u.TotalTokens
+		e.CachedTokens, e.ReasoningTokens = u.CachedTokens, u.ReasoningTokens
+	}
+	ledger.Record(e)
+}
+
+// requestStreamUsage asks a streamed chat or text completion for model to
+// report its usage, which streams only do when asked to, so rec sees it.
+func requestStreamUsage(c *gin.Context, rec *usage.Recorder, model string) {
+	path := c.Request.URL.Path
+	if !strings.HasSuffix(path, "/chat/completions") && !strings.HasSuffix(path, "/v1/completions") ||
+		azure.ConvertsChatCompletions(model) {
+		return
+	}
+	body := peekBody(c)
+	if rewritten := rec.RequestStreamUsage(body); len(rewritten) != len(body) {
+		c.Request.Body = io.NopCloser(bytes.NewReader(rewritten))
+		c.Request.ContentLength = int64(len(rewritten))
+		c.Request.Header.Set("Content-Length", strconv.Itoa(len(rewritten)))
+	}
+}
+
+// backendName names where a request for model was sent.
+func backendName(tenant *azure.Tenant, model string, info *azure.RequestInfo) string {
+	if info != nil && info.Backend != nil {
+		return info.Backend.Name
+	}
+	switch ProxyMode {
+	case "openai":
+		return "openai"
+	case "hybrid":
+		if upstream := upstreamForModel(tenant, model); upstream != "azure" {
+			return upstream
+		}
+	}
+	if _, ok := tenant.LookupServerlessDeployment(model); ok {
+		return "serverless"
+	}
+	return ""
+}
+
+// handleUsageReport serves GET /admin/usage, aggregating the ledger by the
+// group_by fields as JSON or CSV.
+func handleUsageReport(c *gin.Context) {
+	filter := ledger.Filter{
+		KeyID:  c.Query("key"),
+		Owner:  c.Query("owner"),
+		Model:  c.Query("model"),
+		Tenant: c.Query("tenant"),
+	}
+	for param, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		v := c.Query(param)
+		if v == "" {
+			continue
+		}
+		parsed, err := parseReportTime(v)
+		if err != nil {
+			abortWithError(c, http.StatusBadRequest, param+" must be a date (2006-01-02), an RFC 3339 time or a duration such as 168h", "invalid_request_error", "invalid_request")
+			return
+		}
+		*t = parsed
+	}
+
+	groupBy := splitList(c.DefaultQuery("group_by", "key,model,day"))
+	rows, err := ledger.Query(filter, groupBy)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, err.Error(), "invalid_request_error", "invalid_request")
+		return
+	}
+
+	if c.Query("format") == "csv" {
+		c.Header("Content-Type", "text/csv")
+		c.Header("Content-Disposition", `attachment; filename="usage.csv"`)
+		w := csv.NewWriter(c.Writer)
+		w.Write(append(append([]string{}, groupBy...), ledger.MetricColumns...))
+		for _, row := range rows {
+			w.Write(append(append([]string{}, row.Group...), row.Metrics()...))
+		}
+		w.Flush()
+		return
+	}
+
+	data := make([]gin.H, 0, len(rows))
+	for _, row := range rows {
+		item := gin.H{}
+		for i, field := range groupBy {
+			item[field] = row.Group[i]
+		}
+		metrics := row.Metrics()
+		for i, column := range ledger.MetricColumns {
+			n, _ := strconv.ParseInt(metrics[i], 10, 64)
+			item[column] = n
+		}
+		data = append(data, item)
+	}
+	c.JSON(http.StatusOK, gin.H{"object": "list", "group_by": groupBy, "data": data})
+}
+
+// parseReportTime accepts a date, an RFC 3339 time or a duration before now.
+func parseReportTime(v string) (time.Time, error) {
+	if d, err := time.ParseDuration(v); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse("2006-01-02", v); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
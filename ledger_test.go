@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/ledger"
+)
+
+func TestUsageReport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := json.NewEncoder(f)
+	day := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	for _, e := range []ledger.Entry{
+		{Time: day, KeyID: "a", Model: "gpt-4o", Status: 200, LatencyMS: 100, PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15},
+		{Time: day, KeyID: "a", Model: "gpt-4o", Status: 500, LatencyMS: 300},
+		{Time: day, KeyID: "b", Model: "gpt-4o-mini", Status: 200, TotalTokens: 2},
+	} {
+		enc.Encode(e)
+	}
+	f.Close()
+	saved := ledger.Path
+	ledger.Path = path
+	t.Cleanup(func() { ledger.Path = saved })
+
+	router := gin.New()
+	router.GET("/admin/usage", handleUsageReport)
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/usage?"+query, nil))
+		return w
+	}
+
+	w := get("group_by=key,model&format=csv")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/csv" {
+		t.Fatalf("status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	want := "key,model,requests,errors,prompt_tokens,completion_tokens,cached_tokens,reasoning_tokens,total_tokens,avg_latency_ms\n" +
+		"a,gpt-4o,2,1,10,5,0,0,15,200\n" +
+		"b,gpt-4o-mini,1,0,0,0,0,0,2,0\n"
+	if w.Body.String() != want {
+		t.Errorf("CSV:\n%s\nwant:\n%s", w.Body, want)
+	}
+
+	w = get("group_by=model&key=a")
+	var report struct {
+		Data []map[string]any `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Data) != 1 || report.Data[0]["model"] != "gpt-4o" || report.Data[0]["requests"] != float64(2) {
+		t.Errorf("JSON report = %s", w.Body)
+	}
+
+	for _, query := range []string{"group_by=colour", "since=yesterday"} {
+		if w := get(query); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, w.Code)
+		}
+	}
+}
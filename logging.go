@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/auth"
+	"github.com/gyarbij/azure-oai-proxy/pkg/logging"
+)
+
+// logRequests gives every request an ID, which tags each log line written
+// about it, and logs one line when the request completes. A valid
+// x-request-id from the client is kept as the ID. It is sent upstream and
+// returned on every response, including the proxy's own errors.
+func logRequests(c *gin.Context) {
+	id := c.GetHeader("X-Request-Id")
+	if !logging.ValidRequestID(id) {
+		id = logging.NewRequestID()
+	}
+	c.Request.Header.Set("X-Request-Id", id)
+	c.Header("X-Request-Id", id)
+	ctx := logging.WithRequestID(c.Request.Context(), id)
+	c.Request = c.Request.WithContext(ctx)
+	start := time.Now()
+
+	c.Next()
+
+	status := c.Writer.Status()
+	level := slog.LevelInfo
+	switch {
+	case status >= 500:
+		level = slog.LevelError
+	case status >= 400:
+		level = slog.LevelWarn
+	}
+	attrs := []any{
+		"method", c.Request.Method,
+		"path", c.Request.URL.Path,
+		"status", status,
+		"latency_ms", time.Since(start).Milliseconds(),
+		"client_ip", c.ClientIP(),
+	}
+	if id := auth.IdentityFrom(c.Request.Context()); id != nil {
+		attrs = append(attrs, "key_id", id.KeyID)
+	}
+	logging.FromContext(c.Request.Context()).Log(c.Request.Context(), level, "Request completed", attrs...)
+}
@@ -1,17 +1,29 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/auth"
 	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+	"github.com/gyarbij/azure-oai-proxy/pkg/budget"
+	"github.com/gyarbij/azure-oai-proxy/pkg/logging"
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
 	"github.com/gyarbij/azure-oai-proxy/pkg/openai"
+	"github.com/gyarbij/azure-oai-proxy/pkg/store"
+	"github.com/gyarbij/azure-oai-proxy/pkg/tracing"
 	"github.com/joho/godotenv"
 )
 
@@ -20,6 +32,10 @@ var (
 	ProxyMode = "azure"
 )
 
+// shutdownTimeout bounds how long requests in flight may run on after a
+// SIGTERM.
+const shutdownTimeout = 30 * time.Second
+
 // Define the ModelList and Model types based on the API documentation
 type ModelList struct {
 	Object string  `json:"object"`
@@ -35,6 +51,7 @@ type Model struct {
 	Status          string       `json:"status"`
 	Deprecation     Deprecation  `json:"deprecation"`
 	FineTune        string       `json:"fine_tune,omitempty"`
+	OwnedBy         string       `json:"owned_by,omitempty"`
 }
 
 type Capabilities struct {
@@ -53,7 +70,7 @@ type Deprecation struct {
 func init() {
 	// Load .env file if it exists
 	if err := godotenv.Load(); err != nil {
-		log.Println("No .env file found")
+		slog.Info("No .env file found")
 	}
 
 	gin.SetMode(gin.ReleaseMode)
@@ -63,8 +80,7 @@ func init() {
 	if v := os.Getenv("AZURE_OPENAI_PROXY_MODE"); v != "" {
 		ProxyMode = v
 	}
-	log.Printf("loading azure openai proxy address: %s", Address)
-	log.Printf("loading azure openai proxy mode: %s", ProxyMode)
+	slog.Info("Loading azure openai proxy configuration", "address", Address, "mode", ProxyMode)
 
 	// Load Azure OpenAI Model Mapper
 	if v := os.Getenv("AZURE_OPENAI_MODEL_MAPPER"); v != "" {
@@ -75,51 +91,80 @@ func init() {
 			}
 		}
 	}
+
+	// Format: alias=context:output[:encoding], output 0 for no separate limit
+	if v := os.Getenv("AZURE_OPENAI_MODEL_LIMITS"); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			alias, spec, ok := strings.Cut(pair, "=")
+			fields := strings.Split(spec, ":")
+			if !ok || len(fields) < 2 {
+				continue
+			}
+			window, err1 := strconv.Atoi(fields[0])
+			output, err2 := strconv.Atoi(fields[1])
+			if err1 != nil || err2 != nil {
+				slog.Warn("Ignoring invalid model limits", "model", alias, "limits", spec)
+				continue
+			}
+			limits := azure.ModelLimits{Context: window, Output: output, Encoding: azure.EncodingO200k}
+			if len(fields) > 2 {
+				limits.Encoding = fields[2]
+			}
+			azure.SetModelLimits(alias, limits)
+		}
+	}
 }
 
 func main() {
-	router := gin.Default()
-
-	// Proxy routes
-	if ProxyMode == "azure" {
-		router.GET("/v1/models", handleGetModels)
-		router.OPTIONS("/v1/*path", handleOptions)
-		// Existing routes
-		router.POST("/v1/chat/completions", handleAzureProxy)
-		router.POST("/v1/completions", handleAzureProxy)
-		router.POST("/v1/embeddings", handleAzureProxy)
-		// DALL-E routes
-		router.POST("/v1/images/generations", handleAzureProxy)
-		// speech- routes
-		router.POST("/v1/audio/speech", handleAzureProxy)
-		router.GET("/v1/audio/voices", handleAzureProxy)
-		router.POST("/v1/audio/transcriptions", handleAzureProxy)
-		router.POST("/v1/audio/translations", handleAzureProxy)
-		// Fine-tuning routes
-		router.POST("/v1/fine_tunes", handleAzureProxy)
-		router.GET("/v1/fine_tunes", handleAzureProxy)
-		router.GET("/v1/fine_tunes/:fine_tune_id", handleAzureProxy)
-		router.POST("/v1/fine_tunes/:fine_tune_id/cancel", handleAzureProxy)
-		router.GET("/v1/fine_tunes/:fine_tune_id/events", handleAzureProxy)
-		// Files management routes
-		router.POST("/v1/files", handleAzureProxy)
-		router.GET("/v1/files", handleAzureProxy)
-		router.DELETE("/v1/files/:file_id", handleAzureProxy)
-		router.GET("/v1/files/:file_id", handleAzureProxy)
-		router.GET("/v1/files/:file_id/content", handleAzureProxy)
-		// Deployments management routes
-		router.GET("/deployments", handleAzureProxy)
-		router.GET("/deployments/:deployment_id", handleAzureProxy)
-		router.GET("/v1/models/:model_id/capabilities", handleAzureProxy)
-
-		// Responses API routes
-		router.POST("/v1/responses", handleAzureProxy)
-		router.GET("/v1/responses/:response_id", handleAzureProxy)
-		router.DELETE("/v1/responses/:response_id", handleAzureProxy)
-		router.POST("/v1/responses/:response_id/cancel", handleAzureProxy)
-		router.GET("/v1/responses/:response_id/input_items", handleAzureProxy)
-	} else {
-		router.Any("*path", handleOpenAIProxy)
+	if len(os.Args) > 1 && os.Args[1] == "keygen" {
+		runKeygen(os.Args[2:])
+		return
+	}
+
+	applyStoredConfig()
+	// Authenticated callers' credentials are stripped, so OpenAI needs the proxy's own
+	if ProxyMode != "azure" && ProxyMode != "hybrid" && auth.Required() && openai.OpenAIAPIKey == "" {
+		slog.Error("OPENAI_API_KEY is required when callers authenticate to the proxy in openai mode")
+		os.Exit(1)
+	}
+	if ProxyMode == "hybrid" {
+		if problems := checkHybridRoutes(); len(problems) > 0 {
+			slog.Error("Invalid hybrid routes", "problems", problems)
+			os.Exit(1)
+		}
+	}
+	if auth.Required() || AdminKey != "" {
+		if err := budget.Open(store.Default()); err != nil {
+			slog.Error("Could not load budgets", "path", store.Path, "error", err)
+			os.Exit(1)
+		}
+	}
+	router := gin.New()
+	router.Use(gin.Recovery(), logRequests)
+
+	// Proxy routes, behind tracing, caller authentication, metrics, usage recording,
+	// budgets and rate limits when enabled
+	api := router.Group("/", traceRequest, authenticate, auditRequest, collectMetrics, recordUsage, checkContextWindow, cacheResponses, semanticCache, enforceBudget, rateLimit, limitConcurrency, batchEmbeddings)
+	switch ProxyMode {
+	case "azure":
+		api.GET("/v1/models", handleGetModels)
+		registerProxyRoutes(api, handleAzureProxy)
+	case "hybrid":
+		api.GET("/v1/models", handleGetHybridModels)
+		registerProxyRoutes(api, handleHybridProxy)
+	default:
+		// Everything else goes to OpenAI. NoRoute rather than a catch-all
+		// route keeps /admin and /healthz registrable alongside it.
+		router.NoRoute(traceRequest, authenticate, auditRequest, collectMetrics, recordUsage, checkContextWindow, cacheResponses, semanticCache, enforceBudget, rateLimit, limitConcurrency, batchEmbeddings, handleOpenAIProxy)
+	}
+
+	if TokenizeEndpoint {
+		router.POST("/v1/tokenize", traceRequest, authenticate, handleTokenize)
+	}
+
+	registerAdminRoutes(router)
+	if metrics.Enabled {
+		router.GET("/metrics", gin.WrapH(metrics.Handler()))
 	}
 
 	// Health check endpoint
@@ -128,23 +173,97 @@ func main() {
 			"status": "healthy",
 		})
 	})
+	router.GET("/readyz", handleReadyz)
+	// Backend details name endpoints and upstream errors, which callers
+	// without the admin key should not see once the proxy authenticates them
+	if auth.Required() {
+		router.GET("/health/backends", requireAdminKey, handleBackendHealth)
+	} else {
+		router.GET("/health/backends", handleBackendHealth)
+	}
 
-	router.Run(Address)
+	// Tenants are picked before routing, since their path prefixes are
+	// stripped to match the regular routes
+	slog.Info("Listening", "address", Address)
+	srv := &http.Server{Addr: Address, Handler: routeTenant(router.Handler())}
+	go func() {
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Server stopped", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	// On SIGTERM, finish the requests in flight, then save what is still
+	// held in memory
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	slog.Info("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("Requests still running at shutdown", "error", err)
+	}
+	budget.Flush()
+	if err := tracing.Shutdown(ctx); err != nil {
+		slog.Warn("Could not export the last spans", "error", err)
+	}
+}
+
+// registerProxyRoutes registers the OpenAI-compatible API surface with handler.
+func registerProxyRoutes(router gin.IRoutes, handler gin.HandlerFunc) {
+	router.OPTIONS("/v1/*path", handleOptions)
+	// Existing routes
+	router.POST("/v1/chat/completions", handler)
+	router.POST("/v1/completions", handler)
+	router.POST("/v1/embeddings", handler)
+	// DALL-E routes
+	router.POST("/v1/images/generations", handler)
+	// speech- routes
+	router.POST("/v1/audio/speech", handler)
+	router.GET("/v1/audio/voices", handler)
+	router.POST("/v1/audio/transcriptions", handler)
+	router.POST("/v1/audio/translations", handler)
+	// Fine-tuning routes
+	router.POST("/v1/fine_tunes", handler)
+	router.GET("/v1/fine_tunes", handler)
+	router.GET("/v1/fine_tunes/:fine_tune_id", handler)
+	router.POST("/v1/fine_tunes/:fine_tune_id/cancel", handler)
+	router.GET("/v1/fine_tunes/:fine_tune_id/events", handler)
+	// Files management routes
+	router.POST("/v1/files", handler)
+	router.GET("/v1/files", handler)
+	router.DELETE("/v1/files/:file_id", handler)
+	router.GET("/v1/files/:file_id", handler)
+	router.GET("/v1/files/:file_id/content", handler)
+	// Deployments management routes
+	router.GET("/deployments", handler)
+	router.GET("/deployments/:deployment_id", handler)
+	router.GET("/v1/models/:model_id/capabilities", handler)
+
+	// Responses API routes
+	router.POST("/v1/responses", handler)
+	router.GET("/v1/responses/:response_id", handler)
+	router.DELETE("/v1/responses/:response_id", handler)
+	router.POST("/v1/responses/:response_id/cancel", handler)
+	router.GET("/v1/responses/:response_id/input_items", handler)
 }
 
 func handleGetModels(c *gin.Context) {
-	req, _ := http.NewRequest("GET", c.Request.URL.String(), nil)
+	req, _ := http.NewRequestWithContext(c.Request.Context(), "GET", c.Request.URL.String(), nil)
 	req.Header.Set("Authorization", c.GetHeader("Authorization"))
+	req.Header.Set("api-key", c.GetHeader("api-key"))
 
 	models, err := fetchDeployedModels(req)
 	if err != nil {
-		log.Printf("error fetching deployed models: %v", err)
+		logging.FromContext(c.Request.Context()).Error("Could not fetch deployed models", "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch deployed models"})
 		return
 	}
 
 	// Add serverless deployments to the models list
-	for deploymentName := range azure.ServerlessDeploymentInfo {
+	tenant, _ := azure.TenantFrom(c.Request.Context())
+	for deploymentName := range tenant.ServerlessDeployments() {
 		models = append(models, Model{
 			ID:     deploymentName,
 			Object: "model",
@@ -160,29 +279,33 @@ func handleGetModels(c *gin.Context) {
 
 	result := ModelList{
 		Object: "list",
-		Data:   models,
+		Data:   filterModels(c, models),
 	}
 	c.JSON(http.StatusOK, result)
 }
 
 func fetchDeployedModels(originalReq *http.Request) ([]Model, error) {
-	endpoint := os.Getenv("AZURE_OPENAI_ENDPOINT")
-	if endpoint == "" {
-		endpoint = azure.AzureOpenAIEndpoint
+	tenant, _ := azure.TenantFrom(originalReq.Context())
+	endpoint := tenant.Endpoint()
+	if tenant == azure.DefaultTenant && os.Getenv("AZURE_OPENAI_ENDPOINT") != "" {
+		endpoint = os.Getenv("AZURE_OPENAI_ENDPOINT")
 	}
 
 	// Use the separate models API version
-	modelsAPIVersion := azure.AzureOpenAIModelsAPIVersion
+	modelsAPIVersion := tenant.ModelsAPIVersion
 	url := fmt.Sprintf("%s/openai/models?api-version=%s", endpoint, modelsAPIVersion)
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(originalReq.Context(), "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Set("Authorization", originalReq.Header.Get("Authorization"))
+	req.Header.Set("api-key", originalReq.Header.Get("api-key"))
 
-	azure.HandleToken(req)
+	if err := azure.HandleToken(req); err != nil {
+		return nil, err
+	}
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
@@ -207,7 +330,7 @@ func fetchDeployedModels(originalReq *http.Request) ([]Model, error) {
 func handleOptions(c *gin.Context) {
 	c.Header("Access-Control-Allow-Origin", "*")
 	c.Header("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-	c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Request-Id")
 	c.Status(200)
 	return
 }
@@ -217,16 +340,32 @@ func handleAzureProxy(c *gin.Context) {
 		handleOptions(c)
 		return
 	}
+	req := azure.WithRequestInfo(c.Request)
+	start := time.Now()
+
+	// Mirror a sample of requests to a shadow model; the client's response is
+	// only copied, never altered
+	var writer http.ResponseWriter = c.Writer
+	shadow := azure.StartShadow(req)
+	var tee *azure.TeeResponseWriter
+	if shadow != nil {
+		tee = azure.NewTeeResponseWriter(c.Writer)
+		writer = tee
+	}
+
 	server := azure.NewOpenAIReverseProxy()
-	server.ServeHTTP(c.Writer, c.Request)
+	server.ServeHTTP(writer, req)
+	if shadow != nil {
+		shadow.Finish(tee.StatusCode(), tee.Body(), time.Since(start))
+	}
 	if c.Writer.Header().Get("Content-Type") == "text/event-stream" {
 		if _, err := c.Writer.Write([]byte("\n")); err != nil {
-			log.Printf("rewrite azure response error: %v", err)
+			logging.FromContext(c.Request.Context()).Warn("Could not rewrite azure response", "error", err)
 		}
 	}
 	// Enhanced error logging
 	if c.Writer.Status() >= 400 {
-		log.Printf("Azure API request failed: %s %s, Status: %d", c.Request.Method, c.Request.URL.Path, c.Writer.Status())
+		logging.FromContext(c.Request.Context()).Warn("Azure API request failed", "method", c.Request.Method, "path", c.Request.URL.Path, "status", c.Writer.Status())
 	}
 }
 
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/auth"
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+	"github.com/gyarbij/azure-oai-proxy/pkg/usage"
+)
+
+// collectMetrics measures every proxied request for /metrics. It runs for the
+// whole request, so streamed responses are timed to the end of the stream.
+func collectMetrics(c *gin.Context) {
+	if !metrics.Enabled || c.Request.Method == http.MethodOptions {
+		c.Next()
+		return
+	}
+
+	c.Request = azure.WithRequestInfo(c.Request)
+	ctx, req := metrics.WithRequest(c.Request.Context())
+	ctx, rec := usage.WithRecorder(ctx)
+	c.Request = c.Request.WithContext(ctx)
+
+	tenant, _ := azure.TenantFrom(ctx)
+	alias := peekModel(c)
+	model := modelLabel(tenant, alias)
+	metrics.InFlight.Add(1, tenant.Name, model)
+	defer metrics.InFlight.Add(-1, tenant.Name, model)
+
+	start := time.Now()
+	writer := &firstByteWriter{ResponseWriter: c.Writer}
+	c.Writer = writer
+	c.Next()
+
+	if req.UpstreamStatus >= 200 && req.UpstreamStatus < 300 && alias != "" {
+		metrics.AddServedModel(alias)
+		model = metrics.Model(alias)
+	}
+
+	info := azure.GetRequestInfo(ctx)
+	deployment := ""
+	if info != nil {
+		deployment = info.Deployment
+	}
+	backend := backendName(tenant, alias, info)
+	labels := []string{tenant.Name, model, deployment, backend, req.Conversion}
+
+	metrics.Requests.Inc(append(labels, auth.RouteFamily(c.Request.URL.Path), metrics.Status(c.Writer.Status()))...)
+	metrics.RequestDuration.Observe(time.Since(start).Seconds(), labels...)
+	if !writer.first.IsZero() {
+		metrics.TimeToFirstToken.Observe(writer.first.Sub(start).Seconds(), labels...)
+	}
+	if req.UpstreamStatus != 0 {
+		metrics.UpstreamResponses.Inc(tenant.Name, model, deployment, backend, metrics.Status(req.UpstreamStatus))
+	}
+	if u, ok := rec.Usage(); ok {
+		for kind, n := range map[string]int64{
+			"prompt":     u.PromptTokens,
+			"completion": u.CompletionTokens,
+			"cached":     u.CachedTokens,
+			"reasoning":  u.ReasoningTokens,
+		} {
+			if n > 0 {
+				metrics.Tokens.Add(float64(n), tenant.Name, model, deployment, backend, kind)
+			}
+		}
+	}
+}
+
+// modelLabel bounds the model label of a request, which comes from the
+// client: aliases the tenant configures and aliases an upstream has answered
+// keep their name, and any other is counted as "other".
+func modelLabel(tenant *azure.Tenant, alias string) string {
+	model := metrics.Model(alias)
+	if model == "" || metrics.Served(model) {
+		return model
+	}
+	if _, ok := tenant.LookupModelMapping(model); ok {
+		return model
+	}
+	if _, ok := tenant.LookupServerlessDeployment(model); ok {
+		return model
+	}
+	if _, ok := azure.TrafficSplits[model]; ok && tenant == azure.DefaultTenant {
+		return model
+	}
+	// Prefix routes match names a client can make up, so only exact ones count
+	for _, r := range HybridRoutes {
+		if r.pattern == model {
+			return model
+		}
+	}
+	return metrics.OtherModel
+}
+
+// firstByteWriter notes when the first byte of the response body is written.
+type firstByteWriter struct {
+	gin.ResponseWriter
+	first time.Time
+}
+
+func (w *firstByteWriter) Write(p []byte) (int, error) {
+	if w.first.IsZero() && len(p) > 0 {
+		w.first = time.Now()
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *firstByteWriter) WriteString(s string) (int, error) {
+	if w.first.IsZero() && len(s) > 0 {
+		w.first = time.Now()
+	}
+	return w.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+)
+
+func TestModelLabel(t *testing.T) {
+	azure.SetModelMapping("label-mapped", "gpt-4o-deployment")
+	t.Cleanup(func() { azure.DeleteModelMapping("label-mapped") })
+	savedRoutes := HybridRoutes
+	HybridRoutes = []hybridRoute{{pattern: "label-hybrid", upstream: "openai"}, {pattern: "label-*", upstream: "openai"}}
+	t.Cleanup(func() { HybridRoutes = savedRoutes })
+
+	tests := []struct {
+		alias string
+		want  string
+	}{
+		{"", ""},
+		{"Label-Mapped", "label-mapped"},
+		{"label-hybrid", "label-hybrid"},
+		{"label-made-up", metrics.OtherModel}, // matches a prefix route only
+		{"x7f3-random", metrics.OtherModel},
+	}
+	for _, tt := range tests {
+		if got := modelLabel(azure.DefaultTenant, tt.alias); got != tt.want {
+			t.Errorf("modelLabel(%q) = %q, want %q", tt.alias, got, tt.want)
+		}
+	}
+}
+
+func TestCollectMetricsLearnsServedModels(t *testing.T) {
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Request = c.Request.WithContext(azure.WithTenant(c.Request.Context(), azure.DefaultTenant))
+	}, collectMetrics)
+	// The handler stands in for an upstream that only serves label-custom
+	router.POST("/v1/chat/completions", func(c *gin.Context) {
+		status := http.StatusNotFound
+		if peekModel(c) == "label-custom" {
+			status = http.StatusOK
+		}
+		metrics.RequestFrom(c.Request.Context()).UpstreamStatus = status
+		c.Status(status)
+	})
+	send := func(model string) {
+		body := `{"model":"` + model + `","messages":[]}`
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)))
+	}
+
+	if got := modelLabel(azure.DefaultTenant, "label-custom"); got != metrics.OtherModel {
+		t.Fatalf("modelLabel() = %q before any request", got)
+	}
+	send("label-custom")
+	send("label-missing")
+	if got := modelLabel(azure.DefaultTenant, "label-custom"); got != "label-custom" {
+		t.Errorf("served model labelled %q", got)
+	}
+	if got := modelLabel(azure.DefaultTenant, "label-missing"); got != metrics.OtherModel {
+		t.Errorf("model the upstream rejected labelled %q", got)
+	}
+}
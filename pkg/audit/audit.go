@@ -0,0 +1,153 @@
+// Package audit records full request/response exchanges for callers that
+// opted in: the client's request, the request sent upstream after conversion,
+// the upstream response and the response returned to the client. Records are
+// redacted field by field and written to pluggable sinks.
+package audit
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// All audits every request, not only those of keys and policies that
+	// opted in.
+	All = false
+	// MaxBody is how many bytes of each body are kept in a record.
+	MaxBody = 1 << 20
+
+	sinks    []Sink
+	queues   []*sinkQueue
+	openOnce sync.Once
+)
+
+func init() {
+	All = strings.EqualFold(os.Getenv("AZURE_OPENAI_AUDIT_ALL"), "true")
+	if v := os.Getenv("AZURE_OPENAI_AUDIT_MAX_BODY"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			MaxBody = n
+		} else {
+			slog.Warn("Invalid AZURE_OPENAI_AUDIT_MAX_BODY, using default", "value", v, "default", MaxBody)
+		}
+	}
+	if v := os.Getenv("AZURE_OPENAI_AUDIT_REDACT"); v != "" {
+		SetRedactions(strings.Split(v, ","))
+	}
+
+	if path := os.Getenv("AZURE_OPENAI_AUDIT_FILE"); path != "" {
+		maxSize, maxFiles := 100, 10
+		if v, err := strconv.Atoi(os.Getenv("AZURE_OPENAI_AUDIT_FILE_MAX_MB")); err == nil && v > 0 {
+			maxSize = v
+		}
+		if v, err := strconv.Atoi(os.Getenv("AZURE_OPENAI_AUDIT_FILE_MAX_FILES")); err == nil && v >= 0 {
+			maxFiles = v
+		}
+		AddSink(NewFileSink(path, int64(maxSize)<<20, maxFiles))
+	}
+	if url := os.Getenv("AZURE_OPENAI_AUDIT_WEBHOOK"); url != "" {
+		AddSink(NewWebhookSink(url, os.Getenv("AZURE_OPENAI_AUDIT_WEBHOOK_TOKEN")))
+	}
+	for _, s := range sinks {
+		slog.Info("Audit log enabled", "sink", s.Name(), "all_requests", All)
+	}
+}
+
+// Sink stores audit records. Write is called from a single goroutine with
+// batches of records in the order they completed. Each sink has its own
+// goroutine and queue, so a slow sink does not hold up the others.
+type Sink interface {
+	Name() string
+	Write(records []Record) error
+}
+
+// AddSink registers s. It must be called before the first record is written.
+func AddSink(s Sink) {
+	sinks = append(sinks, s)
+}
+
+// Enabled reports whether any sink is configured.
+func Enabled() bool {
+	return len(sinks) > 0
+}
+
+// SinkNames lists the configured sinks.
+func SinkNames() []string {
+	names := make([]string, len(sinks))
+	for i, s := range sinks {
+		names[i] = s.Name()
+	}
+	return names
+}
+
+// Record is one audited request.
+type Record struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"request_id,omitempty"`
+	Tenant     string    `json:"tenant,omitempty"` // empty for the default tenant
+	KeyID      string    `json:"key_id,omitempty"`
+	Owner      string    `json:"owner,omitempty"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Model      string    `json:"model,omitempty"`      // alias requested by the client
+	Deployment string    `json:"deployment,omitempty"` // resolved upstream deployment
+	Status     int       `json:"status"`
+	Stream     bool      `json:"stream,omitempty"`
+	LatencyMS  int64     `json:"latency_ms"`
+
+	ClientRequest *Message `json:"client_request"`
+	// The upstream parts are missing when the proxy answered on its own,
+	// e.g. rate limited or rejected requests.
+	UpstreamRequest  *Message `json:"upstream_request,omitempty"`
+	UpstreamResponse *Message `json:"upstream_response,omitempty"`
+	ClientResponse   *Message `json:"client_response"`
+}
+
+// Write queues r for the sinks. It never blocks the request; records are
+// dropped with a warning if a sink falls far behind.
+func Write(r Record) {
+	if !Enabled() {
+		return
+	}
+	openOnce.Do(func() {
+		for _, s := range sinks {
+			q := &sinkQueue{sink: s, records: make(chan Record, 1024)}
+			queues = append(queues, q)
+			go q.writeLoop()
+		}
+	})
+	for _, q := range queues {
+		select {
+		case q.records <- r:
+		default:
+			slog.Warn("Audit queue full, dropping record", "sink", q.sink.Name(), "request_id", r.RequestID, "path", r.Path)
+		}
+	}
+}
+
+// sinkQueue holds the records waiting for one sink.
+type sinkQueue struct {
+	sink    Sink
+	records chan Record
+}
+
+func (q *sinkQueue) writeLoop() {
+	for r := range q.records {
+		batch := []Record{r}
+	drain:
+		for len(batch) < 256 {
+			select {
+			case r := <-q.records:
+				batch = append(batch, r)
+			default:
+				break drain
+			}
+		}
+		if err := q.sink.Write(batch); err != nil {
+			slog.Error("Could not write audit records", "sink", q.sink.Name(), "records", len(batch), "error", err)
+		}
+	}
+}
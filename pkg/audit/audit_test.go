@@ -0,0 +1,76 @@
+package audit
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// useSinks replaces the configured sinks for a test.
+func useSinks(t *testing.T, s ...Sink) {
+	t.Helper()
+	savedSinks, savedQueues := sinks, queues
+	sinks, queues, openOnce = s, nil, sync.Once{}
+	t.Cleanup(func() {
+		sinks, queues, openOnce = savedSinks, savedQueues, sync.Once{}
+	})
+}
+
+// memorySink keeps the records written to it, and blocks while hold is set.
+type memorySink struct {
+	hold chan struct{}
+
+	mu      sync.Mutex
+	records []Record
+}
+
+func (s *memorySink) Name() string { return "memory" }
+
+func (s *memorySink) Write(records []Record) error {
+	if s.hold != nil {
+		<-s.hold
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, records...)
+	return nil
+}
+
+func (s *memorySink) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.records)
+}
+
+func waitFor(t *testing.T, s *memorySink, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for s.count() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("sink got %d records, want %d", s.count(), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSlowSinkDoesNotHoldUpOthers(t *testing.T) {
+	slow := &memorySink{hold: make(chan struct{})}
+	fast := &memorySink{}
+	useSinks(t, slow, fast)
+
+	for _, id := range []string{"a", "b", "c"} {
+		Write(Record{RequestID: id, Path: "/v1/chat/completions"})
+	}
+	waitFor(t, fast, 3)
+	if slow.count() != 0 {
+		t.Fatalf("slow sink got %d records while held", slow.count())
+	}
+
+	close(slow.hold)
+	waitFor(t, slow, 3)
+	for i, r := range slow.records {
+		if want := []string{"a", "b", "c"}[i]; r.RequestID != want {
+			t.Errorf("record %d = %q, want %q", i, r.RequestID, want)
+		}
+	}
+}
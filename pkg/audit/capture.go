@@ -0,0 +1,152 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Capture collects the upstream half of an audited request as the proxy
+// sends it.
+type Capture struct {
+	mu              sync.Mutex
+	url             string
+	requestType     string
+	request         *Buffer
+	status          int
+	responseType    string
+	response        *Buffer
+	reachedUpstream bool
+}
+
+type captureKey struct{}
+
+// WithCapture returns a copy of ctx carrying a new Capture.
+func WithCapture(ctx context.Context) (context.Context, *Capture) {
+	c := &Capture{}
+	return context.WithValue(ctx, captureKey{}, c), c
+}
+
+// WithoutCapture returns a copy of ctx without a Capture, for calls made
+// alongside an audited request that are not part of its record.
+func WithoutCapture(ctx context.Context) context.Context {
+	return context.WithValue(ctx, captureKey{}, (*Capture)(nil))
+}
+
+// CaptureFrom returns the Capture carried by ctx, or nil when the request is
+// not audited.
+func CaptureFrom(ctx context.Context) *Capture {
+	c, _ := ctx.Value(captureKey{}).(*Capture)
+	return c
+}
+
+// Fill adds the upstream request and response, if the request got that far.
+func (c *Capture) Fill(r *Record) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.reachedUpstream {
+		return
+	}
+	r.UpstreamRequest = &Message{ContentType: c.requestType}
+	if c.request != nil {
+		r.UpstreamRequest = NewMessage(c.requestType, c.request.Bytes(), c.request.Size(), false)
+	}
+	r.UpstreamRequest.URL = c.url
+	if c.response != nil {
+		r.UpstreamResponse = NewMessage(c.responseType, c.response.Bytes(), c.response.Size(), false)
+		r.UpstreamResponse.Status = c.status
+	}
+}
+
+// Buffer keeps the first MaxBody bytes written to it and counts the rest.
+type Buffer struct {
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	size int
+}
+
+func (b *Buffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.size += len(p)
+	if room := MaxBody - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
+
+// Bytes returns the kept bytes.
+func (b *Buffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.Clone(b.buf.Bytes())
+}
+
+// Size returns how many bytes were written.
+func (b *Buffer) Size() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size
+}
+
+// Transport records the requests it sends and the responses it receives in
+// the Capture of audited requests.
+type Transport struct {
+	Base http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c := CaptureFrom(req.Context())
+	if c == nil {
+		return t.Base.RoundTrip(req)
+	}
+
+	c.mu.Lock()
+	c.reachedUpstream = true
+	c.url = req.URL.String()
+	c.requestType = req.Header.Get("Content-Type")
+	c.request, c.response = nil, nil
+	c.mu.Unlock()
+	if req.Body != nil && req.Body != http.NoBody {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		buf := &Buffer{}
+		buf.Write(body)
+		c.mu.Lock()
+		c.request = buf
+		c.mu.Unlock()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	res, err := t.Base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	buf := &Buffer{}
+	c.mu.Lock()
+	c.status = res.StatusCode
+	c.responseType = res.Header.Get("Content-Type")
+	c.response = buf
+	c.mu.Unlock()
+	res.Body = &teeBody{ReadCloser: res.Body, w: buf}
+	return res, nil
+}
+
+// teeBody copies what is read from a response body into a Buffer.
+type teeBody struct {
+	io.ReadCloser
+	w io.Writer
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 {
+		t.w.Write(p[:n])
+	}
+	return n, err
+}
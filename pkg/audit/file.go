@@ -0,0 +1,97 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FileSink appends records as JSON lines to a file, which is rotated once it
+// grows past a size limit. Rotated files get a timestamp before their
+// extension and only the newest are kept.
+type FileSink struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	f    *os.File
+	size int64
+}
+
+// NewFileSink writes to path, rotating at maxSize bytes and keeping maxFiles
+// rotated files; zero keeps them all.
+func NewFileSink(path string, maxSize int64, maxFiles int) *FileSink {
+	return &FileSink{path: path, maxSize: maxSize, maxFiles: maxFiles}
+}
+
+func (s *FileSink) Name() string { return "file:" + s.path }
+
+func (s *FileSink) Write(records []Record) error {
+	for _, r := range records {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		line = append(line, '\n')
+		if s.f != nil && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+			if err := s.rotate(); err != nil {
+				return err
+			}
+		}
+		if s.f == nil {
+			if err := s.open(); err != nil {
+				return err
+			}
+		}
+		n, err := s.f.Write(line)
+		s.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f, s.size = f, info.Size()
+	return nil
+}
+
+// rotate moves the current file aside and removes the oldest rotated files.
+func (s *FileSink) rotate() error {
+	s.f.Close()
+	s.f = nil
+	ext := filepath.Ext(s.path)
+	base := strings.TrimSuffix(s.path, ext)
+	rotated := fmt.Sprintf("%s-%s%s", base, time.Now().UTC().Format("20060102T150405.000000000"), ext)
+	if err := os.Rename(s.path, rotated); err != nil {
+		return err
+	}
+	if s.maxFiles <= 0 {
+		return nil
+	}
+	old, err := filepath.Glob(base + "-*" + ext)
+	if err != nil {
+		return err
+	}
+	// The timestamps sort chronologically
+	sort.Strings(old)
+	for len(old) > s.maxFiles {
+		os.Remove(old[0])
+		old = old[1:]
+	}
+	return nil
+}
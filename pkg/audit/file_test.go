@@ -0,0 +1,76 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readRecords(t *testing.T, path string) []Record {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestFileSinkRotates(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.jsonl")
+	line, _ := json.Marshal(Record{RequestID: "r00", Path: "/v1/embeddings"})
+	// Two records fit in a file, and two rotated files are kept
+	s := NewFileSink(path, int64(2*(len(line)+1)), 2)
+
+	for i := range 9 {
+		r := Record{RequestID: "r0" + string(rune('0'+i)), Path: "/v1/embeddings"}
+		if err := s.Write([]Record{r}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rotated, _ := filepath.Glob(filepath.Join(dir, "audit-*.jsonl"))
+	if len(rotated) != 2 {
+		t.Fatalf("rotated files = %q, want 2", rotated)
+	}
+	var ids []string
+	for _, p := range append(rotated, path) {
+		for _, r := range readRecords(t, p) {
+			ids = append(ids, r.RequestID)
+		}
+	}
+	// The oldest files were removed, and the rest are in order
+	if got := strings.Join(ids, ","); got != "r04,r05,r06,r07,r08" {
+		t.Errorf("records kept = %s", got)
+	}
+}
+
+func TestFileSinkAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	if err := NewFileSink(path, 1<<20, 0).Write([]Record{{RequestID: "a"}}); err != nil {
+		t.Fatal(err)
+	}
+	// A restarted proxy continues the same file
+	if err := NewFileSink(path, 1<<20, 0).Write([]Record{{RequestID: "b"}, {RequestID: "c"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readRecords(t, path); len(got) != 3 || got[2].RequestID != "c" {
+		t.Errorf("records = %+v", got)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0o600 {
+		t.Errorf("mode = %v, want 0600", info.Mode().Perm())
+	}
+}
@@ -0,0 +1,69 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"mime"
+	"strings"
+)
+
+// Message is one captured HTTP request or response.
+type Message struct {
+	URL         string `json:"url,omitempty"`    // upstream request only
+	Status      int    `json:"status,omitempty"` // responses only
+	ContentType string `json:"content_type,omitempty"`
+	Bytes       int    `json:"bytes"`
+	Truncated   bool   `json:"truncated,omitempty"` // only the first MaxBody bytes were kept
+	// Body holds JSON bodies and reassembled streams, Text other text bodies
+	// and Events the data events of streams that could not be reassembled.
+	// Binary bodies such as audio are only described by their size.
+	Body   json.RawMessage   `json:"body,omitempty"`
+	Text   string            `json:"text,omitempty"`
+	Events []json.RawMessage `json:"events,omitempty"`
+}
+
+// NewMessage describes body, the first MaxBody bytes of a message of size
+// bytes with the given content type. Streams are reassembled into the object
+// a non-streaming request would have returned when reassemble is set, and
+// otherwise kept as their list of events.
+func NewMessage(contentType string, body []byte, size int, reassemble bool) *Message {
+	m := &Message{ContentType: contentType, Bytes: size, Truncated: len(body) < size}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "text/event-stream":
+		events := sseEvents(body)
+		if reassemble {
+			if whole := reassembleStream(events); whole != nil {
+				m.Body = redactJSON(whole)
+				return m
+			}
+		}
+		for _, e := range events {
+			m.Events = append(m.Events, redactJSON(e))
+		}
+	case json.Valid(body):
+		m.Body = redactJSON(body)
+	case strings.HasPrefix(mediaType, "text/") || mediaType == "application/x-www-form-urlencoded":
+		m.Text = string(body)
+	}
+	return m
+}
+
+// sseEvents returns the JSON data events of a server-sent event stream.
+func sseEvents(body []byte) []json.RawMessage {
+	var events []json.RawMessage
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), len(body)+1)
+	for scanner.Scan() {
+		data, ok := bytes.CutPrefix(scanner.Bytes(), []byte("data:"))
+		if !ok {
+			continue
+		}
+		data = bytes.TrimSpace(data)
+		if json.Valid(data) {
+			events = append(events, json.RawMessage(bytes.Clone(data)))
+		}
+	}
+	return events
+}
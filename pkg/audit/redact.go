@@ -0,0 +1,76 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// Redacted replaces the values matched by a redaction rule.
+const Redacted = "[REDACTED]"
+
+// redactions are the field paths hidden in every captured JSON body, split
+// into segments.
+var redactions [][]string
+
+// SetRedactions replaces the redaction rules. A rule is a dot-separated path
+// into a JSON body, e.g. "messages.*.content": "*" matches any object key or
+// array index and "**" any number of levels, so "**.api_key" hides every
+// api_key field wherever it appears.
+func SetRedactions(rules []string) {
+	redactions = nil
+	for _, r := range rules {
+		if r = strings.TrimSpace(r); r != "" {
+			redactions = append(redactions, strings.Split(r, "."))
+		}
+	}
+}
+
+// redactJSON applies the redaction rules to a JSON document.
+func redactJSON(body []byte) json.RawMessage {
+	if len(redactions) == 0 {
+		return json.RawMessage(body)
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return json.RawMessage(body)
+	}
+	for _, path := range redactions {
+		v = redactPath(v, path)
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return json.RawMessage(body)
+	}
+	return out
+}
+
+func redactPath(v any, path []string) any {
+	if len(path) == 0 {
+		return Redacted
+	}
+	seg, rest := path[0], path[1:]
+	if seg == "**" {
+		// Match here, then keep looking below every child
+		v = redactPath(v, rest)
+		rest = path
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		for k, child := range v {
+			if seg == "**" || seg == "*" || seg == k {
+				v[k] = redactPath(child, rest)
+			}
+		}
+	case []any:
+		for i, child := range v {
+			if seg == "**" || seg == "*" || seg == strconv.Itoa(i) {
+				v[i] = redactPath(child, rest)
+			}
+		}
+	}
+	return v
+}
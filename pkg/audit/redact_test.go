@@ -0,0 +1,89 @@
+package audit
+
+import "testing"
+
+func TestRedactJSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []string
+		body  string
+		want  string
+	}{
+		{
+			name: "no rules",
+			body: `{"b": 1, "a": 2}`,
+			want: `{"b": 1, "a": 2}`,
+		},
+		{
+			name:  "exact path",
+			rules: []string{"user"},
+			body:  `{"model":"gpt-4o","user":"alice"}`,
+			want:  `{"model":"gpt-4o","user":"[REDACTED]"}`,
+		},
+		{
+			name:  "star matches array indexes",
+			rules: []string{"messages.*.content"},
+			body:  `{"messages":[{"role":"system","content":"a"},{"role":"user","content":"b"}]}`,
+			want:  `{"messages":[{"content":"[REDACTED]","role":"system"},{"content":"[REDACTED]","role":"user"}]}`,
+		},
+		{
+			name:  "star matches object keys",
+			rules: []string{"metadata.*"},
+			body:  `{"metadata":{"a":"x","b":{"c":1}},"n":1}`,
+			want:  `{"metadata":{"a":"[REDACTED]","b":"[REDACTED]"},"n":1}`,
+		},
+		{
+			name:  "numeric index",
+			rules: []string{"messages.1.content"},
+			body:  `{"messages":[{"content":"a"},{"content":"b"}]}`,
+			want:  `{"messages":[{"content":"a"},{"content":"[REDACTED]"}]}`,
+		},
+		{
+			name:  "double star matches at any depth",
+			rules: []string{"**.api_key"},
+			body:  `{"api_key":"k1","tools":[{"auth":{"api_key":"k2"}}],"other":"x"}`,
+			want:  `{"api_key":"[REDACTED]","other":"x","tools":[{"auth":{"api_key":"[REDACTED]"}}]}`,
+		},
+		{
+			name:  "double star in the middle",
+			rules: []string{"input.**.text"},
+			body:  `{"input":[{"content":[{"type":"input_text","text":"hi"}]}],"text":"kept"}`,
+			want:  `{"input":[{"content":[{"text":"[REDACTED]","type":"input_text"}]}],"text":"kept"}`,
+		},
+		{
+			name:  "double star at the end",
+			rules: []string{"tools.**"},
+			body:  `{"tools":[{"type":"function"}],"model":"m"}`,
+			want:  `{"model":"m","tools":"[REDACTED]"}`,
+		},
+		{
+			name:  "missing path",
+			rules: []string{"messages.*.content"},
+			body:  `{"input":"hi"}`,
+			want:  `{"input":"hi"}`,
+		},
+		{
+			name:  "numbers keep their precision",
+			rules: []string{"user"},
+			body:  `{"seed":12345678901234567890,"user":"u"}`,
+			want:  `{"seed":12345678901234567890,"user":"[REDACTED]"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetRedactions(tt.rules)
+			t.Cleanup(func() { SetRedactions(nil) })
+			if got := string(redactJSON([]byte(tt.body))); got != tt.want {
+				t.Errorf("redactJSON() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetRedactionsSkipsBlankRules(t *testing.T) {
+	SetRedactions([]string{" user ", "", "  "})
+	t.Cleanup(func() { SetRedactions(nil) })
+	if len(redactions) != 1 || redactions[0][0] != "user" {
+		t.Errorf("redactions = %q", redactions)
+	}
+}
@@ -0,0 +1,158 @@
+package audit
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// reassembleStream rebuilds the object a non-streaming request would have
+// returned from the data events of a stream: chat completion and completion
+// chunks are merged per choice and Responses streams yield the response of
+// their response.completed event. It returns nil for other streams.
+func reassembleStream(events []json.RawMessage) json.RawMessage {
+	if len(events) == 0 {
+		return nil
+	}
+	for _, e := range events {
+		if gjson.GetBytes(e, "type").String() == "response.completed" {
+			if r := gjson.GetBytes(e, "response"); r.IsObject() {
+				return json.RawMessage(r.Raw)
+			}
+		}
+	}
+	// Recognised by shape too, as not every OpenAI-compatible server sets object
+	for _, e := range events {
+		switch {
+		case gjson.GetBytes(e, "object").String() == "chat.completion.chunk", gjson.GetBytes(e, "choices.0.delta").Exists():
+			return mergeChunks(events, "chat.completion")
+		case gjson.GetBytes(e, "object").String() == "text_completion", gjson.GetBytes(e, "choices.0.text").Exists():
+			return mergeChunks(events, "text_completion")
+		}
+	}
+	return nil
+}
+
+type streamChoice struct {
+	Index        int64           `json:"index"`
+	Message      *streamMessage  `json:"message,omitempty"`
+	Text         *string         `json:"text,omitempty"`
+	FinishReason json.RawMessage `json:"finish_reason"`
+}
+
+type streamMessage struct {
+	Role      string            `json:"role"`
+	Content   *string           `json:"content"`
+	Refusal   *string           `json:"refusal,omitempty"`
+	ToolCalls []*streamToolCall `json:"tool_calls,omitempty"`
+}
+
+type streamToolCall struct {
+	Index    int64  `json:"-"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// mergeChunks concatenates the deltas of chat completion or completion chunks.
+func mergeChunks(events []json.RawMessage, object string) json.RawMessage {
+	out := map[string]any{"object": object}
+	choices := map[int64]*streamChoice{}
+	for _, e := range events {
+		chunk := gjson.ParseBytes(e)
+		for _, field := range []string{"id", "created", "model", "system_fingerprint"} {
+			if v := chunk.Get(field); v.Exists() && v.Type != gjson.Null {
+				out[field] = json.RawMessage(v.Raw)
+			}
+		}
+		if u := chunk.Get("usage"); u.IsObject() {
+			out["usage"] = json.RawMessage(u.Raw)
+		}
+		chunk.Get("choices").ForEach(func(_, c gjson.Result) bool {
+			idx := c.Get("index").Int()
+			choice := choices[idx]
+			if choice == nil {
+				choice = &streamChoice{Index: idx, FinishReason: json.RawMessage("null")}
+				choices[idx] = choice
+			}
+			if r := c.Get("finish_reason"); r.Exists() && r.Type != gjson.Null {
+				choice.FinishReason = json.RawMessage(r.Raw)
+			}
+			if object == "text_completion" {
+				text := c.Get("text").String()
+				if choice.Text != nil {
+					text = *choice.Text + text
+				}
+				choice.Text = &text
+				return true
+			}
+			mergeDelta(choice, c.Get("delta"))
+			return true
+		})
+	}
+
+	list := make([]*streamChoice, 0, len(choices))
+	for _, c := range choices {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Index < list[j].Index })
+	out["choices"] = list
+	b, err := json.Marshal(out)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func mergeDelta(choice *streamChoice, delta gjson.Result) {
+	if choice.Message == nil {
+		choice.Message = &streamMessage{Role: "assistant"}
+	}
+	m := choice.Message
+	if r := delta.Get("role").String(); r != "" {
+		m.Role = r
+	}
+	appendString := func(dst **string, v gjson.Result) {
+		if v.Type != gjson.String {
+			return
+		}
+		var b strings.Builder
+		if *dst != nil {
+			b.WriteString(**dst)
+		}
+		b.WriteString(v.String())
+		s := b.String()
+		*dst = &s
+	}
+	appendString(&m.Content, delta.Get("content"))
+	appendString(&m.Refusal, delta.Get("refusal"))
+	delta.Get("tool_calls").ForEach(func(_, t gjson.Result) bool {
+		idx := t.Get("index").Int()
+		var call *streamToolCall
+		for _, c := range m.ToolCalls {
+			if c.Index == idx {
+				call = c
+			}
+		}
+		if call == nil {
+			call = &streamToolCall{Index: idx}
+			m.ToolCalls = append(m.ToolCalls, call)
+		}
+		if v := t.Get("id").String(); v != "" {
+			call.ID = v
+		}
+		if v := t.Get("type").String(); v != "" {
+			call.Type = v
+		}
+		if v := t.Get("function.name").String(); v != "" {
+			call.Function.Name = v
+		}
+		call.Function.Arguments += t.Get("function.arguments").String()
+		return true
+	})
+}
@@ -0,0 +1,93 @@
+package audit
+
+import (
+	"strings"
+	"testing"
+)
+
+func sse(events ...string) []byte {
+	var b strings.Builder
+	for _, e := range events {
+		b.WriteString("data: " + e + "\n\n")
+	}
+	b.WriteString("data: [DONE]\n\n")
+	return []byte(b.String())
+}
+
+func TestReassembleStream(t *testing.T) {
+	tests := []struct {
+		name string
+		body []byte
+		want string // empty when the events are kept as they are
+	}{
+		{
+			name: "chat completion",
+			body: sse(
+				`{"id":"c1","object":"chat.completion.chunk","created":1,"model":"gpt-4o","choices":[{"index":0,"delta":{"role":"assistant","content":""},"finish_reason":null}]}`,
+				`{"id":"c1","object":"chat.completion.chunk","created":1,"model":"gpt-4o","choices":[{"index":0,"delta":{"content":"Hel"},"finish_reason":null}]}`,
+				`{"id":"c1","object":"chat.completion.chunk","created":1,"model":"gpt-4o","choices":[{"index":0,"delta":{"content":"lo"},"finish_reason":"stop"}]}`,
+				`{"id":"c1","object":"chat.completion.chunk","created":1,"model":"gpt-4o","choices":[],"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`,
+			),
+			want: `{"choices":[{"index":0,"message":{"role":"assistant","content":"Hello"},"finish_reason":"stop"}],"created":1,"id":"c1","model":"gpt-4o","object":"chat.completion","usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`,
+		},
+		{
+			name: "tool calls and several choices",
+			body: sse(
+				`{"choices":[{"index":1,"delta":{"role":"assistant","content":"b"}},{"index":0,"delta":{"role":"assistant","tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"ci"}}]}}]}`,
+				`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"ty\":\"Oslo\"}"}}]},"finish_reason":"tool_calls"}]}`,
+			),
+			want: `{"choices":[{"index":0,"message":{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Oslo\"}"}}]},"finish_reason":"tool_calls"},{"index":1,"message":{"role":"assistant","content":"b"},"finish_reason":null}],"object":"chat.completion"}`,
+		},
+		{
+			name: "completion",
+			body: sse(
+				`{"id":"t1","object":"text_completion","choices":[{"index":0,"text":"Once "}]}`,
+				`{"id":"t1","object":"text_completion","choices":[{"index":0,"text":"upon","finish_reason":"length"}]}`,
+			),
+			want: `{"choices":[{"index":0,"text":"Once upon","finish_reason":"length"}],"id":"t1","object":"text_completion"}`,
+		},
+		{
+			name: "responses",
+			body: sse(
+				`{"type":"response.output_text.delta","delta":"Hi"}`,
+				`{"type":"response.completed","response":{"id":"resp_1","status":"completed"}}`,
+			),
+			want: `{"id":"resp_1","status":"completed"}`,
+		},
+		{
+			name: "unknown stream",
+			body: sse(`{"type":"message_start"}`, `{"type":"message_stop"}`),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMessage("text/event-stream; charset=utf-8", tt.body, len(tt.body), true)
+			if tt.want == "" {
+				if m.Body != nil || len(m.Events) != 2 {
+					t.Errorf("got body %s and %d events, want the 2 events", m.Body, len(m.Events))
+				}
+				return
+			}
+			if string(m.Body) != tt.want {
+				t.Errorf("body = %s\nwant   %s", m.Body, tt.want)
+			}
+			if m.Events != nil {
+				t.Errorf("events kept alongside the body: %d", len(m.Events))
+			}
+		})
+	}
+}
+
+func TestStreamEventsKeptWithoutReassembly(t *testing.T) {
+	SetRedactions([]string{"choices.*.delta.content"})
+	t.Cleanup(func() { SetRedactions(nil) })
+	body := sse(`{"choices":[{"index":0,"delta":{"content":"secret"}}]}`)
+
+	m := NewMessage("text/event-stream", body, len(body), false)
+	if m.Body != nil || len(m.Events) != 1 {
+		t.Fatalf("got body %s and %d events", m.Body, len(m.Events))
+	}
+	if want := `{"choices":[{"delta":{"content":"[REDACTED]"},"index":0}]}`; string(m.Events[0]) != want {
+		t.Errorf("event = %s, want %s", m.Events[0], want)
+	}
+}
@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/limits"
+)
+
+type identityKey struct{}
+
+// Identity is the authenticated caller of a proxied request.
+type Identity struct {
+	KeyID string // virtual key ID, or "jwt:<subject>" for tokens
+	Owner string // team the caller belongs to
+	Group string // group policy applied on top of Policy
+	// Tenant the caller is bound to: the one a virtual key was issued for, or
+	// a token's claims are mapped to, and "default" otherwise.
+	Tenant string
+	Policy Policy // restrictions set on the key itself
+	// AnyOf lists policies mapped from token claims. The caller may do
+	// whatever one of them allows.
+	AnyOf []string
+	RPM   int // the key's own rate limits; zero falls back to its policies
+	TPM   int
+	// Concurrency and Priority are the key's own queueing settings; zero
+	// and empty fall back to its policies
+	Concurrency int
+	Priority    string
+	Audit       bool // the key itself opted in to the audit log
+}
+
+// NewIdentity returns the identity of a caller authenticated with k.
+func NewIdentity(k *VirtualKey) *Identity {
+	id := &Identity{
+		KeyID: k.ID, Owner: k.Owner, Group: k.Group, Tenant: k.Tenant, Policy: k.Policy(),
+		RPM: k.RPM, TPM: k.TPM, Concurrency: k.Concurrency, Priority: k.Priority, Audit: k.Audit,
+	}
+	if id.Tenant == "" {
+		id.Tenant = DefaultTenant
+	}
+	return id
+}
+
+// DefaultTenant is the tenant of virtual keys issued without one, matching
+// the azure package's default tenant.
+const DefaultTenant = "default"
+
+// policies returns the policies that must all allow a request: the key's
+// own and its group's. A missing group policy is reported as an error so the
+// key is denied.
+func (id *Identity) policies() ([]Policy, error) {
+	if id.Group == "" {
+		return []Policy{id.Policy}, nil
+	}
+	group, ok := Policies.Get(id.Group)
+	if !ok {
+		return nil, &PolicyError{Code: "policy_not_found", Message: fmt.Sprintf("Group policy %s does not exist", id.Group)}
+	}
+	return []Policy{id.Policy, group}, nil
+}
+
+// anyOf returns the claim-mapped policies that exist.
+func (id *Identity) anyOf() []Policy {
+	var list []Policy
+	for _, name := range id.AnyOf {
+		if p, ok := Policies.Get(name); ok {
+			list = append(list, p)
+		}
+	}
+	return list
+}
+
+// Check reports whether the caller may send a request, returning a
+// *PolicyError when it is denied.
+func (id *Identity) Check(method, path, model string) error {
+	policies, err := id.policies()
+	if err != nil {
+		return err
+	}
+	for _, p := range policies {
+		if err := p.Check(method, path, model); err != nil {
+			return err
+		}
+	}
+	if len(id.AnyOf) == 0 {
+		return nil
+	}
+	err = &PolicyError{Code: "policy_not_found", Message: fmt.Sprintf("None of the policies %v exist", id.AnyOf)}
+	for _, p := range id.anyOf() {
+		if err = p.Check(method, path, model); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// AllowsModel reports whether the caller may use model.
+func (id *Identity) AllowsModel(model string) bool {
+	policies, err := id.policies()
+	if err != nil {
+		return false
+	}
+	for _, p := range policies {
+		if !p.AllowsModel(model) {
+			return false
+		}
+	}
+	if len(id.AnyOf) == 0 {
+		return true
+	}
+	for _, p := range id.anyOf() {
+		if p.AllowsModel(model) {
+			return true
+		}
+	}
+	return false
+}
+
+// RateLimit returns the caller's RPM and TPM: the key's own, else the most
+// generous of its policies. Zero means the default applies.
+func (id *Identity) RateLimit() (rpm, tpm int) {
+	rpm, tpm = id.RPM, id.TPM
+	candidates := id.anyOf()
+	if group, ok := Policies.Get(id.Group); ok && id.Group != "" {
+		candidates = append(candidates, group)
+	}
+	for _, p := range candidates {
+		if id.RPM == 0 {
+			rpm = max(rpm, p.RPM)
+		}
+		if id.TPM == 0 {
+			tpm = max(tpm, p.TPM)
+		}
+	}
+	return rpm, tpm
+}
+
+// Scheduling returns the caller's concurrency limit and the highest queue
+// priority it may use, falling back to the most generous of its policies
+// like RateLimit. Zero concurrency means the default applies.
+func (id *Identity) Scheduling() (concurrency, priority int) {
+	concurrency = id.Concurrency
+	candidates := id.anyOf()
+	if group, ok := Policies.Get(id.Group); ok && id.Group != "" {
+		candidates = append(candidates, group)
+	}
+	set := id.Priority != ""
+	priority, _ = limits.ParsePriority(id.Priority)
+	if !set {
+		priority = limits.PriorityLow
+	}
+	for _, p := range candidates {
+		if id.Concurrency == 0 {
+			concurrency = max(concurrency, p.Concurrency)
+		}
+		if id.Priority == "" && p.Priority != "" {
+			class, _ := limits.ParsePriority(p.Priority)
+			priority, set = min(priority, class), true
+		}
+	}
+	if !set {
+		priority = limits.PriorityNormal
+	}
+	return concurrency, priority
+}
+
+// Audited reports whether the caller's requests are written to the audit
+// log, because the key or one of its policies opted in.
+func (id *Identity) Audited() bool {
+	if id.Audit {
+		return true
+	}
+	candidates := id.anyOf()
+	if group, ok := Policies.Get(id.Group); ok && id.Group != "" {
+		candidates = append(candidates, group)
+	}
+	for _, p := range candidates {
+		if p.Audit {
+			return true
+		}
+	}
+	return false
+}
+
+// WithIdentity returns a copy of ctx carrying id.
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// IdentityFrom returns the caller attached to ctx, or nil.
+func IdentityFrom(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
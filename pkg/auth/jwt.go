@@ -0,0 +1,517 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// JWTEnabled accepts OIDC access tokens from the configured issuer.
+	JWTEnabled = false
+	// JWTIssuer is the expected iss claim.
+	JWTIssuer = ""
+	// JWTAudiences are the accepted aud values; one must match.
+	JWTAudiences []string
+	// JWKSURL is where signing keys are fetched. When empty it is discovered
+	// from the issuer's /.well-known/openid-configuration.
+	JWKSURL = ""
+	// JWKSCacheTTL is how long fetched keys are trusted before a refresh.
+	JWKSCacheTTL = time.Hour
+	// JWTClockSkew is tolerated on exp and nbf.
+	JWTClockSkew = time.Minute
+	// JWTSubjectClaim identifies the caller, JWTOwnerClaims its team (the first
+	// present wins) and JWTGroupsClaim its groups, which claim mappings refer
+	// to as "groups" whatever the claim is called.
+	JWTSubjectClaim = "sub"
+	JWTOwnerClaims  = []string{"azp", "appid", "client_id"}
+	JWTGroupsClaim  = "groups"
+	// JWTClaimPolicies maps "claim:value" to a policy name, e.g.
+	// "groups:ml-interns" to "interns" or "azp:<app id>" to "batch".
+	JWTClaimPolicies = make(map[string]string)
+	// JWTDefaultPolicy applies to tokens no mapping matched. When empty such
+	// tokens are unrestricted.
+	JWTDefaultPolicy = ""
+	// JWTClaimTenants maps "claim:value" to the tenant a token is bound to,
+	// e.g. "groups:retail-devs" to "retail". Tokens no mapping matched are
+	// bound to the default tenant.
+	JWTClaimTenants = make(map[string]string)
+
+	ErrInvalidToken = errors.New("invalid token")
+
+	jwks = &keySet{}
+)
+
+func loadJWTConfig() {
+	JWTIssuer = strings.TrimSuffix(os.Getenv("AZURE_OPENAI_JWT_ISSUER"), "/")
+	if JWTIssuer == "" {
+		slog.Error("AZURE_OPENAI_JWT_ISSUER is required for JWT authentication")
+		os.Exit(1)
+	}
+	JWTAudiences = splitCSV(os.Getenv("AZURE_OPENAI_JWT_AUDIENCE"))
+	if len(JWTAudiences) == 0 {
+		slog.Error("AZURE_OPENAI_JWT_AUDIENCE is required for JWT authentication")
+		os.Exit(1)
+	}
+	JWKSURL = os.Getenv("AZURE_OPENAI_JWT_JWKS_URL")
+	if v := os.Getenv("AZURE_OPENAI_JWT_JWKS_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			JWKSCacheTTL = d
+		} else {
+			slog.Warn("Invalid AZURE_OPENAI_JWT_JWKS_TTL, using default", "value", v, "default", JWKSCacheTTL.String())
+		}
+	}
+	if v := os.Getenv("AZURE_OPENAI_JWT_CLOCK_SKEW"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			JWTClockSkew = d
+		} else {
+			slog.Warn("Invalid AZURE_OPENAI_JWT_CLOCK_SKEW, using default", "value", v, "default", JWTClockSkew.String())
+		}
+	}
+	if v := os.Getenv("AZURE_OPENAI_JWT_SUBJECT_CLAIM"); v != "" {
+		JWTSubjectClaim = v
+	}
+	if v := os.Getenv("AZURE_OPENAI_JWT_OWNER_CLAIM"); v != "" {
+		JWTOwnerClaims = splitCSV(v)
+	}
+	if v := os.Getenv("AZURE_OPENAI_JWT_GROUPS_CLAIM"); v != "" {
+		JWTGroupsClaim = v
+	}
+	for _, pair := range splitCSV(os.Getenv("AZURE_OPENAI_JWT_CLAIM_POLICIES")) {
+		match, policy, ok := strings.Cut(pair, "=")
+		if !ok || !strings.Contains(match, ":") {
+			slog.Warn("Ignoring invalid claim policy, expected claim:value=policy", "value", pair)
+			continue
+		}
+		JWTClaimPolicies[match] = policy
+	}
+	JWTDefaultPolicy = os.Getenv("AZURE_OPENAI_JWT_DEFAULT_POLICY")
+	for _, pair := range splitCSV(os.Getenv("AZURE_OPENAI_JWT_CLAIM_TENANTS")) {
+		match, tenant, ok := strings.Cut(pair, "=")
+		if !ok || !strings.Contains(match, ":") {
+			slog.Warn("Ignoring invalid claim tenant, expected claim:value=tenant", "value", pair)
+			continue
+		}
+		JWTClaimTenants[match] = tenant
+	}
+	slog.Info("JWT authentication enabled", "issuer", JWTIssuer, "audience", JWTAudiences)
+}
+
+func splitCSV(v string) []string {
+	var list []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// LooksLikeJWT reports whether a bearer credential is a JWT rather than an
+// API key.
+func LooksLikeJWT(token string) bool {
+	return strings.HasPrefix(token, "eyJ") && strings.Count(token, ".") == 2
+}
+
+// Claims is a verified token payload.
+type Claims map[string]any
+
+// String returns a string claim.
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Strings returns a claim that may be a string or an array of strings.
+func (c Claims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func (c Claims) time(name string) (time.Time, bool) {
+	v, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(v), 0), true
+}
+
+// VerifyJWT checks a token's signature against the issuer's keys and its
+// iss, aud, exp and nbf claims.
+func VerifyJWT(ctx context.Context, token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", ErrInvalidToken)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrInvalidToken, err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %v", ErrInvalidToken, err)
+	}
+
+	key, err := jwks.get(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: payload: %v", ErrInvalidToken, err)
+	}
+	if iss := strings.TrimSuffix(claims.String("iss"), "/"); iss != JWTIssuer {
+		return nil, fmt.Errorf("%w: issuer %q is not trusted", ErrInvalidToken, iss)
+	}
+	if !audienceMatches(claims.Strings("aud")) {
+		return nil, fmt.Errorf("%w: audience %v is not accepted", ErrInvalidToken, claims.Strings("aud"))
+	}
+	now := time.Now()
+	exp, ok := claims.time("exp")
+	if !ok {
+		return nil, fmt.Errorf("%w: no expiry", ErrInvalidToken)
+	}
+	if now.After(exp.Add(JWTClockSkew)) {
+		return nil, fmt.Errorf("%w: expired at %s", ErrExpiredKey, exp.Format(time.RFC3339))
+	}
+	if nbf, ok := claims.time("nbf"); ok && now.Add(JWTClockSkew).Before(nbf) {
+		return nil, fmt.Errorf("%w: not valid before %s", ErrInvalidToken, nbf.Format(time.RFC3339))
+	}
+	return claims, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func audienceMatches(aud []string) bool {
+	for _, a := range aud {
+		for _, want := range JWTAudiences {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	var digest []byte
+	switch hash {
+	case crypto.SHA256:
+		sum := sha256.Sum256(signed)
+		digest = sum[:]
+	case crypto.SHA384:
+		sum := sha512.Sum384(signed)
+		digest = sum[:]
+	default:
+		sum := sha512.Sum512(signed)
+		digest = sum[:]
+	}
+
+	switch {
+	case strings.HasPrefix(alg, "RS"):
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key type does not match %s", alg)
+		}
+		return rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+	case strings.HasPrefix(alg, "PS"):
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key type does not match %s", alg)
+		}
+		return rsa.VerifyPSS(pub, hash, digest, sig, nil)
+	case strings.HasPrefix(alg, "ES"):
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig)%2 != 0 {
+			return fmt.Errorf("key type does not match %s", alg)
+		}
+		r := new(big.Int).SetBytes(sig[:len(sig)/2])
+		s := new(big.Int).SetBytes(sig[len(sig)/2:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("signature does not verify")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %q", alg)
+}
+
+// keySet caches the issuer's JWKS. Unknown key IDs trigger a refresh, at
+// most once every refreshCooldown, so rotated keys are picked up quickly.
+// Only one refresh runs at a time; concurrent callers wait for it without
+// holding the lock.
+type keySet struct {
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+	tried   time.Time
+	pending chan struct{} // closed when the refresh in flight is done
+}
+
+const refreshCooldown = 30 * time.Second
+
+func (s *keySet) get(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	if key, ok := s.lookup(kid); ok && time.Since(s.fetched) < JWKSCacheTTL {
+		s.mu.Unlock()
+		return key, nil
+	}
+	done := s.pending
+	if done == nil && (time.Since(s.tried) >= refreshCooldown || time.Since(s.fetched) >= JWKSCacheTTL) {
+		s.tried = time.Now()
+		done = make(chan struct{})
+		s.pending = done
+		go s.refresh(done)
+	}
+	s.mu.Unlock()
+
+	if done != nil {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key, ok := s.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: unknown signing key %q", ErrInvalidToken, kid)
+}
+
+// refresh fetches the keys and closes done. The fetch is not tied to the
+// request that started it, so that request giving up does not fail the
+// others waiting; it times out on its own.
+func (s *keySet) refresh(done chan struct{}) {
+	keys, err := fetchJWKS(context.Background())
+	s.mu.Lock()
+	if err != nil {
+		slog.Error("Could not fetch JWKS", "error", err)
+	} else {
+		s.keys, s.fetched = keys, time.Now()
+	}
+	s.pending = nil
+	s.mu.Unlock()
+	close(done)
+}
+
+// lookup finds a key by ID. Tokens without a kid match a single-key set.
+func (s *keySet) lookup(kid string) (crypto.PublicKey, bool) {
+	if key, ok := s.keys[kid]; ok {
+		return key, true
+	}
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+func fetchJWKS(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	url := JWKSURL
+	if url == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := getJSON(ctx, JWTIssuer+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, fmt.Errorf("discovering JWKS URL: %w", err)
+		}
+		url = discovery.JWKSURI
+	}
+
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := getJSON(ctx, url, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no usable signing keys at %s", url)
+	}
+	slog.Info("Loaded JWT signing keys", "keys", len(keys), "url", url)
+	return keys, nil
+}
+
+func getJSON(ctx context.Context, url string, v any) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// subjectFallbacks identify the caller of tokens without JWTSubjectClaim:
+// the object ID Entra ID issues, then the client application's ID.
+var subjectFallbacks = []string{"oid", "azp", "appid", "client_id"}
+
+// IdentityFromClaims maps a verified token to the caller identity: the
+// subject becomes the key ID, the app ID the owner, and mapped claims the
+// policies the caller may act under and the tenant it is bound to. Tokens
+// that identify no caller are rejected, as they could not be told apart.
+func IdentityFromClaims(claims Claims) (*Identity, error) {
+	subject := claims.String(JWTSubjectClaim)
+	for _, name := range subjectFallbacks {
+		if subject != "" {
+			break
+		}
+		subject = claims.String(name)
+	}
+	if subject == "" {
+		return nil, fmt.Errorf("%w: no %s claim", ErrInvalidToken, JWTSubjectClaim)
+	}
+
+	id := &Identity{KeyID: "jwt:" + subject, Tenant: claimTenant(claims)}
+	for _, name := range JWTOwnerClaims {
+		if owner := claims.String(name); owner != "" {
+			id.Owner = owner
+			break
+		}
+	}
+	if id.Owner == "" {
+		id.Owner = subject
+	}
+
+	id.AnyOf = matchClaims(claims, JWTClaimPolicies)
+	if len(id.AnyOf) == 0 && JWTDefaultPolicy != "" {
+		id.AnyOf = []string{JWTDefaultPolicy}
+	}
+	return id, nil
+}
+
+// claimTenant returns the tenant of the first mapping a token's claims
+// match, or the default tenant.
+func claimTenant(claims Claims) string {
+	if tenants := matchClaims(claims, JWTClaimTenants); len(tenants) > 0 {
+		return tenants[0]
+	}
+	return DefaultTenant
+}
+
+// matchClaims returns the values of the "claim:value" mappings that claims
+// match, in sorted order of the mappings. "groups" stands for JWTGroupsClaim.
+func matchClaims(claims Claims, mappings map[string]string) []string {
+	matches := make([]string, 0, len(mappings))
+	for match := range mappings {
+		matches = append(matches, match)
+	}
+	sort.Strings(matches)
+	var values []string
+	for _, match := range matches {
+		name, value, _ := strings.Cut(match, ":")
+		if name == "groups" {
+			name = JWTGroupsClaim
+		}
+		if contains(claims.Strings(name), value) {
+			values = append(values, mappings[match])
+		}
+	}
+	return values
+}
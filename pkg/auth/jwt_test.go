@@ -0,0 +1,289 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClaimTenant(t *testing.T) {
+	saved := JWTClaimTenants
+	JWTClaimTenants = map[string]string{
+		"groups:retail-devs": "retail",
+		"groups:bank-devs":   "bank",
+		"azp:batch":          "batch",
+	}
+	t.Cleanup(func() { JWTClaimTenants = saved })
+
+	tests := []struct {
+		name   string
+		claims Claims
+		want   string
+	}{
+		{name: "no mapping", claims: Claims{"sub": "u1"}, want: DefaultTenant},
+		{name: "group", claims: Claims{"groups": []any{"other", "retail-devs"}}, want: "retail"},
+		{name: "string claim", claims: Claims{"azp": "batch"}, want: "batch"},
+		{name: "first sorted match wins", claims: Claims{"azp": "batch", "groups": []any{"retail-devs", "bank-devs"}}, want: "batch"},
+		{name: "value must match exactly", claims: Claims{"groups": []any{"retail-devs-2"}}, want: DefaultTenant},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.claims["sub"] = "u1"
+			id, err := IdentityFromClaims(tt.claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := id.Tenant; got != tt.want {
+				t.Errorf("tenant = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClaimPoliciesGroupsClaim(t *testing.T) {
+	savedPolicies, savedGroups := JWTClaimPolicies, JWTGroupsClaim
+	JWTClaimPolicies = map[string]string{"groups:admins": "admin", "azp:batch": "batch"}
+	JWTGroupsClaim = "roles"
+	t.Cleanup(func() { JWTClaimPolicies, JWTGroupsClaim = savedPolicies, savedGroups })
+
+	tests := []struct {
+		name   string
+		claims Claims
+		want   []string
+	}{
+		{name: "groups read from the configured claim", claims: Claims{"sub": "u1", "roles": []any{"admins"}}, want: []string{"admin"}},
+		{name: "literal groups claim is not read", claims: Claims{"sub": "u1", "groups": []any{"admins"}}},
+		{name: "every match applies", claims: Claims{"sub": "u1", "azp": "batch", "roles": "admins"}, want: []string{"batch", "admin"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := IdentityFromClaims(tt.claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := id.AnyOf; fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("AnyOf = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIdentityFromClaimsSubject(t *testing.T) {
+	tests := []struct {
+		name      string
+		claims    Claims
+		wantKey   string
+		wantOwner string
+	}{
+		{name: "subject", claims: Claims{"sub": "u1", "azp": "app"}, wantKey: "jwt:u1", wantOwner: "app"},
+		{name: "object ID without subject", claims: Claims{"oid": "o1", "appid": "app"}, wantKey: "jwt:o1", wantOwner: "app"},
+		{name: "client app only", claims: Claims{"azp": "app"}, wantKey: "jwt:app", wantOwner: "app"},
+		{name: "owner falls back to the subject", claims: Claims{"sub": "u1"}, wantKey: "jwt:u1", wantOwner: "u1"},
+		{name: "no caller", claims: Claims{"iss": "x", "groups": []any{"g"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := IdentityFromClaims(tt.claims)
+			if tt.wantKey == "" {
+				if !errors.Is(err, ErrInvalidToken) {
+					t.Fatalf("IdentityFromClaims() error = %v, want invalid token", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id.KeyID != tt.wantKey || id.Owner != tt.wantOwner {
+				t.Errorf("key %q owner %q, want %q and %q", id.KeyID, id.Owner, tt.wantKey, tt.wantOwner)
+			}
+		})
+	}
+}
+
+// testIssuer serves a JWKS with one RSA and one EC signing key.
+type testIssuer struct {
+	rsa     *rsa.PrivateKey
+	ec      *ecdsa.PrivateKey
+	fetches atomic.Int32
+	delay   time.Duration
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	iss := &testIssuer{}
+	var err error
+	if iss.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if iss.ec, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		iss.fetches.Add(1)
+		time.Sleep(iss.delay)
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{
+			{"kid": "rsa1", "kty": "RSA", "use": "sig", "n": b64(iss.rsa.N.Bytes()), "e": b64(big.NewInt(int64(iss.rsa.E)).Bytes())},
+			{"kid": "ec1", "kty": "EC", "crv": "P-256", "x": b64(iss.ec.X.FillBytes(make([]byte, 32))), "y": b64(iss.ec.Y.FillBytes(make([]byte, 32)))},
+			{"kid": "enc1", "kty": "RSA", "use": "enc", "n": b64(iss.rsa.N.Bytes()), "e": "AQAB"},
+		}})
+	}))
+	t.Cleanup(srv.Close)
+
+	saved := struct {
+		issuer, url string
+		aud         []string
+		set         *keySet
+	}{JWTIssuer, JWKSURL, JWTAudiences, jwks}
+	JWTIssuer, JWKSURL, JWTAudiences, jwks = "https://issuer.example.com", srv.URL, []string{"api://proxy"}, &keySet{}
+	t.Cleanup(func() { JWTIssuer, JWKSURL, JWTAudiences, jwks = saved.issuer, saved.url, saved.aud, saved.set })
+	return iss
+}
+
+// sign returns a token for claims signed with alg and the key named kid.
+func (iss *testIssuer) sign(t *testing.T, alg, kid string, claims map[string]any) string {
+	t.Helper()
+	b64 := base64.RawURLEncoding.EncodeToString
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	var err error
+	switch alg {
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, iss.rsa, crypto.SHA256, digest[:])
+	case "PS256":
+		sig, err = rsa.SignPSS(rand.Reader, iss.rsa, crypto.SHA256, digest[:], nil)
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, iss.ec, digest[:])
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(sig)
+}
+
+func TestVerifyJWT(t *testing.T) {
+	iss := newTestIssuer(t)
+	now := time.Now().Unix()
+	valid := func(extra map[string]any) map[string]any {
+		claims := map[string]any{"iss": JWTIssuer, "aud": "api://proxy", "sub": "user-1", "exp": now + 300}
+		for k, v := range extra {
+			claims[k] = v
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{name: "RS256", token: iss.sign(t, "RS256", "rsa1", valid(nil))},
+		{name: "PS256", token: iss.sign(t, "PS256", "rsa1", valid(nil))},
+		{name: "ES256", token: iss.sign(t, "ES256", "ec1", valid(nil))},
+		{name: "audience in a list", token: iss.sign(t, "RS256", "rsa1", valid(map[string]any{"aud": []string{"other", "api://proxy"}}))},
+		{name: "issuer with trailing slash", token: iss.sign(t, "RS256", "rsa1", valid(map[string]any{"iss": JWTIssuer + "/"}))},
+		{name: "expired within skew", token: iss.sign(t, "RS256", "rsa1", valid(map[string]any{"exp": now - 30}))},
+		{name: "expired", token: iss.sign(t, "RS256", "rsa1", valid(map[string]any{"exp": now - 300})), wantErr: ErrExpiredKey},
+		{name: "no expiry", token: iss.sign(t, "RS256", "rsa1", valid(map[string]any{"exp": nil})), wantErr: ErrInvalidToken},
+		{name: "not yet valid", token: iss.sign(t, "RS256", "rsa1", valid(map[string]any{"nbf": now + 300})), wantErr: ErrInvalidToken},
+		{name: "wrong issuer", token: iss.sign(t, "RS256", "rsa1", valid(map[string]any{"iss": "https://evil.example.com"})), wantErr: ErrInvalidToken},
+		{name: "wrong audience", token: iss.sign(t, "RS256", "rsa1", valid(map[string]any{"aud": "api://other"})), wantErr: ErrInvalidToken},
+		{name: "unknown key", token: iss.sign(t, "RS256", "rsa2", valid(nil)), wantErr: ErrInvalidToken},
+		{name: "encryption key", token: iss.sign(t, "RS256", "enc1", valid(nil)), wantErr: ErrInvalidToken},
+		{name: "key type mismatch", token: iss.sign(t, "ES256", "rsa1", valid(nil)), wantErr: ErrInvalidToken},
+		{name: "tampered payload", token: tamper(iss.sign(t, "RS256", "rsa1", valid(nil))), wantErr: ErrInvalidToken},
+		{name: "unsigned", token: "eyJhbGciOiJub25lIn0.eyJzdWIiOiJ4In0.", wantErr: ErrInvalidToken},
+		{name: "malformed", token: "eyJhbGciOiJub25lIn0.e30", wantErr: ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := VerifyJWT(context.Background(), tt.token)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("VerifyJWT() error = %v", err)
+				}
+				if claims.String("sub") != "user-1" {
+					t.Errorf("sub = %q", claims.String("sub"))
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("VerifyJWT() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// tamper swaps the payload of a token for one claiming another subject.
+func tamper(token string) string {
+	parts := strings.Split(token, ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	payload = bytes.Replace(payload, []byte("user-1"), []byte("admin1"), 1)
+	parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+	return strings.Join(parts, ".")
+}
+
+func TestKeySetFetchesOnce(t *testing.T) {
+	iss := newTestIssuer(t)
+	iss.delay = 100 * time.Millisecond
+	token := iss.sign(t, "RS256", "rsa1", map[string]any{
+		"iss": JWTIssuer, "aud": "api://proxy", "sub": "user-1", "exp": time.Now().Unix() + 300,
+	})
+
+	// A caller that gives up does not fail the fetch for the others
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := VerifyJWT(ctx, token); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("VerifyJWT() error = %v, want deadline exceeded", err)
+	}
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := VerifyJWT(context.Background(), token); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := iss.fetches.Load(); n != 1 {
+		t.Errorf("JWKS fetched %d times, want 1", n)
+	}
+
+	// Unknown keys refetch at most once per cooldown
+	unknown := iss.sign(t, "RS256", "rsa2", map[string]any{
+		"iss": JWTIssuer, "aud": "api://proxy", "sub": "user-1", "exp": time.Now().Unix() + 300,
+	})
+	for range 3 {
+		if _, err := VerifyJWT(context.Background(), unknown); !errors.Is(err, ErrInvalidToken) {
+			t.Fatalf("VerifyJWT() error = %v, want invalid token", err)
+		}
+	}
+	if n := iss.fetches.Load(); n != 1 {
+		t.Errorf("JWKS fetched %d times within the cooldown, want 1", n)
+	}
+}
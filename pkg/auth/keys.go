@@ -0,0 +1,296 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/store"
+)
+
+// KeyPrefix starts every proxy-issued key so they are easy to tell apart
+// from Azure and OpenAI keys.
+const KeyPrefix = "sk-proxy-"
+
+var (
+	// Enabled turns on virtual key authentication. Clients must then present
+	// a proxy-issued key and never see the real Azure credentials.
+	Enabled = false
+	// Keys is the process-wide key store.
+	Keys = NewKeyStore()
+
+	ErrInvalidKey = errors.New("invalid API key")
+	ErrExpiredKey = errors.New("API key has expired")
+)
+
+// VirtualKey is a proxy-issued API key. Only the SHA-256 of the secret is kept.
+type VirtualKey struct {
+	ID      string   `json:"id"`
+	Hash    string   `json:"hash"`
+	Hint    string   `json:"hint"` // first characters of the key, for display
+	Owner   string   `json:"owner"`
+	Models  []string `json:"models,omitempty"`  // allowed model aliases; empty allows all
+	Routes  []string `json:"routes,omitempty"`  // allowed route families; empty allows all
+	Methods []string `json:"methods,omitempty"` // allowed HTTP methods; empty allows all
+	Group   string   `json:"group,omitempty"`   // group policy applied on top of the key's own lists
+	Tenant  string   `json:"tenant,omitempty"`  // tenant the key is bound to; empty is the default tenant
+	RPM     int      `json:"rpm,omitempty"`     // requests per minute; zero uses the default
+	TPM     int      `json:"tpm,omitempty"`     // tokens per minute; zero uses the default
+	// Concurrency caps the key's in-flight requests; zero uses the default
+	Concurrency int        `json:"concurrency,omitempty"`
+	Priority    string     `json:"priority,omitempty"` // queue class, see limits.PriorityNames
+	Audit       bool       `json:"audit,omitempty"`    // requests are written to the audit log
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	Revoked     bool       `json:"revoked,omitempty"`
+}
+
+// Expired reports whether the key is past its expiry.
+func (k *VirtualKey) Expired() bool {
+	return k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt)
+}
+
+// AllowsModel reports whether model is on the key's allowlist.
+func (k *VirtualKey) AllowsModel(model string) bool {
+	return MatchModel(k.Models, model)
+}
+
+// Policy returns the restrictions set on the key itself.
+func (k *VirtualKey) Policy() Policy {
+	return Policy{Name: k.ID, Models: k.Models, Routes: k.Routes, Methods: k.Methods}
+}
+
+// MatchModel reports whether model matches one of patterns. An empty list
+// matches everything; a pattern ending in "*" matches by prefix.
+func MatchModel(patterns []string, model string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	model = strings.ToLower(model)
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if p == "*" || p == model {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(p, "*"); ok && strings.HasPrefix(model, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// keysBucket is the store bucket virtual keys are persisted in, by ID.
+const keysBucket = "keys"
+
+// KeyStore holds virtual keys indexed by hash.
+type KeyStore struct {
+	mu     sync.RWMutex
+	byHash map[string]*VirtualKey
+	db     *store.DB
+}
+
+// NewKeyStore creates an empty in-memory store.
+func NewKeyStore() *KeyStore {
+	return &KeyStore{byHash: make(map[string]*VirtualKey)}
+}
+
+func init() {
+	// AZURE_OPENAI_PROXY_AUTH lists the accepted caller credentials
+	for _, mode := range splitCSV(os.Getenv("AZURE_OPENAI_PROXY_AUTH")) {
+		switch strings.ToLower(mode) {
+		case "virtual-keys", "true":
+			Enabled = true
+		case "jwt":
+			JWTEnabled = true
+		default:
+			slog.Warn("Ignoring unknown AZURE_OPENAI_PROXY_AUTH mode", "value", mode)
+		}
+	}
+	if JWTEnabled {
+		loadJWTConfig()
+	}
+	if !Enabled && !JWTEnabled {
+		return
+	}
+	// Policies are shared by keys and tokens
+	if err := Open(store.Default()); err != nil {
+		slog.Error("Could not load virtual keys", "path", store.Path, "error", err)
+		os.Exit(1)
+	}
+	if Enabled {
+		slog.Info("Virtual key authentication enabled", "keys", Keys.Len(), "path", store.Path)
+	}
+}
+
+// Required reports whether callers must authenticate to the proxy.
+func Required() bool {
+	return Enabled || JWTEnabled
+}
+
+// Open loads the process-wide keys and group policies from db.
+func Open(db *store.DB) error {
+	if err := Keys.Open(db); err != nil {
+		return err
+	}
+	return Policies.Open(db)
+}
+
+// HashKey returns the hex SHA-256 of a key secret.
+func HashKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Open loads the keys persisted in db and writes later changes back to it.
+func (s *KeyStore) Open(db *store.DB) error {
+	byHash := make(map[string]*VirtualKey)
+	err := db.ForEach(keysBucket, func(_ string, raw json.RawMessage) error {
+		var k VirtualKey
+		if err := json.Unmarshal(raw, &k); err != nil {
+			return err
+		}
+		byHash[k.Hash] = &k
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.db, s.byHash = db, byHash
+	s.mu.Unlock()
+	return nil
+}
+
+// persist writes k to the database, if one is open. Callers hold s.mu.
+func (s *KeyStore) persist(k *VirtualKey) error {
+	if s.db == nil {
+		return nil
+	}
+	return s.db.Put(keysBucket, k.ID, k)
+}
+
+// Len returns the number of stored keys.
+func (s *KeyStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.byHash)
+}
+
+// KeyOptions describes a key to issue.
+type KeyOptions struct {
+	Owner  string
+	Group  string // optional group policy
+	Tenant string // optional tenant the key is bound to
+	Policy Policy // the key's own model, route and method lists
+	RPM    int
+	TPM    int
+	// Concurrency and Priority control how the key's requests are queued
+	Concurrency int
+	Priority    string
+	Audit       bool          // write the key's requests to the audit log
+	TTL         time.Duration // zero never expires
+}
+
+// Create issues a new key and returns its secret, which is not stored.
+func (s *KeyStore) Create(opts KeyOptions) (*VirtualKey, string, error) {
+	if err := opts.Policy.Validate(); err != nil {
+		return nil, "", err
+	}
+	if err := ValidatePriority(&opts.Priority); err != nil {
+		return nil, "", err
+	}
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, "", err
+	}
+	secret := KeyPrefix + hex.EncodeToString(raw)
+	id := make([]byte, 6)
+	rand.Read(id)
+
+	k := &VirtualKey{
+		ID:          "key_" + hex.EncodeToString(id),
+		Hash:        HashKey(secret),
+		Hint:        secret[:len(KeyPrefix)+4],
+		Owner:       opts.Owner,
+		Models:      opts.Policy.Models,
+		Routes:      opts.Policy.Routes,
+		Methods:     opts.Policy.Methods,
+		Group:       opts.Group,
+		Tenant:      opts.Tenant,
+		RPM:         opts.RPM,
+		TPM:         opts.TPM,
+		Concurrency: opts.Concurrency,
+		Priority:    opts.Priority,
+		Audit:       opts.Audit,
+		CreatedAt:   time.Now().UTC(),
+	}
+	if opts.TTL > 0 {
+		expires := k.CreatedAt.Add(opts.TTL)
+		k.ExpiresAt = &expires
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byHash[k.Hash] = k
+	if err := s.persist(k); err != nil {
+		delete(s.byHash, k.Hash)
+		return nil, "", err
+	}
+	return k, secret, nil
+}
+
+// Authenticate looks up a presented key secret.
+func (s *KeyStore) Authenticate(secret string) (*VirtualKey, error) {
+	s.mu.RLock()
+	stored, ok := s.byHash[HashKey(secret)]
+	var k VirtualKey
+	if ok {
+		k = *stored
+	}
+	s.mu.RUnlock()
+	if !ok || k.Revoked {
+		return nil, ErrInvalidKey
+	}
+	if k.Expired() {
+		return nil, ErrExpiredKey
+	}
+	return &k, nil
+}
+
+// List returns all keys ordered by creation time.
+func (s *KeyStore) List() []VirtualKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]VirtualKey, 0, len(s.byHash))
+	for _, k := range s.byHash {
+		keys = append(keys, *k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys
+}
+
+// Revoke disables the key with the given ID.
+func (s *KeyStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range s.byHash {
+		if k.ID == id {
+			k.Revoked = true
+			if err := s.persist(k); err != nil {
+				k.Revoked = false
+				return err
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("key %s not found", id)
+}
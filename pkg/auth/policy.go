@@ -0,0 +1,248 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/limits"
+	"github.com/gyarbij/azure-oai-proxy/pkg/store"
+)
+
+// Route families a policy can allow.
+const (
+	RouteChat       = "chat"
+	RouteEmbeddings = "embeddings"
+	RouteImages     = "images"
+	RouteAudio      = "audio"
+	RouteFiles      = "files"
+	RouteFineTunes  = "fine_tunes"
+	RouteResponses  = "responses"
+	RouteModels     = "models"
+	RouteOther      = "other"
+)
+
+// RouteFamilies lists every family in display order.
+var RouteFamilies = []string{
+	RouteChat, RouteEmbeddings, RouteImages, RouteAudio, RouteFiles,
+	RouteFineTunes, RouteResponses, RouteModels, RouteOther,
+}
+
+// RouteFamily classifies a request path into a route family.
+func RouteFamily(path string) string {
+	path = strings.TrimPrefix(strings.ToLower(path), "/v1")
+	switch {
+	case strings.HasPrefix(path, "/chat/"), path == "/completions", path == "/messages":
+		return RouteChat
+	case strings.HasPrefix(path, "/embeddings"):
+		return RouteEmbeddings
+	case strings.HasPrefix(path, "/images/"):
+		return RouteImages
+	case strings.HasPrefix(path, "/audio/"):
+		return RouteAudio
+	case strings.HasPrefix(path, "/files"):
+		return RouteFiles
+	case strings.HasPrefix(path, "/fine_tunes"), strings.HasPrefix(path, "/fine_tuning/"):
+		return RouteFineTunes
+	case strings.HasPrefix(path, "/responses"):
+		return RouteResponses
+	case strings.HasPrefix(path, "/models"), strings.HasPrefix(path, "/deployments"):
+		return RouteModels
+	}
+	return RouteOther
+}
+
+// Policy restricts what a caller may do. Empty lists allow everything.
+type Policy struct {
+	Name    string   `json:"name"`
+	Models  []string `json:"models,omitempty"`  // model aliases, * suffix for prefixes
+	Routes  []string `json:"routes,omitempty"`  // route families, see RouteFamilies
+	Methods []string `json:"methods,omitempty"` // HTTP methods
+	RPM     int      `json:"rpm,omitempty"`     // rate limits for callers under this policy; zero uses the default
+	TPM     int      `json:"tpm,omitempty"`
+	// Concurrency caps in-flight requests per caller; zero uses the default
+	Concurrency int `json:"concurrency,omitempty"`
+	// Priority is the highest queue class callers may use: high, normal or low
+	Priority string `json:"priority,omitempty"`
+	// Audit writes the requests of callers under this policy to the audit log
+	Audit bool `json:"audit,omitempty"`
+}
+
+// AllowsModel reports whether model is on the policy's allowlist.
+func (p *Policy) AllowsModel(model string) bool {
+	return MatchModel(p.Models, model)
+}
+
+// AllowsRoute reports whether the route family is allowed.
+func (p *Policy) AllowsRoute(family string) bool {
+	return matchAny(p.Routes, family)
+}
+
+// AllowsMethod reports whether the HTTP method is allowed.
+func (p *Policy) AllowsMethod(method string) bool {
+	return matchAny(p.Methods, method)
+}
+
+// Validate checks that the route families are known and normalizes case.
+func (p *Policy) Validate() error {
+	for i, r := range p.Routes {
+		r = strings.ToLower(strings.TrimSpace(r))
+		if r != "*" && !contains(RouteFamilies, r) {
+			return fmt.Errorf("unknown route family %q, expected one of %s", r, strings.Join(RouteFamilies, ", "))
+		}
+		p.Routes[i] = r
+	}
+	for i, m := range p.Methods {
+		p.Methods[i] = strings.ToUpper(strings.TrimSpace(m))
+	}
+	return ValidatePriority(&p.Priority)
+}
+
+// ValidatePriority checks a priority class name and normalizes its case.
+func ValidatePriority(priority *string) error {
+	if _, ok := limits.ParsePriority(*priority); !ok {
+		return fmt.Errorf("unknown priority %q, expected one of %s", *priority, strings.Join(limits.PriorityNames, ", "))
+	}
+	*priority = strings.ToLower(strings.TrimSpace(*priority))
+	return nil
+}
+
+func matchAny(allowed []string, v string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		if a == "*" || strings.EqualFold(a, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// PolicyError explains why a request was denied. Code is the OpenAI-style
+// error code returned to the client.
+type PolicyError struct {
+	Code    string
+	Message string
+}
+
+func (e *PolicyError) Error() string { return e.Message }
+
+// Check applies p to a request, returning a *PolicyError when it is denied.
+func (p *Policy) Check(method, path, model string) error {
+	if !p.AllowsMethod(method) {
+		return &PolicyError{Code: "method_not_allowed", Message: fmt.Sprintf("Method %s is not allowed", method)}
+	}
+	if family := RouteFamily(path); !p.AllowsRoute(family) {
+		return &PolicyError{Code: "route_not_allowed", Message: fmt.Sprintf("The %s endpoints are not allowed", family)}
+	}
+	if model != "" && !p.AllowsModel(model) {
+		return &PolicyError{Code: "model_not_allowed", Message: fmt.Sprintf("Model %s is not allowed", model)}
+	}
+	return nil
+}
+
+// policiesBucket is the store bucket group policies are persisted in, by name.
+const policiesBucket = "policies"
+
+// Policies is the process-wide set of group policies keys can refer to.
+var Policies = NewPolicyStore()
+
+// PolicyStore holds named group policies.
+type PolicyStore struct {
+	mu     sync.RWMutex
+	byName map[string]Policy
+	db     *store.DB
+}
+
+// NewPolicyStore creates an empty in-memory store.
+func NewPolicyStore() *PolicyStore {
+	return &PolicyStore{byName: make(map[string]Policy)}
+}
+
+// Open loads the policies persisted in db and writes later changes back to it.
+func (s *PolicyStore) Open(db *store.DB) error {
+	byName := make(map[string]Policy)
+	err := db.ForEach(policiesBucket, func(name string, raw json.RawMessage) error {
+		var p Policy
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return err
+		}
+		byName[name] = p
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.db, s.byName = db, byName
+	s.mu.Unlock()
+	return nil
+}
+
+// Get returns the named policy.
+func (s *PolicyStore) Get(name string) (Policy, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.byName[name]
+	return p, ok
+}
+
+// List returns all policies ordered by name.
+func (s *PolicyStore) List() []Policy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	policies := make([]Policy, 0, len(s.byName))
+	for _, p := range s.byName {
+		policies = append(policies, p)
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Name < policies[j].Name })
+	return policies
+}
+
+// Put validates and stores p under its name.
+func (s *PolicyStore) Put(p Policy) error {
+	if p.Name == "" {
+		return fmt.Errorf("policy name is required")
+	}
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db != nil {
+		if err := s.db.Put(policiesBucket, p.Name, p); err != nil {
+			return err
+		}
+	}
+	s.byName[p.Name] = p
+	return nil
+}
+
+// Delete removes the named policy. Keys referring to it are denied until it
+// is recreated.
+func (s *PolicyStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.byName[name]; !ok {
+		return fmt.Errorf("policy %s not found", name)
+	}
+	if s.db != nil {
+		if err := s.db.Delete(policiesBucket, name); err != nil {
+			return err
+		}
+	}
+	delete(s.byName, name)
+	return nil
+}
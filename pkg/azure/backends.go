@@ -0,0 +1,237 @@
+package azure
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/logging"
+)
+
+var (
+	// BackendPool holds the Azure OpenAI resources requests can be routed to.
+	// When AZURE_OPENAI_BACKENDS is not set it contains a single backend for
+	// AzureOpenAIEndpoint.
+	BackendPool     []*Backend
+	RoutingStrategy = "primary" // "primary", "latency" or "sticky"
+	EWMAAlpha       = 0.3       // weight of the newest sample in the latency average
+	HedgingEnabled  = false
+	HedgeMinSamples = 20 // samples needed before a backend's p95 is trusted for hedging
+	BackendCooldown = 30 * time.Second
+)
+
+const latencyWindow = 100
+
+// Backend is one Azure OpenAI resource, usually one region, in the routing pool.
+type Backend struct {
+	Name     string
+	Endpoint string
+	Key      string // optional; overrides the api-key sent by the client
+
+	mu       sync.Mutex
+	ewmaTTFT float64 // milliseconds
+	samples  []float64
+	next     int
+	count    int
+
+	downUntil time.Time
+	probe     probeState // see CheckBackends
+}
+
+// loadBackendPool reads the routing configuration. It runs from the package
+// init in proxy.go so that AzureOpenAIEndpoint is already populated.
+func loadBackendPool() {
+	if v := os.Getenv("AZURE_OPENAI_ROUTING_STRATEGY"); v != "" {
+		RoutingStrategy = strings.ToLower(v)
+	}
+	if v := os.Getenv("AZURE_OPENAI_EWMA_ALPHA"); v != "" {
+		if alpha, err := strconv.ParseFloat(v, 64); err == nil && alpha > 0 && alpha <= 1 {
+			EWMAAlpha = alpha
+		}
+	}
+	if v := os.Getenv("AZURE_OPENAI_HEDGING"); v != "" {
+		HedgingEnabled, _ = strconv.ParseBool(v)
+	}
+	if v := os.Getenv("AZURE_OPENAI_HEDGE_MIN_SAMPLES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			HedgeMinSamples = n
+		}
+	}
+
+	if v := os.Getenv("AZURE_OPENAI_BACKEND_COOLDOWN"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			BackendCooldown = d
+		}
+	}
+
+	// Format: name=https://resource.openai.azure.com/,name2=https://...
+	if v := os.Getenv("AZURE_OPENAI_BACKENDS"); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			name, endpoint, ok := strings.Cut(pair, "=")
+			if !ok || name == "" || endpoint == "" {
+				continue
+			}
+			BackendPool = append(BackendPool, &Backend{
+				Name:     name,
+				Endpoint: endpoint,
+				Key:      os.Getenv("AZURE_OPENAI_BACKEND_KEY_" + strings.ToUpper(name)),
+			})
+		}
+	}
+	if len(BackendPool) == 0 {
+		BackendPool = []*Backend{{Name: "default", Endpoint: AzureOpenAIEndpoint}}
+	}
+
+	names := make([]string, 0, len(BackendPool))
+	for _, b := range BackendPool {
+		names = append(names, b.Name)
+	}
+	slog.Info("Loaded backend pool", "backends", names, "routing_strategy", RoutingStrategy, "hedging", HedgingEnabled)
+
+	loadStickyConfig()
+	loadProbeConfig()
+}
+
+// selectBackend picks the backend for a new request from its tenant's pool
+// according to RoutingStrategy. Sticky routing falls back to latency routing
+// when the request carries no key, and for tenants other than the default,
+// whose pools are not on the hash ring.
+func selectBackend(req *http.Request) *Backend {
+	tenant, _ := TenantFrom(req.Context())
+	pool := tenant.Backends
+	switch RoutingStrategy {
+	case "sticky":
+		key := ""
+		if info := GetRequestInfo(req.Context()); info != nil {
+			key = info.stickyKey
+		}
+		if key != "" && tenant == DefaultTenant {
+			if b := ring.lookup(key); b != nil {
+				logging.FromContext(req.Context()).Debug("Sticky routing", "key_hash", stickyKeyHash(key), "backend", b.Name)
+				return b
+			}
+		}
+		return fastestBackend(pool, nil)
+	case "latency":
+		return fastestBackend(pool, nil)
+	}
+	for _, b := range pool {
+		if b.Available() {
+			return b
+		}
+	}
+	return pool[0]
+}
+
+// fastestBackend returns the available backend of pool with the lowest EWMA
+// time-to-first-token, skipping exclude. Backends without samples are
+// preferred so that every region gets measured at least once. If every
+// backend is cooling down the primary is returned.
+func fastestBackend(pool []*Backend, exclude *Backend) *Backend {
+	var best *Backend
+	bestTTFT := 0.0
+	for _, b := range pool {
+		if b == exclude || !b.Available() {
+			continue
+		}
+		ttft, count := b.Stats()
+		if count == 0 {
+			return b
+		}
+		if best == nil || ttft < bestTTFT {
+			best, bestTTFT = b, ttft
+		}
+	}
+	if best == nil && exclude == nil {
+		return pool[0]
+	}
+	return best
+}
+
+// MarkDown takes the backend out of rotation for BackendCooldown. Sticky keys
+// it owned move to the next backend on the ring until it comes back.
+func (b *Backend) MarkDown(reason string) {
+	b.mu.Lock()
+	wasUp := time.Now().After(b.downUntil)
+	b.downUntil = time.Now().Add(BackendCooldown)
+	b.mu.Unlock()
+	if wasUp {
+		slog.Warn("Backend removed from pool", "backend", b.Name, "cooldown", BackendCooldown.String(), "reason", reason)
+	}
+}
+
+// Available reports whether the backend is currently eligible for routing.
+func (b *Backend) Available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Now().After(b.downUntil)
+}
+
+// Observe records a time-to-first-token sample for the backend.
+func (b *Backend) Observe(ttft time.Duration) {
+	ms := float64(ttft) / float64(time.Millisecond)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.count == 0 {
+		b.ewmaTTFT = ms
+	} else {
+		b.ewmaTTFT = EWMAAlpha*ms + (1-EWMAAlpha)*b.ewmaTTFT
+	}
+	if len(b.samples) < latencyWindow {
+		b.samples = append(b.samples, ms)
+	} else {
+		b.samples[b.next] = ms
+	}
+	b.next = (b.next + 1) % latencyWindow
+	b.count++
+}
+
+// Stats returns the EWMA time-to-first-token in milliseconds and the number
+// of samples observed.
+func (b *Backend) Stats() (float64, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ewmaTTFT, b.count
+}
+
+// P95 returns the 95th percentile of the recent time-to-first-token samples,
+// or zero when fewer than HedgeMinSamples have been observed.
+func (b *Backend) P95() time.Duration {
+	b.mu.Lock()
+	if b.count < HedgeMinSamples {
+		b.mu.Unlock()
+		return 0
+	}
+	sorted := append([]float64(nil), b.samples...)
+	b.mu.Unlock()
+
+	sort.Float64s(sorted)
+	idx := int(float64(len(sorted))*0.95+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return time.Duration(sorted[idx] * float64(time.Millisecond))
+}
+
+// firstByteReader calls onFirstByte the first time data is read from the body.
+type firstByteReader struct {
+	io.ReadCloser
+	onFirstByte func()
+	seen        bool
+}
+
+func (r *firstByteReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 && !r.seen {
+		r.seen = true
+		r.onFirstByte()
+	}
+	return n, err
+}
@@ -0,0 +1,76 @@
+package azure
+
+import (
+	"strings"
+	"sync"
+)
+
+// configMu guards AzureOpenAIModelMapper and ServerlessDeploymentInfo, which
+// the admin API can change while requests are being proxied.
+var configMu sync.RWMutex
+
+// LookupModelMapping returns the deployment an alias is mapped to.
+func LookupModelMapping(alias string) (string, bool) {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	deployment, ok := AzureOpenAIModelMapper[strings.ToLower(alias)]
+	return deployment, ok
+}
+
+// SetModelMapping maps alias to deployment.
+func SetModelMapping(alias, deployment string) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	AzureOpenAIModelMapper[strings.ToLower(alias)] = deployment
+}
+
+// DeleteModelMapping removes the mapping for alias.
+func DeleteModelMapping(alias string) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	delete(AzureOpenAIModelMapper, strings.ToLower(alias))
+}
+
+// ModelMappings returns a copy of the model mapper.
+func ModelMappings() map[string]string {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	mappings := make(map[string]string, len(AzureOpenAIModelMapper))
+	for alias, deployment := range AzureOpenAIModelMapper {
+		mappings[alias] = deployment
+	}
+	return mappings
+}
+
+// LookupServerlessDeployment returns the serverless deployment for a model name.
+func LookupServerlessDeployment(model string) (ServerlessDeployment, bool) {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	info, ok := ServerlessDeploymentInfo[strings.ToLower(model)]
+	return info, ok
+}
+
+// SetServerlessDeployment adds or replaces a serverless deployment.
+func SetServerlessDeployment(model string, info ServerlessDeployment) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	ServerlessDeploymentInfo[strings.ToLower(model)] = info
+}
+
+// DeleteServerlessDeployment removes a serverless deployment.
+func DeleteServerlessDeployment(model string) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	delete(ServerlessDeploymentInfo, strings.ToLower(model))
+}
+
+// ServerlessDeployments returns a copy of the serverless deployments.
+func ServerlessDeployments() map[string]ServerlessDeployment {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	deployments := make(map[string]ServerlessDeployment, len(ServerlessDeploymentInfo))
+	for model, info := range ServerlessDeploymentInfo {
+		deployments[model] = info
+	}
+	return deployments
+}
@@ -0,0 +1,405 @@
+package azure
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// AuthMode selects how the proxy authenticates to Azure OpenAI: "key"
+	// forwards the caller's api-key, "entra" injects a Microsoft Entra ID
+	// bearer token regardless of what the client sends.
+	AuthMode = "key"
+
+	EntraScope         = "https://cognitiveservices.azure.com/.default"
+	EntraAuthorityHost = "https://login.microsoftonline.com"
+	EntraIMDSEndpoint  = "http://169.254.169.254/metadata/identity/oauth2/token"
+	// EntraRefreshWindow is how long before expiry a cached token is renewed.
+	EntraRefreshWindow = 5 * time.Minute
+	// EntraRefreshBackoff is how long a failed renewal waits before the next,
+	// doubling with each failure up to a minute, while the token is valid.
+	EntraRefreshBackoff = 5 * time.Second
+
+	entraCredential TokenCredential
+)
+
+// TokenCredential acquires Entra ID access tokens.
+type TokenCredential interface {
+	// GetToken requests a new token; callers cache the result.
+	GetToken(ctx context.Context) (AccessToken, error)
+}
+
+// AccessToken is a bearer token and its expiry.
+type AccessToken struct {
+	Token     string
+	ExpiresOn time.Time
+}
+
+func loadEntraConfig() {
+	if v := os.Getenv("AZURE_OPENAI_AUTH_MODE"); v != "" {
+		AuthMode = strings.ToLower(v)
+	}
+	if v := os.Getenv("AZURE_OPENAI_ENTRA_SCOPE"); v != "" {
+		EntraScope = v
+	}
+	if v := os.Getenv("AZURE_AUTHORITY_HOST"); v != "" {
+		EntraAuthorityHost = strings.TrimSuffix(v, "/")
+	}
+	if v := os.Getenv("AZURE_IMDS_ENDPOINT"); v != "" {
+		EntraIMDSEndpoint = v
+	}
+	if AuthMode != "entra" {
+		return
+	}
+
+	cred, err := newCredentialFromEnv()
+	if err != nil {
+		slog.Error("Entra ID authentication is enabled but misconfigured", "error", err)
+		os.Exit(1)
+	}
+	entraCredential = newCachedCredential(cred)
+	slog.Info("Using Entra ID authentication", "credential", fmt.Sprintf("%T", cred), "scope", EntraScope)
+}
+
+// newCredentialFromEnv picks a credential from the standard Azure identity
+// environment variables. AZURE_OPENAI_ENTRA_CREDENTIAL forces a specific one.
+func newCredentialFromEnv() (TokenCredential, error) {
+	tenantID := os.Getenv("AZURE_TENANT_ID")
+	clientID := os.Getenv("AZURE_CLIENT_ID")
+
+	kind := strings.ToLower(os.Getenv("AZURE_OPENAI_ENTRA_CREDENTIAL"))
+	if kind == "" {
+		switch {
+		case os.Getenv("AZURE_CLIENT_CERTIFICATE_PATH") != "":
+			kind = "certificate"
+		case os.Getenv("AZURE_CLIENT_SECRET") != "":
+			kind = "secret"
+		case os.Getenv("AZURE_FEDERATED_TOKEN_FILE") != "":
+			kind = "workload"
+		default:
+			kind = "managed"
+		}
+	}
+
+	if kind != "managed" && (tenantID == "" || clientID == "") {
+		return nil, fmt.Errorf("%s credential requires AZURE_TENANT_ID and AZURE_CLIENT_ID", kind)
+	}
+
+	switch kind {
+	case "secret":
+		return &clientSecretCredential{tenantID: tenantID, clientID: clientID, secret: os.Getenv("AZURE_CLIENT_SECRET")}, nil
+	case "certificate":
+		return newClientCertificateCredential(tenantID, clientID, os.Getenv("AZURE_CLIENT_CERTIFICATE_PATH"))
+	case "workload":
+		return &workloadIdentityCredential{tenantID: tenantID, clientID: clientID, tokenFile: os.Getenv("AZURE_FEDERATED_TOKEN_FILE")}, nil
+	case "managed":
+		return &managedIdentityCredential{clientID: clientID}, nil
+	}
+	return nil, fmt.Errorf("unknown credential type %q", kind)
+}
+
+// EntraToken returns a cached bearer token for Azure OpenAI.
+func EntraToken(ctx context.Context) (string, error) {
+	if entraCredential == nil {
+		return "", errors.New("entra ID authentication is not enabled")
+	}
+	tok, err := entraCredential.GetToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	return tok.Token, nil
+}
+
+// cachedCredential keeps the last token and refreshes it in the background
+// once it is within EntraRefreshWindow of expiring, so requests only block
+// on the identity endpoint when no valid token is available at all. Only one
+// refresh runs at a time; concurrent callers wait for it. Failed background
+// refreshes back off, so an identity endpoint outage is not hit by every
+// request while the token lasts.
+type cachedCredential struct {
+	source TokenCredential
+
+	mu       sync.Mutex
+	token    AccessToken
+	pending  *tokenRefresh
+	failures int       // background refreshes failed in a row
+	retryAt  time.Time // no background refresh before then
+}
+
+// tokenRefresh is a token request in flight.
+type tokenRefresh struct {
+	done  chan struct{}
+	token AccessToken
+	err   error
+}
+
+func newCachedCredential(source TokenCredential) *cachedCredential {
+	return &cachedCredential{source: source}
+}
+
+func (c *cachedCredential) GetToken(ctx context.Context) (AccessToken, error) {
+	c.mu.Lock()
+	tok := c.token
+	now := time.Now()
+	if tok.Token != "" && now.Before(tok.ExpiresOn) {
+		if now.Add(EntraRefreshWindow).After(tok.ExpiresOn) && !now.Before(c.retryAt) {
+			c.refresh()
+		}
+		c.mu.Unlock()
+		return tok, nil
+	}
+	r := c.refresh()
+	c.mu.Unlock()
+
+	select {
+	case <-r.done:
+		return r.token, r.err
+	case <-ctx.Done():
+		return AccessToken{}, ctx.Err()
+	}
+}
+
+// refresh starts a token request unless one is in flight, and returns it.
+// The request is not tied to any caller, so one giving up does not fail the
+// others; token requests time out on their own. c.mu must be held.
+func (c *cachedCredential) refresh() *tokenRefresh {
+	if c.pending != nil {
+		return c.pending
+	}
+	r := &tokenRefresh{done: make(chan struct{})}
+	c.pending = r
+	go func() {
+		tok, err := c.source.GetToken(context.Background())
+
+		c.mu.Lock()
+		c.pending = nil
+		if err == nil {
+			c.token = tok
+			c.failures, c.retryAt = 0, time.Time{}
+		} else {
+			c.failures++
+			backoff := min(EntraRefreshBackoff<<min(c.failures-1, 10), time.Minute)
+			c.retryAt = time.Now().Add(backoff)
+		}
+		c.mu.Unlock()
+		if err != nil {
+			slog.Error("Could not acquire Entra ID token", "error", err)
+		} else {
+			slog.Info("Acquired Entra ID token", "expires_at", tok.ExpiresOn.Format(time.RFC3339))
+		}
+		r.token, r.err = tok, err
+		close(r.done)
+	}()
+	return r
+}
+
+// clientSecretCredential uses the OAuth2 client-credentials grant with a secret.
+type clientSecretCredential struct {
+	tenantID, clientID, secret string
+}
+
+func (c *clientSecretCredential) GetToken(ctx context.Context) (AccessToken, error) {
+	return requestClientCredentialsToken(ctx, c.tenantID, url.Values{
+		"client_id":     {c.clientID},
+		"client_secret": {c.secret},
+	})
+}
+
+// clientCertificateCredential uses the client-credentials grant with a
+// client assertion signed by the application's certificate.
+type clientCertificateCredential struct {
+	tenantID, clientID string
+	key                *rsa.PrivateKey
+	thumbprint         string // base64url SHA-1 of the certificate, the JWT x5t header
+}
+
+func newClientCertificateCredential(tenantID, clientID, certPath string) (*clientCertificateCredential, error) {
+	data, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	c := &clientCertificateCredential{tenantID: tenantID, clientID: clientID}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		switch block.Type {
+		case "CERTIFICATE":
+			if c.thumbprint == "" {
+				sum := sha1.Sum(block.Bytes)
+				c.thumbprint = base64.RawURLEncoding.EncodeToString(sum[:])
+			}
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			rsaKey, ok := key.(*rsa.PrivateKey)
+			if !ok {
+				return nil, errors.New("client certificate key must be RSA")
+			}
+			c.key = rsaKey
+		case "RSA PRIVATE KEY":
+			if c.key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if c.key == nil || c.thumbprint == "" {
+		return nil, fmt.Errorf("%s must contain a PEM certificate and RSA private key", certPath)
+	}
+	return c, nil
+}
+
+func (c *clientCertificateCredential) GetToken(ctx context.Context) (AccessToken, error) {
+	assertion, err := c.assertion()
+	if err != nil {
+		return AccessToken{}, err
+	}
+	return requestClientCredentialsToken(ctx, c.tenantID, url.Values{
+		"client_id":             {c.clientID},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {assertion},
+	})
+}
+
+// assertion builds the RS256-signed JWT Entra ID expects as client_assertion.
+func (c *clientCertificateCredential) assertion() (string, error) {
+	jti := make([]byte, 16)
+	rand.Read(jti)
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "x5t": c.thumbprint})
+	claims, _ := json.Marshal(map[string]any{
+		"aud": tokenEndpoint(c.tenantID),
+		"iss": c.clientID,
+		"sub": c.clientID,
+		"jti": hex.EncodeToString(jti),
+		"nbf": now.Unix(),
+		"exp": now.Add(10 * time.Minute).Unix(),
+	})
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// workloadIdentityCredential exchanges a federated token (for example a
+// Kubernetes service account token) for an Entra ID token. The file is read
+// on every refresh because the platform rotates it.
+type workloadIdentityCredential struct {
+	tenantID, clientID, tokenFile string
+}
+
+func (c *workloadIdentityCredential) GetToken(ctx context.Context) (AccessToken, error) {
+	assertion, err := os.ReadFile(c.tokenFile)
+	if err != nil {
+		return AccessToken{}, err
+	}
+	return requestClientCredentialsToken(ctx, c.tenantID, url.Values{
+		"client_id":             {c.clientID},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {strings.TrimSpace(string(assertion))},
+	})
+}
+
+// managedIdentityCredential asks the instance metadata service for a token.
+// clientID selects a user-assigned identity; empty means system-assigned.
+type managedIdentityCredential struct {
+	clientID string
+}
+
+func (c *managedIdentityCredential) GetToken(ctx context.Context) (AccessToken, error) {
+	query := url.Values{
+		"api-version": {"2018-02-01"},
+		"resource":    {strings.TrimSuffix(EntraScope, "/.default")},
+	}
+	if c.clientID != "" {
+		query.Set("client_id", c.clientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, EntraIMDSEndpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return AccessToken{}, err
+	}
+	req.Header.Set("Metadata", "true")
+	return doTokenRequest(req)
+}
+
+func tokenEndpoint(tenantID string) string {
+	return fmt.Sprintf("%s/%s/oauth2/v2.0/token", EntraAuthorityHost, tenantID)
+}
+
+func requestClientCredentialsToken(ctx context.Context, tenantID string, form url.Values) (AccessToken, error) {
+	form.Set("grant_type", "client_credentials")
+	form.Set("scope", EntraScope)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenEndpoint(tenantID), strings.NewReader(form.Encode()))
+	if err != nil {
+		return AccessToken{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return doTokenRequest(req)
+}
+
+// doTokenRequest performs a token request and parses both the v2 endpoint
+// response (numeric expires_in) and the IMDS response (string fields).
+func doTokenRequest(req *http.Request) (AccessToken, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return AccessToken{}, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return AccessToken{}, fmt.Errorf("token request to %s failed with status %d: %s", req.URL.Host, resp.StatusCode, string(body))
+	}
+
+	var payload struct {
+		AccessToken string          `json:"access_token"`
+		ExpiresIn   json.RawMessage `json:"expires_in"`
+		ExpiresOn   json.RawMessage `json:"expires_on"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return AccessToken{}, err
+	}
+	if payload.AccessToken == "" {
+		return AccessToken{}, errors.New("token response did not contain an access_token")
+	}
+
+	tok := AccessToken{Token: payload.AccessToken, ExpiresOn: time.Now().Add(time.Hour)}
+	if secs, ok := jsonNumber(payload.ExpiresOn); ok && secs > 0 {
+		tok.ExpiresOn = time.Unix(secs, 0)
+	} else if secs, ok := jsonNumber(payload.ExpiresIn); ok && secs > 0 {
+		tok.ExpiresOn = time.Now().Add(time.Duration(secs) * time.Second)
+	}
+	return tok, nil
+}
+
+// jsonNumber reads a number that may be encoded as a JSON string.
+func jsonNumber(raw json.RawMessage) (int64, bool) {
+	s := strings.Trim(string(raw), `"`)
+	if s == "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
+}
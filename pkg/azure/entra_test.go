@@ -0,0 +1,356 @@
+package azure
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countingCredential struct {
+	calls   atomic.Int32
+	release chan struct{}
+	err     error
+}
+
+func (c *countingCredential) GetToken(ctx context.Context) (AccessToken, error) {
+	c.calls.Add(1)
+	<-c.release
+	if c.err != nil {
+		return AccessToken{}, c.err
+	}
+	return AccessToken{Token: "token", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+func TestCachedCredentialSharesRefresh(t *testing.T) {
+	for _, fail := range []bool{false, true} {
+		source := &countingCredential{release: make(chan struct{})}
+		if fail {
+			source.err = errors.New("identity endpoint unreachable")
+		}
+		cred := newCachedCredential(source)
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 10)
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				tok, err := cred.GetToken(context.Background())
+				if err == nil && tok.Token != "token" {
+					err = errors.New("wrong token " + tok.Token)
+				}
+				errs <- err
+			}()
+		}
+		// Let every caller reach the pending refresh before it completes
+		time.Sleep(50 * time.Millisecond)
+		close(source.release)
+		wg.Wait()
+		close(errs)
+
+		if n := source.calls.Load(); n != 1 {
+			t.Errorf("fail=%v: %d token requests, want 1", fail, n)
+		}
+		for err := range errs {
+			if (err != nil) != fail {
+				t.Errorf("fail=%v: GetToken() error = %v", fail, err)
+			}
+		}
+	}
+}
+
+func TestCachedCredentialCallerGivesUp(t *testing.T) {
+	source := &countingCredential{release: make(chan struct{})}
+	cred := newCachedCredential(source)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := cred.GetToken(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("GetToken() error = %v, want deadline exceeded", err)
+	}
+	// The refresh carries on for later callers
+	close(source.release)
+	if tok, err := cred.GetToken(context.Background()); err != nil || tok.Token != "token" {
+		t.Fatalf("GetToken() = %q, %v", tok.Token, err)
+	}
+	if n := source.calls.Load(); n != 1 {
+		t.Errorf("%d token requests, want 1", n)
+	}
+}
+
+// tokenServer stands in for the Entra ID token endpoint and IMDS. check
+// inspects each token request; the answer expires in an hour.
+func tokenServer(t *testing.T, check func(r *http.Request)) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		check(r)
+		if r.Header.Get("Metadata") == "true" {
+			// IMDS encodes numbers as strings and gives an absolute expiry
+			json.NewEncoder(w).Encode(map[string]string{
+				"access_token": "imds-token",
+				"expires_on":   strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10),
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"access_token": "entra-token", "expires_in": 3600})
+	}))
+	t.Cleanup(srv.Close)
+
+	savedAuthority, savedIMDS := EntraAuthorityHost, EntraIMDSEndpoint
+	EntraAuthorityHost, EntraIMDSEndpoint = srv.URL, srv.URL+"/metadata/identity/oauth2/token"
+	t.Cleanup(func() { EntraAuthorityHost, EntraIMDSEndpoint = savedAuthority, savedIMDS })
+}
+
+func checkToken(t *testing.T, tok AccessToken, err error, want string) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.Token != want {
+		t.Errorf("token = %q, want %q", tok.Token, want)
+	}
+	if d := time.Until(tok.ExpiresOn); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("token expires in %s, want an hour", d)
+	}
+}
+
+// checkClientCredentials checks the parts of a client-credentials token
+// request every app credential shares.
+func checkClientCredentials(t *testing.T, r *http.Request) {
+	t.Helper()
+	if r.Method != http.MethodPost || r.URL.Path != "/tenant-id/oauth2/v2.0/token" {
+		t.Errorf("%s %s", r.Method, r.URL.Path)
+	}
+	if r.PostForm.Get("grant_type") != "client_credentials" || r.PostForm.Get("client_id") != "client-id" || r.PostForm.Get("scope") != EntraScope {
+		t.Errorf("form = %v", r.PostForm)
+	}
+}
+
+func TestClientSecretCredential(t *testing.T) {
+	tokenServer(t, func(r *http.Request) {
+		checkClientCredentials(t, r)
+		if r.PostForm.Get("client_secret") != "s3cret" {
+			t.Errorf("client_secret = %q", r.PostForm.Get("client_secret"))
+		}
+	})
+	cred := &clientSecretCredential{tenantID: "tenant-id", clientID: "client-id", secret: "s3cret"}
+	tok, err := cred.GetToken(context.Background())
+	checkToken(t, tok, err, "entra-token")
+}
+
+func TestClientCertificateCredential(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "proxy"}, NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "cert.pem")
+	pemData := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})...)
+	if err := os.WriteFile(path, pemData, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tokenServer(t, func(r *http.Request) {
+		checkClientCredentials(t, r)
+		if r.PostForm.Get("client_assertion_type") != "urn:ietf:params:oauth:client-assertion-type:jwt-bearer" {
+			t.Errorf("client_assertion_type = %q", r.PostForm.Get("client_assertion_type"))
+		}
+		parts := strings.Split(r.PostForm.Get("client_assertion"), ".")
+		if len(parts) != 3 {
+			t.Fatalf("client_assertion is not a JWT: %q", r.PostForm.Get("client_assertion"))
+		}
+		var header struct{ Alg, X5t string }
+		var claims struct {
+			Aud, Iss, Sub string
+			Exp           int64
+		}
+		for i, v := range []any{&header, &claims} {
+			raw, _ := base64.RawURLEncoding.DecodeString(parts[i])
+			json.Unmarshal(raw, v)
+		}
+		thumbprint := sha1.Sum(der)
+		if header.Alg != "RS256" || header.X5t != base64.RawURLEncoding.EncodeToString(thumbprint[:]) {
+			t.Errorf("header = %+v", header)
+		}
+		if claims.Aud != tokenEndpoint("tenant-id") || claims.Iss != "client-id" || claims.Sub != "client-id" || claims.Exp <= time.Now().Unix() {
+			t.Errorf("claims = %+v", claims)
+		}
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+			t.Errorf("client_assertion signature: %v", err)
+		}
+	})
+	cred, err := newClientCertificateCredential("tenant-id", "client-id", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := cred.GetToken(context.Background())
+	checkToken(t, tok, err, "entra-token")
+}
+
+func TestWorkloadIdentityCredential(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	var want string
+	tokenServer(t, func(r *http.Request) {
+		checkClientCredentials(t, r)
+		if got := r.PostForm.Get("client_assertion"); got != want {
+			t.Errorf("client_assertion = %q, want %q", got, want)
+		}
+	})
+	cred := &workloadIdentityCredential{tenantID: "tenant-id", clientID: "client-id", tokenFile: path}
+
+	// The platform rotates the file, so each request reads it afresh
+	for _, federated := range []string{"federated-1", "federated-2"} {
+		if err := os.WriteFile(path, []byte(federated+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		want = federated
+		tok, err := cred.GetToken(context.Background())
+		checkToken(t, tok, err, "entra-token")
+	}
+}
+
+func TestManagedIdentityCredential(t *testing.T) {
+	for _, clientID := range []string{"", "user-assigned"} {
+		tokenServer(t, func(r *http.Request) {
+			q := r.URL.Query()
+			if r.Method != http.MethodGet || q.Get("resource") != "https://cognitiveservices.azure.com" || q.Get("client_id") != clientID {
+				t.Errorf("%s %s", r.Method, r.URL)
+			}
+		})
+		cred := &managedIdentityCredential{clientID: clientID}
+		tok, err := cred.GetToken(context.Background())
+		checkToken(t, tok, err, "imds-token")
+	}
+}
+
+// sequenceCredential hands out tokens from a list, then fails.
+type sequenceCredential struct {
+	mu     sync.Mutex
+	tokens []AccessToken
+	calls  int
+}
+
+func (c *sequenceCredential) GetToken(ctx context.Context) (AccessToken, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	if len(c.tokens) == 0 {
+		return AccessToken{}, errors.New("identity endpoint unavailable")
+	}
+	tok := c.tokens[0]
+	c.tokens = c.tokens[1:]
+	return tok, nil
+}
+
+func (c *sequenceCredential) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls
+}
+
+// waitForRefresh waits for cred's background refresh, if any, to finish.
+func waitForRefresh(cred *cachedCredential) {
+	cred.mu.Lock()
+	r := cred.pending
+	cred.mu.Unlock()
+	if r != nil {
+		<-r.done
+	}
+}
+
+func TestCachedCredentialRefreshesBeforeExpiry(t *testing.T) {
+	soon := AccessToken{Token: "old", ExpiresOn: time.Now().Add(EntraRefreshWindow / 2)}
+	later := AccessToken{Token: "new", ExpiresOn: time.Now().Add(time.Hour)}
+	source := &sequenceCredential{tokens: []AccessToken{soon, later}}
+	cred := newCachedCredential(source)
+
+	if tok, err := cred.GetToken(context.Background()); err != nil || tok.Token != "old" {
+		t.Fatalf("GetToken() = %q, %v", tok.Token, err)
+	}
+	// The token is close to expiry: it is still used, and renewed behind it
+	if tok, _ := cred.GetToken(context.Background()); tok.Token != "old" {
+		t.Errorf("GetToken() near expiry = %q, want the cached token", tok.Token)
+	}
+	waitForRefresh(cred)
+	if tok, _ := cred.GetToken(context.Background()); tok.Token != "new" {
+		t.Errorf("GetToken() after the refresh = %q, want the new token", tok.Token)
+	}
+	if n := source.count(); n != 2 {
+		t.Errorf("%d token requests, want 2", n)
+	}
+}
+
+func TestCachedCredentialExpiredTokenBlocks(t *testing.T) {
+	expired := AccessToken{Token: "expired", ExpiresOn: time.Now().Add(-time.Second)}
+	fresh := AccessToken{Token: "fresh", ExpiresOn: time.Now().Add(time.Hour)}
+	cred := newCachedCredential(&sequenceCredential{tokens: []AccessToken{expired, fresh}})
+
+	cred.GetToken(context.Background())
+	if tok, err := cred.GetToken(context.Background()); err != nil || tok.Token != "fresh" {
+		t.Errorf("GetToken() after expiry = %q, %v, want the fresh token", tok.Token, err)
+	}
+}
+
+func TestCachedCredentialBacksOff(t *testing.T) {
+	saved := EntraRefreshBackoff
+	EntraRefreshBackoff = 50 * time.Millisecond
+	t.Cleanup(func() { EntraRefreshBackoff = saved })
+
+	soon := AccessToken{Token: "old", ExpiresOn: time.Now().Add(EntraRefreshWindow / 2)}
+	source := &sequenceCredential{tokens: []AccessToken{soon}}
+	cred := newCachedCredential(source)
+	cred.GetToken(context.Background())
+
+	// Every refresh from here fails; the valid token keeps being served, and
+	// requests during the backoff do not try again
+	for range 20 {
+		if tok, err := cred.GetToken(context.Background()); err != nil || tok.Token != "old" {
+			t.Fatalf("GetToken() = %q, %v", tok.Token, err)
+		}
+		waitForRefresh(cred)
+	}
+	if n := source.count(); n != 2 {
+		t.Errorf("%d token requests during the backoff, want 2", n)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	cred.GetToken(context.Background())
+	waitForRefresh(cred)
+	if n := source.count(); n != 3 {
+		t.Errorf("%d token requests after the backoff, want 3", n)
+	}
+	// The next wait is twice as long
+	time.Sleep(60 * time.Millisecond)
+	cred.GetToken(context.Background())
+	waitForRefresh(cred)
+	if n := source.count(); n != 3 {
+		t.Errorf("%d token requests within the doubled backoff, want 3", n)
+	}
+}
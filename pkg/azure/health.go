@@ -0,0 +1,265 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Probe statuses.
+const (
+	ProbeOK            = "ok"             // the endpoint answered and accepted the proxy's credentials
+	ProbeNoCredentials = "no_credentials" // the endpoint answered; clients bring their own keys
+	ProbeUnauthorized  = "unauthorized"   // the proxy's credentials were rejected
+	ProbeError         = "error"          // the endpoint answered with a server error
+	ProbeUnreachable   = "unreachable"    // no answer at all
+	ProbeUnknown       = "unknown"        // not probed yet
+)
+
+var (
+	// ProbeInterval is how long a probe result is reused before the endpoint
+	// is probed again.
+	ProbeInterval = 30 * time.Second
+	// ProbeTimeout bounds a single probe.
+	ProbeTimeout = 5 * time.Second
+	// ServerlessInfoAPIVersion is sent with serverless /info probes.
+	ServerlessInfoAPIVersion = "2024-05-01-preview"
+
+	probeClient = &http.Client{}
+
+	serverlessProbesMu sync.Mutex
+	serverlessProbes   = make(map[string]*probeState)
+)
+
+func loadProbeConfig() {
+	if v := os.Getenv("AZURE_OPENAI_PROBE_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			ProbeInterval = d
+		}
+	}
+	if v := os.Getenv("AZURE_OPENAI_PROBE_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			ProbeTimeout = d
+		}
+	}
+}
+
+// Probe is the result of a lightweight request to a backend or serverless
+// deployment.
+type Probe struct {
+	Status      string    `json:"status"`
+	HTTPStatus  int       `json:"http_status,omitempty"`
+	LatencyMS   int64     `json:"latency_ms"`
+	CheckedAt   time.Time `json:"checked_at,omitzero"`
+	LastError   string    `json:"last_error,omitempty"` // kept after the endpoint recovers
+	LastErrorAt time.Time `json:"last_error_at,omitzero"`
+}
+
+// Healthy reports whether requests sent to the endpoint can succeed.
+func (p Probe) Healthy() bool {
+	return p.Status == ProbeOK || p.Status == ProbeNoCredentials
+}
+
+// probeState caches the last probe of one endpoint. Concurrent checks share
+// a single probe in flight.
+type probeState struct {
+	mu          sync.Mutex
+	last        Probe
+	lastError   string
+	lastErrorAt time.Time
+	inflight    chan struct{}
+}
+
+// check returns the cached probe result, running probe again once it is
+// older than ProbeInterval. It waits for a running probe until ctx is done.
+func (s *probeState) check(ctx context.Context, probe func(context.Context) Probe) Probe {
+	s.mu.Lock()
+	if !s.last.CheckedAt.IsZero() && time.Since(s.last.CheckedAt) < ProbeInterval {
+		defer s.mu.Unlock()
+		return s.result()
+	}
+	wait := s.inflight
+	if wait == nil {
+		wait = make(chan struct{})
+		s.inflight = wait
+		go func() {
+			// Not tied to ctx, so an impatient caller does not fail the probe for everyone
+			probeCtx, cancel := context.WithTimeout(context.Background(), ProbeTimeout)
+			p := probe(probeCtx)
+			cancel()
+			s.mu.Lock()
+			s.last = p
+			if !p.Healthy() {
+				s.lastError, s.lastErrorAt = fmt.Sprintf("%s: %s", p.Status, p.LastError), p.CheckedAt
+			}
+			s.inflight = nil
+			s.mu.Unlock()
+			close(wait)
+		}()
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-wait:
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.result()
+}
+
+func (s *probeState) result() Probe {
+	p := s.last
+	if p.Status == "" {
+		p.Status = ProbeUnknown
+	}
+	p.LastError, p.LastErrorAt = s.lastError, s.lastErrorAt
+	return p
+}
+
+// probeURL sends a GET to url and classifies the answer. withCredentials
+// tells whether the request carries credentials the proxy holds itself.
+func probeURL(ctx context.Context, url string, header http.Header, withCredentials bool) Probe {
+	start := time.Now()
+	p := Probe{CheckedAt: start.UTC()}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		p.Status, p.LastError = ProbeUnreachable, err.Error()
+		return p
+	}
+	req.Header = header
+	res, err := probeClient.Do(req)
+	p.LatencyMS = time.Since(start).Milliseconds()
+	if err != nil {
+		p.Status, p.LastError = ProbeUnreachable, err.Error()
+		return p
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	p.HTTPStatus = res.StatusCode
+	switch {
+	case res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden:
+		p.Status = ProbeNoCredentials
+		if withCredentials {
+			p.Status, p.LastError = ProbeUnauthorized, res.Status
+		}
+	case res.StatusCode >= 500:
+		p.Status, p.LastError = ProbeError, res.Status
+	default:
+		// Throttling and unknown paths still prove the endpoint is up
+		p.Status = ProbeOK
+	}
+	return p
+}
+
+// probeBackend lists the models of one of t's backends, with the same
+// credentials the proxy would add to a request.
+func probeBackend(ctx context.Context, t *Tenant, b *Backend) Probe {
+	url := fmt.Sprintf("%s/openai/models?api-version=%s", strings.TrimSuffix(b.Endpoint, "/"), t.ModelsAPIVersion)
+	header := make(http.Header)
+	switch {
+	case AuthMode == "entra":
+		token, err := EntraToken(ctx)
+		if err != nil {
+			return Probe{Status: ProbeUnauthorized, CheckedAt: time.Now().UTC(), LastError: "Entra ID token: " + err.Error()}
+		}
+		header.Set("Authorization", "Bearer "+token)
+	case b.Key != "":
+		header.Set("api-key", b.Key)
+	case t.APIKey != "":
+		header.Set("api-key", t.APIKey)
+	}
+	return probeURL(ctx, url, header, len(header) > 0)
+}
+
+// probeServerless asks a serverless deployment for its model information.
+func probeServerless(ctx context.Context, d ServerlessDeployment) Probe {
+	url := fmt.Sprintf("https://%s.%s.models.ai.azure.com/info?api-version=%s", d.Name, d.Region, ServerlessInfoAPIVersion)
+	header := make(http.Header)
+	if d.Key != "" {
+		header.Set("Authorization", "Bearer "+d.Key)
+	}
+	return probeURL(ctx, url, header, d.Key != "")
+}
+
+// BackendHealth describes one Azure OpenAI backend or serverless deployment.
+type BackendHealth struct {
+	Tenant   string `json:"tenant"`
+	Kind     string `json:"kind"` // "azure_openai" or "serverless"
+	Name     string `json:"name"` // backend name, or the model a serverless deployment serves
+	Endpoint string `json:"endpoint"`
+	// Available is false while the backend cools down after failed requests
+	Available bool    `json:"available"`
+	EWMATTFT  float64 `json:"ewma_ttft_ms,omitempty"`
+	Probe
+}
+
+// CheckBackends probes every backend and serverless deployment of every
+// tenant, reusing results younger than ProbeInterval.
+func CheckBackends(ctx context.Context) []BackendHealth {
+	type target struct {
+		health BackendHealth
+		state  *probeState
+		probe  func(context.Context) Probe
+	}
+	var targets []target
+	names := make([]string, 0, len(Tenants))
+	for name := range Tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		t := Tenants[name]
+		for _, b := range t.Backends {
+			ttft, _ := b.Stats()
+			targets = append(targets, target{
+				health: BackendHealth{Tenant: name, Kind: "azure_openai", Name: b.Name, Endpoint: b.Endpoint, Available: b.Available(), EWMATTFT: ttft},
+				state:  &b.probe,
+				probe:  func(ctx context.Context) Probe { return probeBackend(ctx, t, b) },
+			})
+		}
+		serverless := t.ServerlessDeployments()
+		models := make([]string, 0, len(serverless))
+		for model := range serverless {
+			models = append(models, model)
+		}
+		sort.Strings(models)
+		for _, model := range models {
+			d := serverless[model]
+			// Keyed by the deployment as well, so a changed deployment is probed afresh
+			key := strings.Join([]string{name, model, d.Name, d.Region, d.Key}, "\x00")
+			serverlessProbesMu.Lock()
+			state := serverlessProbes[key]
+			if state == nil {
+				state = &probeState{}
+				serverlessProbes[key] = state
+			}
+			serverlessProbesMu.Unlock()
+			targets = append(targets, target{
+				health: BackendHealth{Tenant: name, Kind: "serverless", Name: model, Endpoint: fmt.Sprintf("https://%s.%s.models.ai.azure.com", d.Name, d.Region), Available: true},
+				state:  state,
+				probe:  func(ctx context.Context) Probe { return probeServerless(ctx, d) },
+			})
+		}
+	}
+
+	results := make([]BackendHealth, len(targets))
+	var wg sync.WaitGroup
+	for i, tg := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = tg.health
+			results[i].Probe = tg.state.check(ctx, tg.probe)
+		}()
+	}
+	wg.Wait()
+	return results
+}
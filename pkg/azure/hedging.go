@@ -0,0 +1,198 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/logging"
+	"github.com/tidwall/gjson"
+)
+
+// hedgingTransport sends a duplicate of a slow non-streaming request to a
+// second backend once the primary has been outstanding for longer than its
+// p95 time-to-first-token. Whichever response arrives first is returned and
+// the other attempt is cancelled through its context.
+type hedgingTransport struct {
+	base http.RoundTripper
+}
+
+type hedgeAttempt struct {
+	backend *Backend
+	start   time.Time
+	cancel  context.CancelFunc
+}
+
+type hedgeResult struct {
+	idx int
+	res *http.Response
+	err error
+}
+
+func (t *hedgingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err, ok := req.Context().Value(credentialErrorKey{}).(error); ok {
+		return nil, err
+	}
+	info := GetRequestInfo(req.Context())
+	tenant, _ := TenantFrom(req.Context())
+	if !HedgingEnabled || len(tenant.Backends) < 2 || info == nil || info.Backend == nil ||
+		req.Body == nil || req.Method != http.MethodPost {
+		return t.send(req, info)
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	if gjson.GetBytes(body, "stream").Bool() {
+		return t.send(req, info)
+	}
+
+	primary := info.Backend
+	delay := primary.P95()
+	secondary := fastestBackend(tenant.Backends, primary)
+	if delay <= 0 || secondary == nil {
+		return t.send(req, info)
+	}
+
+	results := make(chan hedgeResult, 2)
+	var attempts []*hedgeAttempt
+	launch := func(r *http.Request, b *Backend) {
+		ctx, cancel := context.WithCancel(r.Context())
+		idx := len(attempts)
+		attempts = append(attempts, &hedgeAttempt{backend: b, start: time.Now(), cancel: cancel})
+		go func() {
+			res, err := t.base.RoundTrip(r.WithContext(ctx))
+			if err != nil && ctx.Err() == nil {
+				b.MarkDown(err.Error())
+			}
+			results <- hedgeResult{idx: idx, res: res, err: err}
+		}()
+	}
+	hedged := false
+	hedge := func() {
+		hedged = true
+		logger := logging.FromContext(req.Context())
+		r, err := retarget(req, secondary, body, info.clientAPIKey)
+		if err != nil {
+			logger.Warn("Hedging: could not build request", "backend", secondary.Name, "error", err)
+			return
+		}
+		logger.Info("Hedging: sending duplicate request", "backend", secondary.Name, "primary", primary.Name, "delay", delay.String())
+		launch(r, secondary)
+	}
+
+	launch(req, primary)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var last *hedgeResult
+	for done := 0; done < len(attempts); {
+		select {
+		case <-timer.C:
+			if !hedged {
+				hedge()
+			}
+		case r := <-results:
+			done++
+			if r.err == nil && r.res.StatusCode < http.StatusInternalServerError {
+				for i, a := range attempts {
+					if i != r.idx {
+						a.cancel()
+					}
+				}
+				go drainLosers(results, len(attempts)-done)
+				if last != nil && last.res != nil {
+					last.res.Body.Close()
+				}
+				winner := attempts[r.idx]
+				info.Backend, info.Start = winner.backend, winner.start
+				r.res.Body = &cancelOnClose{ReadCloser: r.res.Body, cancel: winner.cancel}
+				return r.res, nil
+			}
+			if last != nil {
+				if last.res != nil {
+					last.res.Body.Close()
+				}
+				attempts[last.idx].cancel()
+			}
+			last = &r
+			if !hedged {
+				// The primary failed before the hedge delay; fail over right away.
+				hedge()
+			}
+		}
+	}
+
+	loser := attempts[last.idx]
+	if last.err != nil {
+		loser.cancel()
+		return nil, last.err
+	}
+	info.Backend, info.Start = loser.backend, loser.start
+	last.res.Body = &cancelOnClose{ReadCloser: last.res.Body, cancel: loser.cancel}
+	return last.res, nil
+}
+
+// send performs a single attempt, taking the backend out of the pool when it
+// cannot be reached.
+func (t *hedgingTransport) send(req *http.Request, info *RequestInfo) (*http.Response, error) {
+	if info != nil {
+		info.Start = time.Now()
+	}
+	res, err := t.base.RoundTrip(req)
+	if err != nil && info != nil && info.Backend != nil && req.Context().Err() == nil {
+		info.Backend.MarkDown(err.Error())
+	}
+	return res, err
+}
+
+// retarget clones req for a different backend, replacing the host and the
+// api-key header with the backend's own key or the one the client sent.
+func retarget(req *http.Request, b *Backend, body []byte, clientKey string) (*http.Request, error) {
+	remote, err := url.Parse(b.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	clone := req.Clone(req.Context())
+	clone.URL.Scheme = remote.Scheme
+	clone.URL.Host = remote.Host
+	clone.Host = remote.Host
+	clone.Body = io.NopCloser(bytes.NewReader(body))
+	clone.ContentLength = int64(len(body))
+	switch {
+	case AuthMode == "entra":
+		// The bearer token is valid for every backend in the tenant
+	case b.Key != "":
+		clone.Header.Set("api-key", b.Key)
+	case clientKey != "":
+		clone.Header.Set("api-key", clientKey)
+	}
+	return clone, nil
+}
+
+// drainLosers closes responses of attempts that finished after a winner was chosen.
+func drainLosers(results <-chan hedgeResult, pending int) {
+	for ; pending > 0; pending-- {
+		if r := <-results; r.res != nil {
+			r.res.Body.Close()
+		}
+	}
+}
+
+// cancelOnClose releases the winning attempt's context once the body is consumed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
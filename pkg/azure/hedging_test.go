@@ -0,0 +1,99 @@
+package azure
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// trackedBody records whether the response body was closed.
+type trackedBody struct {
+	io.Reader
+	closed atomic.Bool
+}
+
+func (b *trackedBody) Close() error {
+	b.closed.Store(true)
+	return nil
+}
+
+// hostTransport answers each backend host with a fixed status after a delay.
+type hostTransport struct {
+	status map[string]int
+	delay  map[string]time.Duration
+	bodies map[string]*trackedBody
+}
+
+func (t *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	select {
+	case <-time.After(t.delay[req.URL.Host]):
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	body := &trackedBody{Reader: strings.NewReader(req.URL.Host)}
+	t.bodies[req.URL.Host] = body
+	return &http.Response{StatusCode: t.status[req.URL.Host], Body: body, Header: make(http.Header), Request: req}, nil
+}
+
+func TestHedgingClosesLosingBodies(t *testing.T) {
+	saved := HedgingEnabled
+	HedgingEnabled = true
+	t.Cleanup(func() { HedgingEnabled = saved })
+
+	tests := []struct {
+		name       string
+		status     map[string]int
+		want       string // host whose response is returned
+		wantClosed string // host whose response must be closed
+	}{
+		{
+			name:       "hedge wins after primary 5xx",
+			status:     map[string]int{"primary": 503, "secondary": 200},
+			want:       "secondary",
+			wantClosed: "primary",
+		},
+		{
+			name:       "both fail",
+			status:     map[string]int{"primary": 503, "secondary": 500},
+			want:       "secondary",
+			wantClosed: "primary",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := &Backend{Name: "primary", Endpoint: "https://primary"}
+			secondary := &Backend{Name: "secondary", Endpoint: "https://secondary"}
+			for range HedgeMinSamples {
+				primary.Observe(time.Millisecond)
+			}
+			tenant := &Tenant{Name: "test", Backends: []*Backend{primary, secondary}}
+			base := &hostTransport{
+				status: tt.status,
+				delay:  map[string]time.Duration{"primary": 0, "secondary": 10 * time.Millisecond},
+				bodies: make(map[string]*trackedBody),
+			}
+
+			req, _ := http.NewRequestWithContext(WithTenant(context.Background(), tenant), http.MethodPost,
+				"https://primary/openai/deployments/gpt-4o/chat/completions", strings.NewReader(`{"model":"gpt-4o"}`))
+			req = WithRequestInfo(req)
+			GetRequestInfo(req.Context()).Backend = primary
+
+			res, err := (&hedgingTransport{base: base}).RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			if string(got) != tt.want {
+				t.Errorf("response from %s, want %s", got, tt.want)
+			}
+			if !base.bodies[tt.wantClosed].closed.Load() {
+				t.Errorf("response body of %s was not closed", tt.wantClosed)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package azure
+
+import "strings"
+
+// Tokenizer encodings of the OpenAI model families.
+const (
+	EncodingO200k  = "o200k_base"
+	EncodingCl100k = "cl100k_base"
+)
+
+// ModelLimits are a model's token limits. Context is the whole window, prompt
+// and completion together; for embedding models it is the limit per input.
+// Output is the most tokens one response may generate, zero if only the
+// context window bounds it.
+type ModelLimits struct {
+	Context  int    `json:"context"`
+	Output   int    `json:"output,omitempty"`
+	Encoding string `json:"encoding"`
+}
+
+// AzureOpenAIModelLimits holds the limits of known models by alias. An alias
+// that is not listed takes the limits of its longest listed prefix ending at a
+// dash, so dated versions such as gpt-4o-2024-11-20 share their family's.
+// Models without limits, such as Claude, are not checked.
+var AzureOpenAIModelLimits = map[string]ModelLimits{
+	// GPT-5 series
+	"gpt-5":        {Context: 400000, Output: 128000, Encoding: EncodingO200k},
+	"gpt-5-chat":   {Context: 128000, Output: 16384, Encoding: EncodingO200k},
+	"gpt-5-pro":    {Context: 400000, Output: 272000, Encoding: EncodingO200k},
+	"gpt-5.1":      {Context: 400000, Output: 128000, Encoding: EncodingO200k},
+	"gpt-5.1-chat": {Context: 128000, Output: 16384, Encoding: EncodingO200k},
+	"gpt-5.2":      {Context: 400000, Output: 128000, Encoding: EncodingO200k},
+	"gpt-5.2-chat": {Context: 128000, Output: 16384, Encoding: EncodingO200k},
+	// GPT-4.1 and GPT-4o models
+	"gpt-4.1":      {Context: 1047576, Output: 32768, Encoding: EncodingO200k},
+	"gpt-4o":       {Context: 128000, Output: 16384, Encoding: EncodingO200k},
+	"gpt-4o-mini":  {Context: 128000, Output: 16384, Encoding: EncodingO200k},
+	"computer-use": {Context: 8192, Output: 1024, Encoding: EncodingO200k},
+	"codex-mini":   {Context: 200000, Output: 100000, Encoding: EncodingO200k},
+	// O-series reasoning models
+	"o1":         {Context: 200000, Output: 100000, Encoding: EncodingO200k},
+	"o1-preview": {Context: 128000, Output: 32768, Encoding: EncodingO200k},
+	"o1-mini":    {Context: 128000, Output: 65536, Encoding: EncodingO200k},
+	"o3":         {Context: 200000, Output: 100000, Encoding: EncodingO200k},
+	"o3-mini":    {Context: 200000, Output: 100000, Encoding: EncodingO200k},
+	"o4-mini":    {Context: 200000, Output: 100000, Encoding: EncodingO200k},
+	// GPT-4 and GPT-3.5 models
+	"gpt-4":                  {Context: 8192, Encoding: EncodingCl100k},
+	"gpt-4-32k":              {Context: 32768, Encoding: EncodingCl100k},
+	"gpt-4-turbo":            {Context: 128000, Output: 4096, Encoding: EncodingCl100k},
+	"gpt-4-1106-preview":     {Context: 128000, Output: 4096, Encoding: EncodingCl100k},
+	"gpt-4-0125-preview":     {Context: 128000, Output: 4096, Encoding: EncodingCl100k},
+	"gpt-4-vision-preview":   {Context: 128000, Output: 4096, Encoding: EncodingCl100k},
+	"gpt-3.5-turbo":          {Context: 16385, Output: 4096, Encoding: EncodingCl100k},
+	"gpt-3.5-turbo-0301":     {Context: 4096, Encoding: EncodingCl100k},
+	"gpt-3.5-turbo-0613":     {Context: 4096, Encoding: EncodingCl100k},
+	"gpt-3.5-turbo-16k":      {Context: 16385, Encoding: EncodingCl100k},
+	"gpt-3.5-turbo-instruct": {Context: 4096, Encoding: EncodingCl100k},
+	"gpt-35-turbo":           {Context: 16385, Output: 4096, Encoding: EncodingCl100k},
+	// Embedding models, per input
+	"text-embedding-3-small": {Context: 8191, Encoding: EncodingCl100k},
+	"text-embedding-3-large": {Context: 8191, Encoding: EncodingCl100k},
+	"text-embedding-ada-002": {Context: 8191, Encoding: EncodingCl100k},
+}
+
+// LookupModelLimits returns the limits of a model alias, or of its longest
+// listed prefix.
+func LookupModelLimits(alias string) (ModelLimits, bool) {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	alias = strings.ToLower(alias)
+	for name := alias; ; {
+		if l, ok := AzureOpenAIModelLimits[name]; ok {
+			return l, true
+		}
+		i := strings.LastIndexByte(name, '-')
+		if i <= 0 {
+			return ModelLimits{}, false
+		}
+		name = name[:i]
+	}
+}
+
+// SetModelLimits sets the limits of alias and the models it is a prefix of.
+func SetModelLimits(alias string, l ModelLimits) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	AzureOpenAIModelLimits[strings.ToLower(alias)] = l
+}
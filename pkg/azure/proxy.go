@@ -2,19 +2,28 @@ package azure
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"maps"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"path"
 	"regexp"
+	"slices"
 	"strings"
 	"time"
 
+	"github.com/gyarbij/azure-oai-proxy/pkg/audit"
+	"github.com/gyarbij/azure-oai-proxy/pkg/logging"
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+	"github.com/gyarbij/azure-oai-proxy/pkg/tracing"
+	"github.com/gyarbij/azure-oai-proxy/pkg/usage"
 	"github.com/tidwall/gjson"
 )
 
@@ -24,14 +33,15 @@ var (
 	AzureOpenAIResponsesAPIVersion = "2024-08-01-preview" // API version for Responses API - supports O-series models
 	AnthropicAPIVersion            = "2023-06-01"         // Anthropic API version for Claude models
 	AzureOpenAIEndpoint            = ""
+	AzureOpenAIAPIKey              = "" // key the proxy holds for itself, used with virtual keys
 	ServerlessDeploymentInfo       = make(map[string]ServerlessDeployment)
 	AzureOpenAIModelMapper         = make(map[string]string)
 )
 
 type ServerlessDeployment struct {
-	Name   string
-	Region string
-	Key    string
+	Name   string `json:"name"`
+	Region string `json:"region"`
+	Key    string `json:"key"`
 }
 
 func init() {
@@ -50,6 +60,7 @@ func init() {
 	if v := os.Getenv("AZURE_OPENAI_ENDPOINT"); v != "" {
 		AzureOpenAIEndpoint = v
 	}
+	AzureOpenAIAPIKey = os.Getenv("AZURE_OPENAI_API_KEY")
 
 	if v := os.Getenv("AZURE_AI_STUDIO_DEPLOYMENTS"); v != "" {
 		for _, pair := range strings.Split(v, ",") {
@@ -236,11 +247,17 @@ func init() {
 		"phi-4":        "phi-4",
 	}
 
-	log.Printf("Loaded ServerlessDeploymentInfo: %+v", ServerlessDeploymentInfo)
-	log.Printf("Azure OpenAI Endpoint: %s", AzureOpenAIEndpoint)
-	log.Printf("Azure OpenAI API Version: %s", AzureOpenAIAPIVersion)
-	log.Printf("Azure OpenAI Models API Version: %s", AzureOpenAIModelsAPIVersion)
-	log.Printf("Azure OpenAI Responses API Version: %s", AzureOpenAIResponsesAPIVersion)
+	loadEntraConfig()
+	loadBackendPool()
+	loadTrafficSplits()
+	loadTenants()
+
+	slog.Info("Loaded Azure OpenAI configuration",
+		"endpoint", AzureOpenAIEndpoint,
+		"api_version", AzureOpenAIAPIVersion,
+		"models_api_version", AzureOpenAIModelsAPIVersion,
+		"responses_api_version", AzureOpenAIResponsesAPIVersion,
+		"serverless_deployments", slices.Sorted(maps.Keys(ServerlessDeploymentInfo)))
 }
 
 // stripModelVersion removes date/version suffixes from model names
@@ -250,52 +267,159 @@ func stripModelVersion(model string) string {
 	re := regexp.MustCompile(`-\d{4}-\d{2}-\d{2}$|-\d{8}$`)
 	stripped := re.ReplaceAllString(model, "")
 	if stripped != model {
-		log.Printf("Stripped version suffix from model: %s -> %s", model, stripped)
+		slog.Debug("Stripped version suffix from model", "model", model, "stripped", stripped)
 	}
 	return stripped
 }
 
 // resolveModelDeployment resolves a model name to its deployment name
-// It handles versioned model names automatically and falls back to the model mapper
-func resolveModelDeployment(model string) string {
+// It applies traffic split rules first, then handles versioned model names
+// automatically and falls back to the tenant's model mapper
+func resolveModelDeployment(ctx context.Context, t *Tenant, model string, splitKey string) (deployment string, split bool) {
+	_, span := tracing.Start(ctx, "resolve_model", tracing.KindInternal)
+	span.SetAttr("gen_ai.request.model", model)
+	source := "as_is"
+	defer func() {
+		span.SetAttr("azure.openai.deployment", deployment)
+		span.SetAttr("proxy.model.resolution", source)
+		span.End()
+	}()
+	logger := logging.FromContext(ctx)
 	modelLower := strings.ToLower(model)
 
+	// Traffic split rules (canary rollouts) take precedence over the mapper.
+	// They name the default tenant's deployments.
+	if t == DefaultTenant {
+		if deployment, ok := applyTrafficSplit(modelLower, splitKey); ok {
+			logger.Debug("Model routed by traffic split", "model", model, "deployment", deployment)
+			source = "traffic_split"
+			return deployment, true
+		}
+	}
+
 	// First, try exact match in the mapper
-	if azureModel, ok := AzureOpenAIModelMapper[modelLower]; ok {
-		log.Printf("Model %s found in mapper as %s", model, azureModel)
-		return azureModel
+	if azureModel, ok := t.LookupModelMapping(modelLower); ok {
+		logger.Debug("Model found in mapper", "model", model, "deployment", azureModel)
+		source = "mapper"
+		return azureModel, false
 	}
 
 	// Try stripping version suffix and matching again
 	strippedModel := stripModelVersion(modelLower)
 	if strippedModel != modelLower {
-		if azureModel, ok := AzureOpenAIModelMapper[strippedModel]; ok {
-			log.Printf("Model %s matched stripped version %s in mapper as %s", model, strippedModel, azureModel)
-			return azureModel
+		if azureModel, ok := t.LookupModelMapping(strippedModel); ok {
+			logger.Debug("Model matched stripped version in mapper", "model", model, "stripped", strippedModel, "deployment", azureModel)
+			source = "mapper_stripped_version"
+			return azureModel, false
 		}
 	}
 
 	// If not found, use the original model name (works for custom deployments)
-	log.Printf("Model %s not found in mapper, using as-is for deployment", model)
-	return model
+	logger.Debug("Model not found in mapper, using it as the deployment name", "model", model)
+	return model, false
+}
+
+// ResolveDeployment returns the deployment a request for model will be sent
+// to, before the director runs: the name of a serverless deployment or the
+// resolved Azure OpenAI deployment. The decision is kept on the request's
+// RequestInfo, so the director uses the same deployment even when a traffic
+// split picks one at random.
+func ResolveDeployment(req *http.Request, model string) string {
+	tenant, _ := TenantFrom(req.Context())
+	if d, ok := tenant.LookupServerlessDeployment(strings.ToLower(model)); ok {
+		return d.Name
+	}
+	info := GetRequestInfo(req.Context())
+	if info != nil && info.Deployment != "" {
+		return info.Deployment
+	}
+	var splitKey string
+	if _, ok := TrafficSplits[strings.ToLower(model)]; ok && TrafficSplitSticky && tenant == DefaultTenant {
+		splitKey = trafficSplitKey(req)
+	}
+	deployment, split := resolveModelDeployment(req.Context(), tenant, model, splitKey)
+	if info != nil {
+		info.Deployment, info.split = deployment, split
+	}
+	return deployment
 }
 
 func NewOpenAIReverseProxy() *httputil.ReverseProxy {
 	return &httputil.ReverseProxy{
 		Director:       makeDirector(),
 		ModifyResponse: modifyResponse,
+		ErrorHandler:   errorHandler,
+		Transport:      &tracing.Transport{Base: &audit.Transport{Base: &hedgingTransport{base: http.DefaultTransport}}, Describe: describeUpstream},
 	}
 }
 
-func HandleToken(req *http.Request) {
+// ErrUpstreamAuth means the proxy could not get the credential it sends
+// upstream.
+var ErrUpstreamAuth = errors.New("could not authenticate to Azure OpenAI")
+
+// credentialErrorKey holds the error of a request HandleToken could not
+// authenticate.
+type credentialErrorKey struct{}
+
+// errorHandler answers requests that got no upstream response. Requests the
+// proxy could not authenticate get an OpenAI-style 502 that says so.
+func errorHandler(rw http.ResponseWriter, req *http.Request, err error) {
+	logger := logging.FromContext(req.Context())
+	if !errors.Is(err, ErrUpstreamAuth) {
+		logger.Error("Azure proxy error", "error", err)
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	logger.Error("Could not authenticate upstream request", "error", err)
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusBadGateway)
+	json.NewEncoder(rw).Encode(map[string]any{"error": map[string]any{
+		"message": "The proxy could not authenticate to Azure OpenAI.",
+		"type":    "proxy_error",
+		"param":   nil,
+		"code":    "upstream_auth_failed",
+	}})
+}
+
+// describeUpstream adds the GenAI attributes of an Azure request to its
+// upstream span.
+func describeUpstream(req *http.Request, span *tracing.Span) {
+	system := "az.ai.openai"
+	if strings.Contains(req.URL.Path, "/anthropic/") {
+		system = "anthropic"
+	}
+	span.SetAttr("gen_ai.system", system)
+	if info := GetRequestInfo(req.Context()); info != nil {
+		span.SetAttr("azure.openai.deployment", info.Deployment)
+		if info.Backend != nil {
+			span.SetAttr("proxy.backend", info.Backend.Name)
+		}
+	}
+}
+
+// HandleToken sets the credential req is sent upstream with. It fails when
+// the proxy cannot get an Entra ID token, as the request would be refused
+// without one.
+func HandleToken(req *http.Request) error {
+	logger := logging.FromContext(req.Context())
 	model := getModelFromRequest(req)
 	modelLower := strings.ToLower(model)
+	tenant, _ := TenantFrom(req.Context())
 	// Check if it's a serverless deployment
-	if info, ok := ServerlessDeploymentInfo[modelLower]; ok {
+	if info, ok := tenant.LookupServerlessDeployment(modelLower); ok {
 		// Set the correct authorization header for serverless
 		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", info.Key))
 		req.Header.Del("api-key")
-		log.Printf("Using serverless deployment authentication for %s", model)
+		logger.Debug("Using serverless deployment authentication", "model", model)
+	} else if AuthMode == "entra" {
+		// Entra ID: the proxy's own identity authenticates, whatever the client sent
+		token, err := EntraToken(req.Context())
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrUpstreamAuth, err)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		req.Header.Del("api-key")
+		logger.Debug("Using Entra ID authentication", "model", model)
 	} else {
 		// For regular Azure OpenAI deployments, use the api-key
 		apiKey := req.Header.Get("api-key")
@@ -306,57 +430,101 @@ func HandleToken(req *http.Request) {
 			}
 		}
 		if apiKey == "" {
-			log.Printf("Warning: No api-key or Authorization header found for deployment: %s", model)
+			logger.Warn("No api-key or Authorization header found", "model", model)
 		} else {
 			req.Header.Set("api-key", apiKey)
 			req.Header.Del("Authorization")
-			log.Printf("Using regular Azure OpenAI authentication for %s", model)
+			logger.Debug("Using Azure OpenAI api-key authentication", "model", model)
 		}
 	}
+	return nil
 }
 
 func makeDirector() func(*http.Request) {
 	return func(req *http.Request) {
+		logger := logging.FromContext(req.Context())
 		model := getModelFromRequest(req)
-		originURL := req.URL.String()
-		log.Printf("========== NEW REQUEST ==========")
-		log.Printf("Original request URL: %s", originURL)
-		log.Printf("Request method: %s", req.Method)
-		log.Printf("Request path: %s", req.URL.Path)
-		log.Printf("Model from request: %s", model)
+		originPath := req.URL.Path
+		tenant, _ := TenantFrom(req.Context())
+
+		// Capture the sticky routing key before the body is converted
+		if info := GetRequestInfo(req.Context()); info != nil && RoutingStrategy == "sticky" {
+			info.stickyKey = stickyKey(req)
+		}
+
+		// Capture the caller identity for deterministic traffic splits
+		var splitKey string
+		if _, ok := TrafficSplits[strings.ToLower(model)]; ok && TrafficSplitSticky && tenant == DefaultTenant {
+			splitKey = trafficSplitKey(req)
+		}
 
 		// Check if this is a Claude model - use Anthropic Messages API
 		if isClaudeModel(model) && strings.HasPrefix(req.URL.Path, "/v1/chat/completions") {
-			log.Printf("Model %s is a Claude model - converting to Anthropic Messages API format", model)
+			logger.Debug("Converting chat completion to the Anthropic Messages API", "model", model)
+			metrics.SetConversion(req.Context(), metrics.ConversionAnthropic)
+			span := startConversion(req.Context(), "convert_request", metrics.ConversionAnthropic)
 			convertChatToAnthropicMessages(req, model)
+			span.End()
 		}
 
 		// Check if this is a chat completion request for a model that should use Responses API
 		if strings.HasPrefix(req.URL.Path, "/v1/chat/completions") && shouldUseResponsesAPI(model) {
-			log.Printf("Model %s requires Responses API - converting from chat/completions", model)
+			logger.Debug("Converting chat completion to the Responses API", "model", model)
+			metrics.SetConversion(req.Context(), metrics.ConversionResponses)
 			// Convert the chat completion request to a responses request
+			span := startConversion(req.Context(), "convert_request", metrics.ConversionResponses)
 			convertChatToResponses(req)
+			span.End()
 		}
 
-		// Handle the token
-		HandleToken(req)
+		// Handle the token. Without one the transport fails the request
+		// instead of sending it.
+		if err := HandleToken(req); err != nil {
+			*req = *req.WithContext(context.WithValue(req.Context(), credentialErrorKey{}, err))
+		}
 
 		// Convert model to lowercase for case-insensitive matching
 		modelLower := strings.ToLower(model)
 
 		// Check if it's a serverless deployment
-		if info, ok := ServerlessDeploymentInfo[modelLower]; ok {
-			log.Printf("Model %s matched serverless deployment: %s in region %s", model, info.Name, info.Region)
+		var deployment string
+		if info, ok := tenant.LookupServerlessDeployment(modelLower); ok {
+			logger.Debug("Model matched serverless deployment", "model", model, "deployment", info.Name, "region", info.Region)
+			deployment = info.Name
+			metrics.SetConversion(req.Context(), metrics.ConversionServerless)
+			if reqInfo := GetRequestInfo(req.Context()); reqInfo != nil {
+				reqInfo.Deployment = info.Name
+			}
 			handleServerlessRequest(req, info, model)
 		} else {
-			// Resolve the model deployment (handles versioned names automatically)
-			deployment := resolveModelDeployment(model)
-			log.Printf("Using deployment name: %s for model: %s", deployment, model)
+			// Resolve the model deployment (handles versioned names automatically),
+			// unless ResolveDeployment already did for this request
+			var split bool
+			reqInfo := GetRequestInfo(req.Context())
+			if reqInfo != nil && reqInfo.Deployment != "" {
+				deployment, split = reqInfo.Deployment, reqInfo.split
+			} else {
+				deployment, split = resolveModelDeployment(req.Context(), tenant, model, splitKey)
+			}
+			if reqInfo != nil {
+				reqInfo.Deployment, reqInfo.split = deployment, split
+			}
+			// Splits are counted here, as requests go upstream, and not when
+			// a cache lookup resolves the deployment of a request it answers
+			if split {
+				recordSplit(modelLower, deployment)
+				logger.Info("Traffic split routed request", "model", model, "deployment", deployment)
+			}
 			handleRegularRequest(req, deployment)
 		}
 
-		log.Printf("Final proxied URL: %s", req.URL.String())
-		log.Printf("=================================")
+		logger.Info("Proxying request",
+			"method", req.Method,
+			"path", originPath,
+			"model", model,
+			"tenant", tenant.Name,
+			"deployment", deployment,
+			"upstream", req.URL.String())
 	}
 }
 
@@ -374,17 +542,27 @@ func handleServerlessRequest(req *http.Request, info ServerlessDeployment, model
 	// Set the correct authorization header for serverless
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", info.Key))
 	req.Header.Del("api-key")
-	log.Printf("Using serverless deployment for %s", model)
+	logging.FromContext(req.Context()).Debug("Routing to serverless deployment", "model", model, "host", req.URL.Host)
 }
 
 func handleRegularRequest(req *http.Request, deployment string) {
-	remote, _ := url.Parse(AzureOpenAIEndpoint)
+	tenant, _ := TenantFrom(req.Context())
+	backend := selectBackend(req)
+	remote, _ := url.Parse(backend.Endpoint)
 	req.URL.Scheme = remote.Scheme
 	req.URL.Host = remote.Host
 	req.Host = remote.Host
 
-	log.Printf("Setting up regular Azure OpenAI request for deployment: %s", deployment)
-	log.Printf("Azure endpoint: %s", AzureOpenAIEndpoint)
+	if info := GetRequestInfo(req.Context()); info != nil {
+		info.Backend = backend
+		info.clientAPIKey = req.Header.Get("api-key")
+	}
+	if backend.Key != "" && AuthMode != "entra" {
+		req.Header.Set("api-key", backend.Key)
+	}
+
+	logger := logging.FromContext(req.Context())
+	logger.Debug("Routing to Azure OpenAI backend", "deployment", deployment, "backend", backend.Name, "endpoint", backend.Endpoint)
 
 	// Handle Responses API endpoints
 	if strings.Contains(req.URL.Path, "/v1/responses") {
@@ -392,19 +570,17 @@ func handleRegularRequest(req *http.Request, deployment string) {
 		if strings.HasPrefix(req.URL.Path, "/v1/responses") && !strings.Contains(req.URL.Path, "/responses/") {
 			// POST /v1/responses - Create response
 			req.URL.Path = "/openai/v1/responses"
-			log.Printf("Responses API: Using path /openai/v1/responses")
 		} else {
 			// Other responses endpoints (GET, DELETE, etc.)
 			// Convert /v1/responses/{id} to /openai/v1/responses/{id}
 			req.URL.Path = strings.Replace(req.URL.Path, "/v1/", "/openai/v1/", 1)
-			log.Printf("Responses API: Converted path to %s", req.URL.Path)
 		}
 
 		// Use the preview API version for Responses API
 		query := req.URL.Query()
-		query.Set("api-version", AzureOpenAIResponsesAPIVersion)
+		query.Set("api-version", tenant.ResponsesAPIVersion)
 		req.URL.RawQuery = query.Encode()
-		log.Printf("Responses API: Using API version %s", AzureOpenAIResponsesAPIVersion)
+		logger.Debug("Using the Responses API", "path", req.URL.Path, "api_version", tenant.ResponsesAPIVersion)
 	} else {
 		// Existing logic for other endpoints
 		var endpointType string
@@ -413,7 +589,6 @@ func handleRegularRequest(req *http.Request, deployment string) {
 			// Claude models use Anthropic Messages API
 			req.URL.Path = "/anthropic/v1/messages"
 			endpointType = "anthropic/messages"
-			log.Printf("Claude model detected - using Anthropic Messages API endpoint: %s", req.URL.Path)
 		case strings.HasPrefix(req.URL.Path, "/v1/chat/completions"):
 			req.URL.Path = path.Join("/openai/deployments", deployment, "chat/completions")
 			endpointType = "chat/completions"
@@ -439,33 +614,35 @@ func handleRegularRequest(req *http.Request, deployment string) {
 			req.URL.Path = path.Join("/openai/deployments", deployment, strings.TrimPrefix(req.URL.Path, "/v1/"))
 			endpointType = "other"
 		}
-		log.Printf("Endpoint type: %s, Path set to: %s", endpointType, req.URL.Path)
+		logger.Debug("Mapped endpoint", "endpoint_type", endpointType, "path", req.URL.Path)
 
 		// Add api-version query parameter for non-Responses API (but not for Anthropic API)
 		if endpointType != "anthropic/messages" {
 			query := req.URL.Query()
-			query.Add("api-version", AzureOpenAIAPIVersion)
+			query.Add("api-version", tenant.APIVersion)
 			req.URL.RawQuery = query.Encode()
-			log.Printf("Using API version: %s", AzureOpenAIAPIVersion)
+			logger.Debug("Using API version", "api_version", tenant.APIVersion)
 		} else {
 			// For Anthropic Messages API, set the anthropic-version header
-			req.Header.Set("anthropic-version", AnthropicAPIVersion)
-			log.Printf("Anthropic Messages API: Set anthropic-version header to %s, skipping Azure api-version query parameter", AnthropicAPIVersion)
+			req.Header.Set("anthropic-version", tenant.AnthropicAPIVersion)
+			logger.Debug("Using anthropic-version header instead of api-version", "anthropic_version", tenant.AnthropicAPIVersion)
 		}
 	}
 
 	// Use the api-key from the original request for regular deployments
 	apiKey := req.Header.Get("api-key")
-	if apiKey == "" {
-		log.Printf("Warning: No api-key found in request headers for deployment: %s", deployment)
+	if AuthMode == "entra" {
+		logger.Debug("Entra ID bearer token set", "deployment", deployment)
+	} else if apiKey == "" {
+		logger.Warn("No api-key found in request headers", "deployment", deployment)
 	} else {
 		// For Anthropic Messages API, convert to Authorization Bearer header
 		if strings.Contains(req.URL.Path, "/anthropic/v1/messages") {
 			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
 			req.Header.Del("api-key")
-			log.Printf("Anthropic API: Using Authorization Bearer header for deployment: %s", deployment)
+			logger.Debug("Sending api-key as an Authorization bearer header for the Anthropic API", "deployment", deployment)
 		} else {
-			log.Printf("API key found for deployment: %s", deployment)
+			logger.Debug("API key found", "deployment", deployment)
 		}
 	}
 }
@@ -518,6 +695,24 @@ func sanitizeHeaders(headers http.Header) http.Header {
 }
 
 func modifyResponse(res *http.Response) error {
+	metrics.ObserveUpstream(res)
+	logging.ObserveUpstream(res)
+	logger := logging.FromContext(res.Request.Context())
+
+	// Record time-to-first-token for latency-aware routing and take backends
+	// that are throttling or failing out of the pool for a while
+	if info := GetRequestInfo(res.Request.Context()); info != nil && info.Backend != nil {
+		backend, start := info.Backend, info.Start
+		switch {
+		case res.StatusCode < 400:
+			res.Body = &firstByteReader{ReadCloser: res.Body, onFirstByte: func() {
+				backend.Observe(time.Since(start))
+			}}
+		case res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+			backend.MarkDown(fmt.Sprintf("status %d", res.StatusCode))
+		}
+	}
+
 	// Check if this is a streaming response that needs conversion
 	if res.Header.Get("Content-Type") == "text/event-stream" {
 		res.Header.Set("X-Accel-Buffering", "no")
@@ -538,26 +733,34 @@ func modifyResponse(res *http.Response) error {
 			// Determine which converter to use based on the endpoint
 			if strings.Contains(res.Request.URL.Path, "/anthropic/v1/messages") {
 				// Use Anthropic streaming converter
-				log.Printf("Using Anthropic streaming converter for model: %s", model)
+				logger.Debug("Using Anthropic streaming converter", "model", model)
 				go func() {
+					span := startConversion(res.Request.Context(), "convert_response", metrics.ConversionAnthropic)
+					defer span.End()
 					defer pw.Close()
 					defer res.Body.Close()
 
 					converter := NewAnthropicStreamingConverter(res.Body, pw, model)
+					converter.logger = logger
 					if err := converter.Convert(); err != nil {
-						log.Printf("Anthropic streaming conversion error: %v", err)
+						logger.Error("Anthropic streaming conversion failed", "error", err)
+						span.SetError(err.Error())
 					}
 				}()
 			} else {
 				// Use Responses API streaming converter
-				log.Printf("Using Responses API streaming converter for model: %s", model)
+				logger.Debug("Using Responses API streaming converter", "model", model)
 				go func() {
+					span := startConversion(res.Request.Context(), "convert_response", metrics.ConversionResponses)
+					defer span.End()
 					defer pw.Close()
 					defer res.Body.Close()
 
 					converter := NewStreamingResponseConverter(res.Body, pw, model)
+					converter.logger = logger
 					if err := converter.Convert(); err != nil {
-						log.Printf("Streaming conversion error: %v", err)
+						logger.Error("Responses API streaming conversion failed", "error", err)
+						span.SetError(err.Error())
 					}
 				}()
 			}
@@ -566,6 +769,7 @@ func modifyResponse(res *http.Response) error {
 			res.Body = pr
 		}
 
+		usage.Track(res)
 		return nil
 	}
 
@@ -573,7 +777,9 @@ func modifyResponse(res *http.Response) error {
 	if strings.Contains(res.Request.URL.Path, "/openai/v1/responses") && res.StatusCode == 200 {
 		// Check if the original request was for chat completions
 		if origPath := res.Request.Header.Get("X-Original-Path"); origPath == "/v1/chat/completions" {
+			span := startConversion(res.Request.Context(), "convert_response", metrics.ConversionResponses)
 			convertResponsesToChatCompletion(res)
+			span.End()
 		}
 	}
 
@@ -581,26 +787,34 @@ func modifyResponse(res *http.Response) error {
 	if strings.Contains(res.Request.URL.Path, "/anthropic/v1/messages") && res.StatusCode == 200 {
 		// Check if the original request was for chat completions
 		if origPath := res.Request.Header.Get("X-Original-Path"); origPath == "/v1/chat/completions" {
+			span := startConversion(res.Request.Context(), "convert_response", metrics.ConversionAnthropic)
 			convertAnthropicToChatCompletion(res)
+			span.End()
 		}
 	}
 
 	if res.StatusCode >= 400 {
 		body, _ := io.ReadAll(res.Body)
-		log.Printf("========== API ERROR ==========")
-		log.Printf("Azure API Error Response")
-		log.Printf("Status Code: %d", res.StatusCode)
-		log.Printf("Request URL: %s", res.Request.URL.String())
-		log.Printf("Request Method: %s", res.Request.Method)
-		log.Printf("Response Body: %s", string(body))
-		log.Printf("Response Headers: %v", res.Header)
-		log.Printf("===============================")
+		logger.Warn("Azure API error response",
+			"status", res.StatusCode,
+			"method", res.Request.Method,
+			"url", res.Request.URL.String(),
+			logging.Body("body", body))
+		logger.Debug("Azure API error response headers", "headers", sanitizeHeaders(res.Header))
 		res.Body = io.NopCloser(bytes.NewBuffer(body))
 	}
 
+	usage.Track(res)
 	return nil
 }
 
+// startConversion starts the span of a request or response format conversion.
+func startConversion(ctx context.Context, name, conversion string) *tracing.Span {
+	_, span := tracing.Start(ctx, name, tracing.KindInternal)
+	span.SetAttr("proxy.conversion", conversion)
+	return span
+}
+
 // Add a function to check if a model is Claude model
 func isClaudeModel(model string) bool {
 	modelLower := strings.ToLower(model)
@@ -617,6 +831,12 @@ func isClaudeModel(model string) bool {
 	return false
 }
 
+// ConvertsChatCompletions reports whether chat completions for model are
+// translated to the Anthropic Messages or Responses API.
+func ConvertsChatCompletions(model string) bool {
+	return isClaudeModel(model) || shouldUseResponsesAPI(model)
+}
+
 // Add a function to check if a model should use Responses API
 func shouldUseResponsesAPI(model string) bool {
 	modelLower := strings.ToLower(model)
@@ -648,8 +868,8 @@ func shouldUseResponsesAPI(model string) bool {
 func convertChatToResponses(req *http.Request) {
 	if req.Body != nil {
 		body, _ := io.ReadAll(req.Body)
-
-		log.Printf("Original chat completion request: %s", string(body))
+		logger := logging.FromContext(req.Context())
+		logger.Debug("Original chat completion request", logging.Body("body", body))
 
 		// Parse the chat completion request
 		model := gjson.GetBytes(body, "model").String()
@@ -701,7 +921,7 @@ func convertChatToResponses(req *http.Request) {
 		// Marshal the new body
 		newBodyBytes, _ := json.Marshal(newBody)
 
-		log.Printf("Converted to Responses API request: %s", string(newBodyBytes))
+		logger.Debug("Converted to Responses API request", logging.Body("body", newBodyBytes))
 
 		req.Body = io.NopCloser(bytes.NewBuffer(newBodyBytes))
 		req.ContentLength = int64(len(newBodyBytes))
@@ -717,8 +937,8 @@ func convertChatToResponses(req *http.Request) {
 func convertChatToAnthropicMessages(req *http.Request, model string) {
 	if req.Body != nil {
 		body, _ := io.ReadAll(req.Body)
-
-		log.Printf("Original chat completion request for Claude: %s", string(body))
+		logger := logging.FromContext(req.Context())
+		logger.Debug("Original chat completion request", "model", model, logging.Body("body", body))
 
 		// Parse the chat completion request
 		messages := gjson.GetBytes(body, "messages").Array()
@@ -735,7 +955,7 @@ func convertChatToAnthropicMessages(req *http.Request, model string) {
 
 		if input != "" {
 			// This is a Responses API format - convert to Anthropic Messages format
-			log.Printf("Detected Responses API format with input field, converting to Anthropic Messages format")
+			logger.Debug("Converting Responses API input to the Anthropic Messages format")
 			anthropicMessages = append(anthropicMessages, map[string]interface{}{
 				"role":    "user",
 				"content": input,
@@ -787,7 +1007,7 @@ func convertChatToAnthropicMessages(req *http.Request, model string) {
 		// Marshal the new body
 		newBodyBytes, _ := json.Marshal(newBody)
 
-		log.Printf("Converted to Anthropic Messages API request: %s", string(newBodyBytes))
+		logger.Debug("Converted to Anthropic Messages API request", logging.Body("body", newBodyBytes))
 
 		req.Body = io.NopCloser(bytes.NewBuffer(newBodyBytes))
 		req.ContentLength = int64(len(newBodyBytes))
@@ -798,25 +1018,26 @@ func convertChatToAnthropicMessages(req *http.Request, model string) {
 		req.Header.Set("X-Model", model) // Store model for response conversion
 
 		// Set Anthropic-specific headers
-		req.Header.Set("anthropic-version", AnthropicAPIVersion)
-		log.Printf("Set anthropic-version header: %s", AnthropicAPIVersion)
+		tenant, _ := TenantFrom(req.Context())
+		req.Header.Set("anthropic-version", tenant.AnthropicAPIVersion)
 	}
 }
 
 // convert Responses API response to chat completion format
 func convertResponsesToChatCompletion(res *http.Response) {
+	logger := logging.FromContext(res.Request.Context())
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
-		log.Printf("Error reading response body: %v", err)
+		logger.Error("Could not read Responses API response", "error", err)
 		return
 	}
 
 	// Log the raw response for debugging
-	log.Printf("Raw Responses API response: %s", string(body))
+	logger.Debug("Raw Responses API response", logging.Body("body", body))
 
 	var responseData map[string]interface{}
 	if err := json.Unmarshal(body, &responseData); err != nil {
-		log.Printf("Error unmarshaling response: %v", err)
+		logger.Error("Could not parse Responses API response", "error", err)
 		res.Body = io.NopCloser(bytes.NewBuffer(body))
 		return
 	}
@@ -898,6 +1119,13 @@ func convertResponsesToChatCompletion(res *http.Response) {
 			if totalTokens, ok := usageMap["total_tokens"].(float64); ok {
 				usage["total_tokens"] = int(totalTokens)
 			}
+			// Keep the cached and reasoning token breakdowns
+			if details, ok := usageMap["input_tokens_details"]; ok {
+				usage["prompt_tokens_details"] = details
+			}
+			if details, ok := usageMap["output_tokens_details"]; ok {
+				usage["completion_tokens_details"] = details
+			}
 		}
 	}
 
@@ -937,25 +1165,26 @@ func convertResponsesToChatCompletion(res *http.Response) {
 
 // convert Anthropic Messages API response to chat completion format
 func convertAnthropicToChatCompletion(res *http.Response) {
+	logger := logging.FromContext(res.Request.Context())
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
-		log.Printf("Error reading Anthropic response body: %v", err)
+		logger.Error("Could not read Anthropic Messages API response", "error", err)
 		return
 	}
 
 	// Log the raw response for debugging
-	log.Printf("Raw Anthropic Messages API response: %s", string(body))
+	logger.Debug("Raw Anthropic Messages API response", logging.Body("body", body))
 
 	var anthropicResponse map[string]interface{}
 	if err := json.Unmarshal(body, &anthropicResponse); err != nil {
-		log.Printf("Error unmarshaling Anthropic response: %v", err)
+		logger.Error("Could not parse Anthropic Messages API response", "error", err)
 		res.Body = io.NopCloser(bytes.NewBuffer(body))
 		return
 	}
 
 	// Check if there's an error
 	if errorData, ok := anthropicResponse["error"]; ok && errorData != nil {
-		log.Printf("Error in Anthropic response, passing through: %v", errorData)
+		logger.Warn("Anthropic Messages API returned an error, passing it through", logging.Body("body", body))
 		res.Body = io.NopCloser(bytes.NewBuffer(body))
 		return
 	}
@@ -1036,7 +1265,7 @@ func convertAnthropicToChatCompletion(res *http.Response) {
 
 	// Marshal and set as new body
 	newBody, _ := json.Marshal(chatResponse)
-	log.Printf("Converted Anthropic response to OpenAI format: %s", string(newBody))
+	logger.Debug("Converted Anthropic response to chat completion", logging.Body("body", newBody))
 
 	res.Body = io.NopCloser(bytes.NewBuffer(newBody))
 	res.ContentLength = int64(len(newBody))
@@ -0,0 +1,40 @@
+package azure
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+type requestInfoKey struct{}
+
+// RequestInfo carries per-request routing state from the director through the
+// transport to modifyResponse. It travels on the request context, which
+// httputil.ReverseProxy copies onto the outgoing request.
+type RequestInfo struct {
+	// Start is when the upstream attempt the response came from was sent,
+	// after any time spent in the proxy's own queues and checks.
+	Start      time.Time
+	Backend    *Backend
+	Deployment string // resolved Azure deployment, after mapping and traffic splits
+
+	clientAPIKey string // the caller's api-key, kept for hedged requests to keyless backends
+	stickyKey    string // routing key taken from the client's body before conversion
+	split        bool   // Deployment was picked by a traffic split
+}
+
+// WithRequestInfo attaches a fresh RequestInfo to the request context, unless
+// it already carries one.
+func WithRequestInfo(req *http.Request) *http.Request {
+	if GetRequestInfo(req.Context()) != nil {
+		return req
+	}
+	info := &RequestInfo{}
+	return req.WithContext(context.WithValue(req.Context(), requestInfoKey{}, info))
+}
+
+// GetRequestInfo returns the RequestInfo attached to ctx, or nil.
+func GetRequestInfo(ctx context.Context) *RequestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*RequestInfo)
+	return info
+}
@@ -0,0 +1,93 @@
+package azure
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// BufferedResponseWriter collects a response in memory. It is used when the
+// proxy calls itself, for example to replay a request against a shadow model.
+type BufferedResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+// NewBufferedResponseWriter creates an empty BufferedResponseWriter.
+func NewBufferedResponseWriter() *BufferedResponseWriter {
+	return &BufferedResponseWriter{header: make(http.Header)}
+}
+
+func (w *BufferedResponseWriter) Header() http.Header { return w.header }
+
+func (w *BufferedResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *BufferedResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+func (w *BufferedResponseWriter) Flush() {}
+
+// StatusCode returns the status written, defaulting to 200.
+func (w *BufferedResponseWriter) StatusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// Body returns everything written so far.
+func (w *BufferedResponseWriter) Body() []byte { return w.body.Bytes() }
+
+// TeeResponseWriter passes a response through to the client while keeping a
+// copy of the body.
+type TeeResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+// NewTeeResponseWriter wraps w.
+func NewTeeResponseWriter(w http.ResponseWriter) *TeeResponseWriter {
+	return &TeeResponseWriter{ResponseWriter: w}
+}
+
+func (w *TeeResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *TeeResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *TeeResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *TeeResponseWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// StatusCode returns the status written, defaulting to 200.
+func (w *TeeResponseWriter) StatusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// Body returns the copy of everything written so far.
+func (w *TeeResponseWriter) Body() []byte { return w.body.Bytes() }
@@ -0,0 +1,248 @@
+package azure
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/audit"
+	"github.com/gyarbij/azure-oai-proxy/pkg/budget"
+	"github.com/gyarbij/azure-oai-proxy/pkg/logging"
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+	"github.com/gyarbij/azure-oai-proxy/pkg/usage"
+	"github.com/tidwall/gjson"
+)
+
+var (
+	// ShadowModels maps a lowercase model alias to the candidate model its
+	// traffic is mirrored to.
+	ShadowModels  = make(map[string]string)
+	ShadowRate    = 0.0 // fraction of eligible requests that are mirrored
+	ShadowLogPath = ""  // comparison log; mirroring is off without one
+	ShadowTimeout = 5 * time.Minute
+
+	shadowLogMu sync.Mutex
+)
+
+func init() {
+	// Format: alias=shadow-model,alias2=shadow-model2
+	if v := os.Getenv("AZURE_OPENAI_SHADOW_MODELS"); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			alias, shadow, ok := strings.Cut(pair, "=")
+			if ok && alias != "" && shadow != "" {
+				ShadowModels[strings.ToLower(alias)] = shadow
+			}
+		}
+	}
+	if v := os.Getenv("AZURE_OPENAI_SHADOW_RATE"); v != "" {
+		if rate, err := strconv.ParseFloat(v, 64); err == nil && rate >= 0 && rate <= 1 {
+			ShadowRate = rate
+		}
+	}
+	if v := os.Getenv("AZURE_OPENAI_SHADOW_LOG"); v != "" {
+		ShadowLogPath = v
+	}
+	if len(ShadowModels) > 0 && ShadowLogPath == "" {
+		slog.Warn("AZURE_OPENAI_SHADOW_LOG is not set, shadow mirroring is disabled")
+		ShadowModels = make(map[string]string)
+	}
+	if len(ShadowModels) > 0 {
+		slog.Info("Shadow mirroring enabled", "models", ShadowModels, "rate", ShadowRate, "log", ShadowLogPath)
+	}
+}
+
+// ShadowMirror replays one client request against a shadow model. The shadow
+// call runs in the background and never touches the client's response.
+type ShadowMirror struct {
+	alias       string
+	shadowModel string
+	path        string
+	result      chan shadowResult
+}
+
+type shadowResult struct {
+	Status    int            `json:"status"`
+	LatencyMs int64          `json:"latency_ms"`
+	Usage     map[string]any `json:"usage,omitempty"`
+	CostUSD   float64        `json:"cost_usd,omitempty"` // shadow calls only
+	Output    string         `json:"output"`
+	Error     string         `json:"error,omitempty"`
+}
+
+type shadowRecord struct {
+	Time        time.Time    `json:"time"`
+	Path        string       `json:"path"`
+	Model       string       `json:"model"`
+	ShadowModel string       `json:"shadow_model"`
+	Primary     shadowResult `json:"primary"`
+	Shadow      shadowResult `json:"shadow"`
+}
+
+// StartShadow decides whether req is mirrored and, if so, starts the shadow
+// call. It returns nil when the request is not sampled.
+func StartShadow(req *http.Request) *ShadowMirror {
+	if len(ShadowModels) == 0 || ShadowRate <= 0 || req.Method != http.MethodPost || req.Body == nil {
+		return nil
+	}
+	// Shadow models are deployments of the default tenant
+	if tenant, _ := TenantFrom(req.Context()); tenant != DefaultTenant {
+		return nil
+	}
+	if req.URL.Path != "/v1/chat/completions" && req.URL.Path != "/v1/responses" {
+		return nil
+	}
+
+	body, _ := io.ReadAll(req.Body)
+	req.Body = io.NopCloser(bytes.NewBuffer(body))
+
+	alias := gjson.GetBytes(body, "model").String()
+	shadowModel, ok := ShadowModels[strings.ToLower(alias)]
+	if !ok || rand.Float64() >= ShadowRate {
+		return nil
+	}
+	if decision := budget.Check([]string{budget.ShadowScope}, ""); decision.Exhausted != nil {
+		logging.FromContext(req.Context()).Debug("Skipped shadow call, shadow budget exhausted", "model", alias, "window", decision.Window)
+		return nil
+	}
+
+	// The shadow response is never streamed so that usage is always reported
+	var payload map[string]any
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil
+	}
+	payload["model"] = shadowModel
+	delete(payload, "stream")
+	delete(payload, "stream_options")
+	shadowBody, _ := json.Marshal(payload)
+
+	// The shadow call outlives the client's request but keeps its tenant,
+	// request ID and trace. It has its own routing state, usage, metrics and
+	// audit record, so it never counts as the client's request. Its usage is
+	// charged to the shadow budget scope instead.
+	ctx := context.WithoutCancel(req.Context())
+	ctx = context.WithValue(ctx, requestInfoKey{}, &RequestInfo{})
+	ctx, rec := usage.WithRecorder(metrics.WithoutRequest(audit.WithoutCapture(ctx)))
+	ctx, cancel := context.WithTimeout(ctx, ShadowTimeout)
+	shadowReq, err := http.NewRequestWithContext(ctx, http.MethodPost, req.URL.String(), bytes.NewReader(shadowBody))
+	if err != nil {
+		cancel()
+		return nil
+	}
+	shadowReq.Header = req.Header.Clone()
+	shadowReq.Header.Del("Content-Length")
+	shadowReq.ContentLength = int64(len(shadowBody))
+
+	m := &ShadowMirror{alias: alias, shadowModel: shadowModel, path: req.URL.Path, result: make(chan shadowResult, 1)}
+	go func() {
+		defer cancel()
+		start := time.Now()
+		w := NewBufferedResponseWriter()
+		NewOpenAIReverseProxy().ServeHTTP(w, shadowReq)
+		result := summarizeResponse(w.StatusCode(), w.Body(), time.Since(start))
+		if ctx.Err() != nil {
+			result.Error = ctx.Err().Error()
+		}
+		if u, ok := rec.Usage(); ok {
+			result.CostUSD = budget.Cost(shadowModel, u)
+			budget.Charge([]string{budget.ShadowScope}, result.CostUSD)
+		}
+		m.result <- result
+	}()
+	logging.FromContext(req.Context()).Debug("Mirroring request to shadow model", "path", m.path, "model", alias, "shadow_model", shadowModel)
+	return m
+}
+
+// Finish records the client-facing response and, once the shadow call has
+// completed, appends both to the comparison log.
+func (m *ShadowMirror) Finish(status int, body []byte, latency time.Duration) {
+	primary := summarizeResponse(status, body, latency)
+	go func() {
+		record := shadowRecord{
+			Time:        time.Now().UTC(),
+			Path:        m.path,
+			Model:       m.alias,
+			ShadowModel: m.shadowModel,
+			Primary:     primary,
+			Shadow:      <-m.result,
+		}
+		line, err := json.Marshal(record)
+		if err != nil {
+			slog.Error("Could not marshal shadow record", "error", err)
+			return
+		}
+
+		shadowLogMu.Lock()
+		defer shadowLogMu.Unlock()
+		f, err := os.OpenFile(ShadowLogPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			slog.Error("Could not open shadow log", "path", ShadowLogPath, "error", err)
+			return
+		}
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			slog.Error("Could not write shadow log", "path", ShadowLogPath, "error", err)
+		}
+		if err := f.Close(); err != nil {
+			slog.Error("Could not write shadow log", "path", ShadowLogPath, "error", err)
+		}
+	}()
+}
+
+// summarizeResponse extracts the output text and usage from a chat
+// completion or Responses API body, either JSON or an SSE stream.
+func summarizeResponse(status int, body []byte, latency time.Duration) shadowResult {
+	result := shadowResult{Status: status, LatencyMs: latency.Milliseconds()}
+	trimmed := bytes.TrimSpace(body)
+	if !bytes.HasPrefix(trimmed, []byte("data:")) && !bytes.HasPrefix(trimmed, []byte("event:")) {
+		parsed := gjson.ParseBytes(trimmed)
+		result.Output = parsed.Get("choices.0.message.content").String()
+		if result.Output == "" {
+			result.Output = parsed.Get("output_text").String()
+		}
+		if result.Output == "" {
+			result.Output = parsed.Get(`output.#(type=="message").content.#(type=="output_text").text`).String()
+		}
+		if usage, ok := parsed.Get("usage").Value().(map[string]any); ok {
+			result.Usage = usage
+		}
+		if status >= 400 {
+			result.Error = parsed.Get("error.message").String()
+		}
+		return result
+	}
+
+	var output strings.Builder
+	scanner := bufio.NewScanner(bytes.NewReader(trimmed))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			continue
+		}
+		event := gjson.Parse(data)
+		output.WriteString(event.Get("choices.0.delta.content").String())
+		if event.Get("type").String() == "response.output_text.delta" {
+			output.WriteString(event.Get("delta").String())
+		}
+		if usage, ok := event.Get("usage").Value().(map[string]any); ok {
+			result.Usage = usage
+		} else if usage, ok := event.Get("response.usage").Value().(map[string]any); ok {
+			result.Usage = usage
+		}
+	}
+	result.Output = output.String()
+	return result
+}
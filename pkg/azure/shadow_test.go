@@ -0,0 +1,109 @@
+package azure
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/budget"
+)
+
+// useShadow mirrors every gpt-4o request to shadow-mini on an upstream that
+// answers with usage.
+func useShadow(t *testing.T) string {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices":[{"message":{"content":"shadow answer"}}],"usage":{"prompt_tokens":1000000,"completion_tokens":500000,"total_tokens":1500000}}`))
+	}))
+	t.Cleanup(upstream.Close)
+
+	log := filepath.Join(t.TempDir(), "shadow.jsonl")
+	savedModels, savedRate, savedLog, savedBackends := ShadowModels, ShadowRate, ShadowLogPath, DefaultTenant.Backends
+	ShadowModels, ShadowRate, ShadowLogPath = map[string]string{"gpt-4o": "shadow-mini"}, 1, log
+	DefaultTenant.Backends = []*Backend{{Name: "test", Endpoint: upstream.URL, Key: "test-key"}}
+	if err := budget.SetPrice("shadow-mini", budget.Price{Input: 1, Output: 4}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ShadowModels, ShadowRate, ShadowLogPath, DefaultTenant.Backends = savedModels, savedRate, savedLog, savedBackends
+		budget.DeletePrice("shadow-mini")
+		budget.DeleteBudget(budget.ShadowScope)
+	})
+	return log
+}
+
+func shadowRequest() *http.Request {
+	body := `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"stream":true}`
+	req, _ := http.NewRequestWithContext(WithTenant(context.Background(), DefaultTenant), http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("api-key", "test-key")
+	return req
+}
+
+func readShadowLog(t *testing.T, path string) []shadowRecord {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if f, err := os.Open(path); err == nil {
+			var records []shadowRecord
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				var r shadowRecord
+				if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+					t.Fatal(err)
+				}
+				records = append(records, r)
+			}
+			f.Close()
+			return records
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("shadow log was not written")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShadowUsageChargedToShadowScope(t *testing.T) {
+	log := useShadow(t)
+	_, before := budget.Spend(budget.ShadowScope)
+
+	m := StartShadow(shadowRequest())
+	if m == nil {
+		t.Fatal("request was not mirrored")
+	}
+	m.Finish(http.StatusOK, []byte(`{"choices":[{"message":{"content":"primary answer"}}]}`), time.Millisecond)
+
+	records := readShadowLog(t, log)
+	if len(records) != 1 {
+		t.Fatalf("shadow log has %d records, want 1", len(records))
+	}
+	// 1M input tokens at $1 and 0.5M output tokens at $4 per million
+	shadow := records[0].Shadow
+	if shadow.Output != "shadow answer" || shadow.CostUSD != 3 {
+		t.Errorf("shadow result = %+v, want its answer at $3", shadow)
+	}
+	if _, after := budget.Spend(budget.ShadowScope); math.Abs(after-before-3) > 1e-9 {
+		t.Errorf("shadow scope charged %v, want 3", after-before)
+	}
+}
+
+func TestShadowStopsWhenBudgetExhausted(t *testing.T) {
+	useShadow(t)
+	if err := budget.SetBudget(budget.Budget{Scope: budget.ShadowScope, Daily: 0.01}); err != nil {
+		t.Fatal(err)
+	}
+	budget.Charge([]string{budget.ShadowScope}, 0.01)
+
+	if m := StartShadow(shadowRequest()); m != nil {
+		t.Error("request was mirrored with the shadow budget spent")
+	}
+}
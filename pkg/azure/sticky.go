@@ -0,0 +1,159 @@
+package azure
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/gjson"
+)
+
+var (
+	// StickyKeySources lists, in order of preference, the request attributes
+	// used to pin a conversation to a backend: "user" (the body's user field),
+	// "session" (the x-session-id header), "system" (a hash of the system
+	// prompt or Responses instructions) or "header:<Name>".
+	StickyKeySources   = []string{"user", "session", "system"}
+	stickyVirtualNodes = 160
+)
+
+// hashRing is a consistent-hash ring over the backend pool. Each backend owns
+// stickyVirtualNodes points so that keys spread evenly and, when a backend is
+// unavailable, only the keys it owned move to its neighbours.
+type hashRing struct {
+	mu     sync.RWMutex
+	points []uint64
+	owners map[uint64]*Backend
+}
+
+var ring = &hashRing{}
+
+func loadStickyConfig() {
+	if v := os.Getenv("AZURE_OPENAI_STICKY_KEY"); v != "" {
+		StickyKeySources = nil
+		for _, source := range strings.Split(v, ",") {
+			if source = strings.TrimSpace(source); source != "" {
+				StickyKeySources = append(StickyKeySources, source)
+			}
+		}
+	}
+	if v := os.Getenv("AZURE_OPENAI_STICKY_VIRTUAL_NODES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			stickyVirtualNodes = n
+		}
+	}
+	ring.rebuild(BackendPool)
+}
+
+// rebuild recomputes the ring for the given pool.
+func (r *hashRing) rebuild(pool []*Backend) {
+	owners := make(map[uint64]*Backend, len(pool)*stickyVirtualNodes)
+	points := make([]uint64, 0, len(pool)*stickyVirtualNodes)
+	for _, b := range pool {
+		for i := 0; i < stickyVirtualNodes; i++ {
+			p := hashKey(b.Name + "#" + strconv.Itoa(i))
+			owners[p] = b
+			points = append(points, p)
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i] < points[j] })
+
+	r.mu.Lock()
+	r.points, r.owners = points, owners
+	r.mu.Unlock()
+}
+
+// lookup returns the first available backend clockwise from key's position.
+func (r *hashRing) lookup(key string) *Backend {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.points) == 0 {
+		return nil
+	}
+	h := hashKey(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	for i := 0; i < len(r.points); i++ {
+		b := r.owners[r.points[(start+i)%len(r.points)]]
+		if b.Available() {
+			return b
+		}
+	}
+	return nil
+}
+
+// hashKey places s on the ring. FNV-1a alone clusters short, similar strings
+// such as the virtual node names, so its result is mixed with the murmur3
+// finalizer to spread them evenly.
+func hashKey(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// stickyKeyHash identifies a sticky key in logs without revealing the user,
+// session or header value it was taken from.
+func stickyKeyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// stickyKey extracts the routing key from the request using StickyKeySources.
+// It returns an empty string when none of the sources are present.
+func stickyKey(req *http.Request) string {
+	var body []byte
+	if req.Body != nil {
+		body, _ = io.ReadAll(req.Body)
+		req.Body = io.NopCloser(bytes.NewBuffer(body))
+	}
+
+	for _, source := range StickyKeySources {
+		switch {
+		case source == "user":
+			if user := gjson.GetBytes(body, "user").String(); user != "" {
+				return "user:" + user
+			}
+		case source == "session":
+			if session := req.Header.Get("X-Session-Id"); session != "" {
+				return "session:" + session
+			}
+		case source == "system":
+			if system := systemPrompt(body); system != "" {
+				sum := sha256.Sum256([]byte(system))
+				return "system:" + hex.EncodeToString(sum[:])
+			}
+		case strings.HasPrefix(source, "header:"):
+			name := strings.TrimPrefix(source, "header:")
+			if v := req.Header.Get(name); v != "" {
+				return name + ":" + v
+			}
+		}
+	}
+	return ""
+}
+
+// systemPrompt returns the system prompt of a chat, Anthropic or Responses body.
+func systemPrompt(body []byte) string {
+	for _, msg := range gjson.GetBytes(body, "messages").Array() {
+		if role := msg.Get("role").String(); role == "system" || role == "developer" {
+			return msg.Get("content").String()
+		}
+	}
+	if system := gjson.GetBytes(body, "system").String(); system != "" {
+		return system
+	}
+	return gjson.GetBytes(body, "instructions").String()
+}
@@ -0,0 +1,137 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func newPool(names ...string) []*Backend {
+	pool := make([]*Backend, len(names))
+	for i, name := range names {
+		pool[i] = &Backend{Name: name}
+	}
+	return pool
+}
+
+// owners looks up n keys on r, returning the backend name of each.
+func owners(r *hashRing, n int) []string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = r.lookup(fmt.Sprintf("user:%d", i)).Name
+	}
+	return names
+}
+
+func TestHashRingIsStable(t *testing.T) {
+	r := &hashRing{}
+	r.rebuild(newPool("eastus", "westus", "swedencentral", "japaneast"))
+	first := owners(r, 10000)
+	if again := owners(r, 10000); strings.Join(again, ",") != strings.Join(first, ",") {
+		t.Fatal("the same keys landed on other backends")
+	}
+
+	// Another replica, or a restart, with the same pool routes the same way
+	other := &hashRing{}
+	other.rebuild(newPool("japaneast", "swedencentral", "westus", "eastus"))
+	if got := owners(other, 10000); strings.Join(got, ",") != strings.Join(first, ",") {
+		t.Error("a ring built from the same pool in another order routes differently")
+	}
+
+	counts := map[string]int{}
+	for _, name := range first {
+		counts[name]++
+	}
+	for name, n := range counts {
+		if n < 1500 || n > 3500 {
+			t.Errorf("%s owns %d of 10000 keys, want about 2500", name, n)
+		}
+	}
+}
+
+func TestHashRingMovesOnlyKeysOfRemovedBackend(t *testing.T) {
+	const keys = 10000
+	names := []string{"eastus", "westus", "swedencentral", "japaneast"}
+
+	tests := []struct {
+		name   string
+		remove func(r *hashRing, pool []*Backend)
+	}{
+		{"backend leaves the pool", func(r *hashRing, pool []*Backend) { r.rebuild(pool[1:]) }},
+		{"backend marked down", func(r *hashRing, pool []*Backend) { pool[0].MarkDown("test") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := newPool(names...)
+			r := &hashRing{}
+			r.rebuild(pool)
+			before := owners(r, keys)
+			tt.remove(r, pool)
+			after := owners(r, keys)
+
+			moved := 0
+			for i := range before {
+				switch {
+				case before[i] == after[i]:
+				case before[i] != "eastus":
+					t.Fatalf("key %d moved from %s to %s, but %s is still there", i, before[i], after[i], before[i])
+				default:
+					moved++
+				}
+				if after[i] == "eastus" {
+					t.Fatalf("key %d still routed to the removed backend", i)
+				}
+			}
+			// Only the removed backend's share, about 1/N, moves
+			if share := float64(moved) / keys; share < 0.5/float64(len(names)) || share > 1.5/float64(len(names)) {
+				t.Errorf("%d of %d keys moved, want about %d", moved, keys, keys/len(names))
+			}
+		})
+	}
+}
+
+func TestHashRingWithoutBackends(t *testing.T) {
+	r := &hashRing{}
+	r.rebuild(nil)
+	if b := r.lookup("user:alice"); b != nil {
+		t.Errorf("lookup() = %s on an empty ring", b.Name)
+	}
+	pool := newPool("eastus")
+	r.rebuild(pool)
+	pool[0].MarkDown("test")
+	if b := r.lookup("user:alice"); b != nil {
+		t.Errorf("lookup() = %s with every backend down", b.Name)
+	}
+}
+
+func TestSelectBackendLogsKeyHash(t *testing.T) {
+	savedStrategy, savedLogger := RoutingStrategy, slog.Default()
+	RoutingStrategy = "sticky"
+	var logs bytes.Buffer
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() {
+		RoutingStrategy = savedStrategy
+		slog.SetDefault(savedLogger)
+		ring.rebuild(BackendPool)
+	})
+	ring.rebuild([]*Backend{{Name: "eastus"}, {Name: "westus"}})
+
+	key := "user:alice@example.com"
+	req, _ := http.NewRequestWithContext(WithTenant(context.Background(), DefaultTenant), http.MethodPost, "/v1/chat/completions", nil)
+	req = WithRequestInfo(req)
+	GetRequestInfo(req.Context()).stickyKey = key
+
+	if b := selectBackend(req); b == nil {
+		t.Fatal("selectBackend() = nil")
+	}
+	if strings.Contains(logs.String(), "alice") {
+		t.Errorf("log reveals the sticky key: %s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "key_hash="+stickyKeyHash(key)) {
+		t.Errorf("log lacks the key hash: %s", logs.String())
+	}
+}
@@ -5,9 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"strings"
 	"time"
+
+	"github.com/tidwall/gjson"
 )
 
 // StreamingResponseConverter handles the conversion of Responses API SSE to Chat Completions SSE
@@ -15,6 +17,7 @@ type StreamingResponseConverter struct {
 	reader io.Reader
 	writer io.Writer
 	model  string
+	logger *slog.Logger
 }
 
 // NewStreamingResponseConverter creates a new streaming converter
@@ -23,6 +26,7 @@ func NewStreamingResponseConverter(reader io.Reader, writer io.Writer, model str
 		reader: reader,
 		writer: writer,
 		model:  model,
+		logger: slog.Default(),
 	}
 }
 
@@ -67,7 +71,7 @@ func (c *StreamingResponseConverter) Convert() error {
 func (c *StreamingResponseConverter) handleTextDelta(data string) {
 	var deltaEvent map[string]interface{}
 	if err := json.Unmarshal([]byte(data), &deltaEvent); err != nil {
-		log.Printf("Error parsing delta event: %v", err)
+		c.logger.Warn("Could not parse Responses API delta event", "error", err)
 		return
 	}
 
@@ -111,6 +115,10 @@ func (c *StreamingResponseConverter) handleCompleted(data string) {
 			},
 		},
 	}
+	// Carry the token usage over so clients and the proxy can account for it
+	if usage := gjson.Get(data, "response.usage"); usage.Exists() {
+		chunk["usage"] = chatUsage(usage.Get("input_tokens").Int(), usage.Get("output_tokens").Int())
+	}
 
 	c.writeChunk(chunk)
 
@@ -124,7 +132,7 @@ func (c *StreamingResponseConverter) handleCompleted(data string) {
 func (c *StreamingResponseConverter) writeChunk(chunk map[string]interface{}) {
 	chunkJSON, err := json.Marshal(chunk)
 	if err != nil {
-		log.Printf("Error marshaling chunk: %v", err)
+		c.logger.Error("Could not marshal chat completion chunk", "error", err)
 		return
 	}
 
@@ -142,11 +150,22 @@ type flushWriter interface {
 	Flush()
 }
 
+// chatUsage builds a Chat Completions usage object.
+func chatUsage(promptTokens, completionTokens int64) map[string]interface{} {
+	return map[string]interface{}{
+		"prompt_tokens":     promptTokens,
+		"completion_tokens": completionTokens,
+		"total_tokens":      promptTokens + completionTokens,
+	}
+}
+
 // AnthropicStreamingConverter handles the conversion of Anthropic Messages API SSE to OpenAI Chat Completions SSE
 type AnthropicStreamingConverter struct {
-	reader io.Reader
-	writer io.Writer
-	model  string
+	reader       io.Reader
+	writer       io.Writer
+	model        string
+	promptTokens int64 // from message_start, reported with the final chunk
+	logger       *slog.Logger
 }
 
 // NewAnthropicStreamingConverter creates a new Anthropic streaming converter
@@ -155,6 +174,7 @@ func NewAnthropicStreamingConverter(reader io.Reader, writer io.Writer, model st
 		reader: reader,
 		writer: writer,
 		model:  model,
+		logger: slog.Default(),
 	}
 }
 
@@ -197,7 +217,7 @@ func (c *AnthropicStreamingConverter) Convert() error {
 				// These events don't need conversion
 				continue
 			default:
-				log.Printf("Unhandled Anthropic event type: %s", eventType)
+				c.logger.Debug("Unhandled Anthropic event type", "event", eventType)
 			}
 		}
 
@@ -209,7 +229,7 @@ func (c *AnthropicStreamingConverter) Convert() error {
 	}
 
 	if err := scanner.Err(); err != nil {
-		log.Printf("Scanner error: %v", err)
+		c.logger.Error("Could not read Anthropic stream", "error", err)
 		return err
 	}
 
@@ -219,7 +239,7 @@ func (c *AnthropicStreamingConverter) Convert() error {
 func (c *AnthropicStreamingConverter) handleMessageStart(data string, messageID *string) {
 	var event map[string]interface{}
 	if err := json.Unmarshal([]byte(data), &event); err != nil {
-		log.Printf("Error parsing message_start event: %v", err)
+		c.logger.Warn("Could not parse Anthropic message_start event", "error", err)
 		return
 	}
 
@@ -229,6 +249,7 @@ func (c *AnthropicStreamingConverter) handleMessageStart(data string, messageID
 			*messageID = id
 		}
 	}
+	c.promptTokens = gjson.Get(data, "message.usage.input_tokens").Int()
 
 	// Send initial chunk with role
 	chunk := map[string]interface{}{
@@ -253,7 +274,7 @@ func (c *AnthropicStreamingConverter) handleMessageStart(data string, messageID
 func (c *AnthropicStreamingConverter) handleContentDelta(data string, messageID string) {
 	var event map[string]interface{}
 	if err := json.Unmarshal([]byte(data), &event); err != nil {
-		log.Printf("Error parsing content_block_delta event: %v", err)
+		c.logger.Warn("Could not parse Anthropic content_block_delta event", "error", err)
 		return
 	}
 
@@ -292,7 +313,7 @@ func (c *AnthropicStreamingConverter) handleContentDelta(data string, messageID
 func (c *AnthropicStreamingConverter) handleMessageDelta(data string, messageID string) {
 	var event map[string]interface{}
 	if err := json.Unmarshal([]byte(data), &event); err != nil {
-		log.Printf("Error parsing message_delta event: %v", err)
+		c.logger.Warn("Could not parse Anthropic message_delta event", "error", err)
 		return
 	}
 
@@ -329,6 +350,9 @@ func (c *AnthropicStreamingConverter) handleMessageDelta(data string, messageID
 			},
 		},
 	}
+	if usage := gjson.Get(data, "usage"); usage.Exists() {
+		chunk["usage"] = chatUsage(c.promptTokens, usage.Get("output_tokens").Int())
+	}
 
 	c.writeChunk(chunk)
 }
@@ -344,7 +368,7 @@ func (c *AnthropicStreamingConverter) handleMessageStop(messageID string) {
 func (c *AnthropicStreamingConverter) writeChunk(chunk map[string]interface{}) {
 	chunkJSON, err := json.Marshal(chunk)
 	if err != nil {
-		log.Printf("Error marshaling chunk: %v", err)
+		c.logger.Error("Could not marshal chat completion chunk", "error", err)
 		return
 	}
 
@@ -0,0 +1,259 @@
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// DefaultTenantName names the tenant configured by the AZURE_OPENAI_*
+// variables, which serves every request no other tenant claims.
+const DefaultTenantName = "default"
+
+var (
+	// TenantsFile is a JSON file describing additional tenants.
+	TenantsFile = ""
+	// Tenants holds every tenant by name, including the default one.
+	Tenants = make(map[string]*Tenant)
+	// DefaultTenant shares its mapper, serverless deployments and backend pool
+	// with the package-level configuration, so the admin API changes it.
+	DefaultTenant *Tenant
+)
+
+// Tenant is a business unit with its own Azure OpenAI resources, model
+// mapper and API versions.
+type Tenant struct {
+	Name       string
+	Hosts      []string // host names that select the tenant
+	PathPrefix string   // path prefix that selects the tenant, stripped before routing
+	Backends   []*Backend
+	APIKey     string // key the proxy holds for the tenant's resources, used with virtual keys
+
+	APIVersion          string
+	ModelsAPIVersion    string
+	ResponsesAPIVersion string
+	AnthropicAPIVersion string
+
+	modelMapper map[string]string
+	serverless  map[string]ServerlessDeployment
+}
+
+// Endpoint returns the tenant's primary endpoint.
+func (t *Tenant) Endpoint() string {
+	return t.Backends[0].Endpoint
+}
+
+// LookupModelMapping returns the deployment an alias is mapped to for t.
+func (t *Tenant) LookupModelMapping(alias string) (string, bool) {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	deployment, ok := t.modelMapper[strings.ToLower(alias)]
+	return deployment, ok
+}
+
+// LookupServerlessDeployment returns t's serverless deployment for a model.
+func (t *Tenant) LookupServerlessDeployment(model string) (ServerlessDeployment, bool) {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	info, ok := t.serverless[strings.ToLower(model)]
+	return info, ok
+}
+
+// ServerlessDeployments returns a copy of t's serverless deployments.
+func (t *Tenant) ServerlessDeployments() map[string]ServerlessDeployment {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	deployments := make(map[string]ServerlessDeployment, len(t.serverless))
+	for model, info := range t.serverless {
+		deployments[model] = info
+	}
+	return deployments
+}
+
+// ModelMappingCount returns how many aliases t maps.
+func (t *Tenant) ModelMappingCount() int {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return len(t.modelMapper)
+}
+
+// tenantConfig is one entry of TenantsFile.
+type tenantConfig struct {
+	Hosts      []string `json:"hosts"`
+	PathPrefix string   `json:"path_prefix"`
+	Endpoint   string   `json:"endpoint"`
+	Backends   []struct {
+		Name     string `json:"name"`
+		Endpoint string `json:"endpoint"`
+		Key      string `json:"key"`
+	} `json:"backends"`
+	APIKey      string `json:"api_key"`
+	APIVersions struct {
+		Default   string `json:"default"`
+		Models    string `json:"models"`
+		Responses string `json:"responses"`
+		Anthropic string `json:"anthropic"`
+	} `json:"api_versions"`
+	ModelMapper           map[string]string               `json:"model_mapper"`
+	ServerlessDeployments map[string]ServerlessDeployment `json:"serverless_deployments"`
+}
+
+// loadTenants builds the default tenant from the package configuration and
+// reads the others from TenantsFile. It runs last in the package init, while
+// AzureOpenAIModelMapper still holds only the built-in mappings that new
+// tenants start from.
+func loadTenants() {
+	DefaultTenant = &Tenant{
+		Name:                DefaultTenantName,
+		Backends:            BackendPool,
+		APIKey:              AzureOpenAIAPIKey,
+		APIVersion:          AzureOpenAIAPIVersion,
+		ModelsAPIVersion:    AzureOpenAIModelsAPIVersion,
+		ResponsesAPIVersion: AzureOpenAIResponsesAPIVersion,
+		AnthropicAPIVersion: AnthropicAPIVersion,
+		modelMapper:         AzureOpenAIModelMapper,
+		serverless:          ServerlessDeploymentInfo,
+	}
+	Tenants[DefaultTenantName] = DefaultTenant
+
+	TenantsFile = os.Getenv("AZURE_OPENAI_TENANTS_FILE")
+	if TenantsFile == "" {
+		return
+	}
+	raw, err := os.ReadFile(TenantsFile)
+	if err != nil {
+		slog.Error("Could not read tenants file", "path", TenantsFile, "error", err)
+		os.Exit(1)
+	}
+	var configs map[string]tenantConfig
+	if err := json.Unmarshal(raw, &configs); err != nil {
+		slog.Error("Could not parse tenants file", "path", TenantsFile, "error", err)
+		os.Exit(1)
+	}
+	for name, cfg := range configs {
+		t, err := newTenant(name, cfg)
+		if err != nil {
+			slog.Error("Invalid tenants file", "path", TenantsFile, "error", err)
+			os.Exit(1)
+		}
+		Tenants[name] = t
+	}
+
+	names := make([]string, 0, len(Tenants))
+	for name := range Tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	slog.Info("Loaded tenants", "tenants", names)
+}
+
+func newTenant(name string, cfg tenantConfig) (*Tenant, error) {
+	if name == DefaultTenantName {
+		return nil, fmt.Errorf("tenant %q is reserved for the AZURE_OPENAI_* configuration", name)
+	}
+	t := &Tenant{
+		Name:                name,
+		PathPrefix:          strings.TrimSuffix(cfg.PathPrefix, "/"),
+		APIKey:              cfg.APIKey,
+		APIVersion:          firstNonEmpty(cfg.APIVersions.Default, AzureOpenAIAPIVersion),
+		ModelsAPIVersion:    firstNonEmpty(cfg.APIVersions.Models, AzureOpenAIModelsAPIVersion),
+		ResponsesAPIVersion: firstNonEmpty(cfg.APIVersions.Responses, AzureOpenAIResponsesAPIVersion),
+		AnthropicAPIVersion: firstNonEmpty(cfg.APIVersions.Anthropic, AnthropicAPIVersion),
+		modelMapper:         make(map[string]string, len(AzureOpenAIModelMapper)+len(cfg.ModelMapper)),
+		serverless:          make(map[string]ServerlessDeployment, len(cfg.ServerlessDeployments)),
+	}
+	if t.PathPrefix != "" && !strings.HasPrefix(t.PathPrefix, "/") {
+		return nil, fmt.Errorf("tenant %s: path_prefix must start with /", name)
+	}
+	for _, host := range cfg.Hosts {
+		t.Hosts = append(t.Hosts, strings.ToLower(host))
+	}
+
+	// Secrets can be kept out of the file
+	envName := strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+	if v := os.Getenv("AZURE_OPENAI_TENANT_KEY_" + envName); v != "" {
+		t.APIKey = v
+	}
+
+	if cfg.Endpoint != "" {
+		t.Backends = append(t.Backends, &Backend{Name: name, Endpoint: cfg.Endpoint})
+	}
+	for _, b := range cfg.Backends {
+		if b.Name == "" || b.Endpoint == "" {
+			return nil, fmt.Errorf("tenant %s: backends need a name and an endpoint", name)
+		}
+		t.Backends = append(t.Backends, &Backend{Name: name + "/" + b.Name, Endpoint: b.Endpoint, Key: b.Key})
+	}
+	if len(t.Backends) == 0 {
+		return nil, fmt.Errorf("tenant %s: an endpoint or backends are required", name)
+	}
+
+	for alias, deployment := range AzureOpenAIModelMapper {
+		t.modelMapper[alias] = deployment
+	}
+	for alias, deployment := range cfg.ModelMapper {
+		t.modelMapper[strings.ToLower(alias)] = deployment
+	}
+	for model, info := range cfg.ServerlessDeployments {
+		if info.Key == "" {
+			info.Key = os.Getenv("AZURE_OPENAI_TENANT_KEY_" + envName + "_" + strings.ToUpper(model))
+		}
+		t.serverless[strings.ToLower(model)] = info
+	}
+	return t, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// MatchTenant returns the tenant a request addresses by path prefix or host
+// name, and the path with the prefix removed.
+func MatchTenant(req *http.Request) (*Tenant, string, bool) {
+	host := strings.ToLower(req.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	var byHost *Tenant
+	for _, t := range Tenants {
+		if p := t.PathPrefix; p != "" && (req.URL.Path == p || strings.HasPrefix(req.URL.Path, p+"/")) {
+			return t, strings.TrimPrefix(req.URL.Path, p), true
+		}
+		for _, h := range t.Hosts {
+			if h == host {
+				byHost = t
+			}
+		}
+	}
+	if byHost != nil {
+		return byHost, req.URL.Path, true
+	}
+	return DefaultTenant, req.URL.Path, false
+}
+
+type tenantKey struct{}
+
+// WithTenant returns a copy of ctx carrying t.
+func WithTenant(ctx context.Context, t *Tenant) context.Context {
+	return context.WithValue(ctx, tenantKey{}, t)
+}
+
+// TenantFrom returns the tenant attached to ctx. When none is, it returns the
+// default tenant and false.
+func TenantFrom(ctx context.Context) (*Tenant, bool) {
+	if t, ok := ctx.Value(tenantKey{}).(*Tenant); ok {
+		return t, true
+	}
+	return DefaultTenant, false
+}
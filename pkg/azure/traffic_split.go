@@ -0,0 +1,145 @@
+package azure
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+	"github.com/tidwall/gjson"
+)
+
+var (
+	// TrafficSplits maps a lowercase model alias to weighted deployments.
+	TrafficSplits = make(map[string][]SplitTarget)
+	// TrafficSplitSticky makes the split deterministic per user or session
+	// instead of random per request.
+	TrafficSplitSticky = false
+
+	splitCounts   = make(map[string]map[string]int64)
+	splitCountsMu sync.Mutex
+)
+
+// SplitTarget is one deployment in a traffic split rule.
+type SplitTarget struct {
+	Deployment string
+	Weight     int
+}
+
+// loadTrafficSplits parses AZURE_OPENAI_TRAFFIC_SPLIT.
+// Format: alias=deployment:weight|deployment:weight,alias2=...
+// e.g. gpt-5.1=gpt-5.1:95|gpt-5.2:5
+func loadTrafficSplits() {
+	if v := os.Getenv("AZURE_OPENAI_TRAFFIC_SPLIT_STICKY"); v != "" {
+		TrafficSplitSticky, _ = strconv.ParseBool(v)
+	}
+	v := os.Getenv("AZURE_OPENAI_TRAFFIC_SPLIT")
+	if v == "" {
+		return
+	}
+	for _, rule := range strings.Split(v, ",") {
+		alias, targets, ok := strings.Cut(rule, "=")
+		if !ok {
+			continue
+		}
+		var split []SplitTarget
+		for _, target := range strings.Split(targets, "|") {
+			deployment, weight, ok := strings.Cut(target, ":")
+			w, err := strconv.Atoi(weight)
+			if !ok || err != nil || w < 0 {
+				slog.Warn("Ignoring invalid traffic split target", "target", target, "model", alias)
+				continue
+			}
+			split = append(split, SplitTarget{Deployment: deployment, Weight: w})
+		}
+		if len(split) > 0 {
+			TrafficSplits[strings.ToLower(alias)] = split
+		}
+	}
+	slog.Info("Loaded traffic splits", "splits", TrafficSplits, "sticky", TrafficSplitSticky)
+}
+
+// applyTrafficSplit picks a deployment for alias when a split rule exists.
+// With TrafficSplitSticky the choice is a hash of splitKey, so the same user
+// keeps getting the same deployment while the percentages hold.
+func applyTrafficSplit(alias, splitKey string) (string, bool) {
+	split, ok := TrafficSplits[alias]
+	if !ok {
+		return "", false
+	}
+	total := 0
+	for _, t := range split {
+		total += t.Weight
+	}
+	if total == 0 {
+		return "", false
+	}
+
+	var point int
+	if TrafficSplitSticky && splitKey != "" {
+		point = int(hashKey(alias+"|"+splitKey) % uint64(total))
+	} else {
+		point = rand.IntN(total)
+	}
+	for _, t := range split {
+		if point < t.Weight {
+			return t.Deployment, true
+		}
+		point -= t.Weight
+	}
+	return "", false
+}
+
+// recordSplit counts a request the split for alias sent to deployment.
+func recordSplit(alias, deployment string) {
+	metrics.TrafficSplitRequests.Inc(alias, deployment)
+	splitCountsMu.Lock()
+	defer splitCountsMu.Unlock()
+	if splitCounts[alias] == nil {
+		splitCounts[alias] = make(map[string]int64)
+	}
+	splitCounts[alias][deployment]++
+}
+
+// TrafficSplitCounts returns how many requests each alias sent to each
+// deployment since start-up.
+func TrafficSplitCounts() map[string]map[string]int64 {
+	splitCountsMu.Lock()
+	defer splitCountsMu.Unlock()
+	counts := make(map[string]map[string]int64, len(splitCounts))
+	for alias, deployments := range splitCounts {
+		counts[alias] = make(map[string]int64, len(deployments))
+		for d, n := range deployments {
+			counts[alias][d] = n
+		}
+	}
+	return counts
+}
+
+// trafficSplitKey identifies the caller for deterministic splits: the body's
+// user field, then the x-session-id header, then the caller's credential.
+func trafficSplitKey(req *http.Request) string {
+	if req.Body != nil {
+		body, _ := io.ReadAll(req.Body)
+		req.Body = io.NopCloser(bytes.NewBuffer(body))
+		if user := gjson.GetBytes(body, "user").String(); user != "" {
+			return user
+		}
+	}
+	if session := req.Header.Get("X-Session-Id"); session != "" {
+		return session
+	}
+	if key := req.Header.Get("api-key"); key != "" {
+		return strconv.FormatUint(hashKey(key), 16)
+	}
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		return strconv.FormatUint(hashKey(auth), 16)
+	}
+	return ""
+}
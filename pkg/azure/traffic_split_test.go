@@ -0,0 +1,98 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// useSplit installs a split of alias for the test.
+func useSplit(t *testing.T, alias string, sticky bool, targets ...SplitTarget) {
+	t.Helper()
+	savedSplits, savedSticky := TrafficSplits, TrafficSplitSticky
+	TrafficSplits = map[string][]SplitTarget{alias: targets}
+	TrafficSplitSticky = sticky
+	t.Cleanup(func() { TrafficSplits, TrafficSplitSticky = savedSplits, savedSticky })
+}
+
+func TestTrafficSplitWeights(t *testing.T) {
+	useSplit(t, "gpt-5.1", false,
+		SplitTarget{Deployment: "gpt-5.1", Weight: 90},
+		SplitTarget{Deployment: "gpt-5.2", Weight: 10},
+		SplitTarget{Deployment: "retired", Weight: 0})
+
+	counts := make(map[string]int)
+	for range 10000 {
+		d, ok := applyTrafficSplit("gpt-5.1", "")
+		if !ok {
+			t.Fatal("applyTrafficSplit() found no split")
+		}
+		counts[d]++
+	}
+	if counts["gpt-5.2"] < 800 || counts["gpt-5.2"] > 1200 {
+		t.Errorf("gpt-5.2 got %d of 10000 requests, want about 1000", counts["gpt-5.2"])
+	}
+	if counts["retired"] != 0 {
+		t.Errorf("a zero-weight deployment got %d requests", counts["retired"])
+	}
+	if _, ok := applyTrafficSplit("gpt-4o", ""); ok {
+		t.Error("applyTrafficSplit() split a model without a rule")
+	}
+}
+
+func TestTrafficSplitSticky(t *testing.T) {
+	useSplit(t, "gpt-5.1", true,
+		SplitTarget{Deployment: "gpt-5.1", Weight: 80},
+		SplitTarget{Deployment: "gpt-5.2", Weight: 20})
+
+	counts := make(map[string]int)
+	for i := range 1000 {
+		key := fmt.Sprintf("user-%d", i)
+		first, _ := applyTrafficSplit("gpt-5.1", key)
+		for range 5 {
+			if d, _ := applyTrafficSplit("gpt-5.1", key); d != first {
+				t.Fatalf("%s moved from %s to %s", key, first, d)
+			}
+		}
+		counts[first]++
+	}
+	// Users are still spread by the weights
+	if counts["gpt-5.2"] < 150 || counts["gpt-5.2"] > 250 {
+		t.Errorf("gpt-5.2 got %d of 1000 users, want about 200", counts["gpt-5.2"])
+	}
+}
+
+func TestTrafficSplitCountsRequestsSentUpstream(t *testing.T) {
+	useSplit(t, "canary-model", false,
+		SplitTarget{Deployment: "canary-a", Weight: 1},
+		SplitTarget{Deployment: "canary-b", Weight: 1})
+	sent := func() int64 {
+		counts := TrafficSplitCounts()["canary-model"]
+		return counts["canary-a"] + counts["canary-b"]
+	}
+	before := sent()
+
+	body := `{"model":"canary-model","messages":[]}`
+	req, _ := http.NewRequestWithContext(WithTenant(context.Background(), DefaultTenant), http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	req = WithRequestInfo(req)
+
+	// A cache lookup resolves the deployment, and the answer may come from
+	// the cache, so nothing is counted yet
+	deployment := ResolveDeployment(req, "canary-model")
+	if again := ResolveDeployment(req, "canary-model"); again != deployment {
+		t.Fatalf("ResolveDeployment() changed from %s to %s", deployment, again)
+	}
+	if n := sent() - before; n != 0 {
+		t.Fatalf("%d requests counted before any was sent", n)
+	}
+
+	makeDirector()(req)
+	if n := sent() - before; n != 1 {
+		t.Errorf("%d requests counted after the director ran, want 1", n)
+	}
+	if !strings.Contains(req.URL.Path, "/deployments/"+deployment+"/") {
+		t.Errorf("request sent to %s, want deployment %s", req.URL.Path, deployment)
+	}
+}
@@ -0,0 +1,272 @@
+package budget
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/store"
+)
+
+// Store buckets. Spend is kept per scope and window, e.g. "team:search|2025-06".
+const (
+	pricesBucket  = "prices"
+	budgetsBucket = "budgets"
+	spendBucket   = "spend"
+)
+
+// FlushInterval is how often accumulated spend is written to the database.
+var FlushInterval = 10 * time.Second
+
+// Budget caps the spend of a key ("key:<id>"), a team ("team:<owner>"), a
+// tenant ("tenant:<name>") or shadow calls ("shadow") in USD. A zero limit is
+// unlimited.
+type Budget struct {
+	Scope   string  `json:"scope"`
+	Daily   float64 `json:"daily,omitempty"`
+	Monthly float64 `json:"monthly,omitempty"`
+	// Downgrade maps a model alias to a cheaper one used once the budget is
+	// exhausted. Models without an entry are rejected instead.
+	Downgrade map[string]string `json:"downgrade,omitempty"`
+}
+
+// ShadowScope is charged for the shadow calls that mirror sampled requests,
+// which are not part of any caller's spend.
+const ShadowScope = "shadow"
+
+// KeyScope, TeamScope and TenantScope name the budget scopes of a request.
+func KeyScope(keyID string) string   { return "key:" + keyID }
+func TeamScope(owner string) string  { return "team:" + owner }
+func TenantScope(name string) string { return "tenant:" + name }
+
+var (
+	db *store.DB
+
+	mu      sync.Mutex
+	budgets = make(map[string]Budget)
+	spend   = make(map[string]float64) // by scope|window
+	dirty   = make(map[string]bool)
+)
+
+// Open loads budgets, spend and saved prices from d and starts writing
+// spend back to it periodically.
+func Open(d *store.DB) error {
+	db = d
+	if err := loadPrices(); err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	err := db.ForEach(budgetsBucket, func(scope string, raw json.RawMessage) error {
+		var b Budget
+		if err := json.Unmarshal(raw, &b); err != nil {
+			return err
+		}
+		budgets[scope] = b
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = db.ForEach(spendBucket, func(key string, raw json.RawMessage) error {
+		var amount float64
+		if err := json.Unmarshal(raw, &amount); err != nil {
+			return err
+		}
+		spend[key] = amount
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	go flushLoop()
+	if len(budgets) > 0 {
+		slog.Info("Loaded spend budgets", "budgets", len(budgets), "path", store.Path)
+	}
+	return nil
+}
+
+func persist(bucket, key string, v any) error {
+	if db == nil {
+		return nil
+	}
+	return db.Put(bucket, key, v)
+}
+
+func flushLoop() {
+	for range time.Tick(FlushInterval) {
+		Flush()
+	}
+}
+
+// Flush writes accumulated spend to the database in a single write, and
+// drops the spend of days and months that have ended.
+func Flush() {
+	day, month := Windows(time.Now())
+	mu.Lock()
+	pending := make(map[string]any, len(dirty))
+	for key := range dirty {
+		pending[key] = spend[key]
+	}
+	written := dirty
+	dirty = make(map[string]bool)
+	for key := range spend {
+		if !openWindow(key, day, month) {
+			delete(spend, key)
+			delete(pending, key)
+		}
+	}
+	mu.Unlock()
+
+	if db == nil {
+		return
+	}
+	var closed []string
+	for _, key := range db.Keys(spendBucket) {
+		if !openWindow(key, day, month) {
+			closed = append(closed, key)
+		}
+	}
+	if len(pending) == 0 && len(closed) == 0 {
+		return
+	}
+	if err := db.Update(spendBucket, pending, closed); err != nil {
+		slog.Error("Could not save spend", "keys", len(pending), "error", err)
+		mu.Lock()
+		for key := range written {
+			if _, ok := spend[key]; ok {
+				dirty[key] = true
+			}
+		}
+		mu.Unlock()
+	}
+}
+
+// openWindow reports whether a spend key ("scope|window") belongs to the
+// current day or month.
+func openWindow(key, day, month string) bool {
+	i := strings.LastIndexByte(key, '|')
+	window := key[i+1:]
+	return window == day || window == month
+}
+
+// Windows returns the daily and monthly window names for t, in UTC.
+func Windows(t time.Time) (day, month string) {
+	t = t.UTC()
+	return t.Format("2006-01-02"), t.Format("2006-01")
+}
+
+// Spend returns what a scope has spent today and this month.
+func Spend(scope string) (daily, monthly float64) {
+	day, month := Windows(time.Now())
+	mu.Lock()
+	defer mu.Unlock()
+	return spend[scope+"|"+day], spend[scope+"|"+month]
+}
+
+// Charge adds cost to every scope's daily and monthly spend. Requests are
+// charged once their response is complete, so requests already in flight
+// when a budget runs out still complete and can overrun it.
+func Charge(scopes []string, cost float64) {
+	if cost <= 0 {
+		return
+	}
+	day, month := Windows(time.Now())
+	mu.Lock()
+	defer mu.Unlock()
+	for _, scope := range scopes {
+		for _, key := range []string{scope + "|" + day, scope + "|" + month} {
+			spend[key] += cost
+			dirty[key] = true
+		}
+	}
+}
+
+// Decision is the outcome of checking a request against its budgets.
+type Decision struct {
+	Exhausted *Budget // the first exhausted budget, or nil
+	Window    string  // "daily" or "monthly"
+	Downgrade string  // cheaper model to use instead, if the budget allows one
+}
+
+// Check reports whether a request to model from the given scopes is within
+// budget.
+func Check(scopes []string, model string) Decision {
+	day, month := Windows(time.Now())
+	mu.Lock()
+	defer mu.Unlock()
+	for _, scope := range scopes {
+		b, ok := budgets[scope]
+		if !ok {
+			continue
+		}
+		window := ""
+		switch {
+		case b.Daily > 0 && spend[scope+"|"+day] >= b.Daily:
+			window = "daily"
+		case b.Monthly > 0 && spend[scope+"|"+month] >= b.Monthly:
+			window = "monthly"
+		default:
+			continue
+		}
+		return Decision{Exhausted: &b, Window: window, Downgrade: b.Downgrade[strings.ToLower(model)]}
+	}
+	return Decision{}
+}
+
+// Budgets returns every budget ordered by scope.
+func Budgets() []Budget {
+	mu.Lock()
+	defer mu.Unlock()
+	list := make([]Budget, 0, len(budgets))
+	for _, b := range budgets {
+		list = append(list, b)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Scope < list[j].Scope })
+	return list
+}
+
+// SetBudget adds or replaces the budget of b.Scope.
+func SetBudget(b Budget) error {
+	if !strings.HasPrefix(b.Scope, "key:") && !strings.HasPrefix(b.Scope, "team:") && !strings.HasPrefix(b.Scope, "tenant:") && b.Scope != ShadowScope {
+		return fmt.Errorf("scope must be key:<id>, team:<owner>, tenant:<name> or shadow")
+	}
+	if b.Daily < 0 || b.Monthly < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	downgrade := make(map[string]string, len(b.Downgrade))
+	for from, to := range b.Downgrade {
+		downgrade[strings.ToLower(from)] = to
+	}
+	b.Downgrade = downgrade
+	if err := persist(budgetsBucket, b.Scope, b); err != nil {
+		return err
+	}
+	mu.Lock()
+	budgets[b.Scope] = b
+	mu.Unlock()
+	return nil
+}
+
+// DeleteBudget removes the budget of a scope. Its spend is kept.
+func DeleteBudget(scope string) error {
+	mu.Lock()
+	_, ok := budgets[scope]
+	mu.Unlock()
+	if !ok {
+		return fmt.Errorf("budget %s not found", scope)
+	}
+	if db != nil {
+		if err := db.Delete(budgetsBucket, scope); err != nil {
+			return err
+		}
+	}
+	mu.Lock()
+	delete(budgets, scope)
+	mu.Unlock()
+	return nil
+}
@@ -0,0 +1,50 @@
+package budget
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/store"
+)
+
+func TestFlushPrunesClosedWindows(t *testing.T) {
+	d, err := store.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := db
+	db = d
+	t.Cleanup(func() {
+		db = saved
+		mu.Lock()
+		spend, dirty = make(map[string]float64), make(map[string]bool)
+		mu.Unlock()
+	})
+
+	day, month := Windows(time.Now())
+	for _, key := range []string{"key:a|2020-01-01", "key:a|2020-01"} {
+		if err := d.Put(spendBucket, key, 1.0); err != nil {
+			t.Fatal(err)
+		}
+		spend[key] = 1
+	}
+	Charge([]string{"key:a"}, 0.5)
+	Flush()
+
+	want := []string{"key:a|" + month, "key:a|" + day}
+	slices.Sort(want)
+	if got := d.Keys(spendBucket); !slices.Equal(got, want) {
+		t.Errorf("stored spend keys = %v, want %v", got, want)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(spend) != 2 || len(dirty) != 0 {
+		t.Errorf("spend = %v, dirty = %v after flush", spend, dirty)
+	}
+	var amount float64
+	if _, err := d.Get(spendBucket, "key:a|"+day, &amount); err != nil || amount != 0.5 {
+		t.Errorf("daily spend = %v, %v, want 0.5", amount, err)
+	}
+}
@@ -0,0 +1,166 @@
+// Package budget prices requests from their usage and caps spend per key
+// and per team over daily and monthly windows.
+package budget
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/usage"
+)
+
+// Price is what a model costs in USD. Token prices are per million tokens.
+// A zero cached input or reasoning price falls back to the input or output
+// price.
+type Price struct {
+	Input       float64 `json:"input"`
+	CachedInput float64 `json:"cached_input,omitempty"`
+	Output      float64 `json:"output"`
+	Reasoning   float64 `json:"reasoning,omitempty"`
+	Image       float64 `json:"image,omitempty"`        // per generated image
+	AudioSecond float64 `json:"audio_second,omitempty"` // per second of transcribed audio
+}
+
+// Cost prices u.
+func (p Price) Cost(u usage.Usage) float64 {
+	cachedPrice, reasoningPrice := p.CachedInput, p.Reasoning
+	if cachedPrice == 0 {
+		cachedPrice = p.Input
+	}
+	if reasoningPrice == 0 {
+		reasoningPrice = p.Output
+	}
+	cached := min(u.CachedTokens, u.PromptTokens)
+	reasoning := min(u.ReasoningTokens, u.CompletionTokens)
+	tokens := float64(u.PromptTokens-cached)*p.Input +
+		float64(cached)*cachedPrice +
+		float64(u.CompletionTokens-reasoning)*p.Output +
+		float64(reasoning)*reasoningPrice
+	return tokens/1e6 + float64(u.Images)*p.Image + u.AudioSeconds*p.AudioSecond
+}
+
+var (
+	// PricesFile is a JSON object of model alias to Price. Aliases ending in
+	// "*" match by prefix.
+	PricesFile = ""
+
+	pricesMu sync.RWMutex
+	prices   = make(map[string]Price)
+)
+
+func init() {
+	PricesFile = os.Getenv("AZURE_OPENAI_PRICES_FILE")
+	if PricesFile == "" {
+		return
+	}
+	data, err := os.ReadFile(PricesFile)
+	if err != nil {
+		slog.Error("Could not read price table", "path", PricesFile, "error", err)
+		os.Exit(1)
+	}
+	var table map[string]Price
+	if err := json.Unmarshal(data, &table); err != nil {
+		slog.Error("Could not parse price table", "path", PricesFile, "error", err)
+		os.Exit(1)
+	}
+	for model, p := range table {
+		prices[strings.ToLower(model)] = p
+	}
+	slog.Info("Loaded prices", "models", len(prices), "path", PricesFile)
+}
+
+// PriceFor returns the price of a model alias: an exact entry, else the
+// longest matching prefix entry.
+func PriceFor(model string) (Price, bool) {
+	model = strings.ToLower(model)
+	pricesMu.RLock()
+	defer pricesMu.RUnlock()
+	if p, ok := prices[model]; ok {
+		return p, true
+	}
+	best, found := "", false
+	var price Price
+	for pattern, p := range prices {
+		prefix, ok := strings.CutSuffix(pattern, "*")
+		if ok && strings.HasPrefix(model, prefix) && len(prefix) >= len(best) {
+			best, price, found = prefix, p, true
+		}
+	}
+	return price, found
+}
+
+// Cost prices a request to model. Models without a price cost nothing.
+func Cost(model string, u usage.Usage) float64 {
+	p, ok := PriceFor(model)
+	if !ok {
+		return 0
+	}
+	return p.Cost(u)
+}
+
+// Prices returns a copy of the price table.
+func Prices() map[string]Price {
+	pricesMu.RLock()
+	defer pricesMu.RUnlock()
+	table := make(map[string]Price, len(prices))
+	for model, p := range prices {
+		table[model] = p
+	}
+	return table
+}
+
+// storedPrice is a price saved through the admin API. Deletions are kept as
+// tombstones so entries from the prices file stay deleted after a restart.
+type storedPrice struct {
+	Price
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// SetPrice adds or replaces the price of a model alias.
+func SetPrice(model string, p Price) error {
+	if p.Input < 0 || p.CachedInput < 0 || p.Output < 0 || p.Reasoning < 0 || p.Image < 0 || p.AudioSecond < 0 {
+		return fmt.Errorf("prices must not be negative")
+	}
+	model = strings.ToLower(model)
+	if err := persist(pricesBucket, model, storedPrice{Price: p}); err != nil {
+		return err
+	}
+	pricesMu.Lock()
+	prices[model] = p
+	pricesMu.Unlock()
+	return nil
+}
+
+// DeletePrice removes the price of a model alias.
+func DeletePrice(model string) error {
+	model = strings.ToLower(model)
+	if err := persist(pricesBucket, model, storedPrice{Deleted: true}); err != nil {
+		return err
+	}
+	pricesMu.Lock()
+	delete(prices, model)
+	pricesMu.Unlock()
+	return nil
+}
+
+// loadPrices overlays the prices saved in the database.
+func loadPrices() error {
+	return db.ForEach(pricesBucket, func(model string, raw json.RawMessage) error {
+		var p storedPrice
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return err
+		}
+		pricesMu.Lock()
+		if p.Deleted {
+			delete(prices, model)
+		} else {
+			prices[model] = p.Price
+		}
+		pricesMu.Unlock()
+		return nil
+	})
+}
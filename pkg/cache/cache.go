@@ -0,0 +1,142 @@
+// Package cache stores responses to identical requests, so deterministic
+// prompts and repeated embeddings are answered without calling Azure again.
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// Backend is "memory" or "disk"; anything else disables the cache.
+	Backend = "off"
+	// TTL is how long a response is served from the cache.
+	TTL = time.Hour
+	// MaxBytes bounds the total size of the cached responses.
+	MaxBytes int64 = 256 << 20
+	// MaxEntryBytes bounds a single cached response. Larger ones are not
+	// stored.
+	MaxEntryBytes int64 = 1 << 20
+	// Dir holds the disk backend's entries.
+	Dir = "response-cache"
+
+	openOnce sync.Once
+	store    Store
+)
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_CACHE"); v != "" {
+		Backend = strings.ToLower(v)
+	}
+	if v := os.Getenv("AZURE_OPENAI_CACHE_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			TTL = d
+		} else {
+			slog.Warn("Invalid AZURE_OPENAI_CACHE_TTL, using default", "value", v, "default", TTL.String())
+		}
+	}
+	if v := os.Getenv("AZURE_OPENAI_CACHE_MAX_MB"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			MaxBytes = n << 20
+		}
+	}
+	if v := os.Getenv("AZURE_OPENAI_CACHE_MAX_ENTRY_KB"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			MaxEntryBytes = n << 10
+		}
+	}
+	if v := os.Getenv("AZURE_OPENAI_CACHE_DIR"); v != "" {
+		Dir = v
+	}
+}
+
+// Enabled reports whether responses are cached.
+func Enabled() bool {
+	return Backend == "memory" || Backend == "disk"
+}
+
+// Entry is a cached response.
+type Entry struct {
+	Status      int       `json:"status"`
+	ContentType string    `json:"content_type"`
+	Body        []byte    `json:"body"`
+	Created     time.Time `json:"created"`
+}
+
+// Stream reports whether the entry holds a server-sent event stream.
+func (e *Entry) Stream() bool {
+	return strings.HasPrefix(e.ContentType, "text/event-stream")
+}
+
+func (e *Entry) expired() bool {
+	return time.Since(e.Created) > TTL
+}
+
+// Store holds cached entries under their keys.
+type Store interface {
+	Get(key string) (*Entry, bool)
+	Put(key string, e *Entry)
+}
+
+// Default returns the configured store, opening it on first use.
+func Default() Store {
+	openOnce.Do(func() {
+		switch Backend {
+		case "disk":
+			s, err := OpenDisk(Dir, MaxBytes)
+			if err != nil {
+				slog.Error("Could not open the response cache, using memory instead", "dir", Dir, "error", err)
+				store = NewMemory(MaxBytes)
+				return
+			}
+			store = s
+		default:
+			store = NewMemory(MaxBytes)
+		}
+		slog.Info("Response cache enabled", "backend", Backend, "ttl", TTL.String(), "max_bytes", MaxBytes)
+	})
+	return store
+}
+
+// Key returns the cache key of a request body sent to path and answered by
+// the upstream deployment named by scope. Bodies that are not JSON objects
+// cannot be cached.
+func Key(scope, path string, body []byte) (string, bool) {
+	normalized, ok := Normalize(body)
+	if !ok {
+		return "", false
+	}
+	h := sha256.New()
+	h.Write([]byte(scope))
+	h.Write([]byte{0})
+	h.Write([]byte(path))
+	h.Write([]byte{0})
+	h.Write(normalized)
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// Normalize re-encodes a JSON request body with sorted keys and no
+// insignificant whitespace, dropping the end-user ID, which does not change
+// the response.
+func Normalize(body []byte) ([]byte, bool) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v map[string]any
+	if err := dec.Decode(&v); err != nil || v == nil {
+		return nil, false
+	}
+	delete(v, "user")
+	out, err := json.Marshal(v)
+	if err != nil {
+		return nil, false
+	}
+	return out, true
+}
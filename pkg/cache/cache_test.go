@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		want   string
+		wantOK bool
+	}{
+		{name: "sorts keys", body: `{"model":"gpt-4o","messages":[]}`, want: `{"messages":[],"model":"gpt-4o"}`, wantOK: true},
+		{name: "drops whitespace", body: "{\n  \"model\": \"gpt-4o\",\n  \"n\": 1\n}", want: `{"model":"gpt-4o","n":1}`, wantOK: true},
+		{name: "drops user", body: `{"model":"gpt-4o","user":"alice"}`, want: `{"model":"gpt-4o"}`, wantOK: true},
+		{name: "keeps number precision", body: `{"seed":12345678901234567890}`, want: `{"seed":12345678901234567890}`, wantOK: true},
+		{name: "array", body: `[1,2]`},
+		{name: "null", body: `null`},
+		{name: "not JSON", body: `model=gpt-4o`},
+		{name: "empty", body: ``},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Normalize([]byte(tt.body))
+			if ok != tt.wantOK || string(got) != tt.want {
+				t.Errorf("Normalize(%s) = %s, %t, want %s, %t", tt.body, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestKey(t *testing.T) {
+	body := `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`
+	key, ok := Key("default/gpt-4o", "/v1/chat/completions", []byte(body))
+	if !ok || len(key) != 64 {
+		t.Fatalf("Key() = %q, %t", key, ok)
+	}
+
+	same := []struct {
+		name, scope, path, body string
+	}{
+		{"reordered keys", "default/gpt-4o", "/v1/chat/completions", `{"messages":[{"content":"hi","role":"user"}],"model":"gpt-4o"}`},
+		{"other user", "default/gpt-4o", "/v1/chat/completions", `{"model":"gpt-4o","user":"bob","messages":[{"role":"user","content":"hi"}]}`},
+	}
+	for _, tt := range same {
+		if got, _ := Key(tt.scope, tt.path, []byte(tt.body)); got != key {
+			t.Errorf("%s: key differs", tt.name)
+		}
+	}
+
+	different := []struct {
+		name, scope, path, body string
+	}{
+		{"other scope", "retail/gpt-4o", "/v1/chat/completions", body},
+		{"other path", "default/gpt-4o", "/v1/completions", body},
+		{"other prompt", "default/gpt-4o", "/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"hello"}]}`},
+		// The separator keeps scope and path from running into each other
+		{"shifted boundary", "default/gpt-4o/v1", "/chat/completions", body},
+	}
+	for _, tt := range different {
+		if got, _ := Key(tt.scope, tt.path, []byte(tt.body)); got == key {
+			t.Errorf("%s: key is the same", tt.name)
+		}
+	}
+
+	if _, ok := Key("default/gpt-4o", "/v1/audio/transcriptions", []byte("--boundary")); ok {
+		t.Error("Key() of a non-JSON body succeeded")
+	}
+}
+
+func TestMemoryEvictsLeastRecentlyUsed(t *testing.T) {
+	m := NewMemory(10)
+	entry := func(body string) *Entry { return &Entry{Body: []byte(body), Created: time.Now()} }
+	m.Put("a", entry("aaaa"))
+	m.Put("b", entry("bbbb"))
+	m.Get("a") // a is now more recent than b
+	m.Put("c", entry("cccc"))
+
+	if _, ok := m.Get("b"); ok {
+		t.Error("least recently used entry b was kept")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := m.Get(key); !ok {
+			t.Errorf("entry %s was evicted", key)
+		}
+	}
+
+	m.Put("old", &Entry{Body: []byte("x"), Created: time.Now().Add(-TTL - time.Second)})
+	if _, ok := m.Get("old"); ok {
+		t.Error("expired entry was returned")
+	}
+}
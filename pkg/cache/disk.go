@@ -0,0 +1,147 @@
+package cache
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Disk keeps one JSON file per entry in a directory, so cached responses
+// survive restarts. The oldest entries are removed once the files add up to
+// more than the byte limit.
+type Disk struct {
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex
+	size  int64
+	files map[string]diskFile // by key
+}
+
+type diskFile struct {
+	size    int64
+	created time.Time
+}
+
+// OpenDisk opens the store in dir, creating it if needed.
+func OpenDisk(dir string, maxBytes int64) (*Disk, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	d := &Disk{dir: dir, maxBytes: maxBytes, files: make(map[string]diskFile)}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, de := range entries {
+		key, ok := strings.CutSuffix(de.Name(), ".json")
+		if !ok {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		// Entries are never rewritten, so the modification time is when they were stored
+		d.files[key] = diskFile{size: info.Size(), created: info.ModTime()}
+		d.size += info.Size()
+	}
+	d.mu.Lock()
+	d.evict()
+	d.mu.Unlock()
+	return d, nil
+}
+
+func (d *Disk) path(key string) string {
+	return filepath.Join(d.dir, key+".json")
+}
+
+func (d *Disk) Get(key string) (*Entry, bool) {
+	d.mu.Lock()
+	f, ok := d.files[key]
+	if ok && time.Since(f.created) > TTL {
+		d.remove(key)
+		ok = false
+	}
+	d.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	raw, err := os.ReadFile(d.path(key))
+	if err != nil {
+		return nil, false
+	}
+	var e Entry
+	if err := json.Unmarshal(raw, &e); err != nil || e.expired() {
+		return nil, false
+	}
+	return &e, true
+}
+
+func (d *Disk) Put(key string, e *Entry) {
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	// Written aside and renamed, so readers never see half an entry
+	tmp, err := os.CreateTemp(d.dir, key+".*.tmp")
+	if err != nil {
+		slog.Warn("Could not write response cache entry", "error", err)
+		return
+	}
+	_, err = tmp.Write(raw)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), d.path(key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		slog.Warn("Could not write response cache entry", "error", err)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if old, ok := d.files[key]; ok {
+		d.size -= old.size
+	}
+	d.files[key] = diskFile{size: int64(len(raw)), created: e.Created}
+	d.size += int64(len(raw))
+	d.evict()
+}
+
+// evict removes the oldest entries, expired ones first, until the store fits
+// in its limit. d.mu must be held.
+func (d *Disk) evict() {
+	if d.size <= d.maxBytes {
+		return
+	}
+	keys := make([]string, 0, len(d.files))
+	for key := range d.files {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return d.files[keys[i]].created.Before(d.files[keys[j]].created) })
+	for _, key := range keys {
+		if d.size <= d.maxBytes {
+			break
+		}
+		d.remove(key)
+	}
+}
+
+// remove deletes an entry. d.mu must be held.
+func (d *Disk) remove(key string) {
+	if f, ok := d.files[key]; ok {
+		d.size -= f.size
+		delete(d.files, key)
+		os.Remove(d.path(key))
+	}
+}
@@ -0,0 +1,61 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Memory is an in-process store that evicts the least recently used entries
+// once it holds more than its byte limit.
+type Memory struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	order    *list.List // front is most recently used
+	entries  map[string]*list.Element
+}
+
+type memoryItem struct {
+	key   string
+	entry *Entry
+}
+
+// NewMemory returns an empty store holding up to maxBytes of bodies.
+func NewMemory(maxBytes int64) *Memory {
+	return &Memory{maxBytes: maxBytes, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (m *Memory) Get(key string) (*Entry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+	item := el.Value.(*memoryItem)
+	if item.entry.expired() {
+		m.remove(el)
+		return nil, false
+	}
+	m.order.MoveToFront(el)
+	return item.entry, true
+}
+
+func (m *Memory) Put(key string, e *Entry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.entries[key]; ok {
+		m.remove(el)
+	}
+	m.entries[key] = m.order.PushFront(&memoryItem{key: key, entry: e})
+	m.size += int64(len(e.Body))
+	for m.size > m.maxBytes && m.order.Len() > 1 {
+		m.remove(m.order.Back())
+	}
+}
+
+func (m *Memory) remove(el *list.Element) {
+	item := m.order.Remove(el).(*memoryItem)
+	delete(m.entries, item.key)
+	m.size -= int64(len(item.entry.Body))
+}
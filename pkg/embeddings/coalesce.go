@@ -0,0 +1,108 @@
+package embeddings
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Coalescer gathers the inputs of concurrent requests with the same key into
+// one upstream call. A batch is sent once CoalesceWindow has passed since its
+// first request, or as soon as it holds MaxInputs inputs.
+type Coalescer struct {
+	mu   sync.Mutex
+	open map[string]*batch
+}
+
+var errShortResult = errors.New("embeddings: fewer vectors than inputs")
+
+type batch struct {
+	inputs   []json.RawMessage
+	bytes    int // total size of inputs, to share out the usage
+	requests int
+	full     chan struct{} // closed when the batch is sent early
+	done     chan struct{} // closed when result or err is set
+	result   *Result
+	err      error
+}
+
+// NewCoalescer returns a coalescer with no open batches.
+func NewCoalescer() *Coalescer {
+	return &Coalescer{open: make(map[string]*batch)}
+}
+
+// Do adds inputs to the open batch for key, opening one if needed, and waits
+// for the batch to be sent. The request that opens a batch sends it with its
+// send function. Do returns this request's part of the result, its share of
+// the prompt tokens by input length, and whether other requests shared the
+// call.
+func (c *Coalescer) Do(key string, inputs []json.RawMessage, send func([]json.RawMessage) (*Result, error)) (*Result, bool, error) {
+	size := 0
+	for _, in := range inputs {
+		size += len(in)
+	}
+
+	c.mu.Lock()
+	b := c.open[key]
+	if b != nil && len(b.inputs)+len(inputs) > MaxInputs {
+		c.close(key, b)
+		b = nil
+	}
+	if b == nil {
+		b = &batch{full: make(chan struct{}), done: make(chan struct{})}
+		c.open[key] = b
+		go c.run(key, b, send)
+	}
+	offset := len(b.inputs)
+	b.inputs = append(b.inputs, inputs...)
+	b.bytes += size
+	b.requests++
+	if len(b.inputs) >= MaxInputs {
+		c.close(key, b)
+	}
+	c.mu.Unlock()
+
+	<-b.done
+	shared := b.requests > 1
+	if b.err != nil {
+		return nil, shared, b.err
+	}
+	r := &Result{
+		Model:   b.result.Model,
+		Vectors: b.result.Vectors[offset : offset+len(inputs)],
+		Header:  b.result.Header,
+	}
+	if b.bytes > 0 {
+		r.PromptTokens = b.result.PromptTokens * int64(size) / int64(b.bytes)
+	}
+	return r, shared, nil
+}
+
+// run sends b once its window has passed or it is full.
+func (c *Coalescer) run(key string, b *batch, send func([]json.RawMessage) (*Result, error)) {
+	timer := time.NewTimer(CoalesceWindow)
+	select {
+	case <-timer.C:
+	case <-b.full:
+		timer.Stop()
+	}
+	c.mu.Lock()
+	if c.open[key] == b {
+		delete(c.open, key)
+	}
+	inputs := b.inputs
+	c.mu.Unlock()
+
+	b.result, b.err = send(inputs)
+	if b.err == nil && len(b.result.Vectors) != len(inputs) {
+		b.result, b.err = nil, errShortResult
+	}
+	close(b.done)
+}
+
+// close stops b taking more inputs and sends it. c.mu must be held.
+func (c *Coalescer) close(key string, b *batch) {
+	delete(c.open, key)
+	close(b.full)
+}
@@ -0,0 +1,98 @@
+package embeddings
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCoalescerSharesCalls(t *testing.T) {
+	saved := CoalesceWindow
+	CoalesceWindow = 50 * time.Millisecond
+	t.Cleanup(func() { CoalesceWindow = saved })
+
+	c := NewCoalescer()
+	var calls [][]json.RawMessage
+	send := func(inputs []json.RawMessage) (*Result, error) {
+		calls = append(calls, inputs)
+		r := &Result{Model: "text-embedding-3-small", PromptTokens: 30}
+		for _, in := range inputs {
+			r.Vectors = append(r.Vectors, in)
+		}
+		return r, nil
+	}
+
+	requests := [][]json.RawMessage{
+		{[]byte(`"aaaa"`), []byte(`"bb"`)}, // 10 bytes
+		{[]byte(`"cccccccc"`)},             // 10 bytes
+		{[]byte(`"dddddddddddddddddddd"`)}, // 22 bytes
+	}
+	results := make([]*Result, len(requests))
+	var wg sync.WaitGroup
+	for i, inputs := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, shared, err := c.Do("key", inputs, send)
+			if err != nil || !shared {
+				t.Errorf("request %d: shared %t, %v", i, shared, err)
+			}
+			results[i] = r
+		}()
+	}
+	wg.Wait()
+
+	if len(calls) != 1 || len(calls[0]) != 4 {
+		t.Fatalf("upstream calls = %s, want one with 4 inputs", calls)
+	}
+	// Each request gets its own vectors and a share of the usage by size
+	wantTokens := []int64{30 * 10 / 42, 30 * 10 / 42, 30 * 22 / 42}
+	for i, r := range results {
+		if r == nil {
+			continue
+		}
+		if len(r.Vectors) != len(requests[i]) {
+			t.Errorf("request %d got %d vectors, want %d", i, len(r.Vectors), len(requests[i]))
+			continue
+		}
+		for j, v := range r.Vectors {
+			if string(v) != string(requests[i][j]) {
+				t.Errorf("request %d vector %d = %s, want %s", i, j, v, requests[i][j])
+			}
+		}
+		if r.PromptTokens != wantTokens[i] {
+			t.Errorf("request %d PromptTokens = %d, want %d", i, r.PromptTokens, wantTokens[i])
+		}
+	}
+}
+
+func TestCoalescerSendsFullBatches(t *testing.T) {
+	savedWindow, savedMax := CoalesceWindow, MaxInputs
+	CoalesceWindow, MaxInputs = time.Hour, 2
+	t.Cleanup(func() { CoalesceWindow, MaxInputs = savedWindow, savedMax })
+
+	c := NewCoalescer()
+	send := func(inputs []json.RawMessage) (*Result, error) {
+		return &Result{Vectors: inputs}, nil
+	}
+	// A batch of MaxInputs goes out without waiting for the window
+	done := make(chan struct{})
+	go func() {
+		c.Do("key", []json.RawMessage{[]byte(`"a"`), []byte(`"b"`)}, send)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("full batch waited for the window")
+	}
+
+	// So does one short of a vector, which fails its requests
+	_, _, err := c.Do("key", []json.RawMessage{[]byte(`"a"`), []byte(`"b"`)}, func([]json.RawMessage) (*Result, error) {
+		return &Result{Vectors: []json.RawMessage{[]byte(`"a"`)}}, nil
+	})
+	if err != errShortResult {
+		t.Errorf("Do() with a short result = %v, want errShortResult", err)
+	}
+}
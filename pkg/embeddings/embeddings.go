@@ -0,0 +1,175 @@
+// Package embeddings splits, reassembles and coalesces embeddings requests,
+// so one client request can be answered by several upstream calls and several
+// client requests by one.
+package embeddings
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+var (
+	// MaxInputs is the most inputs sent upstream in one request. Azure OpenAI
+	// accepts up to 2048; larger requests are split into chunks of this size.
+	MaxInputs = 2048
+	// Concurrency is how many chunks of one request are in flight at once.
+	Concurrency = 4
+	// CoalesceWindow is how long a small request waits for others to share an
+	// upstream call with. Zero turns coalescing off.
+	CoalesceWindow time.Duration
+)
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_EMBEDDINGS_MAX_INPUTS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			MaxInputs = n
+		} else {
+			slog.Warn("Invalid AZURE_OPENAI_EMBEDDINGS_MAX_INPUTS, using default", "value", v, "default", MaxInputs)
+		}
+	}
+	if v := os.Getenv("AZURE_OPENAI_EMBEDDINGS_CONCURRENCY"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			Concurrency = n
+		} else {
+			slog.Warn("Invalid AZURE_OPENAI_EMBEDDINGS_CONCURRENCY, using default", "value", v, "default", Concurrency)
+		}
+	}
+	if v := os.Getenv("AZURE_OPENAI_EMBEDDINGS_COALESCE_WINDOW"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			CoalesceWindow = d
+		} else {
+			slog.Warn("Invalid AZURE_OPENAI_EMBEDDINGS_COALESCE_WINDOW, coalescing is off", "value", v)
+		}
+	}
+	if CoalesceWindow > 0 {
+		slog.Info("Embeddings coalescing enabled", "window", CoalesceWindow.String(), "max_inputs", MaxInputs)
+	}
+}
+
+// Inputs splits the input of an embeddings request into its individual
+// inputs: a string, an array of strings, an array of tokens or an array of
+// token arrays.
+func Inputs(input json.RawMessage) ([]json.RawMessage, bool) {
+	input = bytes.TrimSpace(input)
+	if len(input) == 0 {
+		return nil, false
+	}
+	switch input[0] {
+	case '"':
+		return []json.RawMessage{input}, true
+	case '[':
+	default:
+		return nil, false
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(input, &items); err != nil || len(items) == 0 {
+		return nil, false
+	}
+	// An array of numbers is one tokenized input
+	if c := items[0][0]; c == '-' || (c >= '0' && c <= '9') {
+		return []json.RawMessage{input}, true
+	}
+	return items, true
+}
+
+// WithInputs returns a copy of an embeddings request body asking for inputs.
+func WithInputs(body []byte, inputs []json.RawMessage) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var req map[string]any
+	if err := dec.Decode(&req); err != nil {
+		return nil, err
+	}
+	req["input"] = inputs
+	return json.Marshal(req)
+}
+
+// Result is an embeddings response: one vector per input, in input order.
+// Vectors are kept as sent, floats or base64, so they can be passed on as is.
+type Result struct {
+	Model        string
+	Vectors      []json.RawMessage
+	PromptTokens int64
+	// Header holds the request IDs and rate limits of the upstream answer
+	// that came last, to pass on to the client
+	Header http.Header
+}
+
+// ParseResult reads an upstream embeddings response to a request for n inputs.
+func ParseResult(body []byte, n int) (*Result, error) {
+	var res struct {
+		Model string `json:"model"`
+		Data  []struct {
+			Index     int             `json:"index"`
+			Embedding json.RawMessage `json:"embedding"`
+		} `json:"data"`
+		Usage struct {
+			PromptTokens int64 `json:"prompt_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil, err
+	}
+	r := &Result{Model: res.Model, Vectors: make([]json.RawMessage, n), PromptTokens: res.Usage.PromptTokens}
+	for _, d := range res.Data {
+		if d.Index < 0 || d.Index >= n {
+			return nil, fmt.Errorf("embedding index %d out of range for %d inputs", d.Index, n)
+		}
+		r.Vectors[d.Index] = d.Embedding
+	}
+	for i, v := range r.Vectors {
+		if len(v) == 0 {
+			return nil, fmt.Errorf("no embedding for input %d", i)
+		}
+	}
+	return r, nil
+}
+
+// Append adds the vectors and usage of a later chunk to r.
+func (r *Result) Append(o *Result) {
+	if r.Model == "" {
+		r.Model = o.Model
+	}
+	r.Vectors = append(r.Vectors, o.Vectors...)
+	r.PromptTokens += o.PromptTokens
+}
+
+// Response encodes r as an embeddings response.
+func (r *Result) Response() []byte {
+	type embedding struct {
+		Object    string          `json:"object"`
+		Index     int             `json:"index"`
+		Embedding json.RawMessage `json:"embedding"`
+	}
+	data := make([]embedding, len(r.Vectors))
+	for i, v := range r.Vectors {
+		data[i] = embedding{Object: "embedding", Index: i, Embedding: v}
+	}
+	type usage struct {
+		PromptTokens int64 `json:"prompt_tokens"`
+		TotalTokens  int64 `json:"total_tokens"`
+	}
+	out, _ := json.Marshal(struct {
+		Object string      `json:"object"`
+		Data   []embedding `json:"data"`
+		Model  string      `json:"model"`
+		Usage  usage       `json:"usage"`
+	}{"list", data, r.Model, usage{r.PromptTokens, r.PromptTokens}})
+	return out
+}
+
+// Chunks splits inputs into runs of at most MaxInputs.
+func Chunks(inputs []json.RawMessage) [][]json.RawMessage {
+	var chunks [][]json.RawMessage
+	for len(inputs) > MaxInputs {
+		chunks = append(chunks, inputs[:MaxInputs])
+		inputs = inputs[MaxInputs:]
+	}
+	return append(chunks, inputs)
+}
@@ -0,0 +1,101 @@
+package embeddings
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestInputs(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		want   []string
+		wantOK bool
+	}{
+		{name: "string", input: `"hello"`, want: []string{`"hello"`}, wantOK: true},
+		{name: "strings", input: `["a", "b"]`, want: []string{`"a"`, `"b"`}, wantOK: true},
+		{name: "tokens", input: `[1, 2, 3]`, want: []string{`[1, 2, 3]`}, wantOK: true},
+		{name: "token arrays", input: `[[1, 2], [3]]`, want: []string{`[1, 2]`, `[3]`}, wantOK: true},
+		{name: "empty array", input: `[]`},
+		{name: "number", input: `42`},
+		{name: "missing", input: ``},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Inputs(json.RawMessage(tt.input))
+			if ok != tt.wantOK || len(got) != len(tt.want) {
+				t.Fatalf("Inputs(%s) = %s, %t, want %v, %t", tt.input, got, ok, tt.want, tt.wantOK)
+			}
+			for i := range got {
+				if string(got[i]) != tt.want[i] {
+					t.Errorf("input %d = %s, want %s", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestChunks(t *testing.T) {
+	saved := MaxInputs
+	MaxInputs = 2
+	t.Cleanup(func() { MaxInputs = saved })
+
+	inputs := []json.RawMessage{[]byte(`"a"`), []byte(`"b"`), []byte(`"c"`), []byte(`"d"`), []byte(`"e"`)}
+	var sizes []int
+	for _, chunk := range Chunks(inputs) {
+		sizes = append(sizes, len(chunk))
+	}
+	if len(sizes) != 3 || sizes[0] != 2 || sizes[1] != 2 || sizes[2] != 1 {
+		t.Errorf("chunk sizes = %v, want [2 2 1]", sizes)
+	}
+	if chunks := Chunks(inputs[:2]); len(chunks) != 1 {
+		t.Errorf("%d chunks of MaxInputs inputs, want 1", len(chunks))
+	}
+}
+
+func TestReassembly(t *testing.T) {
+	// Upstreams need not list embeddings in input order
+	first, err := ParseResult([]byte(`{"model":"text-embedding-3-small","data":[{"index":1,"embedding":"b"},{"index":0,"embedding":"a"}],"usage":{"prompt_tokens":2}}`), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := ParseResult([]byte(`{"data":[{"index":0,"embedding":"c"}],"usage":{"prompt_tokens":1}}`), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := &Result{}
+	result.Append(first)
+	result.Append(second)
+
+	var res struct {
+		Model string `json:"model"`
+		Data  []struct {
+			Index     int    `json:"index"`
+			Embedding string `json:"embedding"`
+		} `json:"data"`
+		Usage struct {
+			TotalTokens int64 `json:"total_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(result.Response(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Model != "text-embedding-3-small" || res.Usage.TotalTokens != 3 || len(res.Data) != 3 {
+		t.Fatalf("Response() = %s", result.Response())
+	}
+	for i, d := range res.Data {
+		if want := string(rune('a' + i)); d.Index != i || d.Embedding != want {
+			t.Errorf("data[%d] = %d %s, want %d %s", i, d.Index, d.Embedding, i, want)
+		}
+	}
+
+	for _, body := range []string{
+		`{"data":[{"index":0,"embedding":"a"}]}`,
+		`{"data":[{"index":0,"embedding":"a"},{"index":2,"embedding":"c"}]}`,
+	} {
+		if _, err := ParseResult([]byte(body), 2); err == nil || !strings.Contains(err.Error(), "input") {
+			t.Errorf("ParseResult(%s) = %v, want an error", body, err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Package ledger keeps an append-only record of every proxied request and
+// aggregates it for usage reports.
+package ledger
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// Path is the JSONL file entries are appended to. The ledger is off when
+	// it is empty or "off".
+	Path = ""
+
+	entries  chan Entry
+	openOnce sync.Once
+	// fileMu is held while a batch is written, so queries can note where the
+	// last complete batch ends.
+	fileMu sync.RWMutex
+)
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_USAGE_LEDGER"); v != "" {
+		Path = v
+	}
+}
+
+// Enabled reports whether requests are recorded.
+func Enabled() bool {
+	return Path != "" && !strings.EqualFold(Path, "off")
+}
+
+// Entry is one proxied request.
+type Entry struct {
+	Time             time.Time `json:"time"`
+	Tenant           string    `json:"tenant,omitempty"` // empty for the default tenant
+	KeyID            string    `json:"key_id,omitempty"`
+	Owner            string    `json:"owner,omitempty"`
+	Model            string    `json:"model,omitempty"`      // alias requested by the client
+	Deployment       string    `json:"deployment,omitempty"` // resolved upstream deployment
+	Backend          string    `json:"backend,omitempty"`
+	Route            string    `json:"route"`
+	Method           string    `json:"method"`
+	Path             string    `json:"path"`
+	Status           int       `json:"status"`
+	Stream           bool      `json:"stream,omitempty"`
+	LatencyMS        int64     `json:"latency_ms"`
+	PromptTokens     int64     `json:"prompt_tokens"`
+	CompletionTokens int64     `json:"completion_tokens"`
+	CachedTokens     int64     `json:"cached_tokens,omitempty"`
+	ReasoningTokens  int64     `json:"reasoning_tokens,omitempty"`
+	TotalTokens      int64     `json:"total_tokens"`
+}
+
+// Record queues e to be appended. It only blocks the request when the writer
+// has fallen far behind, since dropping entries would lose usage.
+func Record(e Entry) {
+	if !Enabled() {
+		return
+	}
+	openOnce.Do(func() {
+		entries = make(chan Entry, 4096)
+		go writeLoop()
+	})
+	select {
+	case entries <- e:
+	default:
+		slog.Warn("Usage ledger queue full, waiting for the writer", "path", e.Path)
+		entries <- e
+	}
+}
+
+func writeLoop() {
+	f, err := os.OpenFile(Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		slog.Error("Could not open usage ledger, usage will not be recorded", "path", Path, "error", err)
+		for range entries {
+		}
+		return
+	}
+	slog.Info("Recording usage", "path", Path)
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for e := range entries {
+		fileMu.Lock()
+		if err := enc.Encode(e); err != nil {
+			slog.Error("Could not write usage ledger", "error", err)
+		}
+		// Write everything queued so far, then flush once
+		for n := len(entries); n > 0; n-- {
+			if err := enc.Encode(<-entries); err != nil {
+				slog.Error("Could not write usage ledger", "error", err)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			slog.Error("Could not write usage ledger", "error", err)
+		}
+		fileMu.Unlock()
+	}
+}
@@ -0,0 +1,181 @@
+package ledger
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GroupFields are the fields a report can be grouped by.
+var GroupFields = []string{"tenant", "key", "owner", "model", "deployment", "backend", "route", "status", "day"}
+
+// Filter selects ledger entries. Zero fields match everything.
+type Filter struct {
+	Since time.Time
+	Until time.Time
+	KeyID string
+	Owner string
+	Model string
+	// Tenant matches entries of one tenant; "default" matches entries
+	// without a tenant
+	Tenant string
+}
+
+func (f Filter) match(e *Entry) bool {
+	return (f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until)) &&
+		(f.KeyID == "" || e.KeyID == f.KeyID) &&
+		(f.Owner == "" || e.Owner == f.Owner) &&
+		(f.Model == "" || strings.EqualFold(e.Model, f.Model)) &&
+		(f.Tenant == "" || tenantOf(e) == f.Tenant)
+}
+
+func tenantOf(e *Entry) string {
+	if e.Tenant == "" {
+		return "default"
+	}
+	return e.Tenant
+}
+
+// Row is one group of a usage report.
+type Row struct {
+	Group            []string `json:"-"` // values of the group-by fields, in order
+	Requests         int64    `json:"requests"`
+	Errors           int64    `json:"errors"`
+	PromptTokens     int64    `json:"prompt_tokens"`
+	CompletionTokens int64    `json:"completion_tokens"`
+	CachedTokens     int64    `json:"cached_tokens"`
+	ReasoningTokens  int64    `json:"reasoning_tokens"`
+	TotalTokens      int64    `json:"total_tokens"`
+	AvgLatencyMS     int64    `json:"avg_latency_ms"`
+
+	latencySum int64
+}
+
+// MetricColumns names the metric columns of a Row, in CSV order.
+var MetricColumns = []string{"requests", "errors", "prompt_tokens", "completion_tokens", "cached_tokens", "reasoning_tokens", "total_tokens", "avg_latency_ms"}
+
+// Metrics returns the row's metrics in MetricColumns order.
+func (r *Row) Metrics() []string {
+	values := []int64{r.Requests, r.Errors, r.PromptTokens, r.CompletionTokens, r.CachedTokens, r.ReasoningTokens, r.TotalTokens, r.AvgLatencyMS}
+	out := make([]string, len(values))
+	for i, v := range values {
+		out[i] = strconv.FormatInt(v, 10)
+	}
+	return out
+}
+
+func groupValue(e *Entry, field string) string {
+	switch field {
+	case "tenant":
+		return tenantOf(e)
+	case "key":
+		return e.KeyID
+	case "owner":
+		return e.Owner
+	case "model":
+		return e.Model
+	case "deployment":
+		return e.Deployment
+	case "backend":
+		return e.Backend
+	case "route":
+		return e.Route
+	case "status":
+		return strconv.Itoa(e.Status)
+	case "day":
+		return e.Time.UTC().Format("2006-01-02")
+	}
+	return ""
+}
+
+// ValidateGroupBy checks that every field can be grouped by.
+func ValidateGroupBy(fields []string) error {
+	for _, f := range fields {
+		found := false
+		for _, g := range GroupFields {
+			found = found || f == g
+		}
+		if !found {
+			return fmt.Errorf("cannot group by %q, expected one of %s", f, strings.Join(GroupFields, ", "))
+		}
+	}
+	return nil
+}
+
+// Query aggregates the entries matching filter, grouped by the given fields.
+// Rows are ordered by their group values.
+func Query(filter Filter, groupBy []string) ([]Row, error) {
+	if err := ValidateGroupBy(groupBy); err != nil {
+		return nil, err
+	}
+	if !Enabled() {
+		return []Row{}, nil
+	}
+	f, err := os.Open(Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []Row{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// The file is only appended to, so the entries up to the end of the
+	// last complete batch can be read while the writer carries on
+	fileMu.RLock()
+	info, err := f.Stat()
+	fileMu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string]*Row)
+	scanner := bufio.NewScanner(io.LimitReader(f, info.Size()))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil || !filter.match(&e) {
+			continue
+		}
+		values := make([]string, len(groupBy))
+		for i, field := range groupBy {
+			values[i] = groupValue(&e, field)
+		}
+		id := strings.Join(values, "\x00")
+		row, ok := groups[id]
+		if !ok {
+			row = &Row{Group: values}
+			groups[id] = row
+		}
+		row.Requests++
+		if e.Status >= 400 {
+			row.Errors++
+		}
+		row.PromptTokens += e.PromptTokens
+		row.CompletionTokens += e.CompletionTokens
+		row.CachedTokens += e.CachedTokens
+		row.ReasoningTokens += e.ReasoningTokens
+		row.TotalTokens += e.TotalTokens
+		row.latencySum += e.LatencyMS
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	rows := make([]Row, 0, len(groups))
+	for _, row := range groups {
+		row.AvgLatencyMS = row.latencySum / row.Requests
+		rows = append(rows, *row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return strings.Join(rows[i].Group, "\x00") < strings.Join(rows[j].Group, "\x00")
+	})
+	return rows, nil
+}
@@ -0,0 +1,154 @@
+package ledger
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// useLedger points Path at a new file holding entries.
+func useLedger(t *testing.T, entries ...Entry) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := json.NewEncoder(f)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	saved := Path
+	Path = path
+	t.Cleanup(func() { Path = saved })
+}
+
+var (
+	day1 = time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	day2 = time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)
+)
+
+func TestQueryGroups(t *testing.T) {
+	useLedger(t,
+		Entry{Time: day1, KeyID: "a", Model: "gpt-4o", Status: 200, LatencyMS: 100, PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15},
+		Entry{Time: day1, KeyID: "a", Model: "gpt-4o", Status: 429, LatencyMS: 300},
+		Entry{Time: day2, KeyID: "a", Model: "gpt-4o-mini", Status: 200, LatencyMS: 50, TotalTokens: 7, CachedTokens: 4},
+		Entry{Time: day2, KeyID: "b", Tenant: "retail", Model: "gpt-4o", Status: 200, TotalTokens: 3},
+	)
+
+	rows, err := Query(Filter{}, []string{"key", "model"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Row{
+		{Group: []string{"a", "gpt-4o"}, Requests: 2, Errors: 1, PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15, AvgLatencyMS: 200},
+		{Group: []string{"a", "gpt-4o-mini"}, Requests: 1, CachedTokens: 4, TotalTokens: 7, AvgLatencyMS: 50},
+		{Group: []string{"b", "gpt-4o"}, Requests: 1, TotalTokens: 3},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("Query() = %d rows, want %d: %+v", len(rows), len(want), rows)
+	}
+	for i, row := range rows {
+		if !slices.Equal(row.Metrics(), want[i].Metrics()) || !slices.Equal(row.Group, want[i].Group) {
+			t.Errorf("row %d = %v %v, want %v %v", i, row.Group, row.Metrics(), want[i].Group, want[i].Metrics())
+		}
+	}
+
+	rows, err = Query(Filter{}, []string{"tenant", "day"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var groups [][]string
+	for _, row := range rows {
+		groups = append(groups, row.Group)
+	}
+	wantGroups := [][]string{{"default", "2026-03-01"}, {"default", "2026-03-02"}, {"retail", "2026-03-02"}}
+	if !slices.EqualFunc(groups, wantGroups, slices.Equal) {
+		t.Errorf("groups = %v, want %v", groups, wantGroups)
+	}
+
+	if _, err := Query(Filter{}, []string{"colour"}); err == nil {
+		t.Error("Query() grouped by an unknown field")
+	}
+}
+
+func TestQueryFilter(t *testing.T) {
+	useLedger(t,
+		Entry{Time: day1, KeyID: "a", Owner: "alice", Model: "gpt-4o", Status: 200},
+		Entry{Time: day2, KeyID: "a", Owner: "alice", Model: "GPT-4o", Status: 200},
+		Entry{Time: day2, KeyID: "b", Owner: "bob", Tenant: "retail", Model: "gpt-4o-mini", Status: 200},
+	)
+	tests := []struct {
+		name   string
+		filter Filter
+		want   int64
+	}{
+		{"everything", Filter{}, 3},
+		{"since", Filter{Since: day2}, 2},
+		{"until", Filter{Until: day2}, 1},
+		{"key", Filter{KeyID: "b"}, 1},
+		{"owner", Filter{Owner: "alice"}, 2},
+		{"model ignores case", Filter{Model: "gpt-4o"}, 2},
+		{"default tenant", Filter{Tenant: "default"}, 2},
+		{"tenant", Filter{Tenant: "retail"}, 1},
+		{"nothing", Filter{KeyID: "c"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := Query(tt.filter, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got int64
+			for _, row := range rows {
+				got += row.Requests
+			}
+			if got != tt.want {
+				t.Errorf("Query() counted %d requests, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryWhileRecording(t *testing.T) {
+	useLedger(t)
+
+	// Entries recorded during queries are all written
+	const n = 20000
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range n {
+			Record(Entry{Time: day1, KeyID: "a", Status: 200, TotalTokens: int64(i % 2)})
+		}
+	}()
+	var last int64
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		rows, err := Query(Filter{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got int64
+		if len(rows) == 1 {
+			got = rows[0].Requests
+		}
+		if got < last {
+			t.Fatalf("Query() counted %d requests after counting %d", got, last)
+		}
+		if last = got; last == n {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Query() counted %d of %d recorded requests", last, n)
+		}
+	}
+	<-done
+}
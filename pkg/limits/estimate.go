@@ -0,0 +1,39 @@
+package limits
+
+import (
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// bytesPerToken approximates how much request JSON makes up one prompt
+// token. It only sizes the up-front charge; the response's usage replaces it.
+const bytesPerToken = 4
+
+// EstimateTokens estimates the tokens a request will use: its prompt plus the
+// completion it may generate. Non-JSON bodies, such as audio uploads, are not
+// charged up front.
+func EstimateTokens(path string, body []byte) int {
+	if !gjson.ValidBytes(body) {
+		return 0
+	}
+	req := gjson.ParseBytes(body)
+	prompt := len(body) / bytesPerToken
+
+	path = strings.TrimPrefix(path, "/v1")
+	if !strings.HasPrefix(path, "/chat/") && path != "/completions" && !strings.HasPrefix(path, "/responses") {
+		return prompt
+	}
+
+	completion := DefaultMaxTokens
+	for _, field := range []string{"max_completion_tokens", "max_tokens", "max_output_tokens"} {
+		if v := req.Get(field); v.Exists() {
+			completion = int(v.Int())
+			break
+		}
+	}
+	if n := req.Get("n").Int(); n > 1 {
+		completion *= int(n)
+	}
+	return prompt + completion
+}
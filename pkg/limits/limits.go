@@ -0,0 +1,282 @@
+// Package limits implements request-per-minute and token-per-minute rate
+// limiting with token buckets, and concurrency limits with fair queueing.
+package limits
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit is a per-minute budget. Zero means unlimited.
+type Limit struct {
+	RPM int `json:"rpm,omitempty"`
+	TPM int `json:"tpm,omitempty"`
+}
+
+// IsZero reports whether the limit allows everything.
+func (l Limit) IsZero() bool { return l.RPM <= 0 && l.TPM <= 0 }
+
+var (
+	// KeyDefault applies to every virtual key without its own limit.
+	KeyDefault Limit
+	// ModelLimits are shared by all callers of a model alias (lowercase).
+	ModelLimits = make(map[string]Limit)
+	// DefaultMaxTokens is charged for completions when the request sets no
+	// max_tokens, until the response reports the real usage.
+	DefaultMaxTokens = 1024
+
+	// Default is the process-wide limiter.
+	Default = NewLimiter()
+)
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_RATE_LIMIT_KEY_RPM"); v != "" {
+		KeyDefault.RPM = atoi("AZURE_OPENAI_RATE_LIMIT_KEY_RPM", v)
+	}
+	if v := os.Getenv("AZURE_OPENAI_RATE_LIMIT_KEY_TPM"); v != "" {
+		KeyDefault.TPM = atoi("AZURE_OPENAI_RATE_LIMIT_KEY_TPM", v)
+	}
+	if v := os.Getenv("AZURE_OPENAI_RATE_LIMIT_MODELS"); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			model, limit, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok {
+				slog.Warn("Ignoring invalid rate limit, expected model=rpm:tpm", "value", pair)
+				continue
+			}
+			rpm, tpm, _ := strings.Cut(limit, ":")
+			l := Limit{}
+			if rpm != "" {
+				l.RPM = atoi("AZURE_OPENAI_RATE_LIMIT_MODELS", rpm)
+			}
+			if tpm != "" {
+				l.TPM = atoi("AZURE_OPENAI_RATE_LIMIT_MODELS", tpm)
+			}
+			ModelLimits[strings.ToLower(strings.TrimSpace(model))] = l
+		}
+	}
+	if v := os.Getenv("AZURE_OPENAI_RATE_LIMIT_DEFAULT_MAX_TOKENS"); v != "" {
+		DefaultMaxTokens = atoi("AZURE_OPENAI_RATE_LIMIT_DEFAULT_MAX_TOKENS", v)
+	}
+	if !KeyDefault.IsZero() || len(ModelLimits) > 0 {
+		slog.Info("Rate limiting enabled", "key_rpm", KeyDefault.RPM, "key_tpm", KeyDefault.TPM, "model_limits", len(ModelLimits))
+	}
+}
+
+func atoi(name, v string) int {
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || n < 0 {
+		slog.Warn("Ignoring invalid "+name, "value", v)
+		return 0
+	}
+	return n
+}
+
+// ModelLimit returns the limit configured for a model alias.
+func ModelLimit(model string) (Limit, bool) {
+	l, ok := ModelLimits[strings.ToLower(model)]
+	return l, ok && !l.IsZero()
+}
+
+// bucket is a token bucket refilled continuously at capacity per minute. Its
+// level may go negative when a request used more than it reserved.
+type bucket struct {
+	capacity float64
+	level    float64
+	last     time.Time
+}
+
+func newBucket(capacity int, now time.Time) *bucket {
+	return &bucket{capacity: float64(capacity), level: float64(capacity), last: now}
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.level = math.Min(b.capacity, b.level+b.capacity*now.Sub(b.last).Minutes())
+	b.last = now
+}
+
+// wait returns how long until the bucket holds n. A request larger than the
+// whole bucket only needs it to be full.
+func (b *bucket) wait(n float64) time.Duration {
+	n = math.Min(n, b.capacity)
+	if b.level >= n {
+		return 0
+	}
+	return time.Duration((n - b.level) / b.capacity * float64(time.Minute))
+}
+
+// resetIn returns how long until the bucket is full again.
+func (b *bucket) resetIn() time.Duration {
+	return time.Duration((b.capacity - b.level) / b.capacity * float64(time.Minute))
+}
+
+func (b *bucket) remaining() int {
+	return max(0, int(b.level))
+}
+
+// Scope is one limit a request counts against, such as a key or a model.
+type Scope struct {
+	Name  string
+	Limit Limit
+}
+
+type scopeBuckets struct {
+	limit    Limit
+	requests *bucket
+	tokens   *bucket
+}
+
+// Limiter tracks buckets by scope name.
+type Limiter struct {
+	mu     sync.Mutex
+	scopes map[string]*scopeBuckets
+}
+
+// NewLimiter creates an empty limiter.
+func NewLimiter() *Limiter {
+	return &Limiter{scopes: make(map[string]*scopeBuckets)}
+}
+
+// buckets returns the buckets of a scope, recreating them when its limit has
+// changed. Callers hold l.mu.
+func (l *Limiter) buckets(s Scope, now time.Time) *scopeBuckets {
+	sb, ok := l.scopes[s.Name]
+	if !ok || sb.limit != s.Limit {
+		sb = &scopeBuckets{limit: s.Limit}
+		if s.Limit.RPM > 0 {
+			sb.requests = newBucket(s.Limit.RPM, now)
+		}
+		if s.Limit.TPM > 0 {
+			sb.tokens = newBucket(s.Limit.TPM, now)
+		}
+		l.scopes[s.Name] = sb
+	}
+	if sb.requests != nil {
+		sb.requests.refill(now)
+	}
+	if sb.tokens != nil {
+		sb.tokens.refill(now)
+	}
+	return sb
+}
+
+// Status describes the tightest limit a request met, in the form of the
+// OpenAI x-ratelimit-* headers.
+type Status struct {
+	Scope             string // the scope that refused the request
+	LimitRequests     int
+	RemainingRequests int
+	ResetRequests     time.Duration
+	LimitTokens       int
+	RemainingTokens   int
+	ResetTokens       time.Duration
+	RetryAfter        time.Duration // set when the request was refused
+	Reason            string        // "requests" or "tokens" when refused
+}
+
+// SetHeaders writes the x-ratelimit-* headers for the limits that apply.
+func (s Status) SetHeaders(h http.Header) {
+	if s.LimitRequests > 0 {
+		h.Set("x-ratelimit-limit-requests", strconv.Itoa(s.LimitRequests))
+		h.Set("x-ratelimit-remaining-requests", strconv.Itoa(s.RemainingRequests))
+		h.Set("x-ratelimit-reset-requests", FormatDuration(s.ResetRequests))
+	}
+	if s.LimitTokens > 0 {
+		h.Set("x-ratelimit-limit-tokens", strconv.Itoa(s.LimitTokens))
+		h.Set("x-ratelimit-remaining-tokens", strconv.Itoa(s.RemainingTokens))
+		h.Set("x-ratelimit-reset-tokens", FormatDuration(s.ResetTokens))
+	}
+	if s.RetryAfter > 0 {
+		h.Set("Retry-After", strconv.Itoa(int(math.Ceil(s.RetryAfter.Seconds()))))
+	}
+}
+
+// FormatDuration renders a duration the way OpenAI does, e.g. "1s" or "6m0s".
+func FormatDuration(d time.Duration) string {
+	if d < time.Second {
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	}
+	return d.Round(time.Second).String()
+}
+
+// Reservation is the charge taken for an admitted request.
+type Reservation struct {
+	l      *Limiter
+	scopes []Scope
+	tokens int
+}
+
+// Reserve admits a request estimated to use tokens against every scope, or
+// refuses it without charging anything. The returned status is filled in
+// either way.
+func (l *Limiter) Reserve(scopes []Scope, tokens int) (*Reservation, Status, bool) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var st Status
+	ok := true
+	all := make([]*scopeBuckets, len(scopes))
+	for i, s := range scopes {
+		sb := l.buckets(s, now)
+		all[i] = sb
+		if sb.requests != nil {
+			if w := sb.requests.wait(1); w > 0 && w >= st.RetryAfter {
+				ok, st.RetryAfter, st.Reason, st.Scope = false, w, "requests", s.Name
+			}
+		}
+		if sb.tokens != nil {
+			if w := sb.tokens.wait(float64(tokens)); w > 0 && w >= st.RetryAfter {
+				ok, st.RetryAfter, st.Reason, st.Scope = false, w, "tokens", s.Name
+			}
+		}
+	}
+
+	if ok {
+		for _, sb := range all {
+			if sb.requests != nil {
+				sb.requests.level--
+			}
+			if sb.tokens != nil {
+				sb.tokens.level -= float64(tokens)
+			}
+		}
+	}
+
+	// Report the scope with the least headroom
+	for _, sb := range all {
+		if sb.requests != nil && (st.LimitRequests == 0 || sb.requests.remaining() < st.RemainingRequests) {
+			st.LimitRequests, st.RemainingRequests, st.ResetRequests = sb.limit.RPM, sb.requests.remaining(), sb.requests.resetIn()
+		}
+		if sb.tokens != nil && (st.LimitTokens == 0 || sb.tokens.remaining() < st.RemainingTokens) {
+			st.LimitTokens, st.RemainingTokens, st.ResetTokens = sb.limit.TPM, sb.tokens.remaining(), sb.tokens.resetIn()
+		}
+	}
+
+	if !ok {
+		return nil, st, false
+	}
+	return &Reservation{l: l, scopes: scopes, tokens: tokens}, st, true
+}
+
+// Reconcile replaces the estimated token charge with what the request
+// actually used. Pass 0 to refund a request the upstream did not serve.
+func (r *Reservation) Reconcile(actual int) {
+	if r == nil || actual == r.tokens {
+		return
+	}
+	r.l.mu.Lock()
+	defer r.l.mu.Unlock()
+	for _, s := range r.scopes {
+		if sb, ok := r.l.scopes[s.Name]; ok && sb.tokens != nil {
+			sb.tokens.level = math.Min(sb.tokens.capacity, sb.tokens.level-float64(actual-r.tokens))
+		}
+	}
+	r.tokens = actual
+}
@@ -0,0 +1,95 @@
+package limits
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestReserveRequests(t *testing.T) {
+	l := NewLimiter()
+	key := []Scope{{Name: "key:a", Limit: Limit{RPM: 2}}}
+	for i := range 2 {
+		if _, st, ok := l.Reserve(key, 0); !ok {
+			t.Fatalf("request %d refused: %+v", i+1, st)
+		}
+	}
+	_, st, ok := l.Reserve(key, 0)
+	if ok {
+		t.Fatal("third request admitted with an RPM of 2")
+	}
+	if st.Reason != "requests" || st.Scope != "key:a" || st.RemainingRequests != 0 {
+		t.Errorf("status = %+v", st)
+	}
+	// One request comes back every 30s
+	if st.RetryAfter < 29*time.Second || st.RetryAfter > 30*time.Second {
+		t.Errorf("RetryAfter = %s, want about 30s", st.RetryAfter)
+	}
+}
+
+func TestReserveTokens(t *testing.T) {
+	l := NewLimiter()
+	key := []Scope{{Name: "key:a", Limit: Limit{TPM: 100}}}
+	r, _, ok := l.Reserve(key, 80)
+	if !ok {
+		t.Fatal("first request refused")
+	}
+	if _, st, ok := l.Reserve(key, 30); ok || st.Reason != "tokens" {
+		t.Fatalf("second request admitted past the TPM: %+v", st)
+	}
+
+	// The first request used less than estimated
+	r.Reconcile(20)
+	if _, st, ok := l.Reserve(key, 30); !ok {
+		t.Fatalf("request refused after reconciling: %+v", st)
+	}
+
+	// A request larger than the whole bucket only waits for it to be full
+	big := []Scope{{Name: "key:b", Limit: Limit{TPM: 100}}}
+	if _, st, ok := l.Reserve(big, 1000); !ok {
+		t.Fatalf("oversized request refused by a full bucket: %+v", st)
+	}
+}
+
+func TestReserveRefusalChargesNothing(t *testing.T) {
+	l := NewLimiter()
+	scopes := []Scope{
+		{Name: "key:a", Limit: Limit{RPM: 10}},
+		{Name: "model:gpt-4o", Limit: Limit{RPM: 1}},
+	}
+	if _, _, ok := l.Reserve(scopes, 0); !ok {
+		t.Fatal("first request refused")
+	}
+	_, st, ok := l.Reserve(scopes, 0)
+	if ok || st.Scope != "model:gpt-4o" {
+		t.Fatalf("status = %+v, want refusal by the model", st)
+	}
+	// The key was charged for the two admitted requests only
+	_, st, _ = l.Reserve(scopes[:1], 0)
+	if st.RemainingRequests != 8 {
+		t.Errorf("key remaining = %d, want 8", st.RemainingRequests)
+	}
+}
+
+func TestStatusHeaders(t *testing.T) {
+	h := make(http.Header)
+	Status{
+		LimitRequests: 60, RemainingRequests: 59, ResetRequests: time.Second,
+		LimitTokens: 1000, RemainingTokens: 0, ResetTokens: 6 * time.Minute,
+		RetryAfter: 1500 * time.Millisecond,
+	}.SetHeaders(h)
+	want := map[string]string{
+		"x-ratelimit-limit-requests":     "60",
+		"x-ratelimit-remaining-requests": "59",
+		"x-ratelimit-reset-requests":     "1s",
+		"x-ratelimit-limit-tokens":       "1000",
+		"x-ratelimit-remaining-tokens":   "0",
+		"x-ratelimit-reset-tokens":       "6m0s",
+		"Retry-After":                    "2",
+	}
+	for name, v := range want {
+		if got := h.Get(name); got != v {
+			t.Errorf("%s = %q, want %q", name, got, v)
+		}
+	}
+}
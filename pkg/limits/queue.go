@@ -0,0 +1,292 @@
+package limits
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Priority classes, highest first. Waiting requests of a higher class are
+// always admitted before those of a lower one.
+const (
+	PriorityHigh = iota
+	PriorityNormal
+	PriorityLow
+	numPriorities
+)
+
+// PriorityNames lists the classes in order, as used in keys, policies and
+// the x-priority header.
+var PriorityNames = []string{"high", "normal", "low"}
+
+// ParsePriority returns the class named s. An empty name is normal.
+func ParsePriority(s string) (int, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return PriorityNormal, true
+	}
+	for i, name := range PriorityNames {
+		if s == name {
+			return i, true
+		}
+	}
+	return PriorityNormal, false
+}
+
+var (
+	// KeyConcurrency caps the in-flight requests of every key without its
+	// own limit. Zero is unlimited.
+	KeyConcurrency int
+	// ModelConcurrency caps the in-flight requests to a model alias
+	// (lowercase), shared by all callers.
+	ModelConcurrency = make(map[string]int)
+	// QueueSize is how many requests may wait for each key or model.
+	QueueSize = 100
+	// QueueTimeout is how long a request waits for a slot before it is
+	// rejected.
+	QueueTimeout = 30 * time.Second
+
+	// ErrQueueFull and ErrQueueTimeout are returned by Gate.Acquire when a
+	// request is not admitted.
+	ErrQueueFull    = errors.New("queue is full")
+	ErrQueueTimeout = errors.New("timed out waiting in queue")
+
+	// Gates is the process-wide set of concurrency gates.
+	Gates = NewGateSet()
+)
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_CONCURRENCY_KEY"); v != "" {
+		KeyConcurrency = atoi("AZURE_OPENAI_CONCURRENCY_KEY", v)
+	}
+	if v := os.Getenv("AZURE_OPENAI_CONCURRENCY_MODELS"); v != "" {
+		for _, pair := range strings.Split(v, ",") {
+			model, n, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok {
+				slog.Warn("Ignoring invalid concurrency limit, expected model=n", "value", pair)
+				continue
+			}
+			ModelConcurrency[strings.ToLower(strings.TrimSpace(model))] = atoi("AZURE_OPENAI_CONCURRENCY_MODELS", n)
+		}
+	}
+	if v := os.Getenv("AZURE_OPENAI_QUEUE_SIZE"); v != "" {
+		QueueSize = atoi("AZURE_OPENAI_QUEUE_SIZE", v)
+	}
+	if v := os.Getenv("AZURE_OPENAI_QUEUE_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			QueueTimeout = d
+		} else {
+			slog.Warn("Invalid AZURE_OPENAI_QUEUE_TIMEOUT, using default", "value", v, "default", QueueTimeout.String())
+		}
+	}
+	if KeyConcurrency > 0 || len(ModelConcurrency) > 0 {
+		slog.Info("Concurrency limiting enabled", "per_key", KeyConcurrency, "model_limits", len(ModelConcurrency), "queue_size", QueueSize, "queue_timeout", QueueTimeout.String())
+	}
+}
+
+// ModelConcurrencyLimit returns the concurrency limit of a model alias.
+func ModelConcurrencyLimit(model string) (int, bool) {
+	n, ok := ModelConcurrency[strings.ToLower(model)]
+	return n, ok && n > 0
+}
+
+// waiter is a request queued at a gate. ready is closed once it holds a slot.
+type waiter struct {
+	tenant  string
+	ready   chan struct{}
+	granted bool
+}
+
+// class queues the waiters of one priority, per tenant. Tenants take turns,
+// so a tenant with many queued requests cannot starve the others.
+type class struct {
+	tenants  []string // round-robin order of tenants with waiters
+	next     int
+	byTenant map[string][]*waiter
+}
+
+func (c *class) push(w *waiter) {
+	if len(c.byTenant[w.tenant]) == 0 {
+		c.tenants = append(c.tenants, w.tenant)
+	}
+	c.byTenant[w.tenant] = append(c.byTenant[w.tenant], w)
+}
+
+// pop removes the head waiter of the next tenant in turn.
+func (c *class) pop() *waiter {
+	if len(c.tenants) == 0 {
+		return nil
+	}
+	if c.next >= len(c.tenants) {
+		c.next = 0
+	}
+	tenant := c.tenants[c.next]
+	queue := c.byTenant[tenant]
+	w := queue[0]
+	if len(queue) == 1 {
+		delete(c.byTenant, tenant)
+		c.tenants = append(c.tenants[:c.next], c.tenants[c.next+1:]...)
+	} else {
+		c.byTenant[tenant] = queue[1:]
+		c.next++
+	}
+	return w
+}
+
+// remove drops a waiter that gave up.
+func (c *class) remove(w *waiter) {
+	queue := c.byTenant[w.tenant]
+	for i, q := range queue {
+		if q != w {
+			continue
+		}
+		queue = append(queue[:i], queue[i+1:]...)
+		break
+	}
+	if len(queue) > 0 {
+		c.byTenant[w.tenant] = queue
+		return
+	}
+	delete(c.byTenant, w.tenant)
+	for i, t := range c.tenants {
+		if t == w.tenant {
+			c.tenants = append(c.tenants[:i], c.tenants[i+1:]...)
+			if c.next > i {
+				c.next--
+			}
+			break
+		}
+	}
+}
+
+// Gate admits up to a limit of concurrent requests and queues the rest by
+// priority, taking turns between tenants within a priority.
+type Gate struct {
+	mu      sync.Mutex
+	limit   int
+	active  int
+	waiting int
+	classes [numPriorities]class
+}
+
+// NewGate creates a gate admitting limit requests at a time.
+func NewGate(limit int) *Gate {
+	g := &Gate{limit: limit}
+	for i := range g.classes {
+		g.classes[i].byTenant = make(map[string][]*waiter)
+	}
+	return g
+}
+
+// Acquire waits for a slot until ctx is done. The returned function releases
+// the slot and must be called exactly once.
+func (g *Gate) Acquire(ctx context.Context, tenant string, priority int) (func(), error) {
+	g.mu.Lock()
+	if g.active < g.limit && g.waiting == 0 {
+		g.active++
+		g.mu.Unlock()
+		return g.release, nil
+	}
+	if g.waiting >= QueueSize {
+		g.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+	w := &waiter{tenant: tenant, ready: make(chan struct{})}
+	g.classes[priority].push(w)
+	g.waiting++
+	g.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return g.release, nil
+	case <-ctx.Done():
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if w.granted {
+		// The slot was handed over just as the wait ended
+		return g.release, nil
+	}
+	g.classes[priority].remove(w)
+	g.waiting--
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, ErrQueueTimeout
+	}
+	return nil, ctx.Err()
+}
+
+// release hands the slot to the next waiter, or frees it.
+func (g *Gate) release() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.active--
+	g.admit()
+}
+
+// admit grants free slots to waiters. g.mu must be held.
+func (g *Gate) admit() {
+	for g.active < g.limit && g.waiting > 0 {
+		var w *waiter
+		for i := range g.classes {
+			if w = g.classes[i].pop(); w != nil {
+				break
+			}
+		}
+		g.waiting--
+		g.active++
+		w.granted = true
+		close(w.ready)
+	}
+}
+
+// SetLimit changes the number of concurrent requests, admitting waiters if
+// it grew.
+func (g *Gate) SetLimit(limit int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.limit = limit
+	g.admit()
+}
+
+// Stats returns the requests in flight and waiting.
+func (g *Gate) Stats() (active, waiting int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.active, g.waiting
+}
+
+// GateSet holds a gate per scope, created on first use.
+type GateSet struct {
+	mu    sync.Mutex
+	gates map[string]*Gate
+}
+
+// NewGateSet creates an empty set.
+func NewGateSet() *GateSet {
+	return &GateSet{gates: make(map[string]*Gate)}
+}
+
+// Get returns the gate of a scope, creating it or updating its limit.
+func (s *GateSet) Get(scope string, limit int) *Gate {
+	s.mu.Lock()
+	g, ok := s.gates[scope]
+	if !ok {
+		g = NewGate(limit)
+		s.gates[scope] = g
+	}
+	s.mu.Unlock()
+	if ok {
+		g.mu.Lock()
+		changed := g.limit != limit
+		g.mu.Unlock()
+		if changed {
+			g.SetLimit(limit)
+		}
+	}
+	return g
+}
@@ -0,0 +1,145 @@
+package limits
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// queueUp starts a request per name on g, in order, each waiting until the
+// previous one is queued. Admitted requests report their name and release
+// their slot right away.
+func queueUp(t *testing.T, g *Gate, tenants []string, priorities []int, names []string) <-chan string {
+	t.Helper()
+	admitted := make(chan string, len(names))
+	for i, name := range names {
+		go func() {
+			release, err := g.Acquire(context.Background(), tenants[i], priorities[i])
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+				admitted <- ""
+				return
+			}
+			admitted <- name
+			release()
+		}()
+		waitFor(t, g, i+1)
+	}
+	return admitted
+}
+
+func waitFor(t *testing.T, g *Gate, waiting int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, n := g.Stats(); n == waiting {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests never queued", waiting)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func admissionOrder(admitted <-chan string, n int) []string {
+	order := make([]string, n)
+	for i := range order {
+		order[i] = <-admitted
+	}
+	return order
+}
+
+func TestGateAdmitsByPriority(t *testing.T) {
+	g := NewGate(1)
+	hold, err := g.Acquire(context.Background(), "a", PriorityNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admitted := queueUp(t, g,
+		[]string{"a", "a", "a"},
+		[]int{PriorityLow, PriorityNormal, PriorityHigh},
+		[]string{"low", "normal", "high"})
+	hold()
+
+	want := []string{"high", "normal", "low"}
+	if got := admissionOrder(admitted, 3); !slices.Equal(got, want) {
+		t.Errorf("admitted %v, want %v", got, want)
+	}
+}
+
+func TestGateTakesTurnsBetweenTenants(t *testing.T) {
+	g := NewGate(1)
+	hold, err := g.Acquire(context.Background(), "a", PriorityNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admitted := queueUp(t, g,
+		[]string{"a", "a", "a", "b"},
+		[]int{PriorityNormal, PriorityNormal, PriorityNormal, PriorityNormal},
+		[]string{"a1", "a2", "a3", "b1"})
+	hold()
+
+	want := []string{"a1", "b1", "a2", "a3"}
+	if got := admissionOrder(admitted, 4); !slices.Equal(got, want) {
+		t.Errorf("admitted %v, want %v", got, want)
+	}
+}
+
+func TestGateRejects(t *testing.T) {
+	saved := QueueSize
+	QueueSize = 1
+	t.Cleanup(func() { QueueSize = saved })
+
+	g := NewGate(1)
+	hold, err := g.Acquire(context.Background(), "a", PriorityNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := g.Acquire(ctx, "a", PriorityNormal)
+		done <- err
+	}()
+	waitFor(t, g, 1)
+
+	if _, err := g.Acquire(context.Background(), "b", PriorityHigh); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Acquire() on a full queue = %v, want ErrQueueFull", err)
+	}
+	if err := <-done; !errors.Is(err, ErrQueueTimeout) {
+		t.Errorf("Acquire() past its deadline = %v, want ErrQueueTimeout", err)
+	}
+
+	// The waiter that gave up left the queue and never took the slot
+	if active, waiting := g.Stats(); active != 1 || waiting != 0 {
+		t.Errorf("Stats() = %d active, %d waiting, want 1, 0", active, waiting)
+	}
+	hold()
+	if active, _ := g.Stats(); active != 0 {
+		t.Errorf("%d requests active after release", active)
+	}
+}
+
+func TestGateSetLimit(t *testing.T) {
+	s := NewGateSet()
+	g := s.Get("model:gpt-4o", 1)
+	hold, err := g.Acquire(context.Background(), "a", PriorityNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admitted := queueUp(t, g, []string{"a"}, []int{PriorityNormal}, []string{"queued"})
+
+	// Raising the limit admits the waiter without a release
+	if s.Get("model:gpt-4o", 2) != g {
+		t.Fatal("GateSet.Get() replaced the gate")
+	}
+	if got := <-admitted; got != "queued" {
+		t.Errorf("admitted %q", got)
+	}
+	hold()
+}
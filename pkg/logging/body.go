@@ -0,0 +1,101 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Body logging policies.
+const (
+	BodiesOff       = "off"       // bodies are never logged
+	BodiesTruncated = "truncated" // the first BodyLimit bytes are logged
+	BodiesRedacted  = "redacted"  // JSON structure is logged with every string value hidden
+	BodiesFull      = "full"      // bodies are logged as they are
+)
+
+var (
+	// BodyPolicy decides how request and response bodies appear in the logs.
+	BodyPolicy = BodiesOff
+	// BodyLimit is how many bytes of a body the truncated policy keeps.
+	BodyLimit = 1024
+)
+
+// keptFields are JSON fields whose string values describe a body rather than
+// carry its content, so the redacted policy leaves them readable.
+var keptFields = map[string]bool{
+	"model": true, "role": true, "type": true, "object": true, "id": true,
+	"status": true, "finish_reason": true, "stop_reason": true, "code": true,
+}
+
+func loadBodyPolicy() {
+	if v := strings.ToLower(os.Getenv("AZURE_OPENAI_PROXY_LOG_BODIES")); v != "" {
+		switch v {
+		case BodiesOff, BodiesTruncated, BodiesRedacted, BodiesFull:
+			BodyPolicy = v
+		default:
+			slog.Warn("Invalid AZURE_OPENAI_PROXY_LOG_BODIES, bodies are not logged", "value", v)
+		}
+	}
+	if v := os.Getenv("AZURE_OPENAI_PROXY_LOG_BODY_LIMIT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			slog.Warn("Invalid AZURE_OPENAI_PROXY_LOG_BODY_LIMIT, using default", "value", v, "default", BodyLimit)
+		} else {
+			BodyLimit = n
+		}
+	}
+}
+
+// Body returns a log attribute holding body as BodyPolicy allows. Under the
+// off policy only the body's size is logged.
+func Body(key string, body []byte) slog.Attr {
+	switch BodyPolicy {
+	case BodiesFull:
+		return slog.String(key, string(body))
+	case BodiesTruncated:
+		if len(body) > BodyLimit {
+			return slog.String(key, fmt.Sprintf("%s... (%d more bytes)", body[:BodyLimit], len(body)-BodyLimit))
+		}
+		return slog.String(key, string(body))
+	case BodiesRedacted:
+		return slog.String(key, redact(body))
+	}
+	return slog.Int(key+"_bytes", len(body))
+}
+
+// redact hides every string value of a JSON body, apart from keptFields, and
+// replaces bodies that are not JSON with their size.
+func redact(body []byte) string {
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return fmt.Sprintf("[REDACTED %d bytes]", len(body))
+	}
+	out, err := json.Marshal(redactValue("", v))
+	if err != nil {
+		return fmt.Sprintf("[REDACTED %d bytes]", len(body))
+	}
+	return string(out)
+}
+
+func redactValue(key string, v any) any {
+	switch v := v.(type) {
+	case string:
+		if keptFields[key] {
+			return v
+		}
+		return fmt.Sprintf("[REDACTED %d chars]", len(v))
+	case map[string]any:
+		for k, item := range v {
+			v[k] = redactValue(k, item)
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = redactValue(key, item)
+		}
+	}
+	return v
+}
@@ -0,0 +1,101 @@
+// Package logging configures the proxy's structured logger, tags log lines
+// with the ID of the request they belong to and decides how much of request
+// and response bodies may be written to the logs.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	// Level is the minimum level logged. It can be changed at runtime.
+	Level = new(slog.LevelVar)
+	// Format is "json" or "text".
+	Format = "json"
+)
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_PROXY_LOG_LEVEL"); v != "" {
+		if err := Level.UnmarshalText([]byte(v)); err != nil {
+			slog.Warn("Invalid AZURE_OPENAI_PROXY_LOG_LEVEL, using info", "value", v)
+		}
+	}
+	if v := strings.ToLower(os.Getenv("AZURE_OPENAI_PROXY_LOG_FORMAT")); v != "" {
+		if v != "json" && v != "text" {
+			slog.Warn("Invalid AZURE_OPENAI_PROXY_LOG_FORMAT, using json", "value", v)
+		} else {
+			Format = v
+		}
+	}
+	loadBodyPolicy()
+
+	opts := &slog.HandlerOptions{Level: Level}
+	var handler slog.Handler = slog.NewJSONHandler(os.Stderr, opts)
+	if Format == "text" {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	// Also routes the standard logger through the handler, at info level
+	slog.SetDefault(slog.New(handler))
+}
+
+type requestIDKey struct{}
+
+// requestIDs are the IDs a request is known by: the proxy's own and those
+// the upstream assigned once it answered.
+type requestIDs struct {
+	id       string
+	mu       sync.Mutex
+	upstream []any // alternating log keys and values
+}
+
+// NewRequestID returns a random request ID.
+func NewRequestID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ValidRequestID reports whether a client-supplied request ID is safe to
+// adopt: at most 128 letters, digits and the characters - _ . :
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.:", r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// WithRequestID returns a copy of ctx carrying a request ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, &requestIDs{id: id})
+}
+
+// RequestID returns the request ID carried by ctx, or "".
+func RequestID(ctx context.Context) string {
+	if ids, ok := ctx.Value(requestIDKey{}).(*requestIDs); ok {
+		return ids.id
+	}
+	return ""
+}
+
+// FromContext returns the default logger, tagged with the request ID carried
+// by ctx and the upstream's request IDs once they are known.
+func FromContext(ctx context.Context) *slog.Logger {
+	ids, ok := ctx.Value(requestIDKey{}).(*requestIDs)
+	if !ok {
+		return slog.Default()
+	}
+	ids.mu.Lock()
+	defer ids.mu.Unlock()
+	return slog.Default().With(append([]any{"request_id", ids.id}, ids.upstream...)...)
+}
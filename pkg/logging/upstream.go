@@ -0,0 +1,49 @@
+package logging
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// UpstreamIDHeaders are the response headers Azure and OpenAI use to identify
+// a request in their own logs, with the log key each is recorded under.
+var UpstreamIDHeaders = []struct{ Header, Key string }{
+	{"apim-request-id", "apim_request_id"},
+	{"x-ms-request-id", "x_ms_request_id"},
+	{"x-upstream-request-id", "upstream_request_id"},
+}
+
+// ObserveUpstream records the request IDs of an upstream response, so later
+// log lines about the request carry them. The client already gets the
+// proxy's own x-request-id on every response, so one the upstream assigned
+// itself is passed on as x-upstream-request-id instead.
+func ObserveUpstream(res *http.Response) {
+	ids, ok := res.Request.Context().Value(requestIDKey{}).(*requestIDs)
+	if !ok {
+		return
+	}
+	if theirs := res.Header.Get("X-Request-Id"); theirs != "" && !strings.EqualFold(theirs, ids.id) {
+		res.Header.Set("X-Upstream-Request-Id", theirs)
+	}
+	res.Header.Del("X-Request-Id")
+	RecordUpstreamIDs(res.Request.Context(), res.Header)
+}
+
+// RecordUpstreamIDs records the upstream request IDs in h for the request
+// carried by ctx. The proxy uses it to pass on the IDs of calls it made on a
+// request's behalf with a context of their own.
+func RecordUpstreamIDs(ctx context.Context, h http.Header) {
+	ids, ok := ctx.Value(requestIDKey{}).(*requestIDs)
+	if !ok {
+		return
+	}
+	ids.mu.Lock()
+	defer ids.mu.Unlock()
+	ids.upstream = ids.upstream[:0]
+	for _, u := range UpstreamIDHeaders {
+		if v := h.Get(u.Header); v != "" {
+			ids.upstream = append(ids.upstream, u.Key, v)
+		}
+	}
+}
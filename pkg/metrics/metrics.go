@@ -0,0 +1,211 @@
+// Package metrics collects proxy metrics and serves them in the Prometheus
+// text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metric is a family of series sharing a name and label names.
+type metric struct {
+	name    string
+	help    string
+	kind    string // "counter", "gauge" or "histogram"
+	labels  []string
+	buckets []float64 // upper bounds, histograms only
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labels []string
+	value  float64
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []*metric
+)
+
+func register(m *metric) *metric {
+	m.series = make(map[string]*series)
+	registryMu.Lock()
+	registry = append(registry, m)
+	registryMu.Unlock()
+	return m
+}
+
+// get returns the series for labels, creating it on first use.
+// m.mu must be held.
+func (m *metric) get(labels []string) *series {
+	if len(labels) != len(m.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d labels, got %d", m.name, len(m.labels), len(labels)))
+	}
+	key := strings.Join(labels, "\x00")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labels: append([]string(nil), labels...)}
+		if m.kind == "histogram" {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// Counter is a monotonically increasing value per label set.
+type Counter struct{ m *metric }
+
+// NewCounter registers a counter.
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{register(&metric{name: name, help: help, kind: "counter", labels: labels})}
+}
+
+// Add increases the series for labels by v, which must not be negative.
+func (c *Counter) Add(v float64, labels ...string) {
+	c.m.mu.Lock()
+	c.m.get(labels).value += v
+	c.m.mu.Unlock()
+}
+
+// Inc increases the series for labels by one.
+func (c *Counter) Inc(labels ...string) { c.Add(1, labels...) }
+
+// Gauge is a value per label set that can go up and down.
+type Gauge struct{ m *metric }
+
+// NewGauge registers a gauge.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{register(&metric{name: name, help: help, kind: "gauge", labels: labels})}
+}
+
+// Add changes the series for labels by v.
+func (g *Gauge) Add(v float64, labels ...string) {
+	g.m.mu.Lock()
+	g.m.get(labels).value += v
+	g.m.mu.Unlock()
+}
+
+// Set sets the series for labels to v.
+func (g *Gauge) Set(v float64, labels ...string) {
+	g.m.mu.Lock()
+	g.m.get(labels).value = v
+	g.m.mu.Unlock()
+}
+
+// Histogram counts observations into buckets per label set.
+type Histogram struct{ m *metric }
+
+// NewHistogram registers a histogram with the given bucket upper bounds, in
+// increasing order.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{register(&metric{name: name, help: help, kind: "histogram", labels: labels, buckets: buckets})}
+}
+
+// Observe records v in the series for labels.
+func (h *Histogram) Observe(v float64, labels ...string) {
+	h.m.mu.Lock()
+	defer h.m.mu.Unlock()
+	s := h.m.get(labels)
+	if i := sort.SearchFloat64s(h.m.buckets, v); i < len(s.counts) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+// Write writes every registered metric in the Prometheus text format.
+func Write(w io.Writer) error {
+	registryMu.Lock()
+	metrics := append([]*metric(nil), registry...)
+	registryMu.Unlock()
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name < metrics[j].name })
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+func (m *metric) write(w *bufio.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		labels := formatLabels(m.labels, s.labels)
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, wrap(labels), formatValue(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range m.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, wrap(join(labels, `le="`+formatValue(bound)+`"`)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, wrap(join(labels, `le="+Inf"`)), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, wrap(labels), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, wrap(labels), s.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+func join(labels, extra string) string {
+	if labels == "" {
+		return extra
+	}
+	return labels + "," + extra
+}
+
+func wrap(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Handler serves the registered metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Write(w)
+	})
+}
@@ -0,0 +1,154 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Enabled reports whether /metrics is served and requests are measured.
+var Enabled = true
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_PROXY_METRICS"); v != "" {
+		Enabled, _ = strconv.ParseBool(v)
+	}
+}
+
+// Conversion paths a request can take through the proxy.
+const (
+	ConversionChat       = "chat"       // forwarded in the client's API format
+	ConversionResponses  = "responses"  // chat completions served by the Responses API
+	ConversionAnthropic  = "anthropic"  // chat completions served by the Anthropic Messages API
+	ConversionServerless = "serverless" // sent to a serverless deployment
+)
+
+var (
+	latencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+	ttftBuckets    = []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10, 30}
+
+	// requestLabels identify where a request went.
+	requestLabels = []string{"tenant", "model", "deployment", "backend", "conversion"}
+
+	Requests = NewCounter("azure_oai_proxy_requests_total",
+		"Proxied requests by the status returned to the client.",
+		append(requestLabels, "route", "status")...)
+	RequestDuration = NewHistogram("azure_oai_proxy_request_duration_seconds",
+		"Time from receiving a request to the end of its response, including streams.",
+		latencyBuckets, requestLabels...)
+	TimeToFirstToken = NewHistogram("azure_oai_proxy_time_to_first_token_seconds",
+		"Time from receiving a request to the first byte of its response body.",
+		ttftBuckets, requestLabels...)
+	InFlight = NewGauge("azure_oai_proxy_requests_in_flight",
+		"Requests currently being proxied.",
+		"tenant", "model")
+	UpstreamResponses = NewCounter("azure_oai_proxy_upstream_responses_total",
+		"Responses received from upstreams by status code.",
+		"tenant", "model", "deployment", "backend", "status")
+	Tokens = NewCounter("azure_oai_proxy_tokens_total",
+		"Tokens reported by upstreams, by type: prompt, completion, cached or reasoning.",
+		"tenant", "model", "deployment", "backend", "type")
+	TrafficSplitRequests = NewCounter("azure_oai_proxy_traffic_split_requests_total",
+		"Requests a traffic split sent upstream, by model alias and the deployment it picked.",
+		"model", "deployment")
+	CacheLookups = NewCounter("azure_oai_proxy_cache_lookups_total",
+		"Response cache lookups by cache, exact or semantic, and result: hit, miss or error.",
+		"cache", "tenant", "model", "result")
+	SemanticCacheEntries = NewGauge("azure_oai_proxy_semantic_cache_entries",
+		"Responses held by the semantic cache.")
+	SemanticCacheSimilarity = NewHistogram("azure_oai_proxy_semantic_cache_similarity",
+		"Cosine similarity of the closest cached prompt found by semantic cache lookups.",
+		[]float64{0.5, 0.6, 0.7, 0.8, 0.85, 0.9, 0.925, 0.95, 0.975, 0.99, 1})
+)
+
+type requestKey struct{}
+
+// Request collects what the proxy learns about a request on its way through
+// the pipeline.
+type Request struct {
+	Conversion     string
+	UpstreamStatus int // zero if the request never reached an upstream
+}
+
+// WithRequest attaches a Request to ctx, unless it already carries one.
+func WithRequest(ctx context.Context) (context.Context, *Request) {
+	if r := RequestFrom(ctx); r != nil {
+		return ctx, r
+	}
+	r := &Request{Conversion: ConversionChat}
+	return context.WithValue(ctx, requestKey{}, r), r
+}
+
+// WithoutRequest returns a copy of ctx without a Request, for calls made
+// alongside a request that must not be measured as part of it.
+func WithoutRequest(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestKey{}, (*Request)(nil))
+}
+
+// RequestFrom returns the Request attached to ctx, or nil.
+func RequestFrom(ctx context.Context) *Request {
+	r, _ := ctx.Value(requestKey{}).(*Request)
+	return r
+}
+
+// SetConversion records the conversion path of the request carried by ctx.
+func SetConversion(ctx context.Context, conversion string) {
+	if r := RequestFrom(ctx); r != nil {
+		r.Conversion = conversion
+	}
+}
+
+// ObserveUpstream records the status of an upstream response. It is called
+// from the reverse proxies' ModifyResponse.
+func ObserveUpstream(res *http.Response) {
+	if r := RequestFrom(res.Request.Context()); r != nil {
+		r.UpstreamStatus = res.StatusCode
+	}
+}
+
+// Status formats a status code as a label value.
+func Status(code int) string {
+	if code == 0 {
+		return ""
+	}
+	return strconv.Itoa(code)
+}
+
+// Model normalizes a model alias for use as a label value.
+func Model(model string) string {
+	return strings.ToLower(model)
+}
+
+// OtherModel is the label of model aliases the proxy does not know, so that
+// clients cannot create a series for every name they make up.
+const OtherModel = "other"
+
+// maxServedModels caps the aliases learned from upstream responses, in case
+// an upstream accepts any model name.
+const maxServedModels = 1000
+
+var (
+	servedMu     sync.RWMutex
+	servedModels = make(map[string]bool)
+)
+
+// AddServedModel notes that an upstream answered a request for model, which
+// makes it a known model label from then on.
+func AddServedModel(model string) {
+	model = Model(model)
+	servedMu.Lock()
+	defer servedMu.Unlock()
+	if len(servedModels) < maxServedModels {
+		servedModels[model] = true
+	}
+}
+
+// Served reports whether an upstream has answered a request for model.
+func Served(model string) bool {
+	servedMu.RLock()
+	defer servedMu.RUnlock()
+	return servedModels[Model(model)]
+}
@@ -1,25 +1,69 @@
 package openai
 
 import (
-    "os"
 	"bytes"
+    "context"
+    "encoding/json"
+    "fmt"
     "io"
-    "log"
+    "log/slog"
     "net/http"
     "net/http/httputil"
     "net/url"
+    "os"
     "strings"
+    "time"
+
+    "github.com/gyarbij/azure-oai-proxy/pkg/audit"
+    "github.com/gyarbij/azure-oai-proxy/pkg/logging"
+    "github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+    "github.com/gyarbij/azure-oai-proxy/pkg/tracing"
+    "github.com/gyarbij/azure-oai-proxy/pkg/usage"
 )
 
 var (
     OpenAIEndpoint = "https://api.openai.com"
+    // OpenAIAPIKey, when set, is sent to api.openai.com instead of the
+    // client's credential. It is needed in hybrid mode, where the client's
+    // credential is never passed on.
+    OpenAIAPIKey = ""
+    // Upstreams holds the OpenAI-compatible servers (vLLM, Ollama, LM Studio,
+    // ...) that hybrid mode can route to, keyed by name. "openai" always
+    // refers to OpenAIEndpoint.
+    Upstreams = make(map[string]*Upstream)
 )
 
+// Upstream is an OpenAI-compatible API base URL.
+type Upstream struct {
+    Name    string
+    BaseURL string
+    Key     string // optional; the only credential sent in hybrid mode
+}
+
 func init() {
     // Allow overriding the OpenAI endpoint if needed (e.g., for testing or proxies)
     if v := os.Getenv("OPENAI_API_ENDPOINT"); v != "" {
         OpenAIEndpoint = v
     }
+    OpenAIAPIKey = os.Getenv("OPENAI_API_KEY")
+    Upstreams["openai"] = &Upstream{Name: "openai", BaseURL: OpenAIEndpoint, Key: OpenAIAPIKey}
+
+    // Format: name=http://host:port/v1,name2=...
+    if v := os.Getenv("OPENAI_COMPATIBLE_UPSTREAMS"); v != "" {
+        for _, pair := range strings.Split(v, ",") {
+            name, baseURL, ok := strings.Cut(pair, "=")
+            if !ok || name == "" || baseURL == "" {
+                continue
+            }
+            name = strings.ToLower(name)
+            Upstreams[name] = &Upstream{
+                Name:    name,
+                BaseURL: baseURL,
+                Key:     os.Getenv("OPENAI_COMPATIBLE_KEY_" + strings.ToUpper(name)),
+            }
+            slog.Info("Loaded OpenAI-compatible upstream", "upstream", name, "base_url", baseURL)
+        }
+    }
 }
 
 func NewOpenAIReverseProxy() *httputil.ReverseProxy {
@@ -27,41 +71,127 @@ func NewOpenAIReverseProxy() *httputil.ReverseProxy {
         Director:       makeDirector(),
         ModifyResponse: modifyResponse,
         ErrorHandler:   errorHandler,
+        Transport:      newTransport("openai"),
+    }
+}
+
+// NewUpstreamReverseProxy proxies to an OpenAI-compatible upstream.
+func NewUpstreamReverseProxy(u *Upstream) *httputil.ReverseProxy {
+    return &httputil.ReverseProxy{
+        Director:       makeUpstreamDirector(u, false),
+        ModifyResponse: modifyResponse,
+        ErrorHandler:   errorHandler,
+        Transport:      newTransport(u.Name),
+    }
+}
+
+// newTransport traces requests to the named upstream.
+func newTransport(upstream string) http.RoundTripper {
+    return &tracing.Transport{
+        Base: &audit.Transport{Base: http.DefaultTransport},
+        Describe: func(req *http.Request, span *tracing.Span) {
+            span.SetAttr("gen_ai.system", "openai")
+            span.SetAttr("proxy.backend", upstream)
+        },
     }
 }
 
 func makeDirector() func(*http.Request) {
-    remote, err := url.Parse(OpenAIEndpoint)
+    return makeUpstreamDirector(Upstreams["openai"], true)
+}
+
+// makeUpstreamDirector rewrites requests for u. Clients in openai mode send
+// their own OpenAI key, which is passed on when u has none; otherwise the
+// client's credential is meant for the proxy or Azure and is dropped.
+func makeUpstreamDirector(u *Upstream, passCredential bool) func(*http.Request) {
+    remote, err := url.Parse(u.BaseURL)
     if err != nil {
-        log.Printf("Error parsing OpenAI endpoint: %v", err)
+        slog.Error("Could not parse upstream endpoint, using api.openai.com", "upstream", u.Name, "error", err)
         // Fallback to default
         remote, _ = url.Parse("https://api.openai.com")
     }
 
     return func(req *http.Request) {
-        originURL := req.URL.String()
-        
-        // Preserve the original path and query
-        originalPath := req.URL.Path
-        originalRawQuery := req.URL.RawQuery
+        originPath := req.URL.Path
         
         // Set the scheme and host
         req.URL.Scheme = remote.Scheme
         req.URL.Host = remote.Host
         req.Host = remote.Host
         
-        // Preserve the path - OpenAI uses the same paths as the proxy exposes
-        req.URL.Path = originalPath
-        req.URL.RawQuery = originalRawQuery
+        // OpenAI uses the same paths as the proxy exposes. Base URLs that
+        // already end in /v1 (as vLLM, Ollama and LM Studio are usually
+        // configured) replace the proxy's /v1 prefix.
+        req.URL.Path = upstreamPath(remote.Path, req.URL.Path)
         
         // Handle Authorization header
+        if u.Key != "" {
+            req.Header.Set("Authorization", "Bearer "+u.Key)
+        } else if !passCredential {
+            req.Header.Del("Authorization")
+        }
         handleAuthorization(req)
         
         // Add OpenAI-specific headers if needed
         req.Header.Set("User-Agent", "Azure-OAI-Proxy/1.0")
         
-        log.Printf("Proxying request [OpenAI] %s -> %s", originURL, req.URL.String())
+        logging.FromContext(req.Context()).Info("Proxying request",
+            "method", req.Method,
+            "path", originPath,
+            "upstream_name", u.Name,
+            "upstream", req.URL.String())
+    }
+}
+
+func upstreamPath(basePath, reqPath string) string {
+    basePath = strings.TrimSuffix(basePath, "/")
+    if basePath == "" {
+        return reqPath
+    }
+    if strings.HasSuffix(basePath, "/v1") {
+        return basePath + strings.TrimPrefix(reqPath, "/v1")
+    }
+    return basePath + reqPath
+}
+
+// modelsClient fetches model lists. Listing models should not hang on one
+// slow upstream.
+var modelsClient = &http.Client{Timeout: 10 * time.Second}
+
+// ListModels fetches the model list from the upstream's /v1/models endpoint,
+// authenticating with the upstream's own key if it has one.
+func ListModels(ctx context.Context, u *Upstream) ([]map[string]any, error) {
+    remote, err := url.Parse(u.BaseURL)
+    if err != nil {
+        return nil, err
+    }
+    remote.Path = upstreamPath(remote.Path, "/v1/models")
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, remote.String(), nil)
+    if err != nil {
+        return nil, err
+    }
+    if u.Key != "" {
+        req.Header.Set("Authorization", "Bearer "+u.Key)
+    }
+
+    resp, err := modelsClient.Do(req)
+    if err != nil {
+        return nil, err
     }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        body, _ := io.ReadAll(resp.Body)
+        return nil, fmt.Errorf("upstream %s returned %d: %s", u.Name, resp.StatusCode, string(body))
+    }
+
+    var list struct {
+        Data []map[string]any `json:"data"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+        return nil, err
+    }
+    return list.Data, nil
 }
 
 func handleAuthorization(req *http.Request) {
@@ -77,10 +207,17 @@ func handleAuthorization(req *http.Request) {
 }
 
 func modifyResponse(res *http.Response) error {
+    metrics.ObserveUpstream(res)
+    logging.ObserveUpstream(res)
+
     // Log errors for debugging
     if res.StatusCode >= 400 {
         body, _ := io.ReadAll(res.Body)
-        log.Printf("OpenAI API Error Response: Status: %d, Body: %s", res.StatusCode, string(body))
+        logging.FromContext(res.Request.Context()).Warn("OpenAI API error response",
+            "status", res.StatusCode,
+            "method", res.Request.Method,
+            "url", res.Request.URL.String(),
+            logging.Body("body", body))
         res.Body = io.NopCloser(bytes.NewBuffer(body))
     }
     
@@ -91,11 +228,12 @@ func modifyResponse(res *http.Response) error {
         res.Header.Set("Connection", "keep-alive")
     }
     
+    usage.Track(res)
     return nil
 }
 
 func errorHandler(rw http.ResponseWriter, req *http.Request, err error) {
-    log.Printf("OpenAI proxy error: %v", err)
+    logging.FromContext(req.Context()).Error("OpenAI proxy error", "error", err)
     
     // Return a proper error response
     rw.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,78 @@
+package openai
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUpstreamDirectorCredentials(t *testing.T) {
+	tests := []struct {
+		name           string
+		key            string
+		passCredential bool
+		want           string
+	}{
+		{name: "upstream key replaces the client's", key: "sk-upstream", want: "Bearer sk-upstream"},
+		{name: "client credential is dropped", want: ""},
+		{name: "openai mode passes the client's key on", passCredential: true, want: "Bearer sk-client"},
+		{name: "openai mode prefers the proxy's key", key: "sk-upstream", passCredential: true, want: "Bearer sk-upstream"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &Upstream{Name: "vllm", BaseURL: "http://vllm:8000/v1", Key: tt.key}
+			req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+			req.Header.Set("Authorization", "Bearer sk-client")
+			req.Header.Set("api-key", "azure-key")
+			makeUpstreamDirector(u, tt.passCredential)(req)
+			if got := req.Header.Get("Authorization"); got != tt.want {
+				t.Errorf("Authorization = %q, want %q", got, tt.want)
+			}
+			if got := req.Header.Get("api-key"); got != "" {
+				t.Errorf("api-key = %q, want it removed", got)
+			}
+			if req.URL.String() != "http://vllm:8000/v1/chat/completions" {
+				t.Errorf("URL = %s", req.URL)
+			}
+		})
+	}
+}
+
+func TestListModels(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/models" || r.Header.Get("Authorization") != "Bearer sk-upstream" {
+			t.Errorf("%s with Authorization %q", r.URL.Path, r.Header.Get("Authorization"))
+		}
+		w.Write([]byte(`{"data":[{"id":"llama3"},{"id":"qwen"}]}`))
+	}))
+	defer srv.Close()
+
+	models, err := ListModels(context.Background(), &Upstream{Name: "vllm", BaseURL: srv.URL + "/v1", Key: "sk-upstream"})
+	if err != nil || len(models) != 2 || models[0]["id"] != "llama3" {
+		t.Errorf("ListModels() = %v, %v", models, err)
+	}
+}
+
+func TestListModelsGivesUp(t *testing.T) {
+	stuck := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-stuck:
+		}
+	}))
+	defer srv.Close()
+	defer close(stuck)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := ListModels(ctx, &Upstream{Name: "vllm", BaseURL: srv.URL}); err == nil {
+		t.Error("ListModels() of a stuck upstream succeeded")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("ListModels() gave up after %s, want it to end with its context", d)
+	}
+}
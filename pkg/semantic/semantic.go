@@ -0,0 +1,176 @@
+// Package semantic answers paraphrased prompts from earlier responses. Each
+// cached response is indexed by the embedding of the prompt that produced it;
+// a new prompt whose embedding is similar enough gets the cached response.
+package semantic
+
+import (
+	"container/list"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/cache"
+)
+
+var (
+	// Enabled turns the semantic cache on.
+	Enabled = false
+	// Model is the embedding model prompts are embedded with, through the
+	// proxy's own embeddings route.
+	Model = "text-embedding-3-small"
+	// Threshold is the lowest cosine similarity that counts as the same prompt.
+	Threshold = 0.95
+	// TTL is how long a response is served from the cache.
+	TTL = time.Hour
+	// MaxEntries bounds the index; the oldest entries are evicted first.
+	MaxEntries = 10000
+
+	// Default is the process-wide index.
+	Default = NewIndex()
+)
+
+func init() {
+	Enabled = strings.EqualFold(os.Getenv("AZURE_OPENAI_SEMANTIC_CACHE"), "true")
+	if v := os.Getenv("AZURE_OPENAI_SEMANTIC_CACHE_MODEL"); v != "" {
+		Model = v
+	}
+	if v := os.Getenv("AZURE_OPENAI_SEMANTIC_CACHE_THRESHOLD"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f > 0 && f <= 1 {
+			Threshold = f
+		} else {
+			slog.Warn("Invalid AZURE_OPENAI_SEMANTIC_CACHE_THRESHOLD, using default", "value", v, "default", Threshold)
+		}
+	}
+	if v := os.Getenv("AZURE_OPENAI_SEMANTIC_CACHE_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			TTL = d
+		}
+	}
+	if v := os.Getenv("AZURE_OPENAI_SEMANTIC_CACHE_MAX_ENTRIES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			MaxEntries = n
+		}
+	}
+	if Enabled {
+		slog.Info("Semantic cache enabled", "embedding_model", Model, "threshold", Threshold, "ttl", TTL.String())
+	}
+}
+
+// Index is an in-process vector index of cached responses, partitioned by
+// scope. Searches compare against every entry of a scope, which is fast
+// enough for the tens of thousands of entries a single proxy holds.
+type Index struct {
+	mu     sync.Mutex
+	scopes map[string][]*item
+	order  *list.List // of *item, oldest first
+}
+
+type item struct {
+	scope   string
+	vector  []float32 // unit length
+	entry   *cache.Entry
+	element *list.Element
+}
+
+// NewIndex returns an empty index.
+func NewIndex() *Index {
+	return &Index{scopes: make(map[string][]*item), order: list.New()}
+}
+
+// Search returns the response cached in scope for the prompt most similar to
+// vector, if its similarity reaches Threshold, along with the similarity.
+func (x *Index) Search(scope string, vector []float32) (*cache.Entry, float64, bool) {
+	v := normalize(vector)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var best *item
+	bestSim := -1.0
+	for _, it := range x.scopes[scope] {
+		if time.Since(it.entry.Created) > TTL {
+			continue
+		}
+		if sim := dot(v, it.vector); sim > bestSim {
+			best, bestSim = it, sim
+		}
+	}
+	if best == nil || bestSim < Threshold {
+		return nil, bestSim, false
+	}
+	return best.entry, bestSim, true
+}
+
+// Add indexes a response under the embedding of its prompt.
+func (x *Index) Add(scope string, vector []float32, e *cache.Entry) {
+	it := &item{scope: scope, vector: normalize(vector), entry: e}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	it.element = x.order.PushBack(it)
+	x.scopes[scope] = append(x.scopes[scope], it)
+	for x.order.Len() > MaxEntries {
+		x.remove(x.order.Front().Value.(*item))
+	}
+	// Expired entries are dropped as new ones arrive
+	for front := x.order.Front(); front != nil; front = x.order.Front() {
+		oldest := front.Value.(*item)
+		if time.Since(oldest.entry.Created) <= TTL {
+			break
+		}
+		x.remove(oldest)
+	}
+}
+
+// Len returns the number of indexed responses.
+func (x *Index) Len() int {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.order.Len()
+}
+
+// remove drops it from the index. x.mu must be held.
+func (x *Index) remove(it *item) {
+	x.order.Remove(it.element)
+	items := x.scopes[it.scope]
+	for i, other := range items {
+		if other == it {
+			items = append(items[:i], items[i+1:]...)
+			break
+		}
+	}
+	if len(items) == 0 {
+		delete(x.scopes, it.scope)
+	} else {
+		x.scopes[it.scope] = items
+	}
+}
+
+func normalize(v []float32) []float32 {
+	var sum float64
+	for _, f := range v {
+		sum += float64(f) * float64(f)
+	}
+	norm := math.Sqrt(sum)
+	out := make([]float32, len(v))
+	if norm == 0 {
+		return out
+	}
+	for i, f := range v {
+		out[i] = float32(float64(f) / norm)
+	}
+	return out
+}
+
+// dot is the cosine similarity of two unit vectors.
+func dot(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return -1
+	}
+	var sum float64
+	for i := range a {
+		sum += float64(a[i]) * float64(b[i])
+	}
+	return sum
+}
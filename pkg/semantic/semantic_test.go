@@ -0,0 +1,106 @@
+package semantic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gyarbij/azure-oai-proxy/pkg/cache"
+)
+
+func entry(body string, age time.Duration) *cache.Entry {
+	return &cache.Entry{Status: 200, Body: []byte(body), Created: time.Now().Add(-age)}
+}
+
+func TestSearchThreshold(t *testing.T) {
+	saved := Threshold
+	Threshold = 0.95
+	t.Cleanup(func() { Threshold = saved })
+
+	x := NewIndex()
+	x.Add("s", []float32{1, 0, 0}, entry("east", 0))
+	x.Add("s", []float32{0, 1, 0}, entry("north", 0))
+
+	tests := []struct {
+		name   string
+		vector []float32
+		want   string // empty for a miss
+	}{
+		{name: "same direction, other length", vector: []float32{3, 0, 0}, want: "east"},
+		{name: "close enough", vector: []float32{1, 0.2, 0}, want: "east"}, // cos ~0.98
+		{name: "nearest of two", vector: []float32{0.1, 1, 0}, want: "north"},
+		{name: "below threshold", vector: []float32{1, 0.5, 0}}, // cos ~0.89
+		{name: "orthogonal", vector: []float32{0, 0, 1}},
+		{name: "other dimensions", vector: []float32{1, 0}},
+		{name: "zero vector", vector: []float32{0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, sim, ok := x.Search("s", tt.vector)
+			if tt.want == "" {
+				if ok {
+					t.Errorf("Search() = %s at %.3f, want a miss", e.Body, sim)
+				}
+				return
+			}
+			if !ok || string(e.Body) != tt.want {
+				t.Errorf("Search() = %v at %.3f, want %s", ok, sim, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchScopes(t *testing.T) {
+	x := NewIndex()
+	x.Add("default\x00key-a\x00gpt-4o", []float32{1, 0}, entry("a", 0))
+
+	if _, _, ok := x.Search("default\x00key-b\x00gpt-4o", []float32{1, 0}); ok {
+		t.Error("another key's response was returned")
+	}
+	if _, _, ok := x.Search("default\x00key-a\x00gpt-4o-mini", []float32{1, 0}); ok {
+		t.Error("another model's response was returned")
+	}
+	if e, _, ok := x.Search("default\x00key-a\x00gpt-4o", []float32{1, 0}); !ok || string(e.Body) != "a" {
+		t.Error("the scope's own response was not returned")
+	}
+}
+
+func TestTTL(t *testing.T) {
+	saved := TTL
+	TTL = time.Minute
+	t.Cleanup(func() { TTL = saved })
+
+	x := NewIndex()
+	x.Add("s", []float32{1, 0}, entry("old", 2*time.Minute))
+	if _, _, ok := x.Search("s", []float32{1, 0}); ok {
+		t.Error("expired response was returned")
+	}
+
+	// Expired entries are dropped once a new one arrives
+	x.Add("s", []float32{0, 1}, entry("new", 0))
+	if n := x.Len(); n != 1 {
+		t.Errorf("Len() = %d after adding past an expired entry, want 1", n)
+	}
+}
+
+func TestMaxEntries(t *testing.T) {
+	saved := MaxEntries
+	MaxEntries = 2
+	t.Cleanup(func() { MaxEntries = saved })
+
+	x := NewIndex()
+	x.Add("a", []float32{1, 0}, entry("first", 0))
+	x.Add("b", []float32{1, 0}, entry("second", 0))
+	x.Add("a", []float32{0, 1}, entry("third", 0))
+
+	if n := x.Len(); n != 2 {
+		t.Fatalf("Len() = %d, want 2", n)
+	}
+	if _, _, ok := x.Search("a", []float32{1, 0}); ok {
+		t.Error("oldest entry was not evicted")
+	}
+	for scope, v := range map[string][]float32{"b": {1, 0}, "a": {0, 1}} {
+		if _, _, ok := x.Search(scope, v); !ok {
+			t.Errorf("entry of scope %s was evicted", scope)
+		}
+	}
+}
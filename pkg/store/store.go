@@ -0,0 +1,203 @@
+// Package store is a small embedded document store persisted to a single
+// JSON file. It holds the configuration managed through the admin API so
+// that changes survive restarts.
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+var (
+	// Path is the database file.
+	Path = "azure-oai-proxy.db"
+
+	// Default is the process-wide database, opened on first use.
+	defaultDB   *DB
+	defaultOnce sync.Once
+)
+
+func init() {
+	if v := os.Getenv("AZURE_OPENAI_PROXY_DB"); v != "" {
+		Path = v
+	}
+}
+
+// Default returns the process-wide database at Path.
+func Default() *DB {
+	defaultOnce.Do(func() {
+		db, err := Open(Path)
+		if err != nil {
+			slog.Error("Could not open database", "path", Path, "error", err)
+			os.Exit(1)
+		}
+		defaultDB = db
+	})
+	return defaultDB
+}
+
+// DB stores JSON documents in named buckets. Every write rewrites the file
+// atomically, which is fine for the small amount of configuration it holds.
+type DB struct {
+	mu      sync.RWMutex
+	path    string
+	buckets map[string]map[string]json.RawMessage
+}
+
+// Open loads the database at path, creating an empty one if it does not exist.
+func Open(path string) (*DB, error) {
+	db := &DB{path: path, buckets: make(map[string]map[string]json.RawMessage)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return db, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &db.buckets); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Get decodes the document stored under bucket/key into v.
+func (db *DB) Get(bucket, key string, v any) (bool, error) {
+	db.mu.RLock()
+	raw, ok := db.buckets[bucket][key]
+	db.mu.RUnlock()
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(raw, v)
+}
+
+// Put stores v under bucket/key and persists the database.
+func (db *DB) Put(bucket, key string, v any) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.buckets[bucket] == nil {
+		db.buckets[bucket] = make(map[string]json.RawMessage)
+	}
+	prev, existed := db.buckets[bucket][key]
+	db.buckets[bucket][key] = raw
+	if err := db.save(); err != nil {
+		if existed {
+			db.buckets[bucket][key] = prev
+		} else {
+			delete(db.buckets[bucket], key)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes bucket/key and persists the database.
+func (db *DB) Delete(bucket, key string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	prev, ok := db.buckets[bucket][key]
+	if !ok {
+		return nil
+	}
+	delete(db.buckets[bucket], key)
+	if err := db.save(); err != nil {
+		db.buckets[bucket][key] = prev
+		return err
+	}
+	return nil
+}
+
+// Update stores every document of put and removes the keys in remove from
+// bucket, persisting the database once. Nothing changes if the write fails.
+func (db *DB) Update(bucket string, put map[string]any, remove []string) error {
+	raws := make(map[string]json.RawMessage, len(put))
+	for key, v := range put {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		raws[key] = raw
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	prev := db.buckets[bucket]
+	next := make(map[string]json.RawMessage, len(prev)+len(raws))
+	for key, raw := range prev {
+		next[key] = raw
+	}
+	for key, raw := range raws {
+		next[key] = raw
+	}
+	for _, key := range remove {
+		delete(next, key)
+	}
+	db.buckets[bucket] = next
+	if err := db.save(); err != nil {
+		db.buckets[bucket] = prev
+		return err
+	}
+	return nil
+}
+
+// Keys returns the keys of a bucket in sorted order.
+func (db *DB) Keys(bucket string) []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	keys := make([]string, 0, len(db.buckets[bucket]))
+	for k := range db.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ForEach decodes every document of a bucket, in key order, with decode.
+func (db *DB) ForEach(bucket string, decode func(key string, raw json.RawMessage) error) error {
+	for _, k := range db.Keys(bucket) {
+		db.mu.RLock()
+		raw, ok := db.buckets[bucket][k]
+		db.mu.RUnlock()
+		if !ok {
+			continue
+		}
+		if err := decode(k, raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// save writes the database through a temporary file so a crash never leaves
+// it truncated. Callers hold db.mu.
+func (db *DB) save() error {
+	if db.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(db.buckets, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(db.path), ".db-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), db.path)
+}
@@ -0,0 +1,132 @@
+package tokenizer
+
+import "github.com/tidwall/gjson"
+
+// Chat models wrap every message in a few tokens of framing and prime every
+// reply with a few more, as in OpenAI's guide to counting tokens.
+const (
+	tokensPerMessage = 3
+	tokensPerName    = 1
+	tokensPerReply   = 3
+)
+
+// An image costs 85 tokens at low detail. At other details the cost depends
+// on its size, which the proxy does not look at, so a 1024x1024 image at high
+// detail stands in for all of them.
+const (
+	lowDetailImageTokens = 85
+	imageTokens          = 765
+)
+
+// ChatPrompt counts the prompt tokens of a Chat Completions request body.
+// Audio and file parts are not counted.
+func (e *Encoding) ChatPrompt(body []byte) int {
+	req := gjson.ParseBytes(body)
+	n := tokensPerReply
+	req.Get("messages").ForEach(func(_, m gjson.Result) bool {
+		n += tokensPerMessage
+		m.ForEach(func(k, v gjson.Result) bool {
+			switch k.String() {
+			case "content":
+				n += e.content(v)
+			case "name":
+				n += tokensPerName + e.Count(v.String())
+			case "tool_calls", "function_call":
+				n += e.Count(v.Raw)
+			default:
+				if v.Type == gjson.String {
+					n += e.Count(v.String())
+				}
+			}
+			return true
+		})
+		return true
+	})
+	return n + e.definitions(req)
+}
+
+// ResponsesPrompt counts the prompt tokens of a Responses API request body.
+// Earlier turns referenced by previous_response_id are not counted.
+func (e *Encoding) ResponsesPrompt(body []byte) int {
+	req := gjson.ParseBytes(body)
+	n := tokensPerReply + e.Count(req.Get("instructions").String())
+	input := req.Get("input")
+	if !input.IsArray() {
+		return n + tokensPerMessage + e.Count(input.String()) + e.definitions(req)
+	}
+	input.ForEach(func(_, item gjson.Result) bool {
+		n += tokensPerMessage
+		switch item.Get("type").String() {
+		case "function_call":
+			n += e.Count(item.Get("name").String()) + e.Count(item.Get("arguments").String())
+		case "function_call_output":
+			n += e.Count(item.Get("output").String())
+		default:
+			n += e.Count(item.Get("role").String()) + e.content(item.Get("content"))
+		}
+		return true
+	})
+	return n + e.definitions(req)
+}
+
+// EmbeddingInputs counts the tokens of each input of an embeddings request
+// body. Inputs that are already token arrays count their length.
+func (e *Encoding) EmbeddingInputs(body []byte) []int {
+	input := gjson.GetBytes(body, "input")
+	if !input.IsArray() {
+		return []int{e.Count(input.String())}
+	}
+	items := input.Array()
+	if len(items) > 0 && items[0].Type == gjson.Number {
+		return []int{len(items)}
+	}
+	counts := make([]int, len(items))
+	for i, item := range items {
+		if item.IsArray() {
+			counts[i] = len(item.Array())
+		} else {
+			counts[i] = e.Count(item.String())
+		}
+	}
+	return counts
+}
+
+// content counts message content: a string, or a list of text and image
+// parts in Chat Completions or Responses form.
+func (e *Encoding) content(v gjson.Result) int {
+	if !v.IsArray() {
+		return e.Count(v.String())
+	}
+	n := 0
+	v.ForEach(func(_, part gjson.Result) bool {
+		switch part.Get("type").String() {
+		case "image_url", "input_image":
+			detail := part.Get("image_url.detail").String()
+			if detail == "" {
+				detail = part.Get("detail").String()
+			}
+			if detail == "low" {
+				n += lowDetailImageTokens
+			} else {
+				n += imageTokens
+			}
+		default:
+			n += e.Count(part.Get("text").String())
+		}
+		return true
+	})
+	return n
+}
+
+// definitions counts the tool and output format definitions a request sends
+// along, by their JSON. Models see them in a different form, so this is an
+// estimate.
+func (e *Encoding) definitions(req gjson.Result) int {
+	n := 0
+	for _, field := range []string{"tools", "functions", "response_format", "text.format"} {
+		if v := req.Get(field); v.Exists() {
+			n += e.Count(v.Raw)
+		}
+	}
+	return n
+}
@@ -0,0 +1,63 @@
+//go:build ignore
+
+// fetch_vocab downloads the tiktoken vocabularies into vocab/ so they are
+// embedded in the binary, checking them against the hashes tiktoken pins.
+// Run it with go generate ./pkg/tokenizer.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const baseURL = "https://openaipublic.blob.core.windows.net/encodings/"
+
+var vocabularies = map[string]string{
+	"cl100k_base.tiktoken": "223921b76ee99bde995b7ff738513eef100fb51d18c93597a113bcffe865b2a7",
+	"o200k_base.tiktoken":  "446a9538cb6c348e3516120d7c08b09f57c36495e2acfffe59a5bf8b0cfb1a2d",
+}
+
+func main() {
+	client := &http.Client{Timeout: 5 * time.Minute}
+	for name, want := range vocabularies {
+		path := filepath.Join("vocab", name)
+		if data, err := os.ReadFile(path); err == nil && sum(data) == want {
+			continue
+		}
+		data, err := fetch(client, baseURL+name)
+		if err != nil {
+			log.Fatalf("Fetching %s: %v", name, err)
+		}
+		if got := sum(data); got != want {
+			log.Fatalf("Fetching %s: SHA-256 is %s, want %s", name, got, want)
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Fetched %s (%d bytes)", path, len(data))
+	}
+}
+
+func fetch(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: status %d", url, resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func sum(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,61 @@
+package tokenizer
+
+import (
+	"regexp"
+	"unicode/utf8"
+)
+
+// ws is the Unicode whitespace \s stands for in tiktoken's patterns; Go's \s
+// is ASCII only.
+const ws = `\t\n\v\f\r \x{85}\p{Z}`
+
+// The patterns tiktoken splits text with before merging, in Go syntax. Go has
+// no lookahead, so the final `\s+(?!\S)|\s+` is one captured `\s+`, which
+// pieces trims the way the lookahead would.
+var (
+	cl100kPattern = `(?i:'s|'t|'re|'ve|'m|'ll|'d)` +
+		`|[^\r\n\p{L}\p{N}]?\p{L}+` +
+		`|\p{N}{1,3}` +
+		`| ?[^` + ws + `\p{L}\p{N}]+[\r\n]*` +
+		`|[` + ws + `]*[\r\n]+` +
+		`|([` + ws + `]+)`
+
+	o200kPattern = `[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]*[\p{Ll}\p{Lm}\p{Lo}\p{M}]+(?i:'s|'t|'re|'ve|'m|'ll|'d)?` +
+		`|[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]+[\p{Ll}\p{Lm}\p{Lo}\p{M}]*(?i:'s|'t|'re|'ve|'m|'ll|'d)?` +
+		`|\p{N}{1,3}` +
+		`| ?[^` + ws + `\p{L}\p{N}]+[\r\n/]*` +
+		`|[` + ws + `]*[\r\n]+` +
+		`|([` + ws + `]+)`
+)
+
+var splitters = map[string]*splitter{
+	"cl100k_base": {re: regexp.MustCompile(`^(?:` + cl100kPattern + `)`)},
+	"o200k_base":  {re: regexp.MustCompile(`^(?:` + o200kPattern + `)`)},
+}
+
+// splitter cuts text into the pieces that are encoded separately.
+type splitter struct {
+	re *regexp.Regexp
+}
+
+func (s *splitter) pieces(text string) []string {
+	var pieces []string
+	for len(text) > 0 {
+		m := s.re.FindStringSubmatchIndex(text)
+		if m == nil || m[1] == 0 {
+			// Not reachable with these patterns; keep going a rune at a time
+			_, size := utf8.DecodeRuneInString(text)
+			m = []int{0, size, -1, -1}
+		}
+		end := m[1]
+		// \s+(?!\S) leaves the last space of a run for the word after it
+		if m[2] >= 0 && end < len(text) {
+			if _, size := utf8.DecodeLastRuneInString(text[:end]); size < end {
+				end -= size
+			}
+		}
+		pieces = append(pieces, text[:end])
+		text = text[end:]
+	}
+	return pieces
+}
@@ -0,0 +1,221 @@
+// Package tokenizer counts tokens the way OpenAI models do, with the o200k
+// and cl100k byte-pair encodings, so requests can be sized without asking
+// the model.
+//
+// The encodings' vocabularies are the tiktoken files o200k_base.tiktoken and
+// cl100k_base.tiktoken. go generate downloads them into the vocab directory,
+// and files there are embedded in the binary at build time;
+// AZURE_OPENAI_TOKENIZER_DIR names a directory to load them from at run time
+// instead. Without a vocabulary an encoding still
+// splits text the same way but estimates the tokens of each piece, and
+// reports that its counts are not exact.
+package tokenizer
+
+import (
+	"bufio"
+	"bytes"
+	"embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+//go:generate go run fetch_vocab.go
+
+//go:embed vocab
+var embedded embed.FS
+
+// Dir is a directory of tiktoken vocabulary files, looked in before the
+// embedded ones.
+var Dir = os.Getenv("AZURE_OPENAI_TOKENIZER_DIR")
+
+// Encoding is a byte-pair encoding.
+type Encoding struct {
+	Name string
+
+	split *splitter
+	ranks map[string]int // token bytes to token ID; nil without a vocabulary
+}
+
+var (
+	encodingsMu sync.Mutex
+	encodings   = make(map[string]*Encoding)
+)
+
+// Get returns the named encoding, loading its vocabulary on first use.
+func Get(name string) (*Encoding, bool) {
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+	if e, ok := encodings[name]; ok {
+		return e, true
+	}
+	split, ok := splitters[name]
+	if !ok {
+		return nil, false
+	}
+	e := &Encoding{Name: name, split: split}
+	ranks, source, err := loadRanks(name)
+	switch {
+	case err == nil:
+		e.ranks = ranks
+		slog.Info("Loaded tokenizer vocabulary", "encoding", name, "source", source, "tokens", len(ranks))
+	case errors.Is(err, fs.ErrNotExist):
+		slog.Warn("No tokenizer vocabulary, token counts are estimates", "encoding", name)
+	default:
+		slog.Error("Could not load tokenizer vocabulary, token counts are estimates", "encoding", name, "error", err)
+	}
+	encodings[name] = e
+	return e, true
+}
+
+// Exact reports whether the encoding has its vocabulary, so its counts are
+// exact rather than estimates.
+func (e *Encoding) Exact() bool {
+	return e.ranks != nil
+}
+
+// Encode returns the token IDs of text, or nil without a vocabulary.
+func (e *Encoding) Encode(text string) []int {
+	if e.ranks == nil {
+		return nil
+	}
+	var ids []int
+	for _, piece := range e.split.pieces(text) {
+		ids = e.merge([]byte(piece), ids)
+	}
+	return ids
+}
+
+// Count returns the number of tokens in text.
+func (e *Encoding) Count(text string) int {
+	if e.ranks != nil {
+		return len(e.Encode(text))
+	}
+	n := 0
+	for _, piece := range e.split.pieces(text) {
+		n += estimate(piece)
+	}
+	return n
+}
+
+// estimate guesses the tokens of one piece of split text: common words and
+// short runs of ASCII are mostly one token, longer ones about one per six
+// bytes, and other scripts about one per character.
+func estimate(piece string) int {
+	ascii, other := 0, 0
+	for _, r := range piece {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return max(1, int(math.Ceil(float64(ascii)/6))+other)
+}
+
+// merge appends the tokens of one piece, merging its bytes pair by pair in
+// rank order as tiktoken does.
+func (e *Encoding) merge(piece []byte, ids []int) []int {
+	if id, ok := e.ranks[string(piece)]; ok {
+		return append(ids, id)
+	}
+
+	// parts[i] is where the i-th part starts and the rank of merging it with
+	// the next one
+	type part struct{ start, rank int }
+	parts := make([]part, len(piece)+1)
+	rank := func(i int) int {
+		if i+2 >= len(parts) {
+			return math.MaxInt
+		}
+		if r, ok := e.ranks[string(piece[parts[i].start:parts[i+2].start])]; ok {
+			return r
+		}
+		return math.MaxInt
+	}
+	for i := range parts {
+		parts[i] = part{start: i, rank: math.MaxInt}
+	}
+	for i := range len(parts) - 2 {
+		parts[i].rank = rank(i)
+	}
+	for {
+		best := -1
+		for i := range len(parts) - 1 {
+			if parts[i].rank != math.MaxInt && (best < 0 || parts[i].rank < parts[best].rank) {
+				best = i
+			}
+		}
+		if best < 0 {
+			break
+		}
+		parts = append(parts[:best+1], parts[best+2:]...)
+		parts[best].rank = rank(best)
+		if best > 0 {
+			parts[best-1].rank = rank(best - 1)
+		}
+	}
+	for i := range len(parts) - 1 {
+		ids = append(ids, e.ranks[string(piece[parts[i].start:parts[i+1].start])])
+	}
+	return ids
+}
+
+// loadRanks reads the vocabulary of an encoding from Dir or the embedded
+// files, and says where it came from.
+func loadRanks(name string) (map[string]int, string, error) {
+	file := name + ".tiktoken"
+	if Dir != "" {
+		path := filepath.Join(Dir, file)
+		f, err := os.Open(path)
+		if err == nil {
+			defer f.Close()
+			ranks, err := parseRanks(f)
+			return ranks, path, err
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, "", err
+		}
+	}
+	f, err := embedded.Open("vocab/" + file)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	ranks, err := parseRanks(f)
+	return ranks, "embedded", err
+}
+
+// parseRanks reads a tiktoken file: one base64 token and its rank per line.
+func parseRanks(r io.Reader) (map[string]int, error) {
+	ranks := make(map[string]int, 200000)
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		token, rank, ok := bytes.Cut(bytes.TrimSpace(sc.Bytes()), []byte(" "))
+		if !ok {
+			if len(token) == 0 {
+				continue
+			}
+			return nil, fmt.Errorf("line %d: expected a token and a rank", line)
+		}
+		raw, err := base64.StdEncoding.DecodeString(string(token))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		id, err := strconv.Atoi(string(rank))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		ranks[string(raw)] = id
+	}
+	return ranks, sc.Err()
+}
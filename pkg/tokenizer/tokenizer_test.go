@@ -0,0 +1,126 @@
+package tokenizer
+
+import (
+	"slices"
+	"testing"
+)
+
+// testEncoding has every byte as a token, its value as the rank, and a few
+// merges, enough to exercise the merge order.
+func testEncoding() *Encoding {
+	ranks := make(map[string]int)
+	for b := range 256 {
+		ranks[string([]byte{byte(b)})] = b
+	}
+	merges := []string{"he", "ll", "hell", "o ", "hello", " w", "or", "ld", " wor", " world", "ab", "abc", "cd", " a", " ab", "12", "123", "aa", "aaa"}
+	for i, m := range merges {
+		ranks[m] = 256 + i
+	}
+	return &Encoding{Name: "test", split: splitters["cl100k_base"], ranks: ranks}
+}
+
+func TestMerge(t *testing.T) {
+	enc := testEncoding()
+	tests := []struct {
+		piece string
+		want  []int
+	}{
+		{"hello", []int{260}},
+		{"hellohello", []int{260, 260}},
+		// "o " (259) merges before " w" (261), so " world" never forms
+		{"hello world", []int{258, 259, 119, 262, 263}},
+		{"abcabc aaaa 123123", []int{267, 267, 269, 274, 32, 272, 272}},
+		{"aaaaaaa", []int{273, 273, 274}},
+		// "ab" outranks " a", leaving the space alone
+		{" abcd", []int{32, 267, 100}},
+		{"\xff\x00", []int{255, 0}},
+	}
+	for _, tt := range tests {
+		if got := enc.merge([]byte(tt.piece), nil); !slices.Equal(got, tt.want) {
+			t.Errorf("merge(%q) = %v, want %v", tt.piece, got, tt.want)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	enc := testEncoding()
+	if got, want := enc.Encode("hello world hello"), []int{260, 265, 32, 260}; !slices.Equal(got, want) {
+		t.Errorf("Encode() = %v, want %v", got, want)
+	}
+	if got := enc.Count("hello world hello"); got != 4 {
+		t.Errorf("Count() = %d, want 4", got)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"Hello world!  How's it going?\n\n  x", []string{"Hello", " world", "!", " ", " How", "'s", " it", " going", "?\n\n", " ", " x"}},
+		{"abc   def\t\tghi\n", []string{"abc", "  ", " def", "\t", "\tghi", "\n"}},
+		{"1234567 numbers, 89!!  \n\r\n end   ", []string{"123", "456", "7", " numbers", ",", " ", "89", "!!", "  \n\r\n", " end", "   "}},
+		{"I'LL don't  'm ... --> ok", []string{"I", "'LL", " don", "'t", " ", " '", "m", " ...", " -->", " ok"}},
+		{"   leading", []string{"  ", " leading"}},
+		{"trailing   ", []string{"trailing", "   "}},
+		{"x  \n  y", []string{"x", "  \n", " ", " y"}},
+		{"foo.bar/baz  ??  ", []string{"foo", ".bar", "/baz", " ", " ??", "  "}},
+	}
+	for _, tt := range tests {
+		if got := splitters["cl100k_base"].pieces(tt.text); !slices.Equal(got, tt.want) {
+			t.Errorf("pieces(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	enc := &Encoding{Name: "test", split: splitters["o200k_base"]}
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"hello world", 2},
+		{"internationalization", 4},
+		{"こんにちは", 5},
+	}
+	for _, tt := range tests {
+		if got := enc.Count(tt.text); got != tt.want {
+			t.Errorf("Count(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+	if enc.Exact() || enc.Encode("hello") != nil {
+		t.Error("an encoding without a vocabulary claims to be exact")
+	}
+}
+
+// TestKnownEncodings compares with tiktoken's output for the real
+// vocabularies, when they are present (see vocab/README.md).
+func TestKnownEncodings(t *testing.T) {
+	tests := []struct {
+		encoding string
+		text     string
+		want     []int
+	}{
+		{"cl100k_base", "hello world", []int{15339, 1917}},
+		{"cl100k_base", "tiktoken is great!", []int{83, 1609, 5963, 374, 2294, 0}},
+		{"cl100k_base", "antidisestablishmentarianism", []int{519, 85342, 34500, 479, 8997, 2191}},
+		{"cl100k_base", "2 + 2 = 4", []int{17, 489, 220, 17, 284, 220, 19}},
+		{"o200k_base", "hello world", []int{24912, 2375}},
+		{"o200k_base", "tiktoken is great!", []int{83, 8251, 2488, 382, 2212, 0}},
+		{"o200k_base", "2 + 2 = 4", []int{17, 659, 220, 17, 314, 220, 19}},
+	}
+	for _, tt := range tests {
+		enc, ok := Get(tt.encoding)
+		if !ok {
+			t.Fatalf("no encoding %s", tt.encoding)
+		}
+		if !enc.Exact() {
+			t.Logf("skipping %s: no vocabulary", tt.encoding)
+			continue
+		}
+		if got := enc.Encode(tt.text); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: Encode(%q) = %v, want %v", tt.encoding, tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	queueSize    = 2048
+	maxBatchSize = 512
+)
+
+var exporter *batchExporter
+
+// batchExporter sends finished spans to the collector in batches, as OTLP
+// JSON. Spans are dropped rather than blocking requests when the queue is
+// full or the collector cannot be reached; drops are counted and reported
+// once per batch.
+type batchExporter struct {
+	queue   chan *Span
+	delay   time.Duration
+	headers http.Header
+	client  *http.Client
+	dropped atomic.Int64
+
+	stopOnce sync.Once
+	stop     chan struct{} // closed to send the last batch and stop
+	done     chan struct{} // closed once the last batch is sent
+}
+
+func newExporter() *batchExporter {
+	e := &batchExporter{
+		queue:   make(chan *Span, queueSize),
+		delay:   envMillis("OTEL_BSP_SCHEDULE_DELAY", 5*time.Second),
+		headers: make(http.Header),
+		client:  &http.Client{Timeout: envMillis("OTEL_EXPORTER_OTLP_TIMEOUT", 10*time.Second)},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	// Format: key=value,key2=value2 with URL-encoded values
+	for _, v := range []string{os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), os.Getenv("OTEL_EXPORTER_OTLP_TRACES_HEADERS")} {
+		for _, pair := range strings.Split(v, ",") {
+			key, value, ok := strings.Cut(pair, "=")
+			if !ok || strings.TrimSpace(key) == "" {
+				continue
+			}
+			if decoded, err := url.QueryUnescape(value); err == nil {
+				value = decoded
+			}
+			e.headers.Set(strings.TrimSpace(key), strings.TrimSpace(value))
+		}
+	}
+	go e.run()
+	return e
+}
+
+func envMillis(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	ms, err := strconv.Atoi(v)
+	if err != nil || ms <= 0 {
+		slog.Warn("Invalid "+name+", using default", "value", v, "default", def.String())
+		return def
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+func (e *batchExporter) enqueue(s *Span) {
+	select {
+	case e.queue <- s:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+// Shutdown exports the spans that have ended and stops exporting. It returns
+// once they are sent, or when ctx is done.
+func Shutdown(ctx context.Context) error {
+	if exporter == nil {
+		return nil
+	}
+	return exporter.shutdown(ctx)
+}
+
+func (e *batchExporter) shutdown(ctx context.Context) error {
+	e.stopOnce.Do(func() { close(e.stop) })
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *batchExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.delay)
+	defer ticker.Stop()
+	var batch []*Span
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) < maxBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-e.stop:
+			// Send what is queued, in full batches, then stop
+			for {
+				select {
+				case s := <-e.queue:
+					if batch = append(batch, s); len(batch) == maxBatchSize {
+						e.flush(batch)
+						batch = nil
+					}
+				default:
+					e.flush(batch)
+					return
+				}
+			}
+		}
+		e.flush(batch)
+		batch = nil
+	}
+}
+
+// flush exports batch and reports the spans dropped since the last one.
+func (e *batchExporter) flush(batch []*Span) {
+	if n := e.dropped.Swap(0); n > 0 {
+		slog.Warn("Tracing queue full, dropped spans", "spans", n)
+	}
+	if len(batch) == 0 {
+		return
+	}
+	if err := e.export(batch); err != nil {
+		slog.Warn("Could not export spans", "spans", len(batch), "endpoint", Endpoint, "error", err)
+	}
+}
+
+func (e *batchExporter) export(spans []*Span) error {
+	body, err := json.Marshal(encodeSpans(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = e.headers.Clone()
+	req.Header.Set("Content-Type", "application/json")
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("collector returned %d: %s", res.StatusCode, msg)
+	}
+	io.Copy(io.Discard, res.Body)
+	return nil
+}
+
+// The OTLP/HTTP JSON encoding of ExportTraceServiceRequest. IDs are hex and
+// 64-bit integers are strings.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              Kind           `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"` // 1 ok, 2 error
+		Message string `json:"message,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string     `json:"stringValue,omitempty"`
+		BoolValue   *bool       `json:"boolValue,omitempty"`
+		IntValue    *string     `json:"intValue,omitempty"`
+		DoubleValue *float64    `json:"doubleValue,omitempty"`
+		ArrayValue  *otlpValues `json:"arrayValue,omitempty"`
+	}
+	otlpValues struct {
+		Values []otlpValue `json:"values"`
+	}
+)
+
+func encodeSpans(spans []*Span) otlpRequest {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for _, a := range s.attrs {
+			span.Attributes = append(span.Attributes, otlpKeyValue{a.key, encodeValue(a.value)})
+		}
+		if s.failed {
+			span.Status = otlpStatus{Code: 2, Message: s.message}
+		}
+		s.mu.Unlock()
+		encoded = append(encoded, span)
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{
+			{"service.name", encodeValue(ServiceName)},
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/gyarbij/azure-oai-proxy"},
+			Spans: encoded,
+		}},
+	}}}
+}
+
+func encodeValue(v any) otlpValue {
+	switch v := v.(type) {
+	case string:
+		return otlpValue{StringValue: &v}
+	case bool:
+		return otlpValue{BoolValue: &v}
+	case int:
+		s := strconv.Itoa(v)
+		return otlpValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		return otlpValue{IntValue: &s}
+	case float64:
+		return otlpValue{DoubleValue: &v}
+	case []string:
+		values := make([]otlpValue, len(v))
+		for i, s := range v {
+			values[i] = encodeValue(s)
+		}
+		return otlpValue{ArrayValue: &otlpValues{values}}
+	}
+	s := fmt.Sprint(v)
+	return otlpValue{StringValue: &s}
+}
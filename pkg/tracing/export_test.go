@@ -0,0 +1,232 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver is an OTLP/HTTP collector that keeps the batches it is sent.
+type receiver struct {
+	mu      sync.Mutex
+	batches [][]otlpSpan
+}
+
+func (r *receiver) spans() []otlpSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var all []otlpSpan
+	for _, b := range r.batches {
+		all = append(all, b...)
+	}
+	return all
+}
+
+func (r *receiver) batchSizes() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var sizes []int
+	for _, b := range r.batches {
+		sizes = append(sizes, len(b))
+	}
+	return sizes
+}
+
+// useReceiver turns tracing on, exporting to a new receiver every delay.
+func useReceiver(t *testing.T, delay time.Duration) (*receiver, *batchExporter) {
+	t.Helper()
+	rec := &receiver{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("collector got %v", err)
+		}
+		if r.Header.Get("Content-Type") != "application/json" || r.Header.Get("X-Collector-Token") != "secret" {
+			t.Errorf("collector got headers %v", r.Header)
+		}
+		for _, rs := range req.ResourceSpans {
+			if v := rs.Resource.Attributes[0]; v.Key != "service.name" || *v.Value.StringValue != ServiceName {
+				t.Errorf("resource = %+v", rs.Resource)
+			}
+			for _, ss := range rs.ScopeSpans {
+				rec.mu.Lock()
+				rec.batches = append(rec.batches, ss.Spans)
+				rec.mu.Unlock()
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	t.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "X-Collector-Token=secret")
+	t.Setenv("OTEL_BSP_SCHEDULE_DELAY", strconv.Itoa(int(delay.Milliseconds())))
+	savedEnabled, savedEndpoint, savedExporter := Enabled, Endpoint, exporter
+	Enabled, Endpoint = true, srv.URL
+	exporter = newExporter()
+	t.Cleanup(func() {
+		exporter.shutdown(context.Background())
+		Enabled, Endpoint, exporter = savedEnabled, savedEndpoint, savedExporter
+	})
+	return rec, exporter
+}
+
+func attr(s otlpSpan, key string) *otlpValue {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			return &a.Value
+		}
+	}
+	return nil
+}
+
+func TestExportSpans(t *testing.T) {
+	rec, e := useReceiver(t, time.Hour)
+
+	header := http.Header{"Traceparent": {"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}}
+	ctx, server := Start(Extract(context.Background(), header), "POST /v1/chat/completions", KindServer)
+	server.SetAttr("gen_ai.request.model", "gpt-4o")
+	server.SetAttr("http.response.status_code", 200)
+	server.SetAttr("proxy.cache.hit", false)
+	server.SetAttr("proxy.skipped", "")
+	_, child := Start(ctx, "resolve_model", KindInternal)
+	child.SetAttr("proxy.backends", []string{"eastus", "westus"})
+	child.SetError("no deployment")
+	child.End()
+	server.End()
+
+	// Spans wait for the schedule, or shutdown
+	if err := e.shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	spans := rec.spans()
+	if len(spans) != 2 {
+		t.Fatalf("collector got %d spans, want 2", len(spans))
+	}
+	gotChild, gotServer := spans[0], spans[1]
+
+	if gotServer.TraceID != "0af7651916cd43dd8448eb211c80319c" || gotServer.ParentSpanID != "b7ad6b7169203331" {
+		t.Errorf("server span %s/%s does not continue the caller's trace", gotServer.TraceID, gotServer.ParentSpanID)
+	}
+	if gotChild.TraceID != gotServer.TraceID || gotChild.ParentSpanID != gotServer.SpanID {
+		t.Errorf("child span %s/%s is not under the server span %s", gotChild.TraceID, gotChild.ParentSpanID, gotServer.SpanID)
+	}
+	if gotServer.Kind != KindServer || gotServer.Status.Code != 0 {
+		t.Errorf("server span kind %d, status %+v", gotServer.Kind, gotServer.Status)
+	}
+	if v := attr(gotServer, "gen_ai.request.model"); v == nil || *v.StringValue != "gpt-4o" {
+		t.Errorf("gen_ai.request.model = %+v", v)
+	}
+	if v := attr(gotServer, "http.response.status_code"); v == nil || *v.IntValue != "200" {
+		t.Errorf("http.response.status_code = %+v", v)
+	}
+	if v := attr(gotServer, "proxy.cache.hit"); v == nil || *v.BoolValue {
+		t.Errorf("proxy.cache.hit = %+v", v)
+	}
+	if attr(gotServer, "proxy.skipped") != nil {
+		t.Error("empty attribute was exported")
+	}
+	if v := attr(gotChild, "proxy.backends"); v == nil || len(v.ArrayValue.Values) != 2 || *v.ArrayValue.Values[1].StringValue != "westus" {
+		t.Errorf("proxy.backends = %+v", v)
+	}
+	if gotChild.Status.Code != 2 || gotChild.Status.Message != "no deployment" {
+		t.Errorf("child span status = %+v", gotChild.Status)
+	}
+}
+
+func TestTransportPropagatesTraceparent(t *testing.T) {
+	rec, e := useReceiver(t, time.Hour)
+	var sent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent = r.Header.Get("traceparent")
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	ctx, server := Start(context.Background(), "POST /v1/embeddings", KindServer)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, upstream.URL+"/openai/deployments/x/embeddings", nil)
+	res, err := (&Transport{Base: http.DefaultTransport}).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	server.End()
+	e.shutdown(context.Background())
+
+	spans := rec.spans()
+	if len(spans) != 2 {
+		t.Fatalf("collector got %d spans, want 2", len(spans))
+	}
+	client := spans[0]
+	if client.Kind != KindClient || client.ParentSpanID != server.spanIDHex() {
+		t.Errorf("client span kind %d under %s, want a client span under %s", client.Kind, client.ParentSpanID, server.spanIDHex())
+	}
+	// The upstream joins the trace under the client span
+	if want := "00-" + server.TraceID() + "-" + client.SpanID + "-01"; sent != want {
+		t.Errorf("traceparent = %q, want %q", sent, want)
+	}
+	if v := attr(client, "http.response.status_code"); v == nil || *v.IntValue != "200" {
+		t.Errorf("http.response.status_code = %+v", v)
+	}
+}
+
+func TestExportBatches(t *testing.T) {
+	rec, e := useReceiver(t, time.Hour)
+	for range maxBatchSize + 10 {
+		_, s := Start(context.Background(), "span", KindInternal)
+		s.End()
+	}
+
+	// A full batch goes out at once
+	deadline := time.Now().Add(2 * time.Second)
+	for len(rec.batchSizes()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("full batch was not exported")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	// The rest goes out on shutdown
+	if err := e.shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if sizes := rec.batchSizes(); len(sizes) != 2 || sizes[0] != maxBatchSize || sizes[1] != 10 {
+		t.Errorf("batch sizes = %v, want [%d 10]", sizes, maxBatchSize)
+	}
+}
+
+func TestExportReportsDropsOncePerBatch(t *testing.T) {
+	var logs bytes.Buffer
+	saved := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(saved) })
+
+	rec, e := useReceiver(t, time.Hour)
+	// A stopped exporter with a short queue: the first span fits
+	e.shutdown(context.Background())
+	e = &batchExporter{queue: make(chan *Span, 1), delay: time.Hour, headers: e.headers, client: e.client, stop: make(chan struct{}), done: make(chan struct{})}
+	exporter = e
+	for range 5 {
+		_, s := Start(context.Background(), "span", KindInternal)
+		s.End()
+	}
+	go e.run()
+	e.shutdown(context.Background())
+
+	if n := len(rec.spans()); n != 1 {
+		t.Errorf("collector got %d spans, want 1", n)
+	}
+	if n := strings.Count(logs.String(), "dropped spans"); n != 1 || !strings.Contains(logs.String(), "spans=4") {
+		t.Errorf("drops logged %d times:\n%s", n, logs.String())
+	}
+}
+
+func (s *Span) spanIDHex() string {
+	return hex.EncodeToString(s.spanID[:])
+}
@@ -0,0 +1,253 @@
+// Package tracing records spans for proxied requests and exports them to an
+// OpenTelemetry collector over OTLP/HTTP. Trace context is read from and sent
+// on in W3C traceparent headers.
+package tracing
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// Enabled reports whether spans are recorded. It is set when a collector
+	// endpoint is configured.
+	Enabled = false
+	// Endpoint is the URL spans are POSTed to.
+	Endpoint = ""
+	// ServiceName is reported as the service.name resource attribute.
+	ServiceName = "azure-oai-proxy"
+	// SampleRatio is the share of new traces that are recorded. Requests that
+	// carry a traceparent follow the caller's sampling decision.
+	SampleRatio = 1.0
+)
+
+func init() {
+	// The standard OpenTelemetry variables: the per-signal endpoint is used
+	// as is, the generic one gets the traces path appended
+	if v := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); v != "" {
+		Endpoint = v
+	} else if v := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); v != "" {
+		Endpoint = strings.TrimSuffix(v, "/") + "/v1/traces"
+	}
+	if Endpoint == "" {
+		return
+	}
+	if v := os.Getenv("OTEL_SERVICE_NAME"); v != "" {
+		ServiceName = v
+	}
+	if v := os.Getenv("OTEL_TRACES_SAMPLER_ARG"); v != "" {
+		ratio, err := strconv.ParseFloat(v, 64)
+		if err != nil || ratio < 0 || ratio > 1 {
+			slog.Warn("Invalid OTEL_TRACES_SAMPLER_ARG, sampling every trace", "value", v)
+		} else {
+			SampleRatio = ratio
+		}
+	}
+	Enabled = true
+	exporter = newExporter()
+	slog.Info("Tracing enabled", "endpoint", Endpoint, "sample_ratio", SampleRatio)
+}
+
+// Kind is the OTLP span kind.
+type Kind int
+
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+// Span is one timed operation of a trace. A nil *Span is valid and ignores
+// every call, so callers need not check whether tracing is enabled.
+type Span struct {
+	name     string
+	kind     Kind
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+	start    time.Time
+
+	mu      sync.Mutex
+	end     time.Time
+	attrs   []attribute
+	failed  bool
+	message string
+	ended   bool
+}
+
+type attribute struct {
+	key   string
+	value any
+}
+
+// spanContext identifies a span, either one of ours or the remote parent
+// named by an incoming traceparent header.
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// Start begins a span as a child of the span carried by ctx, or of the
+// remote parent extracted into ctx, and returns a copy of ctx carrying it.
+// It returns ctx and a nil span when tracing is disabled.
+func Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	if !Enabled {
+		return ctx, nil
+	}
+	s := &Span{name: name, kind: kind, start: time.Now()}
+	if parent := SpanFrom(ctx); parent != nil {
+		s.traceID, s.parentID, s.sampled = parent.traceID, parent.spanID, parent.sampled
+	} else if remote, ok := ctx.Value(remoteKey{}).(spanContext); ok {
+		s.traceID, s.parentID, s.sampled = remote.traceID, remote.spanID, remote.sampled
+	} else {
+		binary.BigEndian.PutUint64(s.traceID[:8], rand.Uint64())
+		binary.BigEndian.PutUint64(s.traceID[8:], rand.Uint64())
+		s.sampled = rand.Float64() < SampleRatio
+	}
+	binary.BigEndian.PutUint64(s.spanID[:], rand.Uint64())
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// WithSpan returns a copy of ctx carrying s, so work detached from the
+// request s belongs to is still traced under it.
+func WithSpan(ctx context.Context, s *Span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// SpanFrom returns the span carried by ctx, or nil.
+func SpanFrom(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Extract returns a copy of ctx carrying the remote parent named by the
+// traceparent header, or ctx itself when the header is missing or invalid.
+func Extract(ctx context.Context, header http.Header) context.Context {
+	if !Enabled {
+		return ctx
+	}
+	sc, ok := parseTraceparent(header.Get("traceparent"))
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// parseTraceparent parses a version 00 traceparent header:
+// 00-<32 hex trace ID>-<16 hex parent ID>-<2 hex flags>.
+func parseTraceparent(v string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil || sc.traceID == [16]byte{} {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil || sc.spanID == [8]byte{} {
+		return sc, false
+	}
+	sc.sampled = flags[0]&1 == 1
+	return sc, true
+}
+
+// Inject sets the traceparent header naming s as the parent of the request,
+// so the upstream can join the trace.
+func (s *Span) Inject(header http.Header) {
+	if s == nil {
+		return
+	}
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	header.Set("traceparent", fmt.Sprintf("00-%x-%x-%s", s.traceID, s.spanID, flags))
+}
+
+// TraceID returns the hex trace ID of s, or "" for a nil span.
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// SetAttr sets an attribute of s. Values may be strings, bools, integers,
+// floats or string slices; zero strings and empty slices are skipped.
+func (s *Span) SetAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	switch v := value.(type) {
+	case string:
+		if v == "" {
+			return
+		}
+	case []string:
+		if len(v) == 0 {
+			return
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.attrs {
+		if s.attrs[i].key == key {
+			s.attrs[i].value = value
+			return
+		}
+	}
+	s.attrs = append(s.attrs, attribute{key, value})
+}
+
+// SetError marks s as failed with a short description.
+func (s *Span) SetError(message string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.failed, s.message = true, message
+	s.mu.Unlock()
+}
+
+// End finishes s and queues it for export. Later calls do nothing.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended, s.end = true, time.Now()
+	s.mu.Unlock()
+	if s.sampled {
+		exporter.enqueue(s)
+	}
+}
@@ -0,0 +1,67 @@
+package tracing
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// Transport records a client span for each upstream round trip and sends
+// the trace on in the traceparent header. The span lasts until the response
+// body is read to the end or closed, so it covers streamed responses.
+type Transport struct {
+	Base http.RoundTripper
+	// Describe, when set, adds attributes for the upstream to the span once
+	// the round trip has returned.
+	Describe func(req *http.Request, span *Span)
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !Enabled {
+		return t.Base.RoundTrip(req)
+	}
+	// The span is not put on the request context, so work done on the
+	// response stays a child of the caller's span
+	_, span := Start(req.Context(), req.Method+" "+req.URL.Host, KindClient)
+	span.SetAttr("http.request.method", req.Method)
+	span.SetAttr("server.address", req.URL.Hostname())
+	span.SetAttr("url.path", req.URL.Path)
+
+	out := req.Clone(req.Context())
+	span.Inject(out.Header)
+	res, err := t.Base.RoundTrip(out)
+	if t.Describe != nil {
+		t.Describe(out, span)
+	}
+	if err != nil {
+		span.SetError(err.Error())
+		span.End()
+		return nil, err
+	}
+	span.SetAttr("http.response.status_code", res.StatusCode)
+	if res.StatusCode >= 400 {
+		span.SetError(strconv.Itoa(res.StatusCode))
+	}
+	res.Body = &spanBody{ReadCloser: res.Body, span: span}
+	return res, nil
+}
+
+// spanBody ends the client span once the response has been consumed.
+type spanBody struct {
+	io.ReadCloser
+	span *Span
+}
+
+func (b *spanBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.span.End()
+	}
+	return n, err
+}
+
+func (b *spanBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.span.End()
+	return err
+}
@@ -0,0 +1,379 @@
+// Package usage extracts token usage from upstream responses as they stream
+// through the proxy, whatever API shape they use.
+package usage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/gjson"
+)
+
+// maxBufferedBody caps how much of a non-streaming response is kept to find
+// its usage object. Larger bodies are passed through without accounting.
+const maxBufferedBody = 8 << 20
+
+// Usage is what one request consumed. Cached tokens are part of the prompt
+// tokens and reasoning tokens part of the completion tokens, as in OpenAI's
+// usage object.
+type Usage struct {
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	TotalTokens      int64   `json:"total_tokens"`
+	CachedTokens     int64   `json:"cached_tokens,omitempty"`
+	ReasoningTokens  int64   `json:"reasoning_tokens,omitempty"`
+	Images           int64   `json:"images,omitempty"`
+	AudioSeconds     float64 `json:"audio_seconds,omitempty"`
+}
+
+// Parse reads a usage object in Chat Completions (prompt/completion tokens),
+// Responses or Anthropic (input/output tokens) form.
+func Parse(v gjson.Result) (Usage, bool) {
+	if !v.IsObject() {
+		return Usage{}, false
+	}
+	u := Usage{
+		PromptTokens:     v.Get("prompt_tokens").Int(),
+		CompletionTokens: v.Get("completion_tokens").Int(),
+		TotalTokens:      v.Get("total_tokens").Int(),
+		CachedTokens:     v.Get("prompt_tokens_details.cached_tokens").Int(),
+		ReasoningTokens:  v.Get("completion_tokens_details.reasoning_tokens").Int(),
+	}
+	if u.PromptTokens == 0 {
+		u.PromptTokens = v.Get("input_tokens").Int()
+	}
+	if u.CompletionTokens == 0 {
+		u.CompletionTokens = v.Get("output_tokens").Int()
+	}
+	if u.CachedTokens == 0 {
+		u.CachedTokens = v.Get("input_tokens_details.cached_tokens").Int()
+	}
+	if u.ReasoningTokens == 0 {
+		u.ReasoningTokens = v.Get("output_tokens_details.reasoning_tokens").Int()
+	}
+	// Anthropic reports cache reads next to, not inside, the input tokens
+	if cached := v.Get("cache_read_input_tokens").Int(); cached > 0 {
+		u.PromptTokens += cached
+		u.CachedTokens += cached
+	}
+	// Transcriptions are billed by duration
+	if v.Get("type").String() == "duration" {
+		u.AudioSeconds = v.Get("seconds").Float()
+	}
+	if u.TotalTokens == 0 {
+		u.TotalTokens = u.PromptTokens + u.CompletionTokens
+	}
+	return u, true
+}
+
+// parseBody reads the usage of a complete, non-streaming response body,
+// including image generations and transcriptions that have no token usage.
+func parseBody(body []byte) (Usage, bool) {
+	res := gjson.ParseBytes(body)
+	u, ok := Parse(res.Get("usage"))
+	if images := res.Get("data.#(b64_json)#|#").Int() + res.Get("data.#(url)#|#").Int(); images > 0 {
+		u.Images, ok = images, true
+	}
+	if d := res.Get("duration"); d.Exists() && u.AudioSeconds == 0 {
+		u.AudioSeconds, ok = d.Float(), true
+	}
+	return u, ok
+}
+
+// merge folds a later usage report into u. Streams report usage in pieces,
+// such as Anthropic's input tokens at the start and output tokens at the end.
+func (u *Usage) merge(o Usage) {
+	u.PromptTokens = max(u.PromptTokens, o.PromptTokens)
+	u.CompletionTokens = max(u.CompletionTokens, o.CompletionTokens)
+	u.TotalTokens = max(u.TotalTokens, o.TotalTokens, u.PromptTokens+u.CompletionTokens)
+	u.CachedTokens = max(u.CachedTokens, o.CachedTokens)
+	u.ReasoningTokens = max(u.ReasoningTokens, o.ReasoningTokens)
+	u.Images = max(u.Images, o.Images)
+	u.AudioSeconds = max(u.AudioSeconds, o.AudioSeconds)
+}
+
+// Recorder collects the usage of one request. It is put on the request
+// context before proxying and read once the response has been copied.
+type Recorder struct {
+	mu    sync.Mutex
+	usage Usage
+	seen  bool
+	// finishReasons lists the distinct reasons the response ended with.
+	finishReasons []string
+	// stripUsageChunk drops the usage-only chunk of a stream whose usage was
+	// requested by the proxy rather than the client.
+	stripUsageChunk bool
+}
+
+type recorderKey struct{}
+
+// WithRecorder returns a copy of ctx carrying a new Recorder, or ctx itself
+// when it already has one.
+func WithRecorder(ctx context.Context) (context.Context, *Recorder) {
+	if rec := RecorderFrom(ctx); rec != nil {
+		return ctx, rec
+	}
+	rec := &Recorder{}
+	return context.WithValue(ctx, recorderKey{}, rec), rec
+}
+
+// WithoutRecorder returns a copy of ctx without a Recorder, for calls made
+// alongside a request whose usage is not the request's own.
+func WithoutRecorder(ctx context.Context) context.Context {
+	return context.WithValue(ctx, recorderKey{}, (*Recorder)(nil))
+}
+
+// RecorderFrom returns the Recorder attached to ctx, or nil.
+func RecorderFrom(ctx context.Context) *Recorder {
+	rec, _ := ctx.Value(recorderKey{}).(*Recorder)
+	return rec
+}
+
+// Usage returns the recorded usage and whether the response reported any.
+func (r *Recorder) Usage() (Usage, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.usage, r.seen
+}
+
+// FinishReasons returns the distinct finish reasons the response reported.
+func (r *Recorder) FinishReasons() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.finishReasons...)
+}
+
+// recordFinish notes the finish reasons in a response body or stream event:
+// choices[].finish_reason for Chat Completions, stop_reason for Anthropic
+// messages and delta.stop_reason for their message_delta events.
+func (r *Recorder) recordFinish(v gjson.Result) {
+	var reasons []string
+	v.Get("choices.#.finish_reason").ForEach(func(_, reason gjson.Result) bool {
+		reasons = append(reasons, reason.String())
+		return true
+	})
+	reasons = append(reasons, v.Get("stop_reason").String(), v.Get("delta.stop_reason").String())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, reason := range reasons {
+		if reason != "" && !slices.Contains(r.finishReasons, reason) {
+			r.finishReasons = append(r.finishReasons, reason)
+		}
+	}
+}
+
+// Record notes the usage of a response the proxy put together itself, such as
+// one answered by several upstream calls.
+func (r *Recorder) Record(u Usage) {
+	r.record(u)
+}
+
+func (r *Recorder) record(u Usage) {
+	r.mu.Lock()
+	r.usage.merge(u)
+	r.seen = true
+	r.mu.Unlock()
+}
+
+// RequestStreamUsage asks for usage in a streaming Chat Completions request
+// body by setting stream_options.include_usage, so streams can be accounted.
+// The final usage chunk is hidden from the client again when it did not ask
+// for it. It returns the body unchanged when no rewrite is needed.
+func (r *Recorder) RequestStreamUsage(body []byte) []byte {
+	req := gjson.ParseBytes(body)
+	if !req.IsObject() || !req.Get("stream").Bool() || req.Get("stream_options.include_usage").Bool() {
+		return body
+	}
+	var m map[string]any
+	if err := json.Unmarshal(body, &m); err != nil {
+		return body
+	}
+	opts, _ := m["stream_options"].(map[string]any)
+	if opts == nil {
+		opts = make(map[string]any)
+	}
+	opts["include_usage"] = true
+	m["stream_options"] = opts
+	rewritten, err := json.Marshal(m)
+	if err != nil {
+		return body
+	}
+	r.mu.Lock()
+	r.stripUsageChunk = true
+	r.mu.Unlock()
+	return rewritten
+}
+
+// Track wraps the response body so its usage is recorded as the client reads
+// it. Call it last in ModifyResponse, after any format conversion.
+func Track(res *http.Response) {
+	rec := RecorderFrom(res.Request.Context())
+	if rec == nil || res.Body == nil {
+		return
+	}
+	stream := strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream")
+	rec.mu.Lock()
+	strip := stream && rec.stripUsageChunk
+	rec.mu.Unlock()
+	if strip {
+		res.Body = &filteringReader{reader: reader{ReadCloser: res.Body, rec: rec, stream: true}}
+		res.Header.Del("Content-Length")
+		return
+	}
+	res.Body = &reader{ReadCloser: res.Body, rec: rec, stream: stream}
+}
+
+// reader scans a response body for usage. Streams are scanned line by line;
+// other bodies are buffered and parsed at EOF.
+type reader struct {
+	io.ReadCloser
+	rec    *Recorder
+	stream bool
+	buf    bytes.Buffer
+	done   bool
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 && !r.done {
+		r.buf.Write(p[:n])
+		if r.stream {
+			r.scanLines()
+		} else if r.buf.Len() > maxBufferedBody {
+			r.buf.Reset()
+			r.done = true
+		}
+	}
+	if err == io.EOF {
+		r.finish()
+	}
+	return n, err
+}
+
+func (r *reader) Close() error {
+	r.finish()
+	return r.ReadCloser.Close()
+}
+
+func (r *reader) finish() {
+	if r.done {
+		return
+	}
+	r.done = true
+	if r.stream {
+		r.buf.WriteByte('\n')
+		r.scanLines()
+		return
+	}
+	if u, ok := parseBody(r.buf.Bytes()); ok {
+		r.rec.record(u)
+	}
+	r.rec.recordFinish(gjson.ParseBytes(r.buf.Bytes()))
+	r.buf.Reset()
+}
+
+// scanLines consumes the complete lines in buf and records usage found in
+// SSE data lines.
+func (r *reader) scanLines() {
+	for {
+		line, err := r.buf.ReadBytes('\n')
+		if err != nil {
+			// Keep the partial line for the next read
+			rest := append([]byte(nil), line...)
+			r.buf.Reset()
+			r.buf.Write(rest)
+			return
+		}
+		r.scanLine(line)
+	}
+}
+
+// scanLine records the usage in one SSE line and reports whether the line
+// is a usage-only Chat Completions chunk.
+func (r *reader) scanLine(line []byte) bool {
+	data, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:"))
+	if !ok {
+		return false
+	}
+	hasUsage := bytes.Contains(data, []byte(`"usage"`))
+	if !hasUsage && !bytes.Contains(data, []byte(`_reason"`)) {
+		return false
+	}
+	event := gjson.ParseBytes(bytes.TrimSpace(data))
+	r.rec.recordFinish(event)
+	if !hasUsage {
+		return false
+	}
+	// Chat Completions chunks and Anthropic message_delta carry usage at
+	// the top level, Responses API events under response, and Anthropic
+	// message_start under message
+	for _, path := range []string{"usage", "response.usage", "message.usage"} {
+		if u, ok := Parse(event.Get(path)); ok {
+			r.rec.record(u)
+		}
+	}
+	return event.Get("usage").IsObject() && event.Get("choices.#").Int() == 0
+}
+
+// filteringReader is a stream reader that also removes the usage-only chunk
+// the proxy asked for on the client's behalf.
+type filteringReader struct {
+	reader
+	out       bytes.Buffer // filtered lines ready for the client
+	skipBlank bool         // drop the separator after a removed chunk
+	eof       error
+}
+
+func (r *filteringReader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 && r.eof == nil {
+		chunk := make([]byte, len(p))
+		n, err := r.ReadCloser.Read(chunk)
+		r.buf.Write(chunk[:n])
+		r.filterLines()
+		if err != nil {
+			// Pass on a trailing partial line as is
+			r.out.Write(r.buf.Bytes())
+			r.buf.Reset()
+			r.done = true
+			r.eof = err
+		}
+	}
+	if r.out.Len() > 0 {
+		return r.out.Read(p)
+	}
+	return 0, r.eof
+}
+
+func (r *filteringReader) Close() error {
+	r.done = true
+	return r.ReadCloser.Close()
+}
+
+func (r *filteringReader) filterLines() {
+	for {
+		line, err := r.buf.ReadBytes('\n')
+		if err != nil {
+			rest := append([]byte(nil), line...)
+			r.buf.Reset()
+			r.buf.Write(rest)
+			return
+		}
+		if r.skipBlank && len(bytes.TrimSpace(line)) == 0 {
+			r.skipBlank = false
+			continue
+		}
+		r.skipBlank = false
+		if r.scanLine(line) {
+			r.skipBlank = true
+			continue
+		}
+		r.out.Write(line)
+	}
+}
@@ -0,0 +1,154 @@
+package usage
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		usage  string
+		want   Usage
+		wantOK bool
+	}{
+		{
+			name:   "chat completions",
+			usage:  `{"prompt_tokens":100,"completion_tokens":20,"total_tokens":120,"prompt_tokens_details":{"cached_tokens":64},"completion_tokens_details":{"reasoning_tokens":8}}`,
+			want:   Usage{PromptTokens: 100, CompletionTokens: 20, TotalTokens: 120, CachedTokens: 64, ReasoningTokens: 8},
+			wantOK: true,
+		},
+		{
+			name:   "responses",
+			usage:  `{"input_tokens":50,"output_tokens":10,"input_tokens_details":{"cached_tokens":32},"output_tokens_details":{"reasoning_tokens":4}}`,
+			want:   Usage{PromptTokens: 50, CompletionTokens: 10, TotalTokens: 60, CachedTokens: 32, ReasoningTokens: 4},
+			wantOK: true,
+		},
+		{
+			name:   "anthropic cache reads",
+			usage:  `{"input_tokens":10,"output_tokens":5,"cache_read_input_tokens":90}`,
+			want:   Usage{PromptTokens: 100, CompletionTokens: 5, TotalTokens: 105, CachedTokens: 90},
+			wantOK: true,
+		},
+		{
+			name:   "transcription",
+			usage:  `{"type":"duration","seconds":12.5}`,
+			want:   Usage{AudioSeconds: 12.5},
+			wantOK: true,
+		},
+		{name: "missing", usage: ``},
+		{name: "not an object", usage: `42`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Parse(gjson.Parse(tt.usage))
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("Parse() = %+v, %t, want %+v, %t", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+// track runs body through Track as a response to a request carrying rec, and
+// returns what the client reads, one byte at a time.
+func track(t *testing.T, rec *Recorder, contentType, body string) string {
+	t.Helper()
+	ctx := context.WithValue(context.Background(), recorderKey{}, rec)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, "/v1/chat/completions", nil)
+	res := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {contentType}},
+		Body:       io.NopCloser(iotest.OneByteReader(strings.NewReader(body))),
+		Request:    req,
+	}
+	Track(res)
+	out, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return string(out)
+}
+
+func TestTrackBody(t *testing.T) {
+	rec := &Recorder{}
+	body := `{"choices":[{"finish_reason":"stop"}],"usage":{"prompt_tokens":7,"completion_tokens":3,"total_tokens":10}}`
+	if got := track(t, rec, "application/json", body); got != body {
+		t.Errorf("body changed: %s", got)
+	}
+	if u, ok := rec.Usage(); !ok || u.TotalTokens != 10 {
+		t.Errorf("Usage() = %+v, %t", u, ok)
+	}
+	if reasons := rec.FinishReasons(); len(reasons) != 1 || reasons[0] != "stop" {
+		t.Errorf("FinishReasons() = %v", reasons)
+	}
+
+	rec = &Recorder{}
+	track(t, rec, "application/json", `{"created":1,"data":[{"url":"https://a"},{"url":"https://b"}]}`)
+	if u, ok := rec.Usage(); !ok || u.Images != 2 {
+		t.Errorf("image Usage() = %+v, %t", u, ok)
+	}
+}
+
+const stream = "data: {\"choices\":[{\"delta\":{\"content\":\"Hi\"}}]}\n\n" +
+	"data: {\"choices\":[{\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n" +
+	"data: {\"choices\":[],\"usage\":{\"prompt_tokens\":5,\"completion_tokens\":1,\"total_tokens\":6}}\n\n" +
+	"data: [DONE]\n\n"
+
+func TestTrackStream(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		want    string
+	}{
+		{
+			name:    "usage requested by the proxy is removed",
+			request: `{"model":"gpt-4o","stream":true}`,
+			want: "data: {\"choices\":[{\"delta\":{\"content\":\"Hi\"}}]}\n\n" +
+				"data: {\"choices\":[{\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n" +
+				"data: [DONE]\n\n",
+		},
+		{
+			name:    "usage requested by the client is kept",
+			request: `{"model":"gpt-4o","stream":true,"stream_options":{"include_usage":true}}`,
+			want:    stream,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &Recorder{}
+			rewritten := rec.RequestStreamUsage([]byte(tt.request))
+			if !gjson.GetBytes(rewritten, "stream_options.include_usage").Bool() {
+				t.Fatalf("RequestStreamUsage() = %s", rewritten)
+			}
+			if got := track(t, rec, "text/event-stream", stream); got != tt.want {
+				t.Errorf("client read:\n%s\nwant:\n%s", got, tt.want)
+			}
+			if u, ok := rec.Usage(); !ok || u != (Usage{PromptTokens: 5, CompletionTokens: 1, TotalTokens: 6}) {
+				t.Errorf("Usage() = %+v, %t", u, ok)
+			}
+			if reasons := rec.FinishReasons(); len(reasons) != 1 || reasons[0] != "stop" {
+				t.Errorf("FinishReasons() = %v", reasons)
+			}
+		})
+	}
+}
+
+func TestRequestStreamUsageLeavesOtherBodies(t *testing.T) {
+	for _, body := range []string{
+		`{"model":"gpt-4o"}`,
+		`{"model":"gpt-4o","stream":false}`,
+		`not json`,
+	} {
+		rec := &Recorder{}
+		if got := rec.RequestStreamUsage([]byte(body)); string(got) != body {
+			t.Errorf("RequestStreamUsage(%s) = %s", body, got)
+		}
+	}
+}
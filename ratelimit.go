@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/auth"
+	"github.com/gyarbij/azure-oai-proxy/pkg/limits"
+	"github.com/gyarbij/azure-oai-proxy/pkg/logging"
+	"github.com/gyarbij/azure-oai-proxy/pkg/usage"
+)
+
+// rateLimit enforces the per-key and per-model RPM/TPM limits. Requests are
+// charged their estimated prompt and max_tokens up front, and the charge is
+// corrected with the usage the response reports.
+func rateLimit(c *gin.Context) {
+	if c.Request.Method == http.MethodOptions {
+		c.Next()
+		return
+	}
+
+	model := peekModel(c)
+	var scopes []limits.Scope
+	if id := auth.IdentityFrom(c.Request.Context()); id != nil {
+		limit := limits.KeyDefault
+		rpm, tpm := id.RateLimit()
+		if rpm > 0 {
+			limit.RPM = rpm
+		}
+		if tpm > 0 {
+			limit.TPM = tpm
+		}
+		if !limit.IsZero() {
+			scopes = append(scopes, limits.Scope{Name: "key:" + id.KeyID, Limit: limit})
+		}
+	}
+	if limit, ok := limits.ModelLimit(model); ok && model != "" {
+		scopes = append(scopes, limits.Scope{Name: modelScope(c, model), Limit: limit})
+	}
+	if len(scopes) == 0 {
+		c.Next()
+		return
+	}
+
+	estimate := limits.EstimateTokens(c.Request.URL.Path, peekBody(c))
+	reservation, status, ok := limits.Default.Reserve(scopes, estimate)
+	if !ok {
+		status.SetHeaders(c.Writer.Header())
+		logging.FromContext(c.Request.Context()).Info("Rate limited", "method", c.Request.Method, "path", c.Request.URL.Path, "scope", status.Scope, "reason", status.Reason)
+		abortWithError(c, http.StatusTooManyRequests,
+			fmt.Sprintf("Rate limit reached for %s on %s. Please try again in %s.", status.Scope, status.Reason, limits.FormatDuration(status.RetryAfter)),
+			status.Reason, "rate_limit_exceeded")
+		return
+	}
+
+	// Token limits are reconciled with the usage streams report
+	ctx, rec := usage.WithRecorder(c.Request.Context())
+	c.Request = c.Request.WithContext(ctx)
+	requestStreamUsage(c, rec, model)
+	c.Writer = &rateLimitWriter{ResponseWriter: c.Writer, status: status}
+	c.Next()
+
+	if u, ok := rec.Usage(); ok {
+		reservation.Reconcile(int(u.TotalTokens))
+	} else if c.Writer.Status() >= 400 {
+		// Nothing was generated, so nothing is charged
+		reservation.Reconcile(0)
+	}
+}
+
+// rateLimitWriter reports the proxy's own limits in place of the upstream's
+// x-ratelimit-* headers, which describe the shared Azure quota.
+type rateLimitWriter struct {
+	gin.ResponseWriter
+	status limits.Status
+}
+
+func (w *rateLimitWriter) WriteHeader(code int) {
+	w.status.SetHeaders(w.Header())
+	w.ResponseWriter.WriteHeader(code)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/auth"
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+	"github.com/gyarbij/azure-oai-proxy/pkg/budget"
+	"github.com/gyarbij/azure-oai-proxy/pkg/ledger"
+	"github.com/gyarbij/azure-oai-proxy/pkg/logging"
+	"github.com/gyarbij/azure-oai-proxy/pkg/metrics"
+	"github.com/gyarbij/azure-oai-proxy/pkg/semantic"
+	"github.com/gyarbij/azure-oai-proxy/pkg/tracing"
+	"github.com/gyarbij/azure-oai-proxy/pkg/usage"
+	"github.com/tidwall/gjson"
+)
+
+// semanticCache answers chat completions whose last user message means the
+// same as an earlier one from the semantic cache. Prompts only match within
+// the same tenant, key and model, and when everything else in the request,
+// such as the system prompt and earlier turns, is identical.
+func semanticCache(c *gin.Context) {
+	if !semantic.Enabled || c.Request.Method != http.MethodPost || !strings.HasSuffix(c.Request.URL.Path, "/chat/completions") {
+		c.Next()
+		return
+	}
+	directives := strings.ToLower(c.GetHeader("Cache-Control"))
+	if strings.Contains(directives, "no-store") {
+		c.Next()
+		return
+	}
+	prompt, rest, ok := splitPrompt(peekBody(c))
+	if !ok {
+		c.Next()
+		return
+	}
+
+	model := peekModel(c)
+	tenant, _ := azure.TenantFrom(c.Request.Context())
+	keyID := ""
+	if id := auth.IdentityFrom(c.Request.Context()); id != nil {
+		keyID = id.KeyID
+	}
+	scope := strings.Join([]string{tenant.Name, keyID, strings.ToLower(model), rest}, "\x00")
+
+	// The embedding call is charged to the caller, so it needs budget left
+	if id := auth.IdentityFrom(c.Request.Context()); id != nil {
+		if decision := budget.Check(budgetScopes(c.Request.Context(), id), semantic.Model); decision.Exhausted != nil {
+			c.Next()
+			return
+		}
+	}
+
+	vector, err := embedPrompt(c, prompt)
+	if err != nil {
+		logging.FromContext(c.Request.Context()).Warn("Semantic cache: could not embed prompt", "embedding_model", semantic.Model, "error", err)
+		metrics.CacheLookups.Inc("semantic", tenant.Name, modelLabel(tenant, model), "error")
+		c.Next()
+		return
+	}
+	if !strings.Contains(directives, "no-cache") {
+		e, similarity, ok := semantic.Default.Search(scope, vector)
+		if similarity >= 0 {
+			metrics.SemanticCacheSimilarity.Observe(similarity)
+		}
+		if ok {
+			metrics.CacheLookups.Inc("semantic", tenant.Name, modelLabel(tenant, model), "hit")
+			c.Header("X-Proxy-Cache-Similarity", strconv.FormatFloat(similarity, 'f', 4, 64))
+			replayCached(c, e)
+			c.Abort()
+			return
+		}
+		metrics.CacheLookups.Inc("semantic", tenant.Name, modelLabel(tenant, model), "miss")
+	}
+
+	c.Header("X-Proxy-Cache", "MISS")
+	w := &cacheWriter{ResponseWriter: c.Writer}
+	c.Writer = w
+	c.Next()
+
+	// The scope names the model the caller asked for, not a budget downgrade
+	if e, ok := w.entry(c); ok && w.Header().Get("X-Budget-Downgraded-From") == "" {
+		semantic.Default.Add(scope, vector, e)
+		metrics.SemanticCacheEntries.Set(float64(semantic.Default.Len()))
+	}
+}
+
+// splitPrompt returns the text of a chat request's final message, which must
+// come from the user, and a hash of the rest of the request.
+func splitPrompt(body []byte) (prompt, rest string, ok bool) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var req map[string]any
+	if err := dec.Decode(&req); err != nil {
+		return "", "", false
+	}
+	messages, _ := req["messages"].([]any)
+	if len(messages) == 0 {
+		return "", "", false
+	}
+	last, _ := messages[len(messages)-1].(map[string]any)
+	if last == nil || last["role"] != "user" {
+		return "", "", false
+	}
+	switch content := last["content"].(type) {
+	case string:
+		prompt = content
+	case []any:
+		// Only text parts; images and audio cannot be compared by their text
+		var parts []string
+		for _, p := range content {
+			part, _ := p.(map[string]any)
+			text, isText := part["text"].(string)
+			if part["type"] != "text" || !isText {
+				return "", "", false
+			}
+			parts = append(parts, text)
+		}
+		prompt = strings.Join(parts, "\n")
+	}
+	if strings.TrimSpace(prompt) == "" {
+		return "", "", false
+	}
+
+	last["content"] = nil
+	delete(req, "user")
+	normalized, err := json.Marshal(req)
+	if err != nil {
+		return "", "", false
+	}
+	sum := sha256.Sum256(normalized)
+	return prompt, hex.EncodeToString(sum[:]), true
+}
+
+// embedPrompt embeds text with semantic.Model through the proxy's own
+// embeddings route, on behalf of the caller. The call is detached from the
+// chat request, so it does not touch that request's usage, metrics or audit
+// record; it is accounted for on its own by accountEmbedding.
+func embedPrompt(c *gin.Context, text string) ([]float32, error) {
+	ctx, cancel := detachedContext(c.Request.Context(), 30*time.Second)
+	defer cancel()
+	ctx, span := tracing.Start(ctx, "semantic_cache.embed", tracing.KindInternal)
+	span.SetAttr("gen_ai.request.model", semantic.Model)
+	defer span.End()
+
+	body, _ := json.Marshal(map[string]any{"model": semantic.Model, "input": text})
+	req, err := newEmbeddingsRequest(ctx, c, "/v1/embeddings", body)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	raw, _, err := postEmbeddings(req, semantic.Model)
+	accountEmbedding(c, req, raw, err, start)
+	if err != nil {
+		span.SetError(err.Error())
+		return nil, err
+	}
+	var res struct {
+		Data []struct {
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(raw, &res); err != nil {
+		return nil, err
+	}
+	if len(res.Data) == 0 || len(res.Data[0].Embedding) == 0 {
+		return nil, fmt.Errorf("embeddings response holds no vector")
+	}
+	return res.Data[0].Embedding, nil
+}
+
+// accountEmbedding charges the semantic cache's embedding call to the caller:
+// its cost goes to their budgets, its tokens to the metrics, and it gets a
+// ledger entry of its own.
+func accountEmbedding(c *gin.Context, req *http.Request, raw []byte, err error, start time.Time) {
+	status := http.StatusOK
+	var ue *upstreamError
+	switch {
+	case errors.As(err, &ue):
+		status = ue.status
+	case err != nil:
+		return
+	}
+	u, _ := usage.Parse(gjson.GetBytes(raw, "usage"))
+
+	ctx := c.Request.Context()
+	id := auth.IdentityFrom(ctx)
+	if id != nil {
+		budget.Charge(budgetScopes(ctx, id), budget.Cost(semantic.Model, u))
+	}
+
+	tenant, _ := azure.TenantFrom(ctx)
+	info := azure.GetRequestInfo(req.Context())
+	deployment := ""
+	if info != nil {
+		deployment = info.Deployment
+	}
+	backend := backendName(tenant, semantic.Model, info)
+	if metrics.Enabled && u.PromptTokens > 0 {
+		metrics.Tokens.Add(float64(u.PromptTokens), tenant.Name, metrics.Model(semantic.Model), deployment, backend, "prompt")
+	}
+
+	e := ledger.Entry{
+		Time:         start.UTC(),
+		Model:        semantic.Model,
+		Deployment:   deployment,
+		Backend:      backend,
+		Route:        auth.RouteFamily(req.URL.Path),
+		Method:       req.Method,
+		Path:         req.URL.Path,
+		Status:       status,
+		LatencyMS:    time.Since(start).Milliseconds(),
+		PromptTokens: u.PromptTokens,
+		TotalTokens:  u.TotalTokens,
+	}
+	if id != nil {
+		e.KeyID, e.Owner = id.KeyID, id.Owner
+	}
+	if tenant != azure.DefaultTenant {
+		e.Tenant = tenant.Name
+	}
+	ledger.Record(e)
+}
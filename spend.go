@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/auth"
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+	"github.com/gyarbij/azure-oai-proxy/pkg/budget"
+	"github.com/gyarbij/azure-oai-proxy/pkg/logging"
+	"github.com/gyarbij/azure-oai-proxy/pkg/usage"
+	"github.com/tidwall/gjson"
+)
+
+// enforceBudget rejects or downgrades requests from keys, teams and tenants
+// that have used up their spend budget, and charges every request its cost.
+// Teams of other tenants than the default are budgeted as "<tenant>/<owner>",
+// so business units with the same team names stay apart.
+func enforceBudget(c *gin.Context) {
+	id := auth.IdentityFrom(c.Request.Context())
+	if id == nil || c.Request.Method == http.MethodOptions {
+		c.Next()
+		return
+	}
+	scopes := budgetScopes(c.Request.Context(), id)
+
+	model := peekModel(c)
+	if decision := budget.Check(scopes, model); decision.Exhausted != nil {
+		b := decision.Exhausted
+		// The downgrade must not bypass the caller's model allowlist
+		if decision.Downgrade != "" && !id.AllowsModel(decision.Downgrade) {
+			logging.FromContext(c.Request.Context()).Info("Budget downgrade model not allowed for caller", "model", model, "downgrade", decision.Downgrade, "key_id", id.KeyID)
+			decision.Downgrade = ""
+		}
+		if decision.Downgrade == "" || !replaceModel(c, decision.Downgrade) {
+			logging.FromContext(c.Request.Context()).Info("Rejected request, budget exhausted", "key_id", id.KeyID, "window", decision.Window, "scope", b.Scope)
+			abortWithError(c, http.StatusTooManyRequests,
+				fmt.Sprintf("The %s budget of %s is exhausted.", decision.Window, b.Scope),
+				"insufficient_quota", "insufficient_quota")
+			return
+		}
+		logging.FromContext(c.Request.Context()).Info("Downgraded model, budget exhausted", "model", model, "downgrade", decision.Downgrade, "key_id", id.KeyID, "window", decision.Window, "scope", b.Scope)
+		c.Header("X-Budget-Downgraded-From", model)
+		model = decision.Downgrade
+	}
+
+	ctx, rec := usage.WithRecorder(c.Request.Context())
+	c.Request = c.Request.WithContext(ctx)
+	requestStreamUsage(c, rec, model)
+	c.Next()
+
+	if u, ok := rec.Usage(); ok && model != "" {
+		budget.Charge(scopes, budget.Cost(model, u))
+	}
+}
+
+// budgetScopes returns the budget scopes a request from id is charged to.
+func budgetScopes(ctx context.Context, id *auth.Identity) []string {
+	team := id.Owner
+	tenant, _ := azure.TenantFrom(ctx)
+	if tenant != azure.DefaultTenant {
+		team = tenant.Name + "/" + id.Owner
+	}
+	return []string{budget.KeyScope(id.KeyID), budget.TeamScope(team), budget.TenantScope(tenant.Name)}
+}
+
+// replaceModel rewrites the model of a JSON request body in place.
+func replaceModel(c *gin.Context, model string) bool {
+	body := peekBody(c)
+	field := gjson.GetBytes(body, "model")
+	if field.Type != gjson.String || field.Index == 0 {
+		return false
+	}
+	var rewritten bytes.Buffer
+	rewritten.Write(body[:field.Index])
+	rewritten.WriteString(strconv.Quote(model))
+	rewritten.Write(body[field.Index+len(field.Raw):])
+	c.Request.Body = io.NopCloser(&rewritten)
+	c.Request.ContentLength = int64(rewritten.Len())
+	c.Request.Header.Set("Content-Length", strconv.Itoa(rewritten.Len()))
+	// A deployment resolved for the old model, such as by the response
+	// cache, no longer applies
+	if info := azure.GetRequestInfo(c.Request.Context()); info != nil {
+		info.Deployment = ""
+	}
+	return true
+}
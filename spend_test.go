@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/auth"
+	"github.com/gyarbij/azure-oai-proxy/pkg/budget"
+)
+
+func TestBudgetDowngradeRespectsAllowlist(t *testing.T) {
+	tests := []struct {
+		name       string
+		models     []string
+		wantStatus int
+		wantModel  string
+	}{
+		{"no allowlist", nil, http.StatusOK, "gpt-4o-mini"},
+		{"downgrade allowed", []string{"gpt-4o", "gpt-4o-mini"}, http.StatusOK, "gpt-4o-mini"},
+		{"downgrade allowed by prefix", []string{"gpt-4o*"}, http.StatusOK, "gpt-4o-mini"},
+		{"downgrade not allowed", []string{"gpt-4o"}, http.StatusTooManyRequests, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := &auth.Identity{KeyID: "downgrade-allowlist", Owner: "downgrade-allowlist", Policy: auth.Policy{Models: tt.models}}
+			scope := budget.KeyScope(id.KeyID)
+			if err := budget.SetBudget(budget.Budget{Scope: scope, Daily: 1, Downgrade: map[string]string{"gpt-4o": "gpt-4o-mini"}}); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { budget.DeleteBudget(scope) })
+			budget.Charge([]string{scope}, 2)
+
+			var sent string
+			router := gin.New()
+			router.Use(func(c *gin.Context) {
+				c.Request = c.Request.WithContext(auth.WithIdentity(c.Request.Context(), id))
+			}, enforceBudget)
+			router.POST("/v1/chat/completions", func(c *gin.Context) {
+				sent = peekModel(c)
+				c.JSON(http.StatusOK, gin.H{"model": sent})
+			})
+
+			body := `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)))
+			if w.Code != tt.wantStatus || sent != tt.wantModel {
+				t.Errorf("got %d sent to %q, want %d sent to %q", w.Code, sent, tt.wantStatus, tt.wantModel)
+			}
+			if tt.wantStatus == http.StatusTooManyRequests && !strings.Contains(w.Body.String(), "insufficient_quota") {
+				t.Errorf("body = %s", w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+)
+
+// routeTenant attaches the tenant a request addresses by path prefix or host
+// name, and strips the prefix so the request matches the regular routes.
+func routeTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tenant, path, ok := azure.MatchTenant(r); ok {
+			r = r.WithContext(azure.WithTenant(r.Context(), tenant))
+			if path != r.URL.Path {
+				u := *r.URL
+				u.Path, u.RawPath = path, ""
+				if u.Path == "" {
+					u.Path = "/"
+				}
+				r.URL = &u
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// modelScope names the limiter scope of a model alias. Each tenant has its
+// own Azure resources, and so its own model limits.
+func modelScope(c *gin.Context, model string) string {
+	if tenant, _ := azure.TenantFrom(c.Request.Context()); tenant != azure.DefaultTenant {
+		return "model:" + tenant.Name + "/" + model
+	}
+	return "model:" + model
+}
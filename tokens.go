@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+	"github.com/gyarbij/azure-oai-proxy/pkg/tokenizer"
+	"github.com/tidwall/gjson"
+)
+
+var (
+	// ContextCheck rejects requests that cannot fit in their model's context
+	// window before they are sent upstream.
+	ContextCheck = true
+	// TokenizeEndpoint serves POST /v1/tokenize.
+	TokenizeEndpoint = false
+)
+
+// approximateMargin is how far an estimated token count may go over a limit
+// before the request is rejected, as estimates are not exact.
+const approximateMargin = 1.1
+
+func init() {
+	switch strings.ToLower(os.Getenv("AZURE_OPENAI_CONTEXT_CHECK")) {
+	case "off", "false":
+		ContextCheck = false
+	}
+	TokenizeEndpoint = strings.EqualFold(os.Getenv("AZURE_OPENAI_TOKENIZE_ENDPOINT"), "true")
+}
+
+// checkContextWindow counts the prompt tokens of chat, Responses and
+// embeddings requests, and answers 400 when the prompt and the requested
+// completion do not fit in the model's limits, instead of letting the
+// request travel to Azure to fail there.
+func checkContextWindow(c *gin.Context) {
+	if !ContextCheck || c.Request.Method != http.MethodPost {
+		c.Next()
+		return
+	}
+	path := c.Request.URL.Path
+	chat := strings.HasSuffix(path, "/chat/completions")
+	responses := strings.HasSuffix(path, "/responses")
+	embeddings := strings.HasSuffix(path, "/embeddings")
+	if !chat && !responses && !embeddings {
+		c.Next()
+		return
+	}
+	body := peekBody(c)
+	if !gjson.ValidBytes(body) {
+		c.Next()
+		return
+	}
+	model := peekModel(c)
+	limits, enc, ok := modelTokenizer(c, model)
+	if !ok {
+		c.Next()
+		return
+	}
+	setTokenCountHeader(c, enc)
+	over := func(n, limit int) bool {
+		if enc.Exact() {
+			return n > limit
+		}
+		return float64(n) > float64(limit)*approximateMargin
+	}
+
+	if embeddings {
+		for i, n := range enc.EmbeddingInputs(body) {
+			if over(n, limits.Context) {
+				abortWithError(c, http.StatusBadRequest, fmt.Sprintf(
+					"This model's maximum context length is %d tokens, however input %d has %s tokens. Please reduce the length of the input.",
+					limits.Context, i, countText(n, enc)), "invalid_request_error", "context_length_exceeded")
+				return
+			}
+		}
+		c.Next()
+		return
+	}
+
+	var prompt int
+	var outputField string
+	if chat {
+		prompt = enc.ChatPrompt(body)
+		outputField = "max_completion_tokens"
+		if !gjson.GetBytes(body, outputField).Exists() {
+			outputField = "max_tokens"
+		}
+	} else {
+		prompt = enc.ResponsesPrompt(body)
+		outputField = "max_output_tokens"
+	}
+	output := int(gjson.GetBytes(body, outputField).Int())
+	if n := gjson.GetBytes(body, "n").Int(); chat && n > 1 {
+		output *= int(n)
+	}
+
+	if limits.Output > 0 && output > limits.Output {
+		abortWithError(c, http.StatusBadRequest, fmt.Sprintf(
+			"%s is too large: %d. This model supports at most %d completion tokens, whereas you provided %d.",
+			outputField, output, limits.Output, output), "invalid_request_error", "invalid_value")
+		return
+	}
+	// Only the prompt is counted; the completion tokens asked for are exact
+	if over(prompt, limits.Context-output) {
+		var msg string
+		if output > 0 {
+			msg = fmt.Sprintf("This model's maximum context length is %d tokens. However, you requested %s tokens (%s in the prompt, %d for the completion). Please reduce the length of the prompt or %s.",
+				limits.Context, countText(prompt+output, enc), countText(prompt, enc), output, outputField)
+		} else {
+			msg = fmt.Sprintf("This model's maximum context length is %d tokens. However, your prompt is %s tokens. Please reduce the length of the prompt.",
+				limits.Context, countText(prompt, enc))
+		}
+		abortWithError(c, http.StatusBadRequest, msg, "invalid_request_error", "context_length_exceeded")
+		return
+	}
+	c.Next()
+}
+
+// modelTokenizer returns the limits and encoding of model, looking it up by
+// the deployment it is mapped to if the alias itself is not known.
+func modelTokenizer(c *gin.Context, model string) (azure.ModelLimits, *tokenizer.Encoding, bool) {
+	limits, ok := azure.LookupModelLimits(model)
+	if !ok {
+		tenant, _ := azure.TenantFrom(c.Request.Context())
+		if deployment, mapped := tenant.LookupModelMapping(model); mapped {
+			limits, ok = azure.LookupModelLimits(deployment)
+		}
+	}
+	if !ok {
+		return azure.ModelLimits{}, nil, false
+	}
+	enc, ok := tokenizer.Get(limits.Encoding)
+	return limits, enc, ok
+}
+
+// setTokenCountHeader tells the client whether the proxy's token counts are
+// exact or estimated, as builds without the vocabulary files only estimate.
+func setTokenCountHeader(c *gin.Context, enc *tokenizer.Encoding) {
+	if enc.Exact() {
+		c.Header("X-Proxy-Token-Count", "exact")
+	} else {
+		c.Header("X-Proxy-Token-Count", "estimated")
+	}
+}
+
+// countText formats a token count, marking estimates.
+func countText(n int, enc *tokenizer.Encoding) string {
+	if enc.Exact() {
+		return fmt.Sprint(n)
+	}
+	return fmt.Sprintf("about %d", n)
+}
+
+// handleTokenize serves POST /v1/tokenize: the token count of a chat,
+// Responses or embeddings request body for its model, or of a plain "text".
+// Token IDs are included for text when the encoding's vocabulary is loaded.
+func handleTokenize(c *gin.Context) {
+	body := peekBody(c)
+	if !gjson.ValidBytes(body) {
+		abortWithError(c, http.StatusBadRequest, "Request body must be JSON", "invalid_request_error", "")
+		return
+	}
+	model := peekModel(c)
+	limits, enc, ok := modelTokenizer(c, model)
+	if !ok {
+		abortWithError(c, http.StatusBadRequest, fmt.Sprintf("No tokenizer is known for model %q", model), "invalid_request_error", "model_not_found")
+		return
+	}
+	setTokenCountHeader(c, enc)
+
+	res := gin.H{
+		"object":         "tokenize",
+		"model":          model,
+		"encoding":       enc.Name,
+		"exact":          enc.Exact(),
+		"context_window": limits.Context,
+	}
+	if limits.Output > 0 {
+		res["max_output_tokens"] = limits.Output
+	}
+	req := gjson.ParseBytes(body)
+	switch {
+	case req.Get("text").Exists():
+		text := req.Get("text").String()
+		res["tokens"] = enc.Count(text)
+		if ids := enc.Encode(text); ids != nil {
+			res["ids"] = ids
+		}
+	case req.Get("messages").Exists():
+		res["tokens"] = enc.ChatPrompt(body)
+	case req.Get("input").Exists() && strings.HasPrefix(strings.ToLower(model), "text-embedding"):
+		counts := enc.EmbeddingInputs(body)
+		total := 0
+		for _, n := range counts {
+			total += n
+		}
+		res["tokens"] = total
+		res["inputs"] = counts
+	case req.Get("input").Exists() || req.Get("instructions").Exists():
+		res["tokens"] = enc.ResponsesPrompt(body)
+	default:
+		abortWithError(c, http.StatusBadRequest, "Send text, messages or input to count", "invalid_request_error", "")
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
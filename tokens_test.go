@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+	"github.com/gyarbij/azure-oai-proxy/pkg/tokenizer"
+)
+
+func TestTokenCountsMarkedEstimated(t *testing.T) {
+	limits, ok := azure.LookupModelLimits("gpt-4o")
+	if !ok {
+		t.Fatal("no limits for gpt-4o")
+	}
+	enc, _ := tokenizer.Get(limits.Encoding)
+	want := "estimated"
+	if enc.Exact() {
+		want = "exact"
+	}
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Request = c.Request.WithContext(azure.WithTenant(c.Request.Context(), azure.DefaultTenant))
+	})
+	router.POST("/v1/tokenize", handleTokenize)
+	router.POST("/v1/chat/completions", checkContextWindow, func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	tests := []struct {
+		name       string
+		path       string
+		body       string
+		wantStatus int
+	}{
+		{"tokenize", "/v1/tokenize", `{"model":"gpt-4o","text":"hello world"}`, http.StatusOK},
+		{"within the context window", "/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`, http.StatusOK},
+		{"over the context window", "/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"` + strings.Repeat("word ", 300000) + `"}]}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body)))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if got := w.Header().Get("X-Proxy-Token-Count"); got != want {
+				t.Errorf("X-Proxy-Token-Count = %q, want %q", got, want)
+			}
+			if tt.wantStatus == http.StatusBadRequest && !enc.Exact() && !strings.Contains(w.Body.String(), "about ") {
+				t.Errorf("estimated count not marked in %s", w.Body.String())
+			}
+		})
+	}
+}
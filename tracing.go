@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gyarbij/azure-oai-proxy/pkg/auth"
+	"github.com/gyarbij/azure-oai-proxy/pkg/azure"
+	"github.com/gyarbij/azure-oai-proxy/pkg/logging"
+	"github.com/gyarbij/azure-oai-proxy/pkg/tracing"
+	"github.com/gyarbij/azure-oai-proxy/pkg/usage"
+)
+
+// genAIOperations maps route suffixes to gen_ai.operation.name values.
+var genAIOperations = []struct{ suffix, operation string }{
+	{"/chat/completions", "chat"},
+	{"/completions", "text_completion"},
+	{"/embeddings", "embeddings"},
+	{"/responses", "chat"},
+	{"/messages", "chat"},
+}
+
+// traceRequest records the server span of a proxied request, continuing the
+// caller's trace when it sends a traceparent header. It runs first, so the
+// span covers authentication, queueing and the whole response.
+func traceRequest(c *gin.Context) {
+	if !tracing.Enabled || c.Request.Method == http.MethodOptions {
+		c.Next()
+		return
+	}
+
+	route := c.FullPath()
+	if route == "" {
+		route = c.Request.URL.Path
+	}
+	ctx := tracing.Extract(c.Request.Context(), c.Request.Header)
+	ctx, span := tracing.Start(ctx, c.Request.Method+" "+route, tracing.KindServer)
+	ctx, rec := usage.WithRecorder(ctx)
+	c.Request = c.Request.WithContext(ctx)
+
+	span.SetAttr("http.request.method", c.Request.Method)
+	span.SetAttr("http.route", route)
+	span.SetAttr("url.path", c.Request.URL.Path)
+	span.SetAttr("proxy.request_id", logging.RequestID(ctx))
+	span.SetAttr("gen_ai.request.model", peekModel(c))
+	for _, op := range genAIOperations {
+		if strings.HasSuffix(c.Request.URL.Path, op.suffix) {
+			span.SetAttr("gen_ai.operation.name", op.operation)
+			break
+		}
+	}
+
+	c.Next()
+
+	status := c.Writer.Status()
+	span.SetAttr("http.response.status_code", status)
+	if status >= 500 {
+		span.SetError(http.StatusText(status))
+	}
+	tenant, _ := azure.TenantFrom(c.Request.Context())
+	span.SetAttr("proxy.tenant", tenant.Name)
+	if info := azure.GetRequestInfo(c.Request.Context()); info != nil {
+		span.SetAttr("azure.openai.deployment", info.Deployment)
+	}
+	if u, ok := rec.Usage(); ok {
+		span.SetAttr("gen_ai.usage.input_tokens", u.PromptTokens)
+		span.SetAttr("gen_ai.usage.output_tokens", u.CompletionTokens)
+	}
+	span.SetAttr("gen_ai.response.finish_reasons", rec.FinishReasons())
+	span.End()
+}
+
+// traceAuthentication records a span for the checks of authenticate.
+func traceAuthentication(c *gin.Context, check func(*gin.Context)) {
+	_, span := tracing.Start(c.Request.Context(), "authenticate", tracing.KindInternal)
+	check(c)
+	if id := auth.IdentityFrom(c.Request.Context()); id != nil {
+		span.SetAttr("enduser.id", id.KeyID)
+	}
+	if c.IsAborted() {
+		span.SetError(http.StatusText(c.Writer.Status()))
+	}
+	span.End()
+}